@@ -0,0 +1,145 @@
+package api
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/SanteonNL/fenix/cmd/fenix/types"
+	"github.com/SanteonNL/fenix/models/fhir"
+)
+
+// isChainedParameter reports whether a parameter searches through a reference, e.g.
+// subject:Patient.name or _has:Observation:patient:code
+func isChainedParameter(param string) bool {
+	return strings.HasPrefix(param, "_has:") || strings.Contains(param, ".")
+}
+
+// chainedFilter creates the filter of a chained or reverse chained parameter and returns it with
+// the innermost filter, which gets the value. An invalid chain gives an invalid filter.
+func (fr *FHIRRouter) chainedFilter(resourceType string, param string) (*types.Filter, *types.Filter) {
+	var filter, innermost *types.Filter
+	var err error
+	if strings.HasPrefix(param, "_has:") {
+		filter, innermost, err = fr.reverseChainedFilter(resourceType, param)
+	} else {
+		filter, innermost, err = fr.forwardChainedFilter(resourceType, param)
+	}
+	if err != nil {
+		fr.log.Debug().
+			Err(err).
+			Str("parameter", param).
+			Msg("Invalid chained search parameter")
+		invalid := &types.Filter{Code: param, IsValid: false, ErrorType: "invalid-chain"}
+		return invalid, invalid
+	}
+	return filter, innermost
+}
+
+// parameterFilter creates the filter of a parameter within a chain, which may be chained itself
+func (fr *FHIRRouter) parameterFilter(resourceType string, param string) (*types.Filter, *types.Filter, error) {
+	if isChainedParameter(param) {
+		filter, innermost := fr.chainedFilter(resourceType, param)
+		if !filter.IsValid {
+			return nil, nil, fmt.Errorf("invalid chain %s on %s", param, resourceType)
+		}
+		return filter, innermost, nil
+	}
+
+	baseParam, modifier := splitParameter(param)
+	filter, err := fr.searchParamService.ValidateSearchParameter(resourceType, baseParam, modifier)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !filter.IsValid {
+		return nil, nil, fmt.Errorf("invalid parameter %s on %s", param, resourceType)
+	}
+	return filter, filter, nil
+}
+
+// forwardChainedFilter creates the filter of reference[:Type].parameter, the type is needed when
+// more than one of the served resource types can be the target
+func (fr *FHIRRouter) forwardChainedFilter(resourceType string, param string) (*types.Filter, *types.Filter, error) {
+	head, rest, _ := strings.Cut(param, ".")
+	code, targetType := splitParameter(head)
+
+	sp, err := fr.referenceParameter(resourceType, code)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if targetType == "" {
+		var candidates []string
+		for _, served := range fr.dataSource.ResourceTypes() {
+			if !isValidResourceType(served) || !targetsType(sp, served) {
+				continue
+			}
+			if _, _, err := fr.parameterFilter(served, rest); err == nil {
+				candidates = append(candidates, served)
+			}
+		}
+		if len(candidates) != 1 {
+			return nil, nil, fmt.Errorf("%s refers to %d served resource types with %s, use %s:[type].%s", code, len(candidates), rest, code, rest)
+		}
+		targetType = candidates[0]
+	}
+	if !isValidResourceType(targetType) || !targetsType(sp, targetType) {
+		return nil, nil, fmt.Errorf("%s does not refer to %s", code, targetType)
+	}
+
+	inner, innermost, err := fr.parameterFilter(targetType, rest)
+	if err != nil {
+		return nil, nil, err
+	}
+	filter := &types.Filter{
+		Code:    code,
+		Type:    "reference",
+		IsValid: true,
+		Chain:   &types.Chain{ResourceType: targetType, Reference: code, Filter: inner},
+	}
+	return filter, innermost, nil
+}
+
+// reverseChainedFilter creates the filter of _has:Type:reference:parameter, the resources of Type
+// refer to the searched resources with the reference parameter
+func (fr *FHIRRouter) reverseChainedFilter(resourceType string, param string) (*types.Filter, *types.Filter, error) {
+	parts := strings.SplitN(param, ":", 4)
+	if len(parts) != 4 {
+		return nil, nil, fmt.Errorf("expected _has:[type]:[reference]:[parameter]")
+	}
+	sourceType, code, rest := parts[1], parts[2], parts[3]
+
+	if !isValidResourceType(sourceType) {
+		return nil, nil, fmt.Errorf("resource type %s is not supported", sourceType)
+	}
+	sp, err := fr.referenceParameter(sourceType, code)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !targetsType(sp, resourceType) {
+		return nil, nil, fmt.Errorf("%s of %s does not refer to %s", code, sourceType, resourceType)
+	}
+
+	inner, innermost, err := fr.parameterFilter(sourceType, rest)
+	if err != nil {
+		return nil, nil, err
+	}
+	filter := &types.Filter{
+		Code:    "_has",
+		Type:    "reference",
+		IsValid: true,
+		Chain:   &types.Chain{Reverse: true, ResourceType: sourceType, Reference: code, Filter: inner},
+	}
+	return filter, innermost, nil
+}
+
+// referenceParameter returns the reference search parameter of a resource type
+func (fr *FHIRRouter) referenceParameter(resourceType string, code string) (*fhir.SearchParameter, error) {
+	sp, err := fr.searchParamService.GetSearchParameterByCode(code, resourceType)
+	if err != nil {
+		return nil, fmt.Errorf("unknown search parameter %s of %s", code, resourceType)
+	}
+	if sp.Type != fhir.SearchParamTypeReference {
+		return nil, fmt.Errorf("%s of %s is not a reference search parameter", code, resourceType)
+	}
+	return sp, nil
+}
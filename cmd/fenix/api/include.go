@@ -0,0 +1,292 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/SanteonNL/fenix/cmd/fenix/fhir/bundle"
+	"github.com/SanteonNL/fenix/cmd/fenix/types"
+	"github.com/SanteonNL/fenix/models/fhir"
+)
+
+// include is an _include or _revinclude parameter, e.g. _include=Observation:subject:Patient
+type include struct {
+	reverse    bool   // _revinclude, the source resources refer to the matches
+	sourceType string // resource type of the reference search parameter
+	code       string // code of the reference search parameter
+	targetType string // resource type the references are restricted to, empty for all targets
+}
+
+// isIncludeParameter reports whether a parameter adds resources to the result instead of filtering it
+func isIncludeParameter(param string) bool {
+	baseParam, _ := splitParameter(param)
+	return baseParam == "_include" || baseParam == "_revinclude"
+}
+
+// parseIncludes parses the _include and _revinclude parameters of a search on a resource type
+func (fr *FHIRRouter) parseIncludes(resourceType string, params map[string][]string) ([]include, []bundle.SearchIssue) {
+	var includes []include
+	var issues []bundle.SearchIssue
+
+	for paramName, values := range params {
+		if !isIncludeParameter(paramName) {
+			continue
+		}
+		baseParam, modifier := splitParameter(paramName)
+		if modifier != "" {
+			issues = append(issues, bundle.NewInvalidParameterIssue(
+				fmt.Sprintf("Search modifier '%s' is not supported for parameter '%s'", modifier, baseParam)))
+			continue
+		}
+
+		for _, value := range values {
+			inc, err := fr.parseInclude(resourceType, baseParam == "_revinclude", value)
+			if err != nil {
+				issues = append(issues, bundle.NewInvalidParameterIssue(
+					fmt.Sprintf("Invalid %s '%s': %s", baseParam, value, err)))
+				continue
+			}
+			includes = append(includes, inc)
+		}
+	}
+
+	return includes, issues
+}
+
+// parseInclude parses the value of an _include or _revinclude parameter, source:code[:target]
+func (fr *FHIRRouter) parseInclude(resourceType string, reverse bool, value string) (include, error) {
+	parts := strings.Split(value, ":")
+	if len(parts) < 2 || len(parts) > 3 {
+		return include{}, fmt.Errorf("expected SourceType:parameter[:TargetType]")
+	}
+	inc := include{reverse: reverse, sourceType: parts[0], code: parts[1]}
+	if len(parts) == 3 {
+		inc.targetType = parts[2]
+	}
+
+	if !isValidResourceType(inc.sourceType) {
+		return include{}, fmt.Errorf("resource type %s is not supported", inc.sourceType)
+	}
+	if !reverse && inc.sourceType != resourceType {
+		return include{}, fmt.Errorf("only parameters of %s can be included", resourceType)
+	}
+	if inc.code == "*" {
+		return include{}, fmt.Errorf("including all references is not supported")
+	}
+
+	sp, err := fr.searchParamService.GetSearchParameterByCode(inc.code, inc.sourceType)
+	if err != nil {
+		return include{}, fmt.Errorf("unknown search parameter %s of %s", inc.code, inc.sourceType)
+	}
+	if sp.Type != fhir.SearchParamTypeReference {
+		return include{}, fmt.Errorf("%s is not a reference search parameter", inc.code)
+	}
+
+	if reverse {
+		if inc.targetType != "" && inc.targetType != resourceType {
+			return include{}, fmt.Errorf("target type has to be %s", resourceType)
+		}
+		inc.targetType = resourceType
+	}
+	if inc.targetType != "" && !targetsType(sp, inc.targetType) {
+		return include{}, fmt.Errorf("%s does not refer to %s", inc.code, inc.targetType)
+	}
+
+	return inc, nil
+}
+
+// targetsType reports whether a reference search parameter can refer to a resource type
+func targetsType(sp *fhir.SearchParameter, resourceType string) bool {
+	if len(sp.Target) == 0 {
+		return true
+	}
+	for _, target := range sp.Target {
+		if target.String() == resourceType {
+			return true
+		}
+	}
+	return false
+}
+
+// includeResources adds the resources of the _include and _revinclude parameters to the search
+// result. The resources are read through the query files of their own resource type.
+func (fr *FHIRRouter) includeResources(ctx context.Context, resourceType string, includes []include, searchResult *bundle.SearchResult) error {
+	if len(includes) == 0 {
+		return nil
+	}
+
+	searchResult.Included = make([][]interface{}, len(searchResult.Resources))
+	for _, inc := range includes {
+		var err error
+		if inc.reverse {
+			err = fr.revIncludeResources(ctx, resourceType, inc, searchResult)
+		} else {
+			err = fr.forwardIncludeResources(ctx, inc, searchResult)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// includeChunkSize bounds the number of ids or references in the filter of a single include search
+const includeChunkSize = 100
+
+// forwardIncludeResources reads the resources the matches refer to with a search on _id per
+// target type, every target is read once
+func (fr *FHIRRouter) forwardIncludeResources(ctx context.Context, inc include, searchResult *bundle.SearchResult) error {
+	var targetTypes []string
+	ids := make(map[string][]string)    // target type -> ids of the targets
+	referrers := make(map[string][]int) // resourceType/id -> positions of the resources referring to it
+	for i, resource := range searchResult.Resources {
+		for _, target := range fr.references(inc, resource) {
+			if _, exists := referrers[target]; !exists {
+				targetType, id, _ := strings.Cut(target, "/")
+				if ids[targetType] == nil {
+					targetTypes = append(targetTypes, targetType)
+				}
+				ids[targetType] = append(ids[targetType], id)
+			}
+			referrers[target] = append(referrers[target], i)
+		}
+	}
+
+	for _, targetType := range targetTypes {
+		for _, chunk := range chunkValues(ids[targetType], includeChunkSize) {
+			filter := &types.Filter{Code: "_id", Type: "token", IsValid: true}
+			filter.SetValue(strings.Join(chunk, ","))
+
+			resources, validationIssues, err := fr.processorService.ProcessResources(ctx, fr.dataSource, targetType, "", []*types.Filter{filter})
+			if err != nil {
+				if ctx.Err() != nil {
+					return fmt.Errorf("error including %s: %w", targetType, err)
+				}
+				fr.log.Warn().
+					Err(err).
+					Str("resource_type", targetType).
+					Msg("Failed to read included resources")
+				searchResult.Issues = append(searchResult.Issues, bundle.NewIssue(fhir.IssueSeverityWarning, fhir.IssueTypeIncomplete,
+					fmt.Sprintf("Resources of %s could not be included", targetType)))
+				continue
+			}
+			addValidationIssues(searchResult, validationIssues)
+
+			for _, resource := range resources {
+				for _, i := range referrers[targetType+"/"+getResourceID(resource)] {
+					searchResult.Included[i] = append(searchResult.Included[i], resource)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// revIncludeResources searches the resources that refer to the matches with a search on the
+// reference parameter per chunk of matches
+func (fr *FHIRRouter) revIncludeResources(ctx context.Context, resourceType string, inc include, searchResult *bundle.SearchResult) error {
+	var references []string
+	positions := make(map[string]int) // resourceType/id -> position of the match
+	for i, resource := range searchResult.Resources {
+		if id := getResourceID(resource); id != "" {
+			reference := resourceType + "/" + id
+			positions[reference] = i
+			references = append(references, reference)
+		}
+	}
+
+	for _, chunk := range chunkValues(references, includeChunkSize) {
+		filter, err := fr.searchParamService.ValidateSearchParameter(inc.sourceType, inc.code, "")
+		if err != nil {
+			return fmt.Errorf("error including %s:%s: %w", inc.sourceType, inc.code, err)
+		}
+		filter.SetValue(strings.Join(chunk, ","))
+
+		resources, validationIssues, err := fr.processorService.ProcessResources(ctx, fr.dataSource, inc.sourceType, "", []*types.Filter{filter})
+		if err != nil {
+			if ctx.Err() != nil {
+				return fmt.Errorf("error including %s:%s: %w", inc.sourceType, inc.code, err)
+			}
+			fr.log.Warn().
+				Err(err).
+				Str("resource_type", inc.sourceType).
+				Msg("Failed to read resources for _revinclude")
+			searchResult.Issues = append(searchResult.Issues, bundle.NewIssue(fhir.IssueSeverityWarning, fhir.IssueTypeIncomplete,
+				fmt.Sprintf("Resources of %s could not be included", inc.sourceType)))
+			continue
+		}
+		addValidationIssues(searchResult, validationIssues)
+
+		for _, resource := range resources {
+			for _, reference := range fr.references(inc, resource) {
+				if i, ok := positions[reference]; ok {
+					searchResult.Included[i] = append(searchResult.Included[i], resource)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// chunkValues splits values into chunks of at most size values
+func chunkValues(values []string, size int) [][]string {
+	var chunks [][]string
+	for len(values) > size {
+		chunks = append(chunks, values[:size])
+		values = values[size:]
+	}
+	if len(values) > 0 {
+		chunks = append(chunks, values)
+	}
+	return chunks
+}
+
+// references returns the resources the reference search parameter of an include selects in a
+// resource as resourceType/id, restricted to the target type of the include
+func (fr *FHIRRouter) references(inc include, resource interface{}) []string {
+	expression := fr.searchParamService.GetExpression(inc.sourceType, inc.code)
+	if expression == nil {
+		return nil
+	}
+	values, err := expression.Evaluate(resource)
+	if err != nil {
+		fr.log.Debug().
+			Err(err).
+			Str("code", inc.code).
+			Msg("Failed to evaluate reference search parameter")
+		return nil
+	}
+
+	var references []string
+	for _, value := range values {
+		reference, ok := value.(fhir.Reference)
+		if !ok || reference.Reference == nil {
+			continue
+		}
+		targetType, id, ok := splitReference(*reference.Reference)
+		if !ok || (inc.targetType != "" && targetType != inc.targetType) {
+			continue
+		}
+		references = append(references, targetType+"/"+id)
+	}
+	return references
+}
+
+// splitReference returns the resource type and id of a relative or absolute literal reference,
+// e.g. Patient/123 or https://example.org/fhir/Patient/123/_history/2. Contained and logical
+// references have neither.
+func splitReference(reference string) (string, string, bool) {
+	if history := strings.Index(reference, "/_history/"); history != -1 {
+		reference = reference[:history]
+	}
+	parts := strings.Split(reference, "/")
+	if len(parts) < 2 {
+		return "", "", false
+	}
+	resourceType, id := parts[len(parts)-2], parts[len(parts)-1]
+	if !isValidResourceType(resourceType) || !isValidResourceID(id) {
+		return "", "", false
+	}
+	return resourceType, id, true
+}
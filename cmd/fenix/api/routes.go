@@ -3,16 +3,22 @@ package api
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"net/url"
+	"reflect"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/SanteonNL/fenix/cmd/fenix/datasource"
 	"github.com/SanteonNL/fenix/cmd/fenix/fhir/bundle"
+	"github.com/SanteonNL/fenix/cmd/fenix/fhir/capabilitystatement"
 	"github.com/SanteonNL/fenix/cmd/fenix/fhir/searchparameter"
 	"github.com/SanteonNL/fenix/cmd/fenix/processor"
 	"github.com/SanteonNL/fenix/cmd/fenix/types"
+	"github.com/SanteonNL/fenix/models/fhir"
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
 	"github.com/rs/zerolog"
@@ -20,19 +26,38 @@ import (
 
 // Add bundleCache to FHIRRouter struct
 type FHIRRouter struct {
-	searchParamService *searchparameter.SearchParameterService
-	processorService   *processor.ProcessorService
-	bundleService      *bundle.BundleService
-	dataSourceService  *datasource.DataSourceService
-	bundleCache        *bundle.BundleCache // Add this
-	log                zerolog.Logger
+	searchParamService         *searchparameter.SearchParameterService
+	processorService           *processor.ProcessorService
+	bundleService              *bundle.BundleService
+	dataSource                 datasource.DataSource
+	capabilityStatementService *capabilitystatement.CapabilityStatementService
+	bundleCache                *bundle.BundleCache // Add this
+	timeouts                   RouteTimeouts
+	log                        zerolog.Logger
+}
+
+// RouteTimeouts bounds how long a request may read from the datasources. When a timeout expires
+// the queries are cancelled and the request is answered with a timeout OperationOutcome.
+type RouteTimeouts struct {
+	Search time.Duration
+	Read   time.Duration
+}
+
+// DefaultRouteTimeouts returns the timeouts used when none are configured
+func DefaultRouteTimeouts() RouteTimeouts {
+	return RouteTimeouts{
+		Search: 60 * time.Second, // Searches may scan large parts of the source
+		Read:   15 * time.Second, // Reads are bound to a single id
+	}
 }
 
 // Update NewFHIRRouter to include cache initialization
 func NewFHIRRouter(
 	searchParamService *searchparameter.SearchParameterService,
 	processorService *processor.ProcessorService,
-	dataSourceService *datasource.DataSourceService,
+	dataSource datasource.DataSource,
+	capabilityStatementService *capabilitystatement.CapabilityStatementService,
+	timeouts RouteTimeouts,
 	log zerolog.Logger,
 ) *FHIRRouter {
 	// Initialize cache with default config
@@ -40,15 +65,23 @@ func NewFHIRRouter(
 	bundleCache := bundle.NewBundleCache(*cacheConfig, log)
 
 	return &FHIRRouter{
-		searchParamService: searchParamService,
-		processorService:   processorService,
-		bundleService:      bundle.NewBundleService(log, cacheConfig),
-		dataSourceService:  dataSourceService,
-		bundleCache:        bundleCache,
-		log:                log,
+		searchParamService:         searchParamService,
+		processorService:           processorService,
+		bundleService:              bundle.NewBundleService(log, cacheConfig),
+		dataSource:                 dataSource,
+		capabilityStatementService: capabilityStatementService,
+		bundleCache:                bundleCache,
+		timeouts:                   timeouts,
+		log:                        log,
 	}
 }
 
+// Close stops the cleanup routines of the bundle caches
+func (fr *FHIRRouter) Close() {
+	fr.bundleCache.Stop()
+	fr.bundleService.Stop()
+}
+
 func (fr *FHIRRouter) SetupRoutes() http.Handler {
 	r := chi.NewRouter()
 
@@ -56,14 +89,27 @@ func (fr *FHIRRouter) SetupRoutes() http.Handler {
 	r.Use(middleware.Recoverer)
 
 	r.Route("/r4", func(r chi.Router) {
+		r.Get("/metadata", fr.handleMetadata)
 		r.Route("/{resourceType}", func(r chi.Router) {
 			r.Get("/", fr.handleSearch)
+			r.Get("/{id}", fr.handleRead)
 		})
 	})
 
 	return r
 }
 
+func (fr *FHIRRouter) handleMetadata(w http.ResponseWriter, r *http.Request) {
+	statement, err := fr.capabilityStatementService.CreateCapabilityStatement(getBaseURL(r))
+	if err != nil {
+		fr.log.Error().Err(err).Msg("Failed to create CapabilityStatement")
+		respondWithOperationOutcome(w, http.StatusInternalServerError, bundle.NewProcessingError(err.Error()))
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, statement)
+}
+
 func (fr *FHIRRouter) handleSearch(w http.ResponseWriter, r *http.Request) {
 	resourceType := chi.URLParam(r, "resourceType")
 	queryParams := r.URL.Query()
@@ -103,20 +149,44 @@ func (fr *FHIRRouter) handleSearch(w http.ResponseWriter, r *http.Request) {
 	// Validate search parameters
 	validFilters, invalidFilters := fr.validateSearchParameters(resourceType, queryParams)
 
+	includes, includeIssues := fr.parseIncludes(resourceType, queryParams)
+
 	// Add any parameter validation issues
 	for _, invalidFilter := range invalidFilters {
 		issue := fr.createIssueFromFilter(invalidFilter)
 		searchResult.Issues = append(searchResult.Issues, issue)
 	}
+	searchResult.Issues = append(searchResult.Issues, includeIssues...)
 
 	// If there are only invalid parameters, return error response
-	if len(validFilters) == 0 && len(invalidFilters) > 0 {
+	if len(validFilters) == 0 && len(includes) == 0 && len(searchResult.Issues) > 0 {
 		fr.createAndRespondWithBundle(w, r, searchResult, http.StatusBadRequest)
 		return
 	}
 
-	// Process the request
-	if err := fr.processRequest(r.Context(), resourceType, &searchResult); err != nil {
+	// Process the request, the queries stop when the client disconnects or the timeout expires
+	ctx, cancel := context.WithTimeout(r.Context(), fr.timeouts.Search)
+	defer cancel()
+
+	err := fr.processRequest(ctx, resourceType, "", validFilters, &searchResult)
+	if err == nil {
+		err = fr.includeResources(ctx, resourceType, includes, &searchResult)
+	}
+	if err != nil {
+		if fr.requestStopped(r) {
+			return
+		}
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			searchResult.Issues = append(searchResult.Issues, bundle.NewTimeoutIssue(
+				fmt.Sprintf("Search did not complete within %s", fr.timeouts.Search)))
+			fr.createAndRespondWithBundle(w, r, searchResult, http.StatusGatewayTimeout)
+			return
+		}
+		if errors.Is(err, processor.ErrTooManyChainMatches) {
+			searchResult.Issues = append(searchResult.Issues, bundle.NewIssue(fhir.IssueSeverityError, fhir.IssueTypeTooCostly, err.Error()))
+			fr.createAndRespondWithBundle(w, r, searchResult, http.StatusBadRequest)
+			return
+		}
 		searchResult.Issues = append(searchResult.Issues, bundle.NewProcessingError(err.Error()))
 		fr.createAndRespondWithBundle(w, r, searchResult, http.StatusInternalServerError)
 		return
@@ -131,33 +201,70 @@ func (fr *FHIRRouter) handleSearch(w http.ResponseWriter, r *http.Request) {
 	fr.createAndRespondWithBundle(w, r, searchResult, http.StatusOK)
 }
 
-// Helper method to process the request
-func (fr *FHIRRouter) processRequest(ctx context.Context, resourceType string, searchResult *bundle.SearchResult) error {
-	// Get query file path
-	queryFiles, err := fr.dataSourceService.FindSQLFilesInDir("queries/hix/flat", resourceType)
-	if err != nil {
-		return fmt.Errorf("failed to find query file: %v", err)
+func (fr *FHIRRouter) handleRead(w http.ResponseWriter, r *http.Request) {
+	resourceType := chi.URLParam(r, "resourceType")
+	id := chi.URLParam(r, "id")
+
+	// Validate resource type
+	if !isValidResourceType(resourceType) {
+		respondWithOperationOutcome(w, http.StatusNotFound, bundle.NewNotFoundIssue(
+			fmt.Sprintf("Resource type %s is not supported", resourceType)))
+		return
 	}
 
-	// Load query file
-	if err := fr.dataSourceService.LoadQueryFile(queryFiles[0]); err != nil {
-		return fmt.Errorf("failed to load query file: %v", err)
+	// Validate id, this also prevents arbitrary input from reaching the query
+	if !isValidResourceID(id) {
+		respondWithOperationOutcome(w, http.StatusBadRequest, bundle.NewInvalidParameterIssue(
+			fmt.Sprintf("Invalid resource id '%s'", id)))
+		return
 	}
 
-	// Execute query and get results
-	_, err = fr.dataSourceService.ReadResources(resourceType, "")
-	if err != nil {
-		return fmt.Errorf("failed to read resources: %v", err)
+	// Process the request with the id bound to the query
+	ctx, cancel := context.WithTimeout(r.Context(), fr.timeouts.Read)
+	defer cancel()
+
+	searchResult := bundle.SearchResult{}
+	if err := fr.processRequest(ctx, resourceType, id, nil, &searchResult); err != nil {
+		if fr.requestStopped(r) {
+			return
+		}
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			respondWithOperationOutcome(w, http.StatusGatewayTimeout, bundle.NewTimeoutIssue(
+				fmt.Sprintf("Read did not complete within %s", fr.timeouts.Read)))
+			return
+		}
+		respondWithOperationOutcome(w, http.StatusInternalServerError, bundle.NewProcessingError(err.Error()))
+		return
 	}
 
-	// Process results
-	resources, err := fr.processorService.ProcessResources(ctx, fr.dataSourceService, resourceType, "", nil)
+	resource := findResourceByID(searchResult.Resources, id)
+	if resource == nil {
+		// A resource dropped for not conforming to its profile is reported with the issues of its elements
+		issues := []bundle.SearchIssue{bundle.NewNotFoundIssue(
+			fmt.Sprintf("Resource %s/%s is not known", resourceType, id))}
+		for _, issue := range searchResult.Issues {
+			if issue.Expression != "" {
+				issues = append(issues, issue)
+			}
+		}
+		respondWithOperationOutcome(w, http.StatusNotFound, issues...)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, resource)
+}
+
+// Helper method to process the request, id is optional and restricts the query to a single resource
+func (fr *FHIRRouter) processRequest(ctx context.Context, resourceType string, id string, filters []*types.Filter, searchResult *bundle.SearchResult) error {
+	// Execute query and process results
+	resources, validationIssues, err := fr.processorService.ProcessResources(ctx, fr.dataSource, resourceType, id, filters)
 	if err != nil {
-		return fmt.Errorf("error processing resources: %v", err)
+		return fmt.Errorf("error processing resources: %w", err)
 	}
 
 	searchResult.Resources = resources
 	searchResult.Total = len(resources)
+	addValidationIssues(searchResult, validationIssues)
 
 	if len(resources) == 0 {
 		searchResult.Issues = append(searchResult.Issues, bundle.NewNotFoundIssue(
@@ -167,12 +274,38 @@ func (fr *FHIRRouter) processRequest(ctx context.Context, resourceType string, s
 	return nil
 }
 
+// addValidationIssues reports the resources that do not conform to their profile as outcome entries
+func addValidationIssues(searchResult *bundle.SearchResult, validationIssues []processor.ValidationIssue) {
+	for _, issue := range validationIssues {
+		searchResult.Issues = append(searchResult.Issues, bundle.SearchIssue{
+			Severity:   issue.Severity,
+			Code:       issue.Code,
+			Details:    issue.Details,
+			Expression: issue.Expression,
+		})
+	}
+}
+
+// requestStopped reports whether the client went away, there is nobody left to respond to
+func (fr *FHIRRouter) requestStopped(r *http.Request) bool {
+	if errors.Is(r.Context().Err(), context.Canceled) {
+		fr.log.Info().
+			Str("path", r.URL.Path).
+			Msg("Request cancelled by the client, stopped reading the datasources")
+		return true
+	}
+	return false
+}
+
 // Helper to create issue from invalid filter
 func (fr *FHIRRouter) createIssueFromFilter(filter *types.Filter) bundle.SearchIssue {
 	switch filter.ErrorType {
 	case "unknown-parameter":
 		return bundle.NewInvalidParameterIssue(
 			fmt.Sprintf("Unknown search parameter '%s'", filter.Code))
+	case "invalid-chain":
+		return bundle.NewInvalidParameterIssue(
+			fmt.Sprintf("Chained search parameter '%s' is not valid or not supported", filter.Code))
 	case "unsupported-modifier":
 		return bundle.NewInvalidParameterIssue(
 			fmt.Sprintf("Search modifier '%s' is not supported for parameter '%s'",
@@ -217,17 +350,16 @@ func getBaseURL(r *http.Request) string {
 	return fmt.Sprintf("%s://%s/r4", scheme, r.Host)
 }
 
+// getSearchParams returns the search parameters without the pagination parameters as an encoded
+// query, sorted by parameter so equal searches give the same string
 func getSearchParams(params map[string][]string) string {
-	// Filter out pagination parameters
-	var queryParts []string
+	query := url.Values{}
 	for key, values := range params {
 		if key != "_count" && key != "_offset" {
-			for _, value := range values {
-				queryParts = append(queryParts, fmt.Sprintf("%s=%s", key, value))
-			}
+			query[key] = values
 		}
 	}
-	return strings.Join(queryParts, "&")
+	return query.Encode()
 }
 
 func splitParameter(param string) (string, string) {
@@ -239,35 +371,98 @@ func splitParameter(param string) (string, string) {
 }
 
 func isValidResourceType(resourceType string) bool {
-	_, exists := processor.ResourceFactoryMap[resourceType]
+	_, exists := types.ResourceFactoryMap[resourceType]
 	return exists
 }
 
+// isValidResourceID checks the id against the FHIR id datatype: [A-Za-z0-9\-\.]{1,64}
+func isValidResourceID(id string) bool {
+	if len(id) == 0 || len(id) > 64 {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= 'A' && c <= 'Z') && !(c >= 'a' && c <= 'z') && !(c >= '0' && c <= '9') && c != '-' && c != '.' {
+			return false
+		}
+	}
+	return true
+}
+
+// findResourceByID returns the resource with the given id or nil if there is none
+func findResourceByID(resources []interface{}, id string) interface{} {
+	for _, resource := range resources {
+		if getResourceID(resource) == id {
+			return resource
+		}
+	}
+	return nil
+}
+
+// getResourceID reads the Id field of a generated FHIR resource struct
+func getResourceID(resource interface{}) string {
+	value := reflect.ValueOf(resource)
+	if value.Kind() == reflect.Ptr {
+		if value.IsNil() {
+			return ""
+		}
+		value = value.Elem()
+	}
+	if value.Kind() != reflect.Struct {
+		return ""
+	}
+
+	idField := value.FieldByName("Id")
+	if !idField.IsValid() || idField.Kind() != reflect.Ptr || idField.IsNil() {
+		return ""
+	}
+	return idField.Elem().String()
+}
+
+// validateSearchParameters creates a filter for every occurrence of a search parameter, the
+// filters of a repeated parameter all have to match
 func (fr *FHIRRouter) validateSearchParameters(resourceType string, params map[string][]string) ([]*types.Filter, []*types.Filter) {
 	var validFilters, invalidFilters []*types.Filter
 
 	for paramName, values := range params {
-		// Skip pagination parameters
-		if paramName == "_count" || paramName == "_offset" {
+		// Skip pagination parameters, _include and _revinclude do not filter
+		if paramName == "_count" || paramName == "_offset" || isIncludeParameter(paramName) {
 			continue
 		}
 
-		baseParam, modifier := splitParameter(paramName)
-		filter, err := fr.searchParamService.ValidateSearchParameter(resourceType, baseParam, modifier)
-
-		if err != nil || !filter.IsValid {
-			filter.Value = values[0]
-			invalidFilters = append(invalidFilters, filter)
+		if isChainedParameter(paramName) {
+			for _, value := range values {
+				filter, innermost := fr.chainedFilter(resourceType, paramName)
+				innermost.SetValue(value)
+				if !filter.IsValid {
+					invalidFilters = append(invalidFilters, filter)
+					continue
+				}
+				filter.Value = value
+				validFilters = append(validFilters, filter)
+			}
 			continue
 		}
 
-		filter.Value = values[0]
-		validFilters = append(validFilters, filter)
+		baseParam, modifier := splitParameter(paramName)
+		for _, value := range values {
+			filter, err := fr.searchParamService.ValidateSearchParameter(resourceType, baseParam, modifier)
+			filter.SetValue(value)
+
+			if err != nil || !filter.IsValid {
+				invalidFilters = append(invalidFilters, filter)
+				continue
+			}
+			validFilters = append(validFilters, filter)
+		}
 	}
 
 	return validFilters, invalidFilters
 }
 
+func respondWithOperationOutcome(w http.ResponseWriter, status int, issues ...bundle.SearchIssue) {
+	respondWithJSON(w, status, bundle.NewOperationOutcome(issues))
+}
+
 func respondWithJSON(w http.ResponseWriter, status int, data interface{}) {
 	w.Header().Set("Content-Type", "application/fhir+json")
 	w.WriteHeader(status)
@@ -0,0 +1,200 @@
+package datasource
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/SanteonNL/fenix/cmd/fenix/types"
+	"github.com/SanteonNL/fenix/models/fhir"
+)
+
+// alias is a parsed column alias. An alias is a path of elements relative to the fhir_path of
+// its row, each element optionally followed by a selector:
+//
+//	name[0].given[1]                                   array index, counting from 0
+//	extension[url=http://example.org/ext].valueString  element selected by url
+//	value[x]                                           choice element, its type given by value[x]:type
+//
+// The resource type may lead the alias of a resource row, e.g. Patient.id.
+type alias struct {
+	column     string
+	segments   []aliasSegment
+	typeColumn bool // the alias is the type of a choice element, e.g. value[x]:type
+}
+
+// aliasSegment is one element of an alias
+type aliasSegment struct {
+	name   string // element name as written in the alias
+	index  int    // array index, -1 when the alias has none
+	url    string // url of an element selected by url
+	choice bool   // choice element without type, e.g. value[x]
+}
+
+// metadataColumns are the columns of a row that are not elements of the resource
+var metadataColumns = map[string]bool{"resource_id": true, "id": true, "parent_id": true, "fhir_path": true}
+
+// fhirPathElementPattern matches the fhir_path literals a query emits for rows of elements, e.g. 'Observation.component' AS fhir_path
+var fhirPathElementPattern = regexp.MustCompile(`(?i)'([A-Za-z]+(?:\.[A-Za-z]+)+)'\s+AS\s+"?fhir_path"?`)
+
+// parseAlias parses a column alias, the error names the column and the position of the problem
+func parseAlias(column string) (*alias, error) {
+	parsed := &alias{column: column}
+	pos := 0
+
+	for {
+		start := pos
+		for pos < len(column) && isAliasNameChar(column[pos], pos == start) {
+			pos++
+		}
+		if pos == start {
+			return nil, fmt.Errorf("column %q: expected an element name at position %d", column, pos+1)
+		}
+		segment := aliasSegment{name: column[start:pos], index: -1}
+
+		if pos < len(column) && column[pos] == '[' {
+			end := strings.IndexByte(column[pos:], ']')
+			if end == -1 {
+				return nil, fmt.Errorf("column %q: missing ] for [ at position %d", column, pos+1)
+			}
+			selector := column[pos+1 : pos+end]
+			switch {
+			case selector == "x":
+				segment.choice = true
+			case strings.HasPrefix(selector, "url="):
+				segment.url = strings.TrimPrefix(selector, "url=")
+				if segment.url == "" {
+					return nil, fmt.Errorf("column %q: empty url at position %d", column, pos+1)
+				}
+			default:
+				index, err := strconv.Atoi(selector)
+				if err != nil || index < 0 {
+					return nil, fmt.Errorf("column %q: invalid index %q at position %d", column, selector, pos+1)
+				}
+				segment.index = index
+			}
+			pos += end + 1
+		}
+		parsed.segments = append(parsed.segments, segment)
+
+		if pos == len(column) {
+			break
+		}
+		if column[pos] == ':' && column[pos:] == ":type" && segment.choice {
+			parsed.typeColumn = true
+			break
+		}
+		if column[pos] != '.' {
+			return nil, fmt.Errorf("column %q: unexpected %q at position %d", column, column[pos], pos+1)
+		}
+		pos++
+	}
+
+	if last := parsed.segments[len(parsed.segments)-1]; last.url != "" {
+		return nil, fmt.Errorf("column %q: element %s selected by url has no value", column, last.name)
+	}
+	return parsed, nil
+}
+
+// isAliasNameChar reports whether c can be part of an element name, names start with a letter
+func isAliasNameChar(c byte, first bool) bool {
+	switch {
+	case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z':
+		return true
+	case c >= '0' && c <= '9', c == '_':
+		return !first
+	}
+	return false
+}
+
+// leafKey is the key of the last element of the alias in the data of its row
+func (a *alias) leafKey() string {
+	leaf := a.segments[len(a.segments)-1]
+	key := leaf.name
+	if leaf.choice {
+		key += "[x]"
+	}
+	if a.typeColumn {
+		key += ":type"
+	}
+	return key
+}
+
+// relativeTo returns the segments of the alias without the resource type leading it
+func (a *alias) relativeTo(resourceType string) []aliasSegment {
+	if len(a.segments) > 1 && a.segments[0].name == resourceType && a.segments[0].index == -1 {
+		return a.segments[1:]
+	}
+	return a.segments
+}
+
+// resolveAliasSegments returns the type of the element an alias refers to within a struct type.
+// Element names are matched to the json tags of the fields, case insensitive.
+func resolveAliasSegments(t reflect.Type, segments []aliasSegment) (reflect.Type, error) {
+	for i, segment := range segments {
+		for t.Kind() == reflect.Ptr {
+			t = t.Elem()
+		}
+		if t.Kind() != reflect.Struct || t == reflect.TypeOf(fhir.Date{}) {
+			return nil, fmt.Errorf("%s has no elements", segments[i-1].name)
+		}
+
+		if segment.choice {
+			if !hasChoiceFields(t, segment.name) {
+				return nil, fmt.Errorf("%s is not a choice element", segment.name)
+			}
+			// The type is only known from the type column when the rows are read
+			return nil, nil
+		}
+
+		field, found := fieldByJSONName(t, segment.name)
+		if !found {
+			return nil, fmt.Errorf("unknown element %s", segment.name)
+		}
+		t = field.Type
+
+		if t.Kind() == reflect.Slice {
+			t = t.Elem()
+		} else if segment.index > 0 {
+			return nil, fmt.Errorf("element %s does not repeat", segment.name)
+		}
+		if segment.url != "" {
+			if t != reflect.TypeOf(fhir.Extension{}) {
+				return nil, fmt.Errorf("element %s is selected by url but is not an extension", segment.name)
+			}
+			// The value of an extension may leave its type to the extension definition
+			if i+1 < len(segments) && strings.EqualFold(segments[i+1].name, "value") {
+				return nil, nil
+			}
+		}
+	}
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return t, nil
+}
+
+// fieldByJSONName returns the field of a struct type by the json tag, case insensitive
+func fieldByJSONName(t reflect.Type, name string) (reflect.StructField, bool) {
+	for i := 0; i < t.NumField(); i++ {
+		if strings.EqualFold(types.JSONName(t.Field(i)), name) {
+			return t.Field(i), true
+		}
+	}
+	return reflect.StructField{}, false
+}
+
+// hasChoiceFields reports whether a struct type has fields for the types of a choice element,
+// e.g. valueQuantity and valueString for value
+func hasChoiceFields(t reflect.Type, name string) bool {
+	for i := 0; i < t.NumField(); i++ {
+		fieldName := types.JSONName(t.Field(i))
+		if len(fieldName) > len(name) && strings.EqualFold(fieldName[:len(name)], name) &&
+			fieldName[len(name)] >= 'A' && fieldName[len(name)] <= 'Z' {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,195 @@
+package datasource
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/SanteonNL/fenix/cmd/fenix/types"
+)
+
+// ChainJoiner is a datasource that searches a chained parameter itself by joining the query files
+// of both resource types in SQL, instead of the inner search being resolved first
+type ChainJoiner interface {
+	CanJoinChain(resourceType string, filter *types.Filter) bool
+}
+
+// CanJoinChain reports whether every query file of the resource type can join the inner search
+// of a chained filter. The inner filter has to be pushed down completely.
+func (svc *DataSourceService) CanJoinChain(resourceType string, filter *types.Filter) bool {
+	return svc.pushableInAll(resourceType, filter)
+}
+
+// pushableInAll reports whether every query file of the resource type handles a filter completely
+func (svc *DataSourceService) pushableInAll(resourceType string, filter *types.Filter) bool {
+	queryFiles, err := svc.GetQueryFiles(resourceType)
+	if err != nil {
+		return false
+	}
+	for _, queryFile := range queryFiles {
+		if !svc.pushable(resourceType, queryFile.Query, filter) {
+			return false
+		}
+	}
+	return true
+}
+
+// chainPushable reports whether a query can join a chained filter, on the placeholder of its
+// reference or on its column aliases, see buildChainColumnCondition and buildChainAliasCondition
+func (svc *DataSourceService) chainPushable(resourceType string, query string, filter *types.Filter) bool {
+	chain := filter.Chain
+	if !svc.pushableInAll(chain.ResourceType, chain.Filter) {
+		return false
+	}
+
+	if chain.Reverse {
+		if svc.searchParamService == nil {
+			return false
+		}
+		queryFiles, _ := svc.GetQueryFiles(chain.ResourceType)
+		for _, queryFile := range queryFiles {
+			if len(svc.referenceAliases(chain.ResourceType, chain.Reference, queryColumnAliases(queryFile.Query))) == 0 {
+				return false
+			}
+		}
+		return true
+	}
+
+	for _, placeholder := range queryPlaceholders(query) {
+		if placeholder.code == filter.Code && !placeholder.systemPart {
+			return true
+		}
+	}
+	return svc.searchParamService != nil && len(svc.referenceAliases(resourceType, chain.Reference, queryColumnAliases(query))) > 0
+}
+
+// CanJoinChain reports whether a single sql datasource serves the resource types of the search and
+// of all inner searches of a chained filter, so it can join them
+func (r *Registry) CanJoinChain(resourceType string, filter *types.Filter) bool {
+	sources := r.DataSourcesFor(resourceType)
+	if len(sources) != 1 {
+		return false
+	}
+	joiner, ok := sources[0].(ChainJoiner)
+	if !ok {
+		return false
+	}
+	for chain := filter.Chain; chain != nil; chain = chain.Filter.Chain {
+		inner := r.DataSourcesFor(chain.ResourceType)
+		if len(inner) != 1 || inner[0] != sources[0] {
+			return false
+		}
+	}
+	return joiner.CanJoinChain(resourceType, filter)
+}
+
+// buildChainColumnCondition restricts the reference column of a placeholder, holding the id of the
+// referenced resource, to the results of the inner search of a chained filter
+func (svc *DataSourceService) buildChainColumnCondition(column string, filter *types.Filter, args *queryArgs) (string, error) {
+	subquery, err := svc.chainSubquery(filter.Chain, args, func(string) []string {
+		return []string{"c.resource_id"}
+	})
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s IN (\n%s\n)", column, subquery), nil
+}
+
+// buildChainAliasCondition restricts the wrapped query to the results of the inner search of a
+// chained filter. A chain compares the reference aliases of the query with the references of the
+// inner resources, _has compares the resources with the reference aliases of the inner query.
+func (svc *DataSourceService) buildChainAliasCondition(resourceType string, filter *types.Filter, aliases []string, args *queryArgs) (string, error) {
+	if svc.searchParamService == nil {
+		return "", errNotPushable
+	}
+	chain := filter.Chain
+
+	if chain.Reverse {
+		subquery, err := svc.chainSubquery(chain, args, func(query string) []string {
+			var columns []string
+			for _, alias := range svc.referenceAliases(chain.ResourceType, chain.Reference, queryColumnAliases(query)) {
+				columns = append(columns, `c."`+strings.ReplaceAll(alias, `"`, `""`)+`"`)
+			}
+			return columns
+		})
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("(%s || q.resource_id) IN (\n%s\n)", sqlString(resourceType+"/"), subquery), nil
+	}
+
+	columns := svc.referenceAliases(resourceType, chain.Reference, aliases)
+	if len(columns) == 0 {
+		return "", errNotPushable
+	}
+	subquery, err := svc.chainSubquery(chain, args, func(string) []string {
+		return []string{sqlString(chain.ResourceType+"/") + " || c.resource_id"}
+	})
+	if err != nil {
+		return "", err
+	}
+
+	conditions := make([]string, 0, len(columns))
+	for _, column := range columns {
+		conditions = append(conditions, fmt.Sprintf("%s IN (\n%s\n)", quoteAlias(column), subquery))
+	}
+	if len(conditions) == 1 {
+		return conditions[0], nil
+	}
+	return "(" + strings.Join(conditions, " OR ") + ")", nil
+}
+
+// chainSubquery combines a select on every query file of the inner resource type of a chain. The
+// inner filter is pushed down into the query files, the select lists the columns the query gives
+// for each of them. No values are bound when the chain cannot be joined.
+func (svc *DataSourceService) chainSubquery(chain *types.Chain, args *queryArgs, columns func(query string) []string) (string, error) {
+	queryFiles, err := svc.GetQueryFiles(chain.ResourceType)
+	if err != nil {
+		return "", errNotPushable
+	}
+
+	bound := len(args.values)
+	var selects []string
+	for _, queryFile := range queryFiles {
+		inner, remaining, err := svc.buildConditions(chain.ResourceType, queryFile.Query, "", []*types.Filter{chain.Filter}, args)
+		if err != nil {
+			args.values = args.values[:bound]
+			return "", fmt.Errorf("chained search on %s: %w", chain.ResourceType, err)
+		}
+		selected := columns(inner)
+		if len(remaining) > 0 || len(selected) == 0 {
+			args.values = args.values[:bound]
+			return "", errNotPushable
+		}
+
+		for _, column := range selected {
+			selects = append(selects, fmt.Sprintf("SELECT %s FROM (\n%s\n) c", column, trimStatement(inner)))
+		}
+	}
+
+	svc.log.Debug().
+		Str("resourceType", chain.ResourceType).
+		Str("reference", chain.Reference).
+		Msg("Joined chained search parameter in SQL")
+	return strings.Join(selects, "\nUNION\n"), nil
+}
+
+// referenceAliases returns the column aliases of a query that hold the references of a reference
+// search parameter, e.g. subject.reference
+func (svc *DataSourceService) referenceAliases(resourceType string, code string, aliases []string) []string {
+	var references []string
+	for _, path := range svc.searchParamService.GetPathsForSearchParameter(resourceType, code) {
+		element := strings.ToLower(strings.TrimPrefix(path, resourceType+"."))
+		for _, alias := range aliases {
+			normalized := strings.ToLower(removeIndexes(alias))
+			if normalized == element || normalized == element+".reference" {
+				references = append(references, alias)
+			}
+		}
+	}
+	return references
+}
+
+// sqlString quotes a value as a SQL string literal, only used for resource types
+func sqlString(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", "''") + "'"
+}
@@ -0,0 +1,151 @@
+package datasource
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/SanteonNL/fenix/cmd/fenix/types"
+	"github.com/rs/zerolog"
+)
+
+// CSVDataSource reads flat rows from a CSV file. The header uses the same columns as a
+// query: resource_id, id, parent_id, fhir_path and FHIR path aliases like name[0].family.
+// The file is read on every request so changes are picked up without a restart, the rows of a
+// resource have to be adjacent.
+type CSVDataSource struct {
+	name       string
+	sourcePath string
+	delimiter  rune
+	log        zerolog.Logger
+}
+
+// NewCSVDataSource creates a datasource for a csv connection
+func NewCSVDataSource(connection ConnectionConfig, log zerolog.Logger) (*CSVDataSource, error) {
+	if connection.Format != "" && connection.Format != "flat" {
+		return nil, fmt.Errorf("unsupported csv format: %s", connection.Format)
+	}
+
+	delimiter := ','
+	if connection.Delimiter != "" {
+		r, size := utf8.DecodeRuneInString(connection.Delimiter)
+		if size != len(connection.Delimiter) {
+			return nil, fmt.Errorf("csv delimiter %q has to be a single character", connection.Delimiter)
+		}
+		delimiter = r
+	}
+
+	return &CSVDataSource{
+		name:       connection.Name,
+		sourcePath: connection.SourcePath,
+		delimiter:  delimiter,
+		log:        log,
+	}, nil
+}
+
+// Name returns the connection name of the datasource
+func (ds *CSVDataSource) Name() string {
+	return ds.name
+}
+
+// ResourceTypes returns the resource types of the resource rows in the file
+func (ds *CSVDataSource) ResourceTypes() []string {
+	seen := make(map[string]bool)
+	var resourceTypes []string
+
+	err := ds.readRows(func(row map[string]interface{}) error {
+		fhirPath, _ := row["fhir_path"].(string)
+		if fhirPath != "" && !strings.Contains(fhirPath, ".") && !seen[fhirPath] {
+			seen[fhirPath] = true
+			resourceTypes = append(resourceTypes, fhirPath)
+		}
+		return nil
+	})
+	if err != nil {
+		ds.log.Error().Err(err).Str("file", ds.sourcePath).Msg("Failed to read resource types")
+	}
+
+	sort.Strings(resourceTypes)
+	return resourceTypes
+}
+
+// ReadResources reads all resources of the resource type, see StreamResources
+func (ds *CSVDataSource) ReadResources(resourceType, id string, filters []*types.Filter) ([]ResourceResult, []*types.Filter, error) {
+	stream, err := ds.StreamResources(context.Background(), resourceType, id, filters)
+	if err != nil {
+		return nil, nil, err
+	}
+	results, err := CollectResources(stream)
+	return results, stream.RemainingFilters, err
+}
+
+// StreamResources streams the resources of the resource type, the rows of a resource have to be
+// adjacent in the file. Search parameters are not handled by the file and are all returned as
+// remaining.
+func (ds *CSVDataSource) StreamResources(ctx context.Context, resourceType, id string, filters []*types.Filter) (*ResourceStream, error) {
+	return streamRows(ctx, ds.sourcePath, filters, ds.log, func(add func(row map[string]interface{}) error) error {
+		// Rows belong to the resource type when the fhir_path starts with it
+		return ds.readRows(func(row map[string]interface{}) error {
+			fhirPath, _ := row["fhir_path"].(string)
+			if fhirPath != resourceType && !strings.HasPrefix(fhirPath, resourceType+".") {
+				return nil
+			}
+			if id != "" {
+				if resourceID, _ := row["resource_id"].(string); resourceID != id {
+					return nil
+				}
+			}
+			return add(row)
+		})
+	}), nil
+}
+
+// readRows calls fn for every row in the file, empty values are left out. An error of fn stops
+// reading and is returned.
+func (ds *CSVDataSource) readRows(fn func(row map[string]interface{}) error) error {
+	file, err := os.Open(ds.sourcePath)
+	if err != nil {
+		return fmt.Errorf("failed to open csv file %s: %w", ds.sourcePath, err)
+	}
+	defer file.Close()
+
+	reader := csv.NewReader(file)
+	reader.Comma = ds.delimiter
+
+	header, err := reader.Read()
+	if err != nil {
+		return fmt.Errorf("failed to read header of csv file %s: %w", ds.sourcePath, err)
+	}
+	for _, column := range []string{"resource_id", "id", "parent_id", "fhir_path"} {
+		if !containsString(header, column) {
+			return fmt.Errorf("csv file %s has no %s column", ds.sourcePath, column)
+		}
+	}
+
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read csv file %s: %w", ds.sourcePath, err)
+		}
+
+		row := make(map[string]interface{}, len(header))
+		for i, column := range header {
+			if record[i] != "" || column == "parent_id" {
+				row[column] = record[i]
+			}
+		}
+		if err := fn(row); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
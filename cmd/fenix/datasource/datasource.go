@@ -1,15 +1,19 @@
 package datasource
 
 import (
+	"context"
 	"fmt"
-	"io"
 	"log"
 	"os"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/SanteonNL/fenix/cmd/fenix/fhir/searchparameter"
+	"github.com/SanteonNL/fenix/cmd/fenix/types"
 	"github.com/jmoiron/sqlx"
 	_ "github.com/lib/pq"
 	"github.com/rs/zerolog"
@@ -25,50 +29,184 @@ type RowData struct {
 	Data     map[string]interface{}
 }
 
+// resultBuilder groups flat rows into a ResourceResult per resource_id
+type resultBuilder struct {
+	source      string   // meta.source of the resources, empty to leave it unset
+	profile     string   // meta.profile of the resources, empty to leave it unset
+	resourceIDs []string // in order of first appearance
+	resources   map[string]ResourceResult
+	positions   map[string]map[rowKey]int      // resource_id -> position of each row within its path
+	selectors   map[string]map[rowKey][]string // resource_id -> urls of the elements selected by url per path and parent
+	aliases     map[string]*alias              // parsed column aliases, nil when invalid
+	log         zerolog.Logger
+}
+
+// rowKey identifies a row of a resource by its path and id
+type rowKey struct {
+	path string
+	id   string
+}
+
+// newResultBuilder creates a resultBuilder for the rows of a single source
+func newResultBuilder(source string, log zerolog.Logger) *resultBuilder {
+	return &resultBuilder{
+		source:    source,
+		resources: make(map[string]ResourceResult),
+		positions: make(map[string]map[rowKey]int),
+		selectors: make(map[string]map[rowKey][]string),
+		aliases:   make(map[string]*alias),
+		log:       log,
+	}
+}
+
+// addRow adds a flat row with the resource_id, id, parent_id and fhir_path columns
+func (b *resultBuilder) addRow(row map[string]interface{}) {
+	// Remove NULL values
+	for key, value := range row {
+		if value == nil {
+			delete(row, key)
+		}
+	}
+
+	// Only the resource row itself gets meta.source and meta.profile, unless the source sets them
+	if fhirPath, _ := row["fhir_path"].(string); fhirPath != "" && !strings.Contains(fhirPath, ".") {
+		if _, exists := row["meta.source"]; b.source != "" && !exists {
+			row["meta.source"] = b.source
+		}
+		if b.profile != "" && !hasColumnPrefix(row, "meta.profile") {
+			row["meta.profile[0]"] = b.profile
+		}
+	}
+
+	resourceID, _ := row["resource_id"].(string)
+	if b.resources[resourceID] == nil {
+		b.resourceIDs = append(b.resourceIDs, resourceID)
+		b.resources[resourceID] = make(ResourceResult)
+		b.positions[resourceID] = make(map[rowKey]int)
+		b.selectors[resourceID] = make(map[rowKey][]string)
+	}
+
+	b.processRow(row, resourceID)
+}
+
+// hasColumnPrefix reports whether a row has a column for the element or one of its indexes
+func hasColumnPrefix(row map[string]interface{}, element string) bool {
+	for column := range row {
+		if column == element || strings.HasPrefix(column, element+"[") {
+			return true
+		}
+	}
+	return false
+}
+
+// results returns the grouped resources in order of first appearance
+func (b *resultBuilder) results() []ResourceResult {
+	results := make([]ResourceResult, 0, len(b.resourceIDs))
+	for _, resourceID := range b.resourceIDs {
+		results = append(results, b.resources[resourceID])
+	}
+	return results
+}
+
+// take removes a complete resource from the builder and returns it
+func (b *resultBuilder) take(resourceID string) ResourceResult {
+	result := b.resources[resourceID]
+	delete(b.resources, resourceID)
+	delete(b.positions, resourceID)
+	delete(b.selectors, resourceID)
+
+	for i, id := range b.resourceIDs {
+		if id == resourceID {
+			b.resourceIDs = append(b.resourceIDs[:i], b.resourceIDs[i+1:]...)
+			break
+		}
+	}
+	return result
+}
+
+// find returns the position of the row with the id within the path of the resource, or -1
+func (b *resultBuilder) find(resourceID, path, id string) int {
+	if position, exists := b.positions[resourceID][rowKey{path: path, id: id}]; exists {
+		return position
+	}
+	return -1
+}
+
+// appendRow adds a row to the path of the resource. The first row with an id is the one find returns.
+func (b *resultBuilder) appendRow(resourceID, path string, row RowData) {
+	key := rowKey{path: path, id: row.ID}
+	if _, exists := b.positions[resourceID][key]; !exists {
+		b.positions[resourceID][key] = len(b.resources[resourceID][path])
+	}
+	b.resources[resourceID][path] = append(b.resources[resourceID][path], row)
+}
+
 // DataSourceService handles database operations and query management
 type DataSourceService struct {
-	db      *sqlx.DB
-	queries map[string]string // resourceType -> query
-	log     zerolog.Logger
+	name               string
+	db                 *sqlx.DB
+	searchParamService *searchparameter.SearchParameterService
+	queries            map[string][]*QueryFile // resourceType -> query files ordered by path
+	mu                 sync.RWMutex
+	log                zerolog.Logger
 }
 
-// NewDataSourceService creates a new DataSourceService
-func NewDataSourceService(db *sqlx.DB, log zerolog.Logger) *DataSourceService {
+// NewDataSourceService creates a new DataSourceService, the name is the connection name query files refer to.
+// The SearchParameterService is used to push search parameters down into the query.
+func NewDataSourceService(name string, db *sqlx.DB, searchParamService *searchparameter.SearchParameterService, log zerolog.Logger) *DataSourceService {
 	return &DataSourceService{
-		db:      db,
-		queries: make(map[string]string),
-		log:     log,
+		name:               name,
+		db:                 db,
+		searchParamService: searchParamService,
+		queries:            make(map[string][]*QueryFile),
+		log:                log,
 	}
 }
 
-// LoadQueryFile loads a single query file
+// LoadQueryFile loads a single query file. The resource type and other metadata are
+// taken from the header block of the file, see QueryMetadata. Lint issues of the column
+// aliases are logged, the file is loaded regardless.
 func (svc *DataSourceService) LoadQueryFile(filePath string) error {
-	// Get resource type from filename (e.g., "patient_query.sql" -> "Patient")
-	fileName := filepath.Base(filePath)
-	parts := strings.Split(fileName, "_")
-	if len(parts) < 2 {
-		return fmt.Errorf("invalid query file name format: %s", fileName)
+	query, err := os.ReadFile(filePath)
+	if err != nil {
+		return fmt.Errorf("failed to read query file %s: %w", filePath, err)
 	}
 
-	resourceType := strings.TrimSuffix(
-		strings.Title(parts[0]),
-		filepath.Ext(fileName),
-	)
-
-	file, err := os.Open(filePath)
+	metadata, err := parseQueryMetadata(string(query))
 	if err != nil {
-		return fmt.Errorf("failed to open query file %s: %w", filePath, err)
+		return fmt.Errorf("invalid metadata in query file %s: %w", filePath, err)
+	}
+	for _, issue := range lintQuery(metadata.ResourceType, string(query)) {
+		svc.log.Warn().
+			Str("file", filePath).
+			Str("column", issue.Column).
+			Str("severity", issue.Severity).
+			Msg(issue.Message)
 	}
-	defer file.Close()
+	return svc.addQuery(filePath, string(query), metadata)
+}
 
-	query, err := io.ReadAll(file)
-	if err != nil {
-		return fmt.Errorf("failed to read query file %s: %w", filePath, err)
+// addQuery checks the metadata of a query file against the query and adds it to the queries
+// of its resource type
+func (svc *DataSourceService) addQuery(filePath string, query string, metadata QueryMetadata) error {
+	if err := svc.validateQueryMetadata(metadata, query); err != nil {
+		return fmt.Errorf("inconsistent metadata in query file %s: %w", filePath, err)
+	}
+
+	queryFile := &QueryFile{
+		Path:     filePath,
+		Metadata: metadata,
+		Query:    query,
 	}
 
-	svc.queries[resourceType] = string(query)
+	svc.mu.Lock()
+	svc.addQueryFile(queryFile)
+	svc.mu.Unlock()
+
 	svc.log.Debug().
-		Str("resourceType", resourceType).
+		Str("resourceType", metadata.ResourceType).
+		Str("profile", metadata.Profile).
+		Str("datasource", metadata.DataSource).
 		Str("file", filePath).
 		Msg("Loaded query file")
 
@@ -115,251 +253,442 @@ func (svc *DataSourceService) LoadQueryDirectory(dirPath string) error {
 	return nil
 }
 
-// GetQuery retrieves a query for a resource type
+// addQueryFile registers a query file for its resource type, replacing an earlier load of the same path.
+// The caller must hold the write lock.
+func (svc *DataSourceService) addQueryFile(queryFile *QueryFile) {
+	// A reloaded file may have changed its resource type
+	for resourceType, queryFiles := range svc.queries {
+		for i, existing := range queryFiles {
+			if existing.Path == queryFile.Path {
+				svc.queries[resourceType] = append(queryFiles[:i:i], queryFiles[i+1:]...)
+				break
+			}
+		}
+	}
+
+	queryFiles := append(svc.queries[queryFile.Metadata.ResourceType], queryFile)
+	sort.Slice(queryFiles, func(i, j int) bool {
+		return queryFiles[i].Path < queryFiles[j].Path
+	})
+	svc.queries[queryFile.Metadata.ResourceType] = queryFiles
+}
+
+// Name returns the connection name of the datasource
+func (svc *DataSourceService) Name() string {
+	return svc.name
+}
+
+// ResourceTypes returns the resource types that have at least one query file
+func (svc *DataSourceService) ResourceTypes() []string {
+	svc.mu.RLock()
+	defer svc.mu.RUnlock()
+
+	resourceTypes := make([]string, 0, len(svc.queries))
+	for resourceType := range svc.queries {
+		resourceTypes = append(resourceTypes, resourceType)
+	}
+	sort.Strings(resourceTypes)
+	return resourceTypes
+}
+
+// Close closes the database connection
+func (svc *DataSourceService) Close() error {
+	if svc.db == nil {
+		return nil
+	}
+	return svc.db.Close()
+}
+
+// GetQuery retrieves the first query for a resource type
 func (svc *DataSourceService) GetQuery(resourceType string) (string, error) {
-	query, exists := svc.queries[resourceType]
-	if !exists {
-		return "", fmt.Errorf("no query found for resource type: %s", resourceType)
+	queryFiles, err := svc.GetQueryFiles(resourceType)
+	if err != nil {
+		return "", err
+	}
+	return queryFiles[0].Query, nil
+}
+
+// GetQueryFiles retrieves all query files, including their metadata, for a resource type
+func (svc *DataSourceService) GetQueryFiles(resourceType string) ([]*QueryFile, error) {
+	svc.mu.RLock()
+	defer svc.mu.RUnlock()
+
+	queryFiles := svc.queries[resourceType]
+	if len(queryFiles) == 0 {
+		return nil, fmt.Errorf("no query found for resource type: %s", resourceType)
+	}
+	return append([]*QueryFile(nil), queryFiles...), nil
+}
+
+// ListQueryFiles returns all loaded query files ordered by resource type and path
+func (svc *DataSourceService) ListQueryFiles() []*QueryFile {
+	svc.mu.RLock()
+	defer svc.mu.RUnlock()
+
+	resourceTypes := make([]string, 0, len(svc.queries))
+	for resourceType := range svc.queries {
+		resourceTypes = append(resourceTypes, resourceType)
 	}
-	return query, nil
+	sort.Strings(resourceTypes)
+
+	var queryFiles []*QueryFile
+	for _, resourceType := range resourceTypes {
+		queryFiles = append(queryFiles, svc.queries[resourceType]...)
+	}
+	return queryFiles
+}
+
+// ReadResources reads all resources of the resource type, see StreamResources
+func (svc *DataSourceService) ReadResources(resourceType, id string, filters []*types.Filter) ([]ResourceResult, []*types.Filter, error) {
+	stream, err := svc.StreamResources(context.Background(), resourceType, id, filters)
+	if err != nil {
+		return nil, nil, err
+	}
+	results, err := CollectResources(stream)
+	return results, stream.RemainingFilters, err
 }
 
-// ReadResources reads resources from the database using the stored query
-func (svc *DataSourceService) ReadResources(resourceType, patientID string) ([]ResourceResult, error) {
-	query, err := svc.GetQuery(resourceType)
+// StreamResources runs every query registered for the resource type and streams the resources.
+// The id and the search parameters are pushed down into the queries as bound parameters where possible;
+// the filters that could not be pushed down into all of the queries are returned with the stream so
+// they can be checked on the processed resources.
+// Every query is ordered by resource_id, so a resource is sent as soon as the rows of the next one start.
+// The queries run concurrently on at most maxConcurrentQueries connections and are sent in file order.
+// A resource_id produced by more than one query file is kept from the first file only.
+func (svc *DataSourceService) StreamResources(ctx context.Context, resourceType, id string, filters []*types.Filter) (*ResourceStream, error) {
+	queryFiles, err := svc.GetQueryFiles(resourceType)
 	if err != nil {
 		return nil, err
 	}
+	filters = withIDFilter(filters, id)
+
+	// The queries are built up front so the remaining filters are known before the first resource
+	queries := make([]sqlQuery, len(queryFiles))
+	remaining := make([][]*types.Filter, len(queryFiles))
+	for i, queryFile := range queryFiles {
+		query, args, remainingFilters, err := svc.buildQuery(resourceType, queryFile.Query, id, filters)
+		if err != nil {
+			return nil, fmt.Errorf("query file %s: %w", queryFile.Path, err)
+		}
+		queries[i] = sqlQuery{file: queryFile, query: orderQuery(query), args: args}
+		remaining[i] = remainingFilters
+	}
 
-	// Replace parameter in query
-	query = strings.ReplaceAll(query,
-		fmt.Sprintf(":%s.id", resourceType),
-		fmt.Sprintf("'%s'", patientID))
+	return newResourceStream(ctx, remainingFilters(filters, remaining), func(send func(ResourceResult) bool) error {
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
 
-	rows, err := svc.db.Queryx(query)
+		// Slots are taken in file order, so a file is never waiting for a slot held by a later file
+		outputs := make([]chan queryResource, len(queries))
+		errs := make([]error, len(queries))
+		for i := range outputs {
+			outputs[i] = make(chan queryResource, streamBuffer)
+		}
+		go func() {
+			slots := make(chan struct{}, maxConcurrentQueries)
+			for i := range queries {
+				select {
+				case slots <- struct{}{}:
+				case <-ctx.Done():
+					for ; i < len(queries); i++ {
+						errs[i] = ctx.Err()
+						close(outputs[i])
+					}
+					return
+				}
+				go func(i int) {
+					defer func() { <-slots }()
+					defer close(outputs[i])
+					errs[i] = svc.runQuery(ctx, queries[i], outputs[i])
+				}(i)
+			}
+		}()
+
+		// With a single query file there is nothing to deduplicate
+		var producedBy map[string]string
+		if len(queries) > 1 {
+			producedBy = make(map[string]string)
+		}
+
+		for i, output := range outputs {
+			for resource := range output {
+				if producedBy != nil {
+					if firstFile, exists := producedBy[resource.resourceID]; exists {
+						svc.log.Warn().
+							Str("resourceType", resourceType).
+							Str("resourceID", resource.resourceID).
+							Str("file", queries[i].file.Path).
+							Str("firstFile", firstFile).
+							Msg("Duplicate resource_id produced by multiple query files, keeping the first")
+						continue
+					}
+					producedBy[resource.resourceID] = queries[i].file.Path
+				}
+				if !send(resource.result) {
+					return ctx.Err()
+				}
+			}
+			if errs[i] != nil {
+				return fmt.Errorf("query file %s: %w", queries[i].file.Path, errs[i])
+			}
+		}
+		return nil
+	}), nil
+}
+
+// maxConcurrentQueries bounds the number of query files of one search that run at the same time
+const maxConcurrentQueries = 4
+
+// sqlQuery is a query file with its search parameters applied
+type sqlQuery struct {
+	file  *QueryFile
+	query string
+	args  []interface{}
+}
+
+// queryResource is a complete resource produced by a query
+type queryResource struct {
+	resourceID string
+	result     ResourceResult
+}
+
+// runQuery executes a query and sends each resource as soon as its rows are complete.
+// The rows have to be ordered by resource_id. Cancelling the context cancels the query in the database.
+func (svc *DataSourceService) runQuery(ctx context.Context, query sqlQuery, output chan<- queryResource) error {
+	rows, err := svc.db.QueryxContext(ctx, query.query, query.args...)
 	if err != nil {
-		return nil, fmt.Errorf("error executing query: %w", err)
+		return fmt.Errorf("error executing query: %w", err)
 	}
 	defer rows.Close()
 
-	// Map to hold resources by their resource_id
-	resources := make(map[string]ResourceResult)
+	// Each resource records which query produced it
+	builder := newResultBuilder(filepath.ToSlash(query.file.Path), svc.log)
+	builder.profile = query.file.Metadata.Profile
+
+	send := func(resourceID string) bool {
+		select {
+		case output <- queryResource{resourceID: resourceID, result: builder.take(resourceID)}:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
 
+	current, started := "", false
 	for rows.Next() {
 		row := make(map[string]interface{})
 		if err := rows.MapScan(row); err != nil {
-			return nil, fmt.Errorf("error scanning row: %w", err)
+			return fmt.Errorf("error scanning row: %w", err)
 		}
 
-		// Remove NULL values
-		for key, value := range row {
-			if value == nil {
-				delete(row, key)
-			}
+		resourceID, _ := row["resource_id"].(string)
+		if started && resourceID != current && !send(current) {
+			return ctx.Err()
 		}
-
-		svc.processRow(row, resources)
+		current, started = resourceID, true
+		builder.addRow(row)
 	}
 
 	if err := rows.Err(); err != nil {
-		return nil, fmt.Errorf("error iterating over rows: %w", err)
+		return fmt.Errorf("error iterating over rows: %w", err)
 	}
+	if started && !send(current) {
+		return ctx.Err()
+	}
+	return nil
+}
 
-	// Convert map to slice
-	results := make([]ResourceResult, 0, len(resources))
-	for _, result := range resources {
-		results = append(results, result)
+// remainingFilters returns the filters that at least one of the queries or sources could not handle, in their original order
+func remainingFilters(filters []*types.Filter, perSource [][]*types.Filter) []*types.Filter {
+	remaining := make(map[*types.Filter]bool)
+	for _, sourceFilters := range perSource {
+		for _, filter := range sourceFilters {
+			remaining[filter] = true
+		}
 	}
 
-	return results, nil
+	var result []*types.Filter
+	for _, filter := range filters {
+		if remaining[filter] {
+			result = append(result, filter)
+		}
+	}
+	return result
 }
 
-func (ds *DataSourceService) processRow(row map[string]interface{}, resources map[string]ResourceResult) {
+// processRow adds the columns of a row to the resource, every element of an alias becomes a row of its own path
+func (b *resultBuilder) processRow(row map[string]interface{}, resourceID string) {
 	// Extract metadata fields
 	id, _ := row["id"].(string)
 	parentID, _ := row["parent_id"].(string)
 	fhirPath, _ := row["fhir_path"].(string)
-	resourceID, _ := row["resource_id"].(string)
 
-	ds.log.Debug().
+	b.log.Debug().
 		Str("id", id).
 		Str("fhirPath", fhirPath).
 		Str("resourceID", resourceID).
 		Msg("Processing row")
 
-	// Initialize resource result if needed
-	if resources[resourceID] == nil {
-		resources[resourceID] = make(ResourceResult)
+	// Columns are processed in natural order so repeating elements keep their index order
+	keys := make([]string, 0, len(row))
+	for key := range row {
+		keys = append(keys, key)
 	}
+	sort.Slice(keys, func(i, j int) bool {
+		return naturalLess(keys[i], keys[j])
+	})
 
-	// Process top-level fields
-	topLevelData := make(map[string]interface{})
+	rowData := b.element(resourceID, fhirPath, id, parentID)
 
-	for key, value := range row {
+	// Elements of the resource row have no parent ID, those of a row of an element have that row as parent
+	isResourceRow := !strings.Contains(fhirPath, ".")
+	elementParentID := id
+	if isResourceRow {
+		elementParentID = ""
+	}
+
+	for _, key := range keys {
+		value := row[key]
 		// Skip if value is nil
 		if value == nil {
 			continue
 		}
 
 		// Skip metadata fields
-		if key == "id" || key == "parent_id" || key == "fhir_path" || key == "resource_id" {
+		if metadataColumns[key] {
 			continue
 		}
 
-		// Handle based on whether field contains dots (nested) or not
-		if !strings.Contains(key, ".") {
-			// Top level field
-			topLevelData[key] = value
-		} else {
-			// Nested field, process separately
-			parts := strings.Split(key, ".")
-			ds.processNestedField(parts, value, id, parentID, fhirPath, resourceID, resources)
+		parsed := b.alias(key)
+		if parsed == nil {
+			continue
 		}
-	}
 
-	// Handle top-level fields if any exist
-	if len(topLevelData) > 0 {
-		// Initialize slice for this path if needed
-		if resources[resourceID][fhirPath] == nil {
-			resources[resourceID][fhirPath] = []RowData{}
+		segments := parsed.segments
+		if isResourceRow {
+			segments = parsed.relativeTo(fhirPath)
 		}
 
-		// Try to find existing entry
-		existingIndex := -1
-		for idx, existingRow := range resources[resourceID][fhirPath] {
-			if existingRow.ID == id {
-				existingIndex = idx
-				break
+		data := rowData
+		currentPath := fhirPath
+		currentParentID := elementParentID
+		for _, segment := range segments[:len(segments)-1] {
+			currentPath += "." + segment.name
+
+			// Elements selected by url, e.g. extension[url=http://...], are numbered in order of appearance
+			index := segment.index
+			if segment.url != "" {
+				index = b.selectorIndex(resourceID, currentPath, currentParentID, segment.url)
+			}
+			if index < 0 {
+				index = 0
+			}
+
+			// The id of an element is the path of indexes from the row, counting from 1
+			currentID := strconv.Itoa(index + 1)
+			if currentParentID != "" {
+				currentID = currentParentID + "_" + currentID
 			}
-		}
 
-		if existingIndex != -1 {
-			// Update existing entry
-			for k, v := range topLevelData {
-				resources[resourceID][fhirPath][existingIndex].Data[k] = v
+			data = b.element(resourceID, currentPath, currentID, currentParentID)
+			if segment.url != "" {
+				data["url"] = segment.url
 			}
-			ds.log.Debug().
-				Str("id", id).
-				Str("path", fhirPath).
-				Msg("Updated existing entry")
-		} else {
-			// Add new entry
-			resources[resourceID][fhirPath] = append(resources[resourceID][fhirPath], RowData{
-				ID:       id,
-				ParentID: parentID,
-				Data:     topLevelData,
-			})
-			ds.log.Debug().
-				Str("id", id).
-				Str("path", fhirPath).
-				Msg("Added new entry")
+			currentParentID = currentID
 		}
+
+		setLeaf(data, parsed, value)
 	}
 }
 
-func (ds *DataSourceService) processNestedField(
-	parts []string,
-	value interface{},
-	id string,
-	parentID string,
-	basePath string,
-	resourceID string,
-	resources map[string]ResourceResult,
-) {
-	currentPath := basePath
-	currentID := id
-	currentParentID := parentID
-
-	for i := 0; i < len(parts)-1; i++ {
-		part := parts[i]
-
-		// Extract any array index and clean the part name
-		arrayIndex := ds.extractIndex(part)
-		cleanPart := ds.removeIndex(part)
-
-		// Build path without array index
-		currentPath += "." + cleanPart
-
-		// Generate ID based on array index if present
-		if arrayIndex > 0 {
-			// For array elements, use the index as the ID
-			currentID = strconv.Itoa(arrayIndex)
-		} else if i == 0 {
-			// First level, use "1" if no index specified
-			currentID = "1"
-		}
-
-		// For nested elements under an array item, prefix with parent ID
-		if i > 0 && strings.Contains(parts[i-1], "[") {
-			currentID = fmt.Sprintf("%s_%d", currentParentID, arrayIndex+1)
-		}
+// alias returns the parsed alias of a column, or nil if the alias is invalid. Query files are
+// validated when loaded, columns of other sources are logged once and skipped.
+func (b *resultBuilder) alias(column string) *alias {
+	if parsed, exists := b.aliases[column]; exists {
+		return parsed
+	}
+	parsed, err := parseAlias(column)
+	if err != nil {
+		b.log.Warn().Err(err).Msg("Skipping column with invalid alias")
+	}
+	b.aliases[column] = parsed
+	return parsed
+}
 
-		// Check if we're at the leaf level
-		isLeaf := i >= len(parts)-2
+// element returns the data of the row with the id within the path, the row is created if needed
+func (b *resultBuilder) element(resourceID, path, id, parentID string) map[string]interface{} {
+	position := b.find(resourceID, path, id)
+	if position == -1 {
+		b.appendRow(resourceID, path, RowData{
+			ID:       id,
+			ParentID: parentID,
+			Data:     make(map[string]interface{}),
+		})
+		position = b.find(resourceID, path, id)
+	}
+	return b.resources[resourceID][path][position].Data
+}
 
-		// Initialize path if needed
-		if resources[resourceID][currentPath] == nil {
-			resources[resourceID][currentPath] = []RowData{}
-		}
+// setLeaf sets the value of the last element of an alias. Values of a repeating primitive,
+// e.g. given[0] and given[1], are collected in a slice in index order.
+func setLeaf(data map[string]interface{}, parsed *alias, value interface{}) {
+	key := parsed.leafKey()
+	index := parsed.segments[len(parsed.segments)-1].index
+	if index < 0 {
+		data[key] = value
+		return
+	}
 
-		// Find existing entry or create new one
-		existingIndex := -1
-		for idx, row := range resources[resourceID][currentPath] {
-			if row.ID == currentID {
-				existingIndex = idx
-				break
-			}
-		}
+	values, _ := data[key].([]interface{})
+	for len(values) <= index {
+		values = append(values, nil)
+	}
+	values[index] = value
+	data[key] = values
+}
 
-		if isLeaf {
-			// Handle leaf node
-			leafField := parts[len(parts)-1]
-
-			if existingIndex != -1 {
-				// Update existing entry
-				resources[resourceID][currentPath][existingIndex].Data[leafField] = value
-			} else {
-				// Create new entry
-				newRow := RowData{
-					ID:       currentID,
-					ParentID: currentParentID,
-					Data:     map[string]interface{}{leafField: value},
-				}
-				resources[resourceID][currentPath] = append(resources[resourceID][currentPath], newRow)
-			}
-		} else if existingIndex == -1 {
-			// Create new intermediate node
-			newRow := RowData{
-				ID:       currentID,
-				ParentID: currentParentID,
-				Data:     make(map[string]interface{}),
-			}
-			resources[resourceID][currentPath] = append(resources[resourceID][currentPath], newRow)
+// selectorIndex returns the index of the element selected by url among the selected elements
+// with the same path and parent
+func (b *resultBuilder) selectorIndex(resourceID, path, parentID, url string) int {
+	key := rowKey{path: path, id: parentID}
+	urls := b.selectors[resourceID][key]
+	for i, existing := range urls {
+		if existing == url {
+			return i
 		}
-
-		// Update parent ID for next iteration
-		currentParentID = currentID
 	}
+	b.selectors[resourceID][key] = append(urls, url)
+	return len(urls)
 }
 
-func (ds *DataSourceService) extractIndex(part string) int {
-	start := strings.Index(part, "[")
-	end := strings.Index(part, "]")
-	if start != -1 && end != -1 && start < end {
-		index, err := strconv.Atoi(part[start+1 : end])
-		if err == nil {
-			return index
+// naturalLess compares strings with the numbers in them compared by value, so name[2] sorts before name[10]
+func naturalLess(a, b string) bool {
+	for a != "" && b != "" {
+		aDigits, bDigits := leadingDigits(a), leadingDigits(b)
+		if aDigits != "" && bDigits != "" {
+			aNumber, _ := strconv.Atoi(aDigits)
+			bNumber, _ := strconv.Atoi(bDigits)
+			if aNumber != bNumber {
+				return aNumber < bNumber
+			}
+			a, b = a[len(aDigits):], b[len(bDigits):]
+			continue
+		}
+		if a[0] != b[0] {
+			return a[0] < b[0]
 		}
+		a, b = a[1:], b[1:]
 	}
-	return 0
+	return len(a) < len(b)
 }
 
-func (ds *DataSourceService) removeIndex(part string) string {
-	index := strings.Index(part, "[")
-	if index != -1 {
-		return part[:index]
+// leadingDigits returns the digits at the start of s
+func leadingDigits(s string) string {
+	end := 0
+	for end < len(s) && s[end] >= '0' && s[end] <= '9' {
+		end++
 	}
-	return part
+	return s[:end]
 }
 
 // findSQLFilesInDir recursively searches for SQL files in a directory
@@ -402,7 +731,7 @@ func Example() {
 	})).With().Timestamp().Caller().Logger()
 
 	// Initialize service
-	service := NewDataSourceService(db, logger)
+	service := NewDataSourceService("HIX", db, nil, logger)
 
 	// Load queries
 	err = service.LoadQueryFile("queries/hix/flat/patient_1.sql")
@@ -411,7 +740,7 @@ func Example() {
 	}
 
 	// Read resources
-	results, err := service.ReadResources("Patient", "12345")
+	results, _, err := service.ReadResources("Patient", "12345", nil)
 	if err != nil {
 		log.Printf("Error: %v", err)
 	}
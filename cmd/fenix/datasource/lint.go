@@ -0,0 +1,235 @@
+package datasource
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/SanteonNL/fenix/cmd/fenix/types"
+	"github.com/SanteonNL/fenix/models/fhir"
+)
+
+// Severities of a LintIssue
+const (
+	LintError   = "error"   // the column maps to no element, or its value can never be set
+	LintWarning = "warning" // the column is read, but probably not as intended
+)
+
+// LintIssue is a problem found by checking the column aliases of a query file against the
+// Go model of its resource type
+type LintIssue struct {
+	File     string `json:"file"`
+	Column   string `json:"column,omitempty"`
+	Severity string `json:"severity"`
+	Message  string `json:"message"`
+}
+
+// String formats the issue for logs and errors
+func (issue LintIssue) String() string {
+	if issue.Column == "" {
+		return issue.Message
+	}
+	return fmt.Sprintf("column %q: %s", issue.Column, issue.Message)
+}
+
+// HasLintErrors reports whether any of the issues is an error
+func HasLintErrors(issues []LintIssue) bool {
+	for _, issue := range issues {
+		if issue.Severity == LintError {
+			return true
+		}
+	}
+	return false
+}
+
+// firstLintError returns the first issue that is an error
+func firstLintError(issues []LintIssue) LintIssue {
+	for _, issue := range issues {
+		if issue.Severity == LintError {
+			return issue
+		}
+	}
+	return LintIssue{}
+}
+
+// literalColumnPattern matches the columns of a SELECT list with a constant value, e.g. 'male' AS "gender" or true AS active
+var literalColumnPattern = regexp.MustCompile(`(?im)(?:^|,|\bSELECT\b)\s*('(?:[^']|'')*'|\btrue\b|\bfalse\b|-?\b\d+(?:\.\d+)?\b)\s+AS\s+(?:"([^"]+)"|([A-Za-z_][A-Za-z0-9_]*))`)
+
+// lintQuery checks that every column alias of a query is an element of the resource type, or of
+// one of the elements the query emits rows for, and that constant values fit the type of their
+// element. Resource types without a Go model are not checked.
+func lintQuery(resourceType string, query string) []LintIssue {
+	factory, exists := types.ResourceFactoryMap[resourceType]
+	if !exists {
+		return nil
+	}
+	resource := reflect.TypeOf(factory()).Elem()
+
+	var issues []LintIssue
+	report := func(column, severity, format string, args ...interface{}) {
+		issues = append(issues, LintIssue{Column: column, Severity: severity, Message: fmt.Sprintf(format, args...)})
+	}
+
+	contexts := []reflect.Type{resource}
+	for _, match := range fhirPathElementPattern.FindAllStringSubmatch(stripLineComments(query), -1) {
+		path := strings.Split(match[1], ".")
+		if path[0] != resourceType {
+			report("", LintError, "fhir_path %q is not an element of %s", match[1], resourceType)
+			continue
+		}
+		var segments []aliasSegment
+		for _, name := range path[1:] {
+			segments = append(segments, aliasSegment{name: name, index: -1})
+		}
+		element, err := resolveAliasSegments(resource, segments)
+		if err != nil {
+			report("", LintError, "fhir_path %q: %v", match[1], err)
+			continue
+		}
+		if element == nil || element.Kind() != reflect.Struct {
+			report("", LintError, "fhir_path %q is not a complex element", match[1])
+			continue
+		}
+		contexts = append(contexts, element)
+	}
+
+	literals := queryLiteralColumns(query)
+	for _, column := range queryColumnAliases(query) {
+		if metadataColumns[strings.ToLower(column)] {
+			continue
+		}
+		parsed, err := parseAlias(column)
+		if err != nil {
+			report(column, LintError, "%v", strings.TrimPrefix(err.Error(), fmt.Sprintf("column %q: ", column)))
+			continue
+		}
+		segments := parsed.relativeTo(resourceType)
+
+		// Reported is why the alias is no element of the resource itself
+		var context, element reflect.Type
+		var resolveErr error
+		for i, candidate := range contexts {
+			t, err := resolveAliasSegments(candidate, segments)
+			if err == nil {
+				context, element, resolveErr = candidate, t, nil
+				break
+			}
+			if i == 0 {
+				resolveErr = err
+			}
+		}
+		if resolveErr != nil {
+			report(column, LintError, "%v", resolveErr)
+			continue
+		}
+
+		if written := aliasSpelling(context, segments); written != "" {
+			report(column, LintWarning, "element is written %s", written)
+		}
+
+		literal, isLiteral := literals[column]
+		if !isLiteral || element == nil || parsed.typeColumn {
+			continue
+		}
+		if severity, err := checkLiteralValue(element, literal); err != nil {
+			report(column, severity, "%v", err)
+		}
+	}
+	return issues
+}
+
+// queryLiteralColumns returns the constant values of the columns of a query by alias, strings
+// without their quotes
+func queryLiteralColumns(query string) map[string]string {
+	literals := make(map[string]string)
+	for _, match := range literalColumnPattern.FindAllStringSubmatch(stripLineComments(query), -1) {
+		column := match[2]
+		if column == "" {
+			column = strings.ToLower(match[3])
+		}
+		value := match[1]
+		if strings.HasPrefix(value, "'") {
+			value = strings.ReplaceAll(value[1:len(value)-1], "''", "'")
+		}
+		literals[column] = value
+	}
+	return literals
+}
+
+// aliasSpelling returns the alias as the json tags write it when an element name of the alias
+// differs in case, and an empty string when it matches
+func aliasSpelling(t reflect.Type, segments []aliasSegment) string {
+	var written []string
+	differs := false
+	for _, segment := range segments {
+		for t.Kind() == reflect.Ptr || t.Kind() == reflect.Slice {
+			t = t.Elem()
+		}
+		if segment.choice || t.Kind() != reflect.Struct {
+			return ""
+		}
+		field, found := fieldByJSONName(t, segment.name)
+		if !found {
+			return ""
+		}
+		name := types.JSONName(field)
+		if name != segment.name {
+			differs = true
+		}
+		written = append(written, name)
+		t = field.Type
+	}
+	if !differs {
+		return ""
+	}
+	return strings.Join(written, ".")
+}
+
+// checkLiteralValue checks that a constant value of a query can be set on an element of the type.
+// A code that is not in the value set is a warning, concept maps may still translate it.
+func checkLiteralValue(t reflect.Type, value string) (string, error) {
+	if t.Kind() == reflect.Slice {
+		t = t.Elem()
+	}
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	switch {
+	case t == reflect.TypeOf(fhir.Date{}):
+		var date fhir.Date
+		if err := date.UnmarshalJSON([]byte(strconv.Quote(value))); err != nil {
+			return LintError, fmt.Errorf("%q is not a date", value)
+		}
+	case t == reflect.TypeOf(json.Number("")):
+		if _, err := strconv.ParseFloat(value, 64); err != nil {
+			return LintError, fmt.Errorf("%q is not a decimal", value)
+		}
+	case isCodeType(t):
+		code := reflect.New(t).Interface().(json.Unmarshaler)
+		if err := code.UnmarshalJSON([]byte(strconv.Quote(value))); err != nil {
+			return LintWarning, fmt.Errorf("%q is not a code of %s", value, t.Name())
+		}
+	case t.Kind() == reflect.Bool:
+		if _, err := strconv.ParseBool(value); err != nil {
+			return LintError, fmt.Errorf("%q is not a boolean", value)
+		}
+	case t.Kind() == reflect.Int || t.Kind() == reflect.Int64:
+		if _, err := strconv.ParseInt(value, 10, 64); err != nil {
+			return LintError, fmt.Errorf("%q is not an integer", value)
+		}
+	}
+	return "", nil
+}
+
+// isCodeType reports whether t is a generated code enum, e.g. AdministrativeGender
+func isCodeType(t reflect.Type) bool {
+	if t.Kind() == reflect.Struct {
+		return false
+	}
+	_, hasCode := t.MethodByName("Code")
+	return hasCode && reflect.PointerTo(t).Implements(reflect.TypeOf((*json.Unmarshaler)(nil)).Elem())
+}
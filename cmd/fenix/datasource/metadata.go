@@ -0,0 +1,178 @@
+package datasource
+
+import (
+	"bufio"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/SanteonNL/fenix/models/fhir"
+)
+
+// QueryMetadata is the header block at the start of a query file, e.g.
+//
+//	-- resourceType: Patient
+//	-- profile: http://hl7.org/fhir/StructureDefinition/Patient
+//	-- datasource: HIX
+//	-- searchParameters: _id, identifier, gender
+//	-- description: Patients from the HIX patient table
+type QueryMetadata struct {
+	ResourceType     string
+	Profile          string
+	DataSource       string
+	SearchParameters []string
+	Description      string
+}
+
+// QueryFile is a loaded query file with its metadata
+type QueryFile struct {
+	Path     string
+	Metadata QueryMetadata
+	Query    string
+}
+
+// metadataLinePattern matches a "-- key: value" line of the header block
+var metadataLinePattern = regexp.MustCompile(`^--\s*([A-Za-z]+)\s*:\s*(.*?)\s*$`)
+
+// fhirPathLiteralPattern matches the resource type literal a query emits as fhir_path, e.g. 'Patient' AS fhir_path
+var fhirPathLiteralPattern = regexp.MustCompile(`(?i)'([A-Za-z]+)'\s+AS\s+"?fhir_path"?`)
+
+// parseQueryMetadata reads the leading comment block of a query file
+func parseQueryMetadata(query string) (QueryMetadata, error) {
+	var metadata QueryMetadata
+	seen := make(map[string]bool)
+
+	scanner := bufio.NewScanner(strings.NewReader(query))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		// The header ends at the first line that is not a comment
+		if !strings.HasPrefix(line, "--") {
+			break
+		}
+
+		match := metadataLinePattern.FindStringSubmatch(line)
+		if match == nil {
+			continue
+		}
+
+		key, value := strings.ToLower(match[1]), match[2]
+		if seen[key] {
+			return metadata, fmt.Errorf("duplicate metadata key %q", match[1])
+		}
+		seen[key] = true
+
+		switch key {
+		case "resourcetype":
+			metadata.ResourceType = value
+		case "profile":
+			metadata.Profile = value
+		case "datasource":
+			metadata.DataSource = value
+		case "searchparameters":
+			for _, code := range strings.Split(value, ",") {
+				if code = strings.TrimSpace(code); code != "" {
+					metadata.SearchParameters = append(metadata.SearchParameters, code)
+				}
+			}
+		case "description":
+			metadata.Description = value
+		default:
+			return metadata, fmt.Errorf("unknown metadata key %q", match[1])
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return metadata, fmt.Errorf("failed to read metadata: %w", err)
+	}
+
+	return metadata, nil
+}
+
+// validateQueryMetadata checks the metadata for consistency with itself and with the query
+func (svc *DataSourceService) validateQueryMetadata(metadata QueryMetadata, query string) error {
+	if metadata.ResourceType == "" {
+		return fmt.Errorf("missing resourceType in metadata header")
+	}
+
+	var resourceType fhir.ResourceType
+	if err := resourceType.UnmarshalJSON([]byte(`"` + metadata.ResourceType + `"`)); err != nil {
+		return fmt.Errorf("unknown resourceType %q", metadata.ResourceType)
+	}
+
+	if metadata.Profile != "" {
+		if profileURL, err := url.Parse(metadata.Profile); err != nil || !profileURL.IsAbs() {
+			return fmt.Errorf("profile %q is not an absolute URL", metadata.Profile)
+		}
+	}
+
+	// The query has to produce the declared resource type
+	for _, match := range fhirPathLiteralPattern.FindAllStringSubmatch(stripLineComments(query), -1) {
+		if match[1] != metadata.ResourceType {
+			return fmt.Errorf("query emits fhir_path %q but metadata declares resourceType %q", match[1], metadata.ResourceType)
+		}
+	}
+
+	declared := make(map[string]bool)
+	for _, code := range metadata.SearchParameters {
+		if declared[code] {
+			return fmt.Errorf("search parameter %q is declared twice", code)
+		}
+		declared[code] = true
+
+		if code == "_id" || svc.searchParamService == nil {
+			continue
+		}
+		if len(svc.searchParamService.GetPathsForSearchParameter(metadata.ResourceType, code)) == 0 {
+			return fmt.Errorf("search parameter %q is not defined for %s", code, metadata.ResourceType)
+		}
+	}
+
+	// Every placeholder has to be declared when search parameters are listed
+	if len(metadata.SearchParameters) > 0 {
+		for _, match := range queryPlaceholderPattern.FindAllStringSubmatch(query, -1) {
+			code := match[4]
+			if code == "id" {
+				code = "_id"
+			}
+			if !declared[code] {
+				return fmt.Errorf("placeholder ?%s is not declared in searchParameters", match[4])
+			}
+		}
+	}
+
+	return nil
+}
+
+// stripLineComments removes -- comments so commented out SQL is not validated. A -- within a
+// string literal or quoted identifier is not a comment, e.g. in a url.
+func stripLineComments(query string) string {
+	var builder strings.Builder
+	var quote rune
+	inComment := false
+	runes := []rune(query)
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+		switch {
+		case inComment:
+			if r != '\n' {
+				continue
+			}
+			inComment = false
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+		case r == '\'' || r == '"':
+			quote = r
+		case r == '-' && i+1 < len(runes) && runes[i+1] == '-':
+			inComment = true
+			continue
+		}
+		builder.WriteRune(r)
+	}
+	return builder.String()
+}
@@ -0,0 +1,80 @@
+package datasource
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/rs/zerolog"
+)
+
+func TestStripLineComments(t *testing.T) {
+	tests := []struct {
+		name  string
+		query string
+		want  string
+	}{
+		{"comment", "SELECT a -- the a column\nFROM t", "SELECT a \nFROM t"},
+		{"comment line", "-- header\nSELECT a", "\nSELECT a"},
+		{"string literal", "SELECT 'http://example.org/ValueSet/1.2--2020' AS \"x\" -- comment", "SELECT 'http://example.org/ValueSet/1.2--2020' AS \"x\" "},
+		{"quoted identifier", "SELECT a AS \"a--b\"", "SELECT a AS \"a--b\""},
+		{"escaped quote", "SELECT 'it''s -- here' AS x -- don't", "SELECT 'it''s -- here' AS x "},
+		{"quote in comment", "SELECT a -- don't\nFROM t", "SELECT a \nFROM t"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := stripLineComments(tt.query); got != tt.want {
+				t.Errorf("expected %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestQueryColumnAliasesAfterURLWithDashes(t *testing.T) {
+	query := `SELECT
+    'http://decor.nictiz.nl/fhir/ValueSet/2.16.840.1.113883.2.4.3.11.60.40.2.12.4.1--20200901000000' AS "code.coding[0].system",
+    o.code AS "code.coding[0].code" -- the code
+FROM observation o`
+
+	want := []string{"code.coding[0].system", "code.coding[0].code"}
+	if got := queryColumnAliases(query); !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+}
+
+func TestLoadQueryFileWithLintErrors(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "patient.sql")
+	query := `-- resourceType: Patient
+SELECT
+    p.id AS resource_id,
+    p.id AS id,
+    NULL AS parent_id,
+    'Patient' AS fhir_path,
+    p.shoe_size AS "shoeSize"
+FROM patient p`
+	if err := os.WriteFile(path, []byte(query), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, strict := range []bool{false, true} {
+		registry := NewRegistry(zerolog.Nop())
+		registry.strict = strict
+		if err := registry.Register(NewDataSourceService("test", nil, nil, zerolog.Nop())); err != nil {
+			t.Fatalf("Register: %v", err)
+		}
+
+		err := registry.loadQueryFile(path)
+		loaded := len(registry.ListQueryFiles()) == 1
+		if strict && (err == nil || loaded) {
+			t.Errorf("strict: expected the file to be rejected, got error %v and loaded %v", err, loaded)
+		}
+		if !strict && (err != nil || !loaded) {
+			t.Errorf("not strict: expected the file to be loaded, got error %v and loaded %v", err, loaded)
+		}
+		if !HasLintErrors(registry.LintReport()) {
+			t.Errorf("strict %v: expected the lint error in the report", strict)
+		}
+	}
+}
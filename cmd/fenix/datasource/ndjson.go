@@ -0,0 +1,175 @@
+package datasource
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/SanteonNL/fenix/cmd/fenix/types"
+	"github.com/rs/zerolog"
+)
+
+// NDJSONDataSource reads FHIR resources from a newline delimited JSON file.
+// The file is read on every request so changes are picked up without a restart.
+type NDJSONDataSource struct {
+	name       string
+	sourcePath string
+	log        zerolog.Logger
+}
+
+// NewNDJSONDataSource creates a datasource for a FHIR NDJSON file
+func NewNDJSONDataSource(name string, sourcePath string, log zerolog.Logger) *NDJSONDataSource {
+	return &NDJSONDataSource{
+		name:       name,
+		sourcePath: sourcePath,
+		log:        log,
+	}
+}
+
+// Name returns the connection name of the datasource
+func (ds *NDJSONDataSource) Name() string {
+	return ds.name
+}
+
+// ResourceTypes returns the resource types present in the file
+func (ds *NDJSONDataSource) ResourceTypes() []string {
+	seen := make(map[string]bool)
+	var resourceTypes []string
+
+	err := ds.readResources(func(resourceType string, resource map[string]interface{}) error {
+		if !seen[resourceType] {
+			seen[resourceType] = true
+			resourceTypes = append(resourceTypes, resourceType)
+		}
+		return nil
+	})
+	if err != nil {
+		ds.log.Error().Err(err).Str("file", ds.sourcePath).Msg("Failed to read resource types")
+	}
+
+	sort.Strings(resourceTypes)
+	return resourceTypes
+}
+
+// ReadResources reads all resources of the resource type, see StreamResources
+func (ds *NDJSONDataSource) ReadResources(resourceType, id string, filters []*types.Filter) ([]ResourceResult, []*types.Filter, error) {
+	stream, err := ds.StreamResources(context.Background(), resourceType, id, filters)
+	if err != nil {
+		return nil, nil, err
+	}
+	results, err := CollectResources(stream)
+	return results, stream.RemainingFilters, err
+}
+
+// StreamResources flattens the resources of the resource type into the same rows a query would
+// produce, each line is sent as soon as it is read. Search parameters are not handled by the file
+// and are all returned as remaining.
+func (ds *NDJSONDataSource) StreamResources(ctx context.Context, resourceType, id string, filters []*types.Filter) (*ResourceStream, error) {
+	return streamRows(ctx, ds.sourcePath, filters, ds.log, func(add func(row map[string]interface{}) error) error {
+		return ds.readResources(func(lineType string, resource map[string]interface{}) error {
+			resourceID, _ := resource["id"].(string)
+			if lineType != resourceType || (id != "" && resourceID != id) {
+				return nil
+			}
+
+			row := map[string]interface{}{
+				"resource_id": resourceID,
+				"id":          resourceID,
+				"parent_id":   "",
+				"fhir_path":   resourceType,
+			}
+			for key, value := range resource {
+				if key == "resourceType" || key == "id" {
+					continue
+				}
+				ds.flatten(key, value, row)
+			}
+			return add(row)
+		})
+	}), nil
+}
+
+// readResources calls fn for every resource in the file, an error of fn stops reading and is returned
+func (ds *NDJSONDataSource) readResources(fn func(resourceType string, resource map[string]interface{}) error) error {
+	file, err := os.Open(ds.sourcePath)
+	if err != nil {
+		return fmt.Errorf("failed to open ndjson file %s: %w", ds.sourcePath, err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+
+		// Numbers are kept as json.Number so they are not rounded
+		decoder := json.NewDecoder(bytes.NewReader(line))
+		decoder.UseNumber()
+
+		var resource map[string]interface{}
+		if err := decoder.Decode(&resource); err != nil {
+			return fmt.Errorf("invalid JSON on line %d of %s: %w", lineNumber, ds.sourcePath, err)
+		}
+
+		resourceType, _ := resource["resourceType"].(string)
+		if resourceType == "" {
+			return fmt.Errorf("missing resourceType on line %d of %s", lineNumber, ds.sourcePath)
+		}
+		if err := fn(resourceType, resource); err != nil {
+			return err
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read ndjson file %s: %w", ds.sourcePath, err)
+	}
+	return nil
+}
+
+// flatten adds a JSON value to the row as column aliases, e.g. name[0].family
+func (ds *NDJSONDataSource) flatten(path string, value interface{}, row map[string]interface{}) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, child := range v {
+			ds.flatten(path+"."+key, child, row)
+		}
+	case []interface{}:
+		for i, child := range v {
+			if _, isObject := child.(map[string]interface{}); !isObject {
+				// The flat row format has no columns for lists of primitives
+				ds.log.Debug().
+					Str("path", path).
+					Msg("Skipping list of primitive values")
+				return
+			}
+			ds.flatten(fmt.Sprintf("%s[%d]", path, i), child, row)
+		}
+	case json.Number:
+		row[path] = v.String()
+	case bool:
+		row[path] = fmt.Sprint(v)
+	default:
+		row[path] = v
+	}
+}
+
+// validFilters returns the valid filters, which all remain to be checked on the processed resources
+func validFilters(filters []*types.Filter) []*types.Filter {
+	var valid []*types.Filter
+	for _, filter := range filters {
+		if filter != nil && filter.IsValid {
+			valid = append(valid, filter)
+		}
+	}
+	return valid
+}
@@ -0,0 +1,507 @@
+package datasource
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/SanteonNL/fenix/cmd/fenix/types"
+	"github.com/SanteonNL/fenix/models/sim"
+	"github.com/rs/zerolog"
+	"github.com/xitongsys/parquet-go-source/local"
+	"github.com/xitongsys/parquet-go/common"
+	"github.com/xitongsys/parquet-go/parquet"
+	"github.com/xitongsys/parquet-go/reader"
+	parquettypes "github.com/xitongsys/parquet-go/types"
+)
+
+// parquetBatchSize is the number of rows read per column at a time, so only one batch of the
+// projected columns is in memory while the row groups are read
+const parquetBatchSize = 10000
+
+// parquetReaders is the number of goroutines the parquet reader uses per column
+const parquetReaders = 4
+
+// ParquetDataSource reads Parquet extracts column by column. The flat format uses the same
+// columns as a query (resource_id, id, parent_id, fhir_path and FHIR path aliases), the sim
+// format maps the columns on the parquet tags of models/sim.Patient like the SIM CSV extracts.
+// Only the columns that are needed are read. The row groups are streamed, the rows of a flat
+// resource have to be adjacent and the SIM child files are held in memory.
+type ParquetDataSource struct {
+	name       string
+	sourcePath string
+	format     string
+
+	// fhirPaths caches the distinct fhir_path values of a flat file until the file changes
+	fhirPaths    []string
+	fhirPathsMod time.Time
+	mu           sync.Mutex
+
+	log zerolog.Logger
+}
+
+// parquetColumn is a top-level column of a parquet file
+type parquetColumn struct {
+	name    string // column name in the file
+	path    string // path in the parquet schema
+	element *parquet.SchemaElement
+}
+
+// NewParquetDataSource creates a datasource for a parquet connection
+func NewParquetDataSource(connection ConnectionConfig, log zerolog.Logger) (*ParquetDataSource, error) {
+	format := connection.Format
+	if format == "" {
+		format = "flat"
+	}
+	if format != "flat" && format != "sim" {
+		return nil, fmt.Errorf("unsupported parquet format: %s", connection.Format)
+	}
+
+	return &ParquetDataSource{
+		name:       connection.Name,
+		sourcePath: connection.SourcePath,
+		format:     format,
+		log:        log,
+	}, nil
+}
+
+// Name returns the connection name of the datasource
+func (ds *ParquetDataSource) Name() string {
+	return ds.name
+}
+
+// ResourceTypes returns the resource types of the file, for the flat format the fhir_path values
+// of the resource rows
+func (ds *ParquetDataSource) ResourceTypes() []string {
+	if ds.format == "sim" {
+		return []string{"Patient"}
+	}
+
+	fhirPaths, err := ds.readFHIRPaths()
+	if err != nil {
+		ds.log.Error().Err(err).Str("file", ds.sourcePath).Msg("Failed to read resource types")
+		return nil
+	}
+
+	resourceTypes := []string{}
+	for _, fhirPath := range fhirPaths {
+		if !strings.Contains(fhirPath, ".") {
+			resourceTypes = append(resourceTypes, fhirPath)
+		}
+	}
+	return resourceTypes
+}
+
+// readFHIRPaths returns the distinct fhir_path values of a flat file. Only the fhir_path column
+// is read, and the result is kept until the file changes.
+func (ds *ParquetDataSource) readFHIRPaths() ([]string, error) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+
+	info, err := os.Stat(ds.sourcePath)
+	if err != nil {
+		return nil, err
+	}
+	if ds.fhirPaths != nil && info.ModTime().Equal(ds.fhirPathsMod) {
+		return ds.fhirPaths, nil
+	}
+
+	seen := make(map[string]bool)
+	fhirPaths := []string{}
+	err = ds.readRows(ds.sourcePath, []string{"fhir_path"}, "", "", func(row map[string]interface{}) error {
+		fhirPath, _ := row["fhir_path"].(string)
+		if fhirPath != "" && !seen[fhirPath] {
+			seen[fhirPath] = true
+			fhirPaths = append(fhirPaths, fhirPath)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Strings(fhirPaths)
+	ds.fhirPaths = fhirPaths
+	ds.fhirPathsMod = info.ModTime()
+	return fhirPaths, nil
+}
+
+// ReadResources reads all resources of the resource type, see StreamResources
+func (ds *ParquetDataSource) ReadResources(resourceType, id string, filters []*types.Filter) ([]ResourceResult, []*types.Filter, error) {
+	stream, err := ds.StreamResources(context.Background(), resourceType, id, filters)
+	if err != nil {
+		return nil, nil, err
+	}
+	results, err := CollectResources(stream)
+	return results, stream.RemainingFilters, err
+}
+
+// StreamResources streams the resources of the resource type as the rows a query would produce.
+// A flat resource is sent as soon as the rows of the next resource start. Search parameters are
+// not handled by the file and are all returned as remaining.
+func (ds *ParquetDataSource) StreamResources(ctx context.Context, resourceType, id string, filters []*types.Filter) (*ResourceStream, error) {
+	if ds.format == "sim" {
+		if resourceType != "Patient" {
+			return nil, fmt.Errorf("resource type %s is not available in SIM extracts", resourceType)
+		}
+		return streamRows(ctx, ds.sourcePath, filters, ds.log, func(add func(row map[string]interface{}) error) error {
+			return ds.readSIMPatients(id, add)
+		}), nil
+	}
+
+	projection, err := ds.flatProjection(resourceType)
+	if err != nil {
+		return nil, err
+	}
+
+	return streamRows(ctx, ds.sourcePath, filters, ds.log, func(add func(row map[string]interface{}) error) error {
+		// Rows belong to the resource type when the fhir_path starts with it
+		return ds.readRows(ds.sourcePath, projection, "resource_id", id, func(row map[string]interface{}) error {
+			fhirPath, _ := row["fhir_path"].(string)
+			if fhirPath != resourceType && !strings.HasPrefix(fhirPath, resourceType+".") {
+				return nil
+			}
+			// Resource rows may leave parent_id null
+			if _, exists := row["parent_id"]; !exists {
+				row["parent_id"] = ""
+			}
+			return add(row)
+		})
+	}), nil
+}
+
+// flatProjection returns the columns of a flat file the rows of a resource type need: the
+// metadata columns and the columns that are an element of the resource type, or of an element
+// it has rows for. All columns are read for resource types without a Go model.
+func (ds *ParquetDataSource) flatProjection(resourceType string) ([]string, error) {
+	factory, exists := types.ResourceFactoryMap[resourceType]
+	if !exists {
+		return nil, nil
+	}
+
+	fhirPaths, err := ds.readFHIRPaths()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read parquet file %s: %w", ds.sourcePath, err)
+	}
+	resource := reflect.TypeOf(factory()).Elem()
+	contexts := []reflect.Type{resource}
+	for _, fhirPath := range fhirPaths {
+		path := strings.Split(fhirPath, ".")
+		if len(path) < 2 || path[0] != resourceType {
+			continue
+		}
+		var segments []aliasSegment
+		for _, name := range path[1:] {
+			segments = append(segments, aliasSegment{name: name, index: -1})
+		}
+		if element, err := resolveAliasSegments(resource, segments); err == nil && element != nil {
+			contexts = append(contexts, element)
+		}
+	}
+
+	columns, err := ds.columnNames(ds.sourcePath)
+	if err != nil {
+		return nil, err
+	}
+	var projection []string
+	for _, column := range columns {
+		if metadataColumns[strings.ToLower(column)] || isElementColumn(resourceType, contexts, column) {
+			projection = append(projection, column)
+		}
+	}
+	return projection, nil
+}
+
+// isElementColumn reports whether a column alias is an element of one of the types
+func isElementColumn(resourceType string, contexts []reflect.Type, column string) bool {
+	parsed, err := parseAlias(column)
+	if err != nil {
+		return false
+	}
+	segments := parsed.relativeTo(resourceType)
+	for _, context := range contexts {
+		if _, err := resolveAliasSegments(context, segments); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// readSIMPatients reads the SIM patients with the names and contacts files next to the patient
+// file. The patients are passed to add one at a time, the child files are held in memory.
+func (ds *ParquetDataSource) readSIMPatients(id string, add func(row map[string]interface{}) error) error {
+	names, err := ds.readSIMChildFile("names", id)
+	if err != nil {
+		return err
+	}
+	contacts, err := ds.readSIMChildFile("contacts", id)
+	if err != nil {
+		return err
+	}
+
+	return ds.readSIM(ds.sourcePath, id, func(patient sim.Patient) error {
+		patientID := stringValue(patient.Identificatienummer)
+		if patientID == "" {
+			ds.log.Warn().Str("file", ds.sourcePath).Msg("Skipping SIM patient without Identificatienummer")
+			return nil
+		}
+		return add(simPatientRow(patient, names[patientID], contacts[patientID]))
+	})
+}
+
+// readSIMChildFile reads a child file, e.g. patient_names.parquet, grouped by Identificatienummer.
+// Child files are optional.
+func (ds *ParquetDataSource) readSIMChildFile(suffix string, id string) (map[string][]sim.Patient, error) {
+	extension := filepath.Ext(ds.sourcePath)
+	path := strings.TrimSuffix(ds.sourcePath, extension) + "_" + suffix + extension
+	if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+
+	grouped := make(map[string][]sim.Patient)
+	err := ds.readSIM(path, id, func(row sim.Patient) error {
+		patientID := stringValue(row.Identificatienummer)
+		grouped[patientID] = append(grouped[patientID], row)
+		return nil
+	})
+	return grouped, err
+}
+
+// readSIM decodes the rows of a SIM parquet file into sim.Patient using the parquet tags, an
+// error of fn stops reading. Only the columns that have a field in sim.Patient are read.
+func (ds *ParquetDataSource) readSIM(path string, id string, fn func(sim.Patient) error) error {
+	patientType := reflect.TypeOf(sim.Patient{})
+	fields := make(map[string]int)
+	var projection []string
+	for i := 0; i < patientType.NumField(); i++ {
+		name := strings.Split(patientType.Field(i).Tag.Get("parquet"), ",")[0]
+		if name != "" {
+			fields[strings.ToLower(name)] = i
+			projection = append(projection, name)
+		}
+	}
+
+	return ds.readRows(path, projection, "Identificatienummer", id, func(row map[string]interface{}) error {
+		var patient sim.Patient
+		value := reflect.ValueOf(&patient).Elem()
+		for column, columnValue := range row {
+			field, exists := fields[strings.ToLower(column)]
+			if !exists {
+				continue
+			}
+			if err := setSIMField(value.Field(field), fmt.Sprint(columnValue)); err != nil {
+				return fmt.Errorf("parquet file %s, column %s: %w", path, column, err)
+			}
+		}
+		return fn(patient)
+	})
+}
+
+// readRows reads the projected columns of a file in batches and calls fn for every row, an
+// error of fn stops reading and is returned. A nil projection reads all top-level columns. When
+// id is set only rows whose key column equals id are passed to fn, and the other columns of
+// batches without a match are skipped.
+func (ds *ParquetDataSource) readRows(path string, projection []string, keyColumn string, id string, fn func(row map[string]interface{}) error) error {
+	file, err := local.NewLocalFileReader(path)
+	if err != nil {
+		return fmt.Errorf("failed to open parquet file %s: %w", path, err)
+	}
+	defer file.Close()
+
+	pr, err := reader.NewParquetColumnReader(file, parquetReaders)
+	if err != nil {
+		return fmt.Errorf("failed to read parquet file %s: %w", path, err)
+	}
+	defer pr.ReadStop()
+
+	columns, err := ds.projectColumns(pr, projection)
+	if err != nil {
+		return fmt.Errorf("parquet file %s: %w", path, err)
+	}
+
+	// The key column is read first so batches without the requested id can be skipped
+	keyIndex := -1
+	if keyColumn != "" {
+		for i, column := range columns {
+			if strings.EqualFold(column.name, keyColumn) {
+				keyIndex = i
+				break
+			}
+		}
+		if keyIndex == -1 {
+			return fmt.Errorf("parquet file %s has no %s column", path, keyColumn)
+		}
+		if id == "" {
+			keyIndex = -1
+		}
+	}
+
+	numRows := pr.GetNumRows()
+	for offset := int64(0); offset < numRows; offset += parquetBatchSize {
+		batchSize := numRows - offset
+		if batchSize > parquetBatchSize {
+			batchSize = parquetBatchSize
+		}
+
+		values := make([][]interface{}, len(columns))
+		var matches []int
+		if keyIndex != -1 {
+			keys, _, _, err := pr.ReadColumnByPath(columns[keyIndex].path, batchSize)
+			if err != nil {
+				return fmt.Errorf("failed to read column %s of parquet file %s: %w", columns[keyIndex].name, path, err)
+			}
+			values[keyIndex] = keys
+			for i, key := range keys {
+				if key != nil && parquetValue(key, columns[keyIndex].element) == id {
+					matches = append(matches, i)
+				}
+			}
+		}
+
+		for i, column := range columns {
+			if i == keyIndex {
+				continue
+			}
+			if keyIndex != -1 && len(matches) == 0 {
+				if err := pr.SkipRowsByPath(column.path, batchSize); err != nil {
+					return fmt.Errorf("failed to skip column %s of parquet file %s: %w", column.name, path, err)
+				}
+				continue
+			}
+			if values[i], _, _, err = pr.ReadColumnByPath(column.path, batchSize); err != nil {
+				return fmt.Errorf("failed to read column %s of parquet file %s: %w", column.name, path, err)
+			}
+		}
+
+		if keyIndex == -1 {
+			matches = make([]int, batchSize)
+			for i := range matches {
+				matches[i] = i
+			}
+		}
+
+		for _, rowIndex := range matches {
+			row := make(map[string]interface{}, len(columns))
+			for i, column := range columns {
+				if rowIndex < len(values[i]) && values[i][rowIndex] != nil {
+					row[column.name] = parquetValue(values[i][rowIndex], column.element)
+				}
+			}
+			if err := fn(row); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// columnNames returns the top-level columns of a file, only the schema is read
+func (ds *ParquetDataSource) columnNames(path string) ([]string, error) {
+	file, err := local.NewLocalFileReader(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open parquet file %s: %w", path, err)
+	}
+	defer file.Close()
+
+	pr, err := reader.NewParquetColumnReader(file, 1)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read parquet file %s: %w", path, err)
+	}
+	defer pr.ReadStop()
+
+	columns, err := ds.projectColumns(pr, nil)
+	if err != nil {
+		return nil, fmt.Errorf("parquet file %s: %w", path, err)
+	}
+	names := make([]string, 0, len(columns))
+	for _, column := range columns {
+		names = append(names, column.name)
+	}
+	return names, nil
+}
+
+// projectColumns returns the top-level columns of the file that are in the projection,
+// nested columns are not supported and skipped
+func (ds *ParquetDataSource) projectColumns(pr *reader.ParquetReader, projection []string) ([]parquetColumn, error) {
+	handler := pr.SchemaHandler
+
+	var columns []parquetColumn
+	for _, inPath := range handler.ValueColumns {
+		exPath := common.StrToPath(handler.InPathToExPath[inPath])
+		if len(exPath) != 2 {
+			ds.log.Debug().Str("column", strings.Join(exPath, ".")).Msg("Skipping nested parquet column")
+			continue
+		}
+
+		name := exPath[1]
+		if projection != nil && !containsFold(projection, name) {
+			continue
+		}
+
+		columns = append(columns, parquetColumn{
+			name:    name,
+			path:    inPath,
+			element: handler.SchemaElements[handler.MapIndex[inPath]],
+		})
+	}
+
+	if len(columns) == 0 {
+		return nil, fmt.Errorf("none of the columns %v found", projection)
+	}
+	return columns, nil
+}
+
+// parquetValue converts a value as read from a column into the string a query would return
+func parquetValue(value interface{}, element *parquet.SchemaElement) string {
+	switch v := value.(type) {
+	case string:
+		if element.GetType() == parquet.Type_INT96 {
+			return parquettypes.INT96ToTime(v).UTC().Format(time.RFC3339)
+		}
+		return v
+	case int32:
+		if element.IsSetConvertedType() && element.GetConvertedType() == parquet.ConvertedType_DATE ||
+			element.IsSetLogicalType() && element.GetLogicalType().IsSetDATE() {
+			return time.Unix(int64(v)*24*60*60, 0).UTC().Format(simDateLayout)
+		}
+	case int64:
+		if element.IsSetConvertedType() {
+			switch element.GetConvertedType() {
+			case parquet.ConvertedType_TIMESTAMP_MILLIS:
+				return time.UnixMilli(v).UTC().Format(time.RFC3339)
+			case parquet.ConvertedType_TIMESTAMP_MICROS:
+				return time.UnixMicro(v).UTC().Format(time.RFC3339)
+			}
+		}
+		if element.IsSetLogicalType() && element.GetLogicalType().IsSetTIMESTAMP() {
+			unit := element.GetLogicalType().GetTIMESTAMP().GetUnit()
+			switch {
+			case unit.IsSetMILLIS():
+				return time.UnixMilli(v).UTC().Format(time.RFC3339)
+			case unit.IsSetMICROS():
+				return time.UnixMicro(v).UTC().Format(time.RFC3339)
+			case unit.IsSetNANOS():
+				return time.Unix(0, v).UTC().Format(time.RFC3339)
+			}
+		}
+	}
+	return fmt.Sprint(value)
+}
+
+// containsFold reports whether value is in values, ignoring case
+func containsFold(values []string, value string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,771 @@
+package datasource
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/SanteonNL/fenix/cmd/fenix/types"
+)
+
+// queryPlaceholderPattern matches search parameter placeholders in query files, e.g.
+// "-- WHERE identificatienummer ?patient" or "-- AND code_codesystem ?code:system".
+// Placeholders without a matching search parameter remain comments.
+var queryPlaceholderPattern = regexp.MustCompile(`(?mi)^([ \t]*)--[ \t]*(WHERE|AND)[ \t]+([A-Za-z_][A-Za-z0-9_."]*)[ \t]+\?([A-Za-z0-9_\-]+)(:system)?[ \t]*$`)
+
+// errNotPushable indicates a filter that cannot be expressed as a SQL condition
+var errNotPushable = errors.New("filter cannot be pushed down to SQL")
+
+// queryArgs collects the values bound to the $n parameters of a query
+type queryArgs struct {
+	values []interface{}
+}
+
+// bind adds a value and returns its positional parameter
+func (qa *queryArgs) bind(value interface{}) string {
+	qa.values = append(qa.values, value)
+	return fmt.Sprintf("$%d", len(qa.values))
+}
+
+// buildQuery translates the id parameter and search placeholders of a query into
+// parameterized conditions. Search parameters without a placeholder are applied by wrapping
+// the query in a filtering subquery when the query emits a column alias for their path.
+// Values are never written into the query text. The filters that could not be pushed down
+// are returned and have to be applied on the processed resources.
+func (svc *DataSourceService) buildQuery(resourceType string, query string, id string, filters []*types.Filter) (string, []interface{}, []*types.Filter, error) {
+	args := &queryArgs{}
+	query, remaining, err := svc.buildConditions(resourceType, query, id, filters, args)
+	if err != nil {
+		return "", nil, nil, err
+	}
+	return query, args.values, remaining, nil
+}
+
+// withIDFilter adds an _id filter for the id of a read to the filters, unless they have it
+// already. The filter is shared by all queries so it is returned as remaining when one of them
+// cannot compare the id.
+func withIDFilter(filters []*types.Filter, id string) []*types.Filter {
+	if id == "" || findIDFilter(filters, id) != nil {
+		return filters
+	}
+	idFilter := &types.Filter{Code: "_id", Type: "token", Value: id, IsValid: true}
+	return append(filters[:len(filters):len(filters)], idFilter)
+}
+
+// findIDFilter returns the _id filter of an id
+func findIDFilter(filters []*types.Filter, id string) *types.Filter {
+	for _, filter := range filters {
+		if filter != nil && filter.IsValid && filter.Code == "_id" && filter.Chain == nil && filter.Value == id {
+			return filter
+		}
+	}
+	return nil
+}
+
+// buildConditions builds the conditions of a query with the values bound to args, so the query
+// can be part of another query, e.g. the inner search of a chained parameter
+func (svc *DataSourceService) buildConditions(resourceType string, query string, id string, filters []*types.Filter, args *queryArgs) (string, []*types.Filter, error) {
+	pushed := make(map[*types.Filter]bool)
+	systemPushed := make(map[*types.Filter]bool)
+
+	// The id of a read is an _id filter, it remains when the query cannot compare it
+	filters = withIDFilter(filters, id)
+
+	// Legacy ":Patient.id" style parameter
+	idParam := fmt.Sprintf(":%s.id", resourceType)
+	if strings.Contains(query, idParam) {
+		query = strings.ReplaceAll(query, idParam, args.bind(id))
+		if idFilter := findIDFilter(filters, id); idFilter != nil {
+			pushed[idFilter] = true
+		}
+	}
+
+	// A placeholder compares the rows of an element one by one. A repeated search parameter has a
+	// filter per occurrence whose values can be on different rows, so only the first occurrence is
+	// compared in the placeholder and the others are applied by wrapping the query. A negating
+	// filter would match the other rows of the element and is applied on the processed resources.
+	// A chained parameter can be joined on the placeholder of its reference.
+	filtersByCode := make(map[string]*types.Filter)
+	chainsByCode := make(map[string][]*types.Filter)
+	for _, filter := range filters {
+		switch {
+		case filter == nil || !filter.IsValid:
+		case filter.Chain != nil:
+			if !filter.Chain.Reverse {
+				chainsByCode[filter.Code] = append(chainsByCode[filter.Code], filter)
+			}
+		case hasNegatingValue(filter) || filtersByCode[filter.Code] != nil:
+		default:
+			filtersByCode[filter.Code] = filter
+		}
+	}
+
+	var buildErr error
+	whereWritten := false
+
+	query = queryPlaceholderPattern.ReplaceAllStringFunc(query, func(placeholder string) string {
+		match := queryPlaceholderPattern.FindStringSubmatch(placeholder)
+		indent, keyword, column, code, systemPart := match[1], strings.ToUpper(match[2]), match[3], match[4], match[5] != ""
+
+		// "?id" is shorthand for the _id search parameter
+		if code == "id" {
+			code = "_id"
+		}
+
+		filter, chainFilters := filtersByCode[code], chainsByCode[code]
+		if filter == nil && len(chainFilters) == 0 || buildErr != nil {
+			return placeholder
+		}
+
+		var conditions []string
+		if filter != nil {
+			condition, err := buildValuesCondition(filter, func(alternative *types.Filter) (string, error) {
+				return buildCondition(column, alternative, systemPart, args)
+			})
+			switch {
+			case errors.Is(err, errNotPushable):
+				svc.log.Debug().
+					Str("code", filter.Code).
+					Str("modifier", filter.Modifier).
+					Msg("Search parameter not pushed down to SQL")
+			case err != nil:
+				buildErr = fmt.Errorf("invalid value for search parameter %s: %w", filter.Code, err)
+				return placeholder
+			default:
+				conditions = append(conditions, condition)
+				pushed[filter] = true
+				if systemPart {
+					systemPushed[filter] = true
+				}
+			}
+		}
+		for _, filter := range chainFilters {
+			if systemPart {
+				continue
+			}
+			condition, err := svc.buildChainColumnCondition(column, filter, args)
+			if errors.Is(err, errNotPushable) {
+				continue
+			}
+			if err != nil {
+				buildErr = err
+				return placeholder
+			}
+			conditions = append(conditions, condition)
+			pushed[filter] = true
+		}
+		if len(conditions) == 0 {
+			return placeholder
+		}
+
+		// Only the first placeholder may open the WHERE clause
+		if keyword == "WHERE" && whereWritten {
+			keyword = "AND"
+		}
+		if keyword == "WHERE" {
+			whereWritten = true
+		}
+
+		svc.log.Debug().
+			Str("code", code).
+			Str("column", column).
+			Msg("Pushed search parameter down to SQL")
+
+		return fmt.Sprintf("%s%s %s", indent, keyword, strings.Join(conditions, " AND "))
+	})
+
+	if buildErr != nil {
+		return "", nil, buildErr
+	}
+
+	var unhandled []*types.Filter
+	for _, filter := range filters {
+		if filter == nil || !filter.IsValid {
+			continue
+		}
+		if pushed[filter] && placeholderHandles(filter, systemPushed[filter]) {
+			continue
+		}
+		unhandled = append(unhandled, filter)
+	}
+
+	return svc.wrapQuery(resourceType, query, unhandled, args)
+}
+
+// placeholderHandles reports whether the placeholders a filter was pushed down to handle it
+// completely. A token with a system is only handled when the system was compared as well, with
+// several values the code and system placeholders are compared separately. A placeholder holds
+// the id of a reference, so a reference with a type is not handled. Those placeholders only
+// narrow the rows down and the filter is applied on the processed resources as well.
+func placeholderHandles(filter *types.Filter, systemPushed bool) bool {
+	if tokenHasSystem(filter) && (!systemPushed || len(filter.Alternatives()) > 1) {
+		return false
+	}
+	return !referenceHasType(filter)
+}
+
+// queryPlaceholder is a search parameter placeholder of a query file
+type queryPlaceholder struct {
+	column     string
+	code       string
+	systemPart bool
+}
+
+// queryPlaceholders returns the search parameter placeholders of a query
+func queryPlaceholders(query string) []queryPlaceholder {
+	var placeholders []queryPlaceholder
+	for _, match := range queryPlaceholderPattern.FindAllStringSubmatch(query, -1) {
+		code := match[4]
+		// "?id" is shorthand for the _id search parameter
+		if code == "id" {
+			code = "_id"
+		}
+		placeholders = append(placeholders, queryPlaceholder{column: match[3], code: code, systemPart: match[5] != ""})
+	}
+	return placeholders
+}
+
+// pushable reports whether buildQuery handles a filter completely for a query, without building
+// the query itself. The conditions are built against scratch args to find out whether the values
+// can be expressed in SQL.
+func (svc *DataSourceService) pushable(resourceType string, query string, filter *types.Filter) bool {
+	if filter == nil || !filter.IsValid {
+		return false
+	}
+	if filter.Chain != nil {
+		return svc.chainPushable(resourceType, query, filter)
+	}
+
+	args := &queryArgs{}
+	pushed, systemPushed := false, false
+	for _, placeholder := range queryPlaceholders(query) {
+		if placeholder.code != filter.Code || hasNegatingValue(filter) {
+			continue
+		}
+		_, err := buildValuesCondition(filter, func(alternative *types.Filter) (string, error) {
+			return buildCondition(placeholder.column, alternative, placeholder.systemPart, args)
+		})
+		if err != nil {
+			continue
+		}
+		pushed = true
+		systemPushed = systemPushed || placeholder.systemPart
+	}
+	if pushed && placeholderHandles(filter, systemPushed) {
+		return true
+	}
+
+	if hasNegatingValue(filter) {
+		return false
+	}
+	aliases := queryColumnAliases(query)
+	_, err := buildValuesCondition(filter, func(alternative *types.Filter) (string, error) {
+		return svc.buildAliasCondition(resourceType, alternative, aliases, args)
+	})
+	return err == nil
+}
+
+// wrapQuery wraps the query in a subquery for the filters whose search parameter path matches a
+// column alias of the query. A resource has several rows and the alias is only set on the row of
+// its element, so every filter selects the resource ids of the matching rows and all rows of
+// those resources are returned:
+//
+//	SELECT * FROM (<query>) r WHERE r.resource_id IN (SELECT q.resource_id FROM (<query>) q WHERE ...)
+//
+// Negating filters would match the rows without the element and are not pushed down.
+func (svc *DataSourceService) wrapQuery(resourceType string, query string, filters []*types.Filter, args *queryArgs) (string, []*types.Filter, error) {
+	if len(filters) == 0 {
+		return query, nil, nil
+	}
+
+	aliases := queryColumnAliases(query)
+	inner := trimStatement(query)
+
+	var conditions []string
+	var remaining []*types.Filter
+	for _, filter := range filters {
+		var condition string
+		var err error
+		if hasNegatingValue(filter) {
+			err = errNotPushable
+		} else if filter.Chain != nil {
+			condition, err = svc.buildChainAliasCondition(resourceType, filter, aliases, args)
+		} else {
+			condition, err = buildValuesCondition(filter, func(alternative *types.Filter) (string, error) {
+				return svc.buildAliasCondition(resourceType, alternative, aliases, args)
+			})
+		}
+		if errors.Is(err, errNotPushable) {
+			remaining = append(remaining, filter)
+			continue
+		}
+		if err != nil {
+			return "", nil, fmt.Errorf("invalid value for search parameter %s: %w", filter.Code, err)
+		}
+
+		svc.log.Debug().
+			Str("code", filter.Code).
+			Msg("Pushed search parameter down to SQL by wrapping the query")
+		conditions = append(conditions, fmt.Sprintf("r.resource_id IN (\nSELECT q.resource_id FROM (\n%s\n) q WHERE %s\n)", inner, condition))
+	}
+
+	if len(conditions) == 0 {
+		return query, remaining, nil
+	}
+
+	wrapped := fmt.Sprintf("SELECT * FROM (\n%s\n) r WHERE %s", inner, strings.Join(conditions, "\nAND "))
+	return wrapped, remaining, nil
+}
+
+// buildAliasCondition creates the condition on the column aliases that belong to the
+// paths of a search parameter, e.g. gender, birthdate or identifier[0].value
+func (svc *DataSourceService) buildAliasCondition(resourceType string, filter *types.Filter, aliases []string, args *queryArgs) (string, error) {
+	if svc.searchParamService == nil {
+		return "", errNotPushable
+	}
+
+	var elements []string
+	if filter.Code == "_id" {
+		elements = []string{"id"}
+	} else {
+		for _, path := range svc.searchParamService.GetPathsForSearchParameter(resourceType, filter.Code) {
+			elements = append(elements, strings.TrimPrefix(path, resourceType+"."))
+		}
+	}
+
+	var conditions []string
+	for _, element := range elements {
+		for _, alias := range aliases {
+			condition, err := buildAliasElementCondition(element, alias, aliases, filter, args)
+			if errors.Is(err, errNotPushable) {
+				continue
+			}
+			if err != nil {
+				return "", err
+			}
+			conditions = append(conditions, condition)
+		}
+	}
+
+	if len(conditions) == 0 {
+		return "", errNotPushable
+	}
+	if len(conditions) == 1 {
+		return conditions[0], nil
+	}
+
+	// Filters that match a missing element must hold for every alias, the others for at least one
+	combinator := " OR "
+	if filter.MatchesMissing() {
+		combinator = " AND "
+	}
+	return "(" + strings.Join(conditions, combinator) + ")", nil
+}
+
+// buildAliasElementCondition creates the condition for a single alias if it holds the
+// value that the search type of the filter compares
+func buildAliasElementCondition(element string, alias string, aliases []string, filter *types.Filter, args *queryArgs) (string, error) {
+	normalized := strings.ToLower(removeIndexes(alias))
+	element = strings.ToLower(element)
+	if normalized != element && !strings.HasPrefix(normalized, element+".") {
+		return "", errNotPushable
+	}
+
+	leaf := normalized[strings.LastIndex(normalized, ".")+1:]
+	isElement := normalized == element
+	column := quoteAlias(alias)
+
+	switch strings.ToLower(filter.Type) {
+	case "token":
+		if !isElement && leaf != "code" && leaf != "value" {
+			return "", errNotPushable
+		}
+		if !tokenHasSystem(filter) {
+			return buildCondition(column, filter, false, args)
+		}
+
+		// The system has to be compared against the sibling system alias
+		systemAlias := ""
+		siblingPrefix := alias[:len(alias)-len(leaf)]
+		for _, candidate := range aliases {
+			if !isElement && strings.EqualFold(candidate, siblingPrefix+"system") {
+				systemAlias = candidate
+				break
+			}
+		}
+		if systemAlias == "" {
+			return "", errNotPushable
+		}
+		condition, err := buildTokenCondition(column, filter, false, args)
+		if err != nil {
+			return "", err
+		}
+		systemCondition, err := buildTokenCondition(quoteAlias(systemAlias), filter, true, args)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("(%s AND %s)", condition, systemCondition), nil
+
+	case "string":
+		if !isElement && stringExcluded(normalized[len(element)+1:]) {
+			return "", errNotPushable
+		}
+		return buildCondition(column, filter, false, args)
+
+	case "date":
+		if !isElement && leaf != "start" && leaf != "end" {
+			return "", errNotPushable
+		}
+		return buildCondition(column, filter, false, args)
+
+	case "number", "quantity":
+		if !isElement && leaf != "value" {
+			return "", errNotPushable
+		}
+		return buildCondition(column, filter, false, args)
+
+	case "reference":
+		if !isElement && leaf != "reference" {
+			return "", errNotPushable
+		}
+		return buildReferenceAliasCondition(column, filter, args)
+
+	case "uri":
+		if !isElement {
+			return "", errNotPushable
+		}
+		return buildCondition(column, filter, false, args)
+
+	default:
+		return "", errNotPushable
+	}
+}
+
+// buildReferenceAliasCondition matches a reference alias (e.g. Patient/123) on the full
+// reference, or on its end so an id matches every type and Patient/123 an absolute url
+func buildReferenceAliasCondition(column string, filter *types.Filter, args *queryArgs) (string, error) {
+	if filter.Modifier != "" {
+		return "", errNotPushable
+	}
+	return fmt.Sprintf("(%s = %s OR %s LIKE %s)", column, args.bind(filter.Value), column, args.bind("%/"+escapeLike(filter.Value))), nil
+}
+
+// stringExcluded reports whether a path below the element of a string parameter is within an
+// element that is not searched, e.g. name.period.start
+func stringExcluded(path string) bool {
+	for _, name := range strings.Split(path, ".") {
+		if types.StringExcludedElements[name] {
+			return true
+		}
+	}
+	return false
+}
+
+// columnAliasPattern matches the column aliases of a SELECT list, quoted or not
+var columnAliasPattern = regexp.MustCompile(`(?i)\bAS\s+(?:"([^"]+)"|([A-Za-z_][A-Za-z0-9_]*))`)
+
+// queryColumnAliases returns the column aliases of a query, ignoring line comments
+func queryColumnAliases(query string) []string {
+	seen := make(map[string]bool)
+	var aliases []string
+
+	for _, line := range strings.Split(stripLineComments(query), "\n") {
+		for _, match := range columnAliasPattern.FindAllStringSubmatch(line, -1) {
+			alias := match[1]
+			if alias == "" {
+				// Postgres folds unquoted identifiers to lower case
+				alias = strings.ToLower(match[2])
+			}
+			if !seen[alias] {
+				seen[alias] = true
+				aliases = append(aliases, alias)
+			}
+		}
+	}
+
+	return aliases
+}
+
+// trimStatement removes trailing comments and the terminating semicolon so the query can be
+// used as a subquery
+func trimStatement(query string) string {
+	lines := strings.Split(query, "\n")
+	for len(lines) > 0 {
+		last := strings.TrimSpace(lines[len(lines)-1])
+		if last == "" || strings.HasPrefix(last, "--") {
+			lines = lines[:len(lines)-1]
+			continue
+		}
+		lines[len(lines)-1] = strings.TrimSuffix(last, ";")
+		break
+	}
+	return strings.Join(lines, "\n")
+}
+
+// orderQuery orders the rows of a query by resource, so the rows of a resource are adjacent.
+// Within a resource the resource row comes before the rows of its elements.
+func orderQuery(query string) string {
+	return fmt.Sprintf("SELECT * FROM (\n%s\n) ordered ORDER BY resource_id, fhir_path, id", trimStatement(query))
+}
+
+// quoteAlias quotes a column alias of the wrapped query
+func quoteAlias(alias string) string {
+	return `q."` + strings.ReplaceAll(alias, `"`, `""`) + `"`
+}
+
+// removeIndexes removes all array indexes from an alias, e.g. name[0].given[1] -> name.given
+func removeIndexes(alias string) string {
+	var builder strings.Builder
+	depth := 0
+	for _, r := range alias {
+		switch {
+		case r == '[':
+			depth++
+		case r == ']':
+			depth--
+		case depth == 0:
+			builder.WriteRune(r)
+		}
+	}
+	return builder.String()
+}
+
+// tokenHasSystem reports whether a value of a token filter restricts the system, e.g. system|code,
+// |code or system|
+func tokenHasSystem(filter *types.Filter) bool {
+	if !strings.EqualFold(filter.Type, "token") {
+		return false
+	}
+	for _, alternative := range filter.Alternatives() {
+		if strings.Contains(alternative.Value, "|") {
+			return true
+		}
+	}
+	return false
+}
+
+// referenceHasType reports whether a value of a reference filter has the type of the referenced
+// resource, e.g. Patient/123 or an absolute url
+func referenceHasType(filter *types.Filter) bool {
+	if !strings.EqualFold(filter.Type, "reference") {
+		return false
+	}
+	for _, alternative := range filter.Alternatives() {
+		if strings.Contains(alternative.Value, "/") {
+			return true
+		}
+	}
+	return false
+}
+
+// buildValuesCondition combines the conditions for the values of a filter: a row matches one of
+// the values or, for a negating filter, none of them
+func buildValuesCondition(filter *types.Filter, build func(*types.Filter) (string, error)) (string, error) {
+	alternatives := filter.Alternatives()
+	conditions := make([]string, 0, len(alternatives))
+	for _, alternative := range alternatives {
+		condition, err := build(alternative)
+		if err != nil {
+			return "", err
+		}
+		conditions = append(conditions, condition)
+	}
+	if len(conditions) == 1 {
+		return conditions[0], nil
+	}
+
+	combinator := " OR "
+	if filter.IsNegating() {
+		combinator = " AND "
+	}
+	return "(" + strings.Join(conditions, combinator) + ")", nil
+}
+
+// hasNegatingValue reports whether one of the values of a filter matches a missing element, so
+// the filter would match the rows without the element
+func hasNegatingValue(filter *types.Filter) bool {
+	for _, alternative := range filter.Alternatives() {
+		if alternative.MatchesMissing() {
+			return true
+		}
+	}
+	return false
+}
+
+// buildCondition creates the SQL condition for a filter on a column
+func buildCondition(column string, filter *types.Filter, systemPart bool, args *queryArgs) (string, error) {
+	if strings.EqualFold(filter.Modifier, "missing") {
+		switch strings.ToLower(filter.Value) {
+		case "true":
+			return fmt.Sprintf("%s IS NULL", column), nil
+		case "false":
+			return fmt.Sprintf("%s IS NOT NULL", column), nil
+		default:
+			return "", fmt.Errorf("missing expects true or false, got %q", filter.Value)
+		}
+	}
+
+	switch strings.ToLower(filter.Type) {
+	case "string":
+		return buildStringCondition(column, filter, args)
+	case "token":
+		return buildTokenCondition(column, filter, systemPart, args)
+	case "date":
+		return buildDateCondition(column, filter, args)
+	case "number":
+		return buildNumberCondition(column, filter, filter.Value, args)
+	case "quantity":
+		// Only the number part of value|system|code is compared against the column
+		return buildNumberCondition(column, filter, strings.Split(filter.Value, "|")[0], args)
+	case "reference":
+		return buildReferenceCondition(column, filter, args)
+	case "uri":
+		return buildURICondition(column, filter, args)
+	default:
+		return "", errNotPushable
+	}
+}
+
+// buildStringCondition uses FHIR string semantics: case-insensitive starts-with by default
+func buildStringCondition(column string, filter *types.Filter, args *queryArgs) (string, error) {
+	switch strings.ToLower(filter.Modifier) {
+	case "":
+		return fmt.Sprintf("%s ILIKE %s", column, args.bind(escapeLike(filter.Value)+"%")), nil
+	case "contains":
+		return fmt.Sprintf("%s ILIKE %s", column, args.bind("%"+escapeLike(filter.Value)+"%")), nil
+	case "exact":
+		return fmt.Sprintf("%s = %s", column, args.bind(filter.Value)), nil
+	default:
+		return "", errNotPushable
+	}
+}
+
+// buildTokenCondition handles [code], system|code, |code and system| values.
+// A placeholder marked :system compares the system part, otherwise the code part.
+func buildTokenCondition(column string, filter *types.Filter, systemPart bool, args *queryArgs) (string, error) {
+	system, code, hasSystem := strings.Cut(filter.Value, "|")
+	if !hasSystem {
+		code, system = system, ""
+	}
+
+	value := code
+	if systemPart {
+		if !hasSystem {
+			// No system given, any system matches
+			return "TRUE", nil
+		}
+		if system == "" {
+			return fmt.Sprintf("%s IS NULL", column), nil
+		}
+		value = system
+	} else if value == "" {
+		// system| matches any code within the system
+		return "TRUE", nil
+	}
+
+	switch strings.ToLower(filter.Modifier) {
+	case "":
+		return fmt.Sprintf("%s = %s", column, args.bind(value)), nil
+	case "not":
+		return fmt.Sprintf("(%s IS NULL OR %s <> %s)", column, column, args.bind(value)), nil
+	case "text":
+		return fmt.Sprintf("%s ILIKE %s", column, args.bind("%"+escapeLike(value)+"%")), nil
+	default:
+		return "", errNotPushable
+	}
+}
+
+// buildDateCondition compares the column against the range implied by the precision of the value
+func buildDateCondition(column string, filter *types.Filter, args *queryArgs) (string, error) {
+	prefix, value := filter.Prefix()
+
+	start, end, layout, err := types.DateRange(value)
+	if err != nil {
+		return "", err
+	}
+	lower := start.Format(layout)
+	upper := end.Format(layout)
+
+	switch prefix {
+	case "eq":
+		return fmt.Sprintf("(%s >= %s AND %s < %s)", column, args.bind(lower), column, args.bind(upper)), nil
+	case "ne":
+		return fmt.Sprintf("(%s < %s OR %s >= %s)", column, args.bind(lower), column, args.bind(upper)), nil
+	case "gt", "sa":
+		return fmt.Sprintf("%s >= %s", column, args.bind(upper)), nil
+	case "ge":
+		return fmt.Sprintf("%s >= %s", column, args.bind(lower)), nil
+	case "lt", "eb":
+		return fmt.Sprintf("%s < %s", column, args.bind(lower)), nil
+	case "le":
+		return fmt.Sprintf("%s < %s", column, args.bind(upper)), nil
+	default:
+		return "", errNotPushable
+	}
+}
+
+// buildNumberCondition compares a numeric column using the FHIR prefix
+func buildNumberCondition(column string, filter *types.Filter, rawValue string, args *queryArgs) (string, error) {
+	prefix, value := types.SplitPrefix(filter.Modifier, rawValue)
+
+	// The precision of the value decides the range eq matches
+	number, low, high, err := types.NumberRange(value)
+	if err != nil {
+		return "", err
+	}
+
+	switch prefix {
+	case "eq":
+		return fmt.Sprintf("(%s >= %s AND %s < %s)", column, args.bind(low), column, args.bind(high)), nil
+	case "ne":
+		return fmt.Sprintf("(%s < %s OR %s >= %s)", column, args.bind(low), column, args.bind(high)), nil
+	case "gt", "sa":
+		return fmt.Sprintf("%s > %s", column, args.bind(number)), nil
+	case "ge":
+		return fmt.Sprintf("%s >= %s", column, args.bind(number)), nil
+	case "lt", "eb":
+		return fmt.Sprintf("%s < %s", column, args.bind(number)), nil
+	case "le":
+		return fmt.Sprintf("%s <= %s", column, args.bind(number)), nil
+	case "ap":
+		// Approximately is interpreted as within 10% of the value
+		margin := number * 0.1
+		if margin < 0 {
+			margin = -margin
+		}
+		return fmt.Sprintf("%s BETWEEN %s AND %s", column, args.bind(number-margin), args.bind(number+margin)), nil
+	default:
+		return "", errNotPushable
+	}
+}
+
+// buildReferenceCondition compares the id part of a reference, e.g. Patient/123 -> 123
+func buildReferenceCondition(column string, filter *types.Filter, args *queryArgs) (string, error) {
+	if filter.Modifier != "" {
+		return "", errNotPushable
+	}
+
+	value := filter.Value
+	if index := strings.LastIndex(value, "/"); index != -1 {
+		value = value[index+1:]
+	}
+	return fmt.Sprintf("%s = %s", column, args.bind(value)), nil
+}
+
+// buildURICondition compares a uri exactly, or as prefix with :below
+func buildURICondition(column string, filter *types.Filter, args *queryArgs) (string, error) {
+	switch strings.ToLower(filter.Modifier) {
+	case "":
+		return fmt.Sprintf("%s = %s", column, args.bind(filter.Value)), nil
+	case "below":
+		return fmt.Sprintf("%s LIKE %s", column, args.bind(escapeLike(filter.Value)+"%")), nil
+	default:
+		return "", errNotPushable
+	}
+}
+
+// escapeLike escapes the LIKE wildcards in a value
+func escapeLike(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(value)
+}
@@ -0,0 +1,405 @@
+package datasource
+
+import (
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/SanteonNL/fenix/cmd/fenix/fhir/searchparameter"
+	"github.com/SanteonNL/fenix/cmd/fenix/types"
+	"github.com/rs/zerolog"
+)
+
+// patientQuery has a resource row and a child row per name, the name aliases are only set on the
+// child rows
+const patientQuery = `-- resourceType: Patient
+SELECT
+    p.id AS resource_id,
+    p.id AS id,
+    NULL AS parent_id,
+    'Patient' AS fhir_path,
+    p.gender AS "gender",
+    NULL AS "name[0].family"
+FROM patient p
+UNION ALL
+SELECT
+    n.patient_id AS resource_id,
+    n.id AS id,
+    n.patient_id AS parent_id,
+    'Patient.name' AS fhir_path,
+    NULL AS "gender",
+    n.family AS "name[0].family"
+FROM patient_name n;`
+
+// newTestService creates a DataSourceService with the search parameters of the repository
+func newTestService(t *testing.T) *DataSourceService {
+	t.Helper()
+	log := zerolog.Nop()
+
+	repo := searchparameter.NewSearchParameterRepository(log)
+	if err := repo.LoadSearchParametersFromFile("../../../searchParameter/search-parameter.json"); err != nil {
+		t.Fatalf("failed to load search parameters: %v", err)
+	}
+	searchParamService := searchparameter.NewSearchParameterService(repo, log)
+	if err := searchParamService.BuildSearchParameterIndex(); err != nil {
+		t.Fatalf("failed to index search parameters: %v", err)
+	}
+	return NewDataSourceService("test", nil, searchParamService, log)
+}
+
+// newFilter creates a valid filter with a search parameter value
+func newFilter(code string, searchType string, modifier string, value string) *types.Filter {
+	filter := &types.Filter{Code: code, Type: searchType, Modifier: modifier, IsValid: true}
+	filter.SetValue(value)
+	return filter
+}
+
+func TestWrapQueryFiltersWholeResources(t *testing.T) {
+	svc := newTestService(t)
+	filters := []*types.Filter{
+		newFilter("gender", "token", "", "male"),
+		newFilter("family", "string", "", "Smith"),
+	}
+
+	query, args, remaining, err := svc.buildQuery("Patient", patientQuery, "", filters)
+	if err != nil {
+		t.Fatalf("buildQuery: %v", err)
+	}
+	if len(remaining) != 0 {
+		t.Errorf("expected all filters to be pushed down, %d remaining", len(remaining))
+	}
+
+	// Each filter selects resource ids, so the child rows are returned and the conditions on
+	// different rows are not combined within a single row
+	if !strings.HasPrefix(query, "SELECT * FROM (") || !strings.Contains(query, ") r WHERE r.resource_id IN (") {
+		t.Errorf("expected the query to be filtered on resource_id, got:\n%s", query)
+	}
+	if got := strings.Count(query, "SELECT q.resource_id FROM ("); got != 2 {
+		t.Errorf("expected a resource_id subquery per filter, got %d in:\n%s", got, query)
+	}
+	for _, condition := range []string{`q."gender" = $1`, `q."name[0].family" ILIKE $2`} {
+		if !strings.Contains(query, condition) {
+			t.Errorf("expected condition %s in:\n%s", condition, query)
+		}
+	}
+	if strings.Contains(query, `q."gender" = $1 AND`) {
+		t.Errorf("conditions on different rows must not be combined in one WHERE clause:\n%s", query)
+	}
+
+	want := []interface{}{"male", "Smith%"}
+	if len(args) != len(want) {
+		t.Fatalf("expected args %v, got %v", want, args)
+	}
+	for i := range want {
+		if args[i] != want[i] {
+			t.Errorf("arg %d: expected %v, got %v", i+1, want[i], args[i])
+		}
+	}
+}
+
+func TestWrapQueryKeepsNegatingFilters(t *testing.T) {
+	svc := newTestService(t)
+	filters := []*types.Filter{
+		newFilter("family", "string", "missing", "true"),
+		newFilter("gender", "token", "not", "male"),
+	}
+
+	query, args, remaining, err := svc.buildQuery("Patient", patientQuery, "", filters)
+	if err != nil {
+		t.Fatalf("buildQuery: %v", err)
+	}
+	if query != patientQuery || len(args) != 0 {
+		t.Errorf("expected the query to be unchanged, got:\n%s", query)
+	}
+	if len(remaining) != 2 {
+		t.Errorf("expected the negating filters to remain, got %d", len(remaining))
+	}
+}
+
+func TestWrapQueryKeepsTokensWithoutSystemAlias(t *testing.T) {
+	svc := newTestService(t)
+	filters := []*types.Filter{newFilter("gender", "token", "", "http://example.org/other|")}
+
+	query, _, remaining, err := svc.buildQuery("Patient", patientQuery, "", filters)
+	if err != nil {
+		t.Fatalf("buildQuery: %v", err)
+	}
+	if query != patientQuery {
+		t.Errorf("expected the query to be unchanged, got:\n%s", query)
+	}
+	if len(remaining) != 1 {
+		t.Errorf("expected the filter to remain, got %d", len(remaining))
+	}
+}
+
+// placeholderQuery has a search placeholder per search parameter of the tests
+const placeholderQuery = `-- resourceType: Patient
+SELECT
+    p.id AS resource_id,
+    p.id AS id,
+    NULL AS parent_id,
+    'Patient' AS fhir_path,
+    p.gender AS "gender",
+    p.birthdate AS "birthDate"
+FROM patient p
+WHERE p.deleted IS NULL
+-- AND p.birthdate ?birthdate
+-- AND p.identifier_value ?identifier
+-- AND p.identifier_system ?identifier:system
+-- AND p.gender ?gender
+-- AND p.family ?family
+-- AND p.organization_id ?organization`
+
+func TestBuildQueryPlaceholders(t *testing.T) {
+	tests := []struct {
+		name       string
+		filters    []*types.Filter
+		conditions []string
+		args       []interface{}
+		remaining  int // filters that are applied on the processed resources as well
+	}{
+		{
+			name:       "date with prefix",
+			filters:    []*types.Filter{newFilter("birthdate", "date", "", "ge2020")},
+			conditions: []string{"AND p.birthdate >= $1"},
+			args:       []interface{}{"2020-01-01"},
+		},
+		{
+			name:       "date precision",
+			filters:    []*types.Filter{newFilter("birthdate", "date", "", "2020-01")},
+			conditions: []string{"AND (p.birthdate >= $1 AND p.birthdate < $2)"},
+			args:       []interface{}{"2020-01-01", "2020-02-01"},
+		},
+		{
+			name:       "date prefix as modifier",
+			filters:    []*types.Filter{newFilter("birthdate", "date", "gt", "2020-01-15")},
+			conditions: []string{"AND p.birthdate >= $1"},
+			args:       []interface{}{"2020-01-16"},
+		},
+		{
+			name:       "token with system",
+			filters:    []*types.Filter{newFilter("identifier", "token", "", "http://example.org/mrn|123")},
+			conditions: []string{"AND p.identifier_value = $1", "AND p.identifier_system = $2"},
+			args:       []interface{}{"123", "http://example.org/mrn"},
+		},
+		{
+			name:       "token without system",
+			filters:    []*types.Filter{newFilter("identifier", "token", "", "|123")},
+			conditions: []string{"AND p.identifier_value = $1", "AND p.identifier_system IS NULL"},
+			args:       []interface{}{"123"},
+		},
+		{
+			name:       "token with system only",
+			filters:    []*types.Filter{newFilter("identifier", "token", "", "http://example.org/mrn|")},
+			conditions: []string{"AND TRUE", "AND p.identifier_system = $1"},
+			args:       []interface{}{"http://example.org/mrn"},
+		},
+		{
+			name:       "token with system only without system placeholder",
+			filters:    []*types.Filter{newFilter("gender", "token", "", "http://example.org/other|")},
+			conditions: []string{"AND TRUE"},
+			remaining:  1,
+		},
+		{
+			name:       "negating modifier",
+			filters:    []*types.Filter{newFilter("gender", "token", "not", "male")},
+			conditions: []string{"-- AND p.gender ?gender"},
+			remaining:  1,
+		},
+		{
+			name:       "missing modifier",
+			filters:    []*types.Filter{newFilter("birthdate", "date", "missing", "true")},
+			conditions: []string{"-- AND p.birthdate ?birthdate"},
+			remaining:  1,
+		},
+		{
+			name:       "reference id",
+			filters:    []*types.Filter{newFilter("organization", "reference", "", "1")},
+			conditions: []string{"AND p.organization_id = $1"},
+			args:       []interface{}{"1"},
+		},
+		{
+			name:       "reference with type",
+			filters:    []*types.Filter{newFilter("organization", "reference", "", "Organization/1")},
+			conditions: []string{"AND p.organization_id = $1"},
+			args:       []interface{}{"1"},
+			remaining:  1,
+		},
+		{
+			name:       "comma separated values",
+			filters:    []*types.Filter{newFilter("gender", "token", "", "male,female")},
+			conditions: []string{"AND (p.gender = $1 OR p.gender = $2)"},
+			args:       []interface{}{"male", "female"},
+		},
+		{
+			// Only the first occurrence is compared in the placeholder, the others select the
+			// resources of the rows that match them
+			name: "repeated parameter",
+			filters: []*types.Filter{
+				newFilter("birthdate", "date", "", "ge2020"),
+				newFilter("birthdate", "date", "", "lt2021"),
+			},
+			conditions: []string{"AND p.birthdate >= $1", `) q WHERE q."birthDate" < $2`},
+			args:       []interface{}{"2020-01-01", "2021-01-01"},
+		},
+		{
+			// The values of a repeating element are on different rows, so a row cannot have both
+			name: "repeated parameter of a repeating element",
+			filters: []*types.Filter{
+				newFilter("identifier", "token", "", "a"),
+				newFilter("identifier", "token", "", "b"),
+			},
+			conditions: []string{"AND p.identifier_value = $1"},
+			args:       []interface{}{"a"},
+			remaining:  1,
+		},
+		{
+			name:       "injection attempt",
+			filters:    []*types.Filter{newFilter("family", "string", "exact", "x'; DROP TABLE patient; --")},
+			conditions: []string{"AND p.family = $1"},
+			args:       []interface{}{"x'; DROP TABLE patient; --"},
+		},
+	}
+
+	svc := newTestService(t)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			query, args, remaining, err := svc.buildQuery("Patient", placeholderQuery, "", tt.filters)
+			if err != nil {
+				t.Fatalf("buildQuery: %v", err)
+			}
+			if len(remaining) != tt.remaining {
+				t.Errorf("expected %d filters to remain, got %d", tt.remaining, len(remaining))
+			}
+			for _, condition := range tt.conditions {
+				if !strings.Contains(query, "\n"+condition+"\n") && !strings.HasSuffix(query, "\n"+condition) {
+					t.Errorf("expected condition %s in:\n%s", condition, query)
+				}
+			}
+			if strings.Contains(query, "DROP") {
+				t.Errorf("values must only be bound as args:\n%s", query)
+			}
+			if len(args) != len(tt.args) {
+				t.Fatalf("expected args %v, got %v", tt.args, args)
+			}
+			for i := range tt.args {
+				if args[i] != tt.args[i] {
+					t.Errorf("arg %d: expected %v, got %v", i+1, tt.args[i], args[i])
+				}
+			}
+		})
+	}
+}
+
+func TestBuildQueryRejectsInvalidValues(t *testing.T) {
+	svc := newTestService(t)
+	for _, filter := range []*types.Filter{
+		newFilter("birthdate", "date", "", "ge2020-13-45"),
+		newFilter("birthdate", "date", "", "2020'; DROP TABLE patient; --"),
+	} {
+		if _, _, _, err := svc.buildQuery("Patient", placeholderQuery, "", []*types.Filter{filter}); err == nil {
+			t.Errorf("expected an error for %q", filter.Value)
+		}
+	}
+}
+
+func TestBuildNumberCondition(t *testing.T) {
+	tests := []struct {
+		value     string
+		condition string
+		args      []interface{}
+	}{
+		{"100", "(n >= $1 AND n < $2)", []interface{}{99.5, 100.5}},
+		{"eq2.5", "(n >= $1 AND n < $2)", []interface{}{2.45, 2.55}},
+		{"ne100", "(n < $1 OR n >= $2)", []interface{}{99.5, 100.5}},
+		{"gt100", "n > $1", []interface{}{100.0}},
+		{"le100", "n <= $1", []interface{}{100.0}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			args := &queryArgs{}
+			condition, err := buildCondition("n", newFilter("length", "number", "", tt.value), false, args)
+			if err != nil {
+				t.Fatalf("buildCondition: %v", err)
+			}
+			if condition != tt.condition {
+				t.Errorf("expected %s, got %s", tt.condition, condition)
+			}
+			if len(args.values) != len(tt.args) {
+				t.Fatalf("expected args %v, got %v", tt.args, args.values)
+			}
+			for i := range tt.args {
+				if math.Abs(args.values[i].(float64)-tt.args[i].(float64)) > 1e-9 {
+					t.Errorf("arg %d: expected %v, got %v", i+1, tt.args[i], args.values[i])
+				}
+			}
+		})
+	}
+}
+
+func TestBuildReferenceAliasCondition(t *testing.T) {
+	tests := []struct {
+		value string
+		args  []interface{}
+	}{
+		{"123", []interface{}{"123", "%/123"}},
+		// A type is compared as well, so Encounter/123 does not match Patient/123
+		{"Encounter/123", []interface{}{"Encounter/123", "%/Encounter/123"}},
+	}
+
+	for _, tt := range tests {
+		args := &queryArgs{}
+		condition, err := buildReferenceAliasCondition(`"subject.reference"`, newFilter("subject", "reference", "", tt.value), args)
+		if err != nil {
+			t.Fatalf("buildReferenceAliasCondition: %v", err)
+		}
+		if want := `("subject.reference" = $1 OR "subject.reference" LIKE $2)`; condition != want {
+			t.Errorf("expected %s, got %s", want, condition)
+		}
+		for i := range tt.args {
+			if args.values[i] != tt.args[i] {
+				t.Errorf("%s arg %d: expected %v, got %v", tt.value, i+1, tt.args[i], args.values[i])
+			}
+		}
+	}
+}
+
+func TestBuildQueryReturnsIDFilter(t *testing.T) {
+	svc := NewDataSourceService("test", nil, nil, zerolog.Nop())
+
+	// Without search parameters the id cannot be compared on an alias and is checked in memory
+	query, args, remaining, err := svc.buildQuery("Patient", patientQuery, "p1", nil)
+	if err != nil {
+		t.Fatalf("buildQuery: %v", err)
+	}
+	if query != patientQuery || len(args) != 0 {
+		t.Errorf("expected the query to be unchanged, got:\n%s", query)
+	}
+	if len(remaining) != 1 || remaining[0].Code != "_id" || remaining[0].Value != "p1" {
+		t.Errorf("expected the _id filter to remain, got %v", remaining)
+	}
+
+	// The legacy id parameter compares the id
+	legacy := strings.Replace(patientQuery, "FROM patient p\n", "FROM patient p WHERE p.id = :Patient.id\n", 1)
+	query, args, remaining, err = svc.buildQuery("Patient", legacy, "p1", nil)
+	if err != nil {
+		t.Fatalf("buildQuery: %v", err)
+	}
+	if !strings.Contains(query, "WHERE p.id = $1") || len(args) != 1 || args[0] != "p1" {
+		t.Errorf("expected the id to be bound, got %v in:\n%s", args, query)
+	}
+	if len(remaining) != 0 {
+		t.Errorf("expected no remaining filters, got %d", len(remaining))
+	}
+}
+
+func TestRemainingFiltersKeepsIDFilter(t *testing.T) {
+	filters := withIDFilter(nil, "p1")
+	if got := remainingFilters(filters, [][]*types.Filter{{}, {filters[0]}}); len(got) != 1 || got[0] != filters[0] {
+		t.Errorf("expected the _id filter to remain, got %v", got)
+	}
+	if again := withIDFilter(filters, "p1"); len(again) != 1 {
+		t.Errorf("expected the _id filter to be added once, got %d filters", len(again))
+	}
+}
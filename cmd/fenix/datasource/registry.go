@@ -0,0 +1,473 @@
+package datasource
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/SanteonNL/fenix/cmd/fenix/fhir/searchparameter"
+	"github.com/SanteonNL/fenix/cmd/fenix/types"
+	"github.com/jmoiron/sqlx"
+	"github.com/rs/zerolog"
+)
+
+// DataSource returns the flat rows of the resources of one or more resource types.
+// Filters a datasource does not handle itself are returned with the stream so they can
+// be checked on the processed resources.
+type DataSource interface {
+	Name() string
+	ResourceTypes() []string
+	StreamResources(ctx context.Context, resourceType, id string, filters []*types.Filter) (*ResourceStream, error)
+}
+
+// ConnectionsConfig is the content of config/connections.json
+type ConnectionsConfig struct {
+	Services []ConnectionConfig `json:"services"`
+	SQLFiles []SQLFilesConfig   `json:"sqlFiles"`
+	Strict   bool               `json:"strict"` // refuse to start when a query file maps to nonexistent elements
+}
+
+// ConnectionConfig describes a single datasource
+type ConnectionConfig struct {
+	Name         string `json:"name"`
+	Type         string `json:"type"`   // ndjson, csv or sql
+	Format       string `json:"format"` // fhir for ndjson, flat or sim for csv
+	SourcePath   string `json:"sourcePath"`
+	Delimiter    string `json:"delimiter,omitempty"` // csv only, defaults to a comma
+	DatabaseType string `json:"databaseType,omitempty"`
+	ConnStr      string `json:"connStr,omitempty"`
+}
+
+// SQLFilesConfig describes a location of query files for the sql datasources
+type SQLFilesConfig struct {
+	Type       string `json:"type"` // flatfile or git
+	Repository string `json:"repository,omitempty"`
+	SourcePath string `json:"sourcePath"`
+}
+
+// Registry holds the configured datasources by name. It is a DataSource itself that
+// combines the resources of all datasources serving a resource type.
+type Registry struct {
+	sources map[string]DataSource
+	names   []string               // in order of registration
+	lint    map[string][]LintIssue // issues of the loaded query files by path
+	strict  bool
+	mu      sync.RWMutex
+	log     zerolog.Logger
+}
+
+// NewRegistry creates an empty datasource registry
+func NewRegistry(log zerolog.Logger) *Registry {
+	return &Registry{
+		sources: make(map[string]DataSource),
+		lint:    make(map[string][]LintIssue),
+		log:     log,
+	}
+}
+
+// Register adds a datasource, names have to be unique
+func (r *Registry) Register(source DataSource) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, exists := r.sources[source.Name()]; exists {
+		return fmt.Errorf("datasource %s is already registered", source.Name())
+	}
+	r.sources[source.Name()] = source
+	r.names = append(r.names, source.Name())
+	return nil
+}
+
+// Get returns the datasource with the given name
+func (r *Registry) Get(name string) (DataSource, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	source, exists := r.sources[name]
+	if !exists {
+		return nil, fmt.Errorf("datasource %s not found", name)
+	}
+	return source, nil
+}
+
+// Len returns the number of registered datasources
+func (r *Registry) Len() int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return len(r.sources)
+}
+
+// LoadConnections builds the datasources described in a connections.json file and loads
+// the query files of the sql datasources. A connection that fails is logged and skipped
+// so the other datasources are still served.
+func (r *Registry) LoadConnections(path string, searchParamService *searchparameter.SearchParameterService) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read connections file %s: %w", path, err)
+	}
+
+	var config ConnectionsConfig
+	if err := json.Unmarshal(data, &config); err != nil {
+		return fmt.Errorf("failed to parse connections file %s: %w", path, err)
+	}
+
+	r.mu.Lock()
+	r.strict = config.Strict
+	r.mu.Unlock()
+
+	var loadErrors []error
+	for _, connection := range config.Services {
+		source, err := r.newDataSource(connection, searchParamService)
+		if err == nil {
+			err = r.Register(source)
+		}
+		if err != nil {
+			loadErrors = append(loadErrors, err)
+			r.log.Error().Err(err).
+				Str("name", connection.Name).
+				Str("type", connection.Type).
+				Msg("Failed to create datasource")
+			continue
+		}
+		r.log.Info().
+			Str("name", connection.Name).
+			Str("type", connection.Type).
+			Str("sourcePath", connection.SourcePath).
+			Msg("Registered datasource")
+	}
+
+	for _, sqlFiles := range config.SQLFiles {
+		if sqlFiles.Type != "flatfile" {
+			r.log.Warn().
+				Str("type", sqlFiles.Type).
+				Str("sourcePath", sqlFiles.SourcePath).
+				Msg("Unsupported query file location, skipping")
+			continue
+		}
+		if err := r.LoadQueryDirectory(sqlFiles.SourcePath); err != nil {
+			loadErrors = append(loadErrors, err)
+		}
+	}
+
+	if len(loadErrors) > 0 {
+		return fmt.Errorf("encountered %d errors while loading connections", len(loadErrors))
+	}
+
+	return nil
+}
+
+// newDataSource creates the datasource for a single connection
+func (r *Registry) newDataSource(connection ConnectionConfig, searchParamService *searchparameter.SearchParameterService) (DataSource, error) {
+	if connection.Name == "" {
+		return nil, fmt.Errorf("connection without a name")
+	}
+
+	switch connection.Type {
+	case "sql":
+		db, err := sqlx.Connect(connection.DatabaseType, connection.ConnStr)
+		if err != nil {
+			return nil, fmt.Errorf("failed to connect to %s database: %w", connection.DatabaseType, err)
+		}
+		return NewDataSourceService(connection.Name, db, searchParamService, r.log), nil
+	case "ndjson":
+		if connection.Format != "" && connection.Format != "fhir" {
+			return nil, fmt.Errorf("unsupported ndjson format: %s", connection.Format)
+		}
+		return NewNDJSONDataSource(connection.Name, connection.SourcePath, r.log), nil
+	case "csv":
+		if connection.Format == "sim" {
+			return NewSIMDataSource(connection, r.log)
+		}
+		return NewCSVDataSource(connection, r.log)
+	case "parquet":
+		return NewParquetDataSource(connection, r.log)
+	default:
+		return nil, fmt.Errorf("unsupported datasource type: %s", connection.Type)
+	}
+}
+
+// LoadQueryDirectory loads the query files of a directory into the sql datasource named
+// in their metadata. Without a datasource in the metadata the only sql datasource is used.
+func (r *Registry) LoadQueryDirectory(dirPath string) error {
+	files, err := os.ReadDir(dirPath)
+	if err != nil {
+		return fmt.Errorf("failed to read query directory %s: %w", dirPath, err)
+	}
+
+	var loadErrors []error
+	for _, file := range files {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), ".sql") {
+			continue
+		}
+
+		filePath := filepath.Join(dirPath, file.Name())
+		if err := r.loadQueryFile(filePath); err != nil {
+			loadErrors = append(loadErrors, err)
+			r.log.Error().Err(err).
+				Str("file", file.Name()).
+				Msg("Failed to load query file")
+		}
+	}
+
+	if len(loadErrors) > 0 {
+		return fmt.Errorf("encountered %d errors while loading query files from %s", len(loadErrors), dirPath)
+	}
+
+	return nil
+}
+
+// loadQueryFile lints a query file and loads it into the sql datasource named in its metadata.
+// The lint issues are kept for the lint report, also when there is no datasource to load it into.
+// In strict mode a file with lint errors is not loaded.
+func (r *Registry) loadQueryFile(filePath string) error {
+	query, err := os.ReadFile(filePath)
+	if err != nil {
+		return fmt.Errorf("failed to read query file %s: %w", filePath, err)
+	}
+
+	metadata, err := parseQueryMetadata(string(query))
+	if err != nil {
+		return fmt.Errorf("invalid metadata in query file %s: %w", filePath, err)
+	}
+
+	issues := lintQuery(metadata.ResourceType, string(query))
+	for i := range issues {
+		issues[i].File = filePath
+		r.log.Warn().
+			Str("file", filePath).
+			Str("column", issues[i].Column).
+			Str("severity", issues[i].Severity).
+			Msg(issues[i].Message)
+	}
+	r.mu.Lock()
+	r.lint[filePath] = issues
+	r.mu.Unlock()
+
+	var sqlSources []*DataSourceService
+	for _, source := range r.sqlSources() {
+		if metadata.DataSource == "" || source.Name() == metadata.DataSource {
+			sqlSources = append(sqlSources, source)
+		}
+	}
+
+	switch {
+	case len(sqlSources) == 0 && metadata.DataSource != "":
+		return fmt.Errorf("query file %s refers to unknown sql datasource %s", filePath, metadata.DataSource)
+	case len(sqlSources) == 0:
+		return fmt.Errorf("no sql datasource for query file %s", filePath)
+	case len(sqlSources) > 1:
+		return fmt.Errorf("query file %s has to declare its datasource, there are %d sql datasources", filePath, len(sqlSources))
+	}
+
+	if r.Strict() && HasLintErrors(issues) {
+		return fmt.Errorf("invalid alias in query file %s: %s", filePath, firstLintError(issues))
+	}
+	return sqlSources[0].addQuery(filePath, string(query), metadata)
+}
+
+// LintReport returns the lint issues of all query files loaded so far, ordered by file
+func (r *Registry) LintReport() []LintIssue {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	paths := make([]string, 0, len(r.lint))
+	for path := range r.lint {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	report := []LintIssue{}
+	for _, path := range paths {
+		report = append(report, r.lint[path]...)
+	}
+	return report
+}
+
+// Strict reports whether the connections require query files without lint errors
+func (r *Registry) Strict() bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.strict
+}
+
+// sqlSources returns the registered sql datasources in order of registration
+func (r *Registry) sqlSources() []*DataSourceService {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var sqlSources []*DataSourceService
+	for _, name := range r.names {
+		if source, ok := r.sources[name].(*DataSourceService); ok {
+			sqlSources = append(sqlSources, source)
+		}
+	}
+	return sqlSources
+}
+
+// ListQueryFiles returns the query files of all sql datasources ordered by resource type and path
+func (r *Registry) ListQueryFiles() []*QueryFile {
+	var queryFiles []*QueryFile
+	for _, source := range r.sqlSources() {
+		queryFiles = append(queryFiles, source.ListQueryFiles()...)
+	}
+	sort.SliceStable(queryFiles, func(i, j int) bool {
+		if queryFiles[i].Metadata.ResourceType != queryFiles[j].Metadata.ResourceType {
+			return queryFiles[i].Metadata.ResourceType < queryFiles[j].Metadata.ResourceType
+		}
+		return queryFiles[i].Path < queryFiles[j].Path
+	})
+	return queryFiles
+}
+
+// Name returns the name of the registry
+func (r *Registry) Name() string {
+	return "registry"
+}
+
+// ResourceTypes returns the resource types served by any of the datasources
+func (r *Registry) ResourceTypes() []string {
+	seen := make(map[string]bool)
+	var resourceTypes []string
+	for _, source := range r.DataSourcesFor("") {
+		for _, resourceType := range source.ResourceTypes() {
+			if !seen[resourceType] {
+				seen[resourceType] = true
+				resourceTypes = append(resourceTypes, resourceType)
+			}
+		}
+	}
+	sort.Strings(resourceTypes)
+	return resourceTypes
+}
+
+// DataSourcesFor returns the datasources serving the resource type in order of registration,
+// an empty resource type returns all datasources
+func (r *Registry) DataSourcesFor(resourceType string) []DataSource {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var sources []DataSource
+	for _, name := range r.names {
+		source := r.sources[name]
+		if resourceType == "" || containsString(source.ResourceTypes(), resourceType) {
+			sources = append(sources, source)
+		}
+	}
+	return sources
+}
+
+// ReadResources reads all resources of the resource type, see StreamResources
+func (r *Registry) ReadResources(resourceType, id string, filters []*types.Filter) ([]ResourceResult, []*types.Filter, error) {
+	stream, err := r.StreamResources(context.Background(), resourceType, id, filters)
+	if err != nil {
+		return nil, nil, err
+	}
+	results, err := CollectResources(stream)
+	return results, stream.RemainingFilters, err
+}
+
+// StreamResources streams the resources from every datasource serving the resource type.
+// The datasources start reading at the same time and are sent in order of registration.
+// A resource id served by more than one datasource is kept from the first registered one.
+func (r *Registry) StreamResources(ctx context.Context, resourceType, id string, filters []*types.Filter) (*ResourceStream, error) {
+	sources := r.DataSourcesFor(resourceType)
+	if len(sources) == 0 {
+		return nil, fmt.Errorf("no datasource found for resource type: %s", resourceType)
+	}
+	filters = withIDFilter(filters, id)
+
+	ctx, cancel := context.WithCancel(ctx)
+
+	streams := make([]*ResourceStream, len(sources))
+	remaining := make([][]*types.Filter, len(sources))
+	for i, source := range sources {
+		stream, err := source.StreamResources(ctx, resourceType, id, filters)
+		if err != nil {
+			cancel()
+			return nil, fmt.Errorf("datasource %s: %w", source.Name(), err)
+		}
+		streams[i] = stream
+		remaining[i] = stream.RemainingFilters
+	}
+
+	return newResourceStream(ctx, remainingFilters(filters, remaining), func(send func(ResourceResult) bool) error {
+		defer cancel()
+
+		// With a single datasource there is nothing to deduplicate
+		var producedBy map[string]string
+		if len(streams) > 1 {
+			producedBy = make(map[string]string)
+		}
+
+		for i, stream := range streams {
+			for result := range stream.Resources {
+				if producedBy != nil {
+					resourceID := ResultID(result, resourceType)
+					if firstSource, exists := producedBy[resourceID]; exists && resourceID != "" {
+						r.log.Warn().
+							Str("resourceType", resourceType).
+							Str("resourceID", resourceID).
+							Str("datasource", sources[i].Name()).
+							Str("firstDatasource", firstSource).
+							Msg("Duplicate resource produced by multiple datasources, keeping the first")
+						continue
+					}
+					producedBy[resourceID] = sources[i].Name()
+				}
+				if !send(result) {
+					return ctx.Err()
+				}
+			}
+			if err := stream.Err(); err != nil {
+				return fmt.Errorf("datasource %s: %w", sources[i].Name(), err)
+			}
+		}
+		return nil
+	}), nil
+}
+
+// Close closes the datasources that hold a connection
+func (r *Registry) Close() error {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var closeErrors []error
+	for _, name := range r.names {
+		if closer, ok := r.sources[name].(io.Closer); ok {
+			if err := closer.Close(); err != nil {
+				closeErrors = append(closeErrors, fmt.Errorf("datasource %s: %w", name, err))
+			}
+		}
+	}
+
+	if len(closeErrors) > 0 {
+		return fmt.Errorf("failed to close %d datasources: %v", len(closeErrors), closeErrors)
+	}
+	return nil
+}
+
+// ResultID returns the id of the resource row of a ResourceResult
+func ResultID(result ResourceResult, resourceType string) string {
+	for _, row := range result[resourceType] {
+		if row.ParentID == "" {
+			return row.ID
+		}
+	}
+	return ""
+}
+
+// containsString reports whether value is in values
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
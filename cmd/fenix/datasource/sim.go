@@ -0,0 +1,286 @@
+package datasource
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/SanteonNL/fenix/cmd/fenix/types"
+	"github.com/SanteonNL/fenix/models/sim"
+	"github.com/rs/zerolog"
+)
+
+// simDateLayout is the date format of the SIM extracts
+const simDateLayout = "2006-01-02"
+
+// SIMDataSource reads Santeon Information Model extracts. The source path is the patient file,
+// the child files next to it (patient_names.csv, patient_contacts.csv) are joined on
+// Identificatienummer. The files are read on every request so new extracts are picked up
+// without a restart. The patients are streamed, the child files are held in memory.
+type SIMDataSource struct {
+	name       string
+	sourcePath string
+	delimiter  rune
+	log        zerolog.Logger
+}
+
+// NewSIMDataSource creates a datasource for a csv connection with the sim format
+func NewSIMDataSource(connection ConnectionConfig, log zerolog.Logger) (*SIMDataSource, error) {
+	delimiter := ';'
+	if connection.Delimiter != "" {
+		r, size := utf8.DecodeRuneInString(connection.Delimiter)
+		if size != len(connection.Delimiter) {
+			return nil, fmt.Errorf("csv delimiter %q has to be a single character", connection.Delimiter)
+		}
+		delimiter = r
+	}
+
+	return &SIMDataSource{
+		name:       connection.Name,
+		sourcePath: connection.SourcePath,
+		delimiter:  delimiter,
+		log:        log,
+	}, nil
+}
+
+// Name returns the connection name of the datasource
+func (ds *SIMDataSource) Name() string {
+	return ds.name
+}
+
+// ResourceTypes returns the resource types that can be produced from the extracts
+func (ds *SIMDataSource) ResourceTypes() []string {
+	return []string{"Patient"}
+}
+
+// ReadResources reads all patients of the extract, see StreamResources
+func (ds *SIMDataSource) ReadResources(resourceType, id string, filters []*types.Filter) ([]ResourceResult, []*types.Filter, error) {
+	stream, err := ds.StreamResources(context.Background(), resourceType, id, filters)
+	if err != nil {
+		return nil, nil, err
+	}
+	results, err := CollectResources(stream)
+	return results, stream.RemainingFilters, err
+}
+
+// StreamResources streams the patients of the extract as the rows a query would produce, each
+// patient as soon as it is read. The child files are read into memory first. Search parameters
+// are not handled by the files and are all returned as remaining.
+func (ds *SIMDataSource) StreamResources(ctx context.Context, resourceType, id string, filters []*types.Filter) (*ResourceStream, error) {
+	if resourceType != "Patient" {
+		return nil, fmt.Errorf("resource type %s is not available in SIM extracts", resourceType)
+	}
+
+	return streamRows(ctx, ds.sourcePath, filters, ds.log, func(add func(row map[string]interface{}) error) error {
+		names, err := ds.readChildFile("names")
+		if err != nil {
+			return err
+		}
+		contacts, err := ds.readChildFile("contacts")
+		if err != nil {
+			return err
+		}
+
+		return ds.readPatients(ds.sourcePath, func(patient sim.Patient) error {
+			patientID := stringValue(patient.Identificatienummer)
+			if patientID == "" {
+				ds.log.Warn().Str("file", ds.sourcePath).Msg("Skipping SIM patient without Identificatienummer")
+				return nil
+			}
+			if id != "" && patientID != id {
+				return nil
+			}
+			return add(simPatientRow(patient, names[patientID], contacts[patientID]))
+		})
+	}), nil
+}
+
+// readChildFile reads a child file, e.g. patient_names.csv, grouped by Identificatienummer.
+// Child files are optional.
+func (ds *SIMDataSource) readChildFile(suffix string) (map[string][]sim.Patient, error) {
+	extension := filepath.Ext(ds.sourcePath)
+	path := strings.TrimSuffix(ds.sourcePath, extension) + "_" + suffix + extension
+
+	grouped := make(map[string][]sim.Patient)
+	err := ds.readPatients(path, func(row sim.Patient) error {
+		patientID := stringValue(row.Identificatienummer)
+		grouped[patientID] = append(grouped[patientID], row)
+		return nil
+	})
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return grouped, nil
+}
+
+// readPatients decodes the rows of a SIM csv file into sim.Patient using the csv tags and calls
+// fn for every row, an error of fn stops reading and is returned
+func (ds *SIMDataSource) readPatients(path string, fn func(sim.Patient) error) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open SIM file %s: %w", path, err)
+	}
+	defer file.Close()
+
+	reader := csv.NewReader(file)
+	reader.Comma = ds.delimiter
+
+	header, err := reader.Read()
+	if err != nil {
+		return fmt.Errorf("failed to read header of SIM file %s: %w", path, err)
+	}
+
+	// Map the columns of the file on the fields of sim.Patient
+	patientType := reflect.TypeOf(sim.Patient{})
+	fieldIndex := make(map[int]int)
+	for column, name := range header {
+		name = strings.TrimPrefix(strings.TrimSpace(name), "\ufeff")
+		for i := 0; i < patientType.NumField(); i++ {
+			tag := strings.Split(patientType.Field(i).Tag.Get("csv"), ",")[0]
+			if strings.EqualFold(tag, name) {
+				fieldIndex[column] = i
+				break
+			}
+		}
+	}
+
+	for line := 2; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read SIM file %s: %w", path, err)
+		}
+
+		var patient sim.Patient
+		value := reflect.ValueOf(&patient).Elem()
+		for column, field := range fieldIndex {
+			if err := setSIMField(value.Field(field), strings.TrimSpace(record[column])); err != nil {
+				return fmt.Errorf("line %d of SIM file %s, column %s: %w", line, path, header[column], err)
+			}
+		}
+		if err := fn(patient); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// setSIMField sets a *string or *time.Time field, empty values are left nil
+func setSIMField(field reflect.Value, value string) error {
+	if value == "" {
+		return nil
+	}
+
+	switch field.Interface().(type) {
+	case *string:
+		field.Set(reflect.ValueOf(&value))
+	case *time.Time:
+		// Parquet extracts can carry timestamps instead of dates
+		date, err := time.Parse(simDateLayout, value)
+		if err != nil {
+			if date, err = time.Parse(time.RFC3339, value); err != nil {
+				return fmt.Errorf("invalid date %q", value)
+			}
+		}
+		field.Set(reflect.ValueOf(&date))
+	default:
+		return fmt.Errorf("unsupported field type %s", field.Type())
+	}
+	return nil
+}
+
+// simPatientRow maps a SIM patient with its names and contacts on the column aliases a Patient query uses
+func simPatientRow(patient sim.Patient, names []sim.Patient, contacts []sim.Patient) map[string]interface{} {
+	patientID := stringValue(patient.Identificatienummer)
+	row := map[string]interface{}{
+		"resource_id":         patientID,
+		"id":                  patientID,
+		"parent_id":           "",
+		"fhir_path":           "Patient",
+		"identifier[0].value": patientID,
+	}
+
+	setColumn(row, "gender", patient.GeslachtCode)
+	setDateColumn(row, "birthDate", patient.Geboortedatum)
+	setDateColumn(row, "deceasedDateTime", patient.DatumOverlijden)
+	setColumn(row, "address[0].country", patient.Land)
+
+	// Without a names file the name on the patient row is used
+	if len(names) == 0 && (patient.Voornaam != nil || patient.Achternaam != nil) {
+		names = []sim.Patient{patient}
+	}
+	for i, name := range names {
+		prefix := fmt.Sprintf("name[%d]", i)
+		setColumn(row, prefix+".family", name.Achternaam)
+		if text := joinNonEmpty(name.Voornaam, name.Achternaam); text != "" {
+			row[prefix+".text"] = text
+		}
+	}
+
+	// Without a contacts file the related person on the patient row is used
+	contactsFromPatient := false
+	if len(contacts) == 0 && patient.GerelateerdPersoonID != nil {
+		contacts = []sim.Patient{patient}
+		contactsFromPatient = true
+	}
+	for i, contact := range contacts {
+		prefix := fmt.Sprintf("contact[%d]", i)
+		setColumn(row, prefix+".id", contact.GerelateerdPersoonID)
+		setColumn(row, prefix+".relationship[0].coding[0].system", contact.GerelateerdeRelatieSysteem)
+		setColumn(row, prefix+".relationship[0].coding[0].code", contact.GerelateerdeRelatie)
+		// The patient file carries the gender and name of the patient, not of the contact
+		if !contactsFromPatient {
+			setColumn(row, prefix+".gender", contact.GeslachtCode)
+			setColumn(row, prefix+".name.family", contact.Achternaam)
+		}
+	}
+
+	return row
+}
+
+// setColumn sets a column when the value is present
+func setColumn(row map[string]interface{}, column string, value *string) {
+	if value != nil && *value != "" {
+		row[column] = *value
+	}
+}
+
+// setDateColumn sets a date column when the value is present
+func setDateColumn(row map[string]interface{}, column string, value *time.Time) {
+	if value != nil {
+		row[column] = value.Format(simDateLayout)
+	}
+}
+
+// joinNonEmpty joins the present values with a space
+func joinNonEmpty(values ...*string) string {
+	var parts []string
+	for _, value := range values {
+		if value != nil && *value != "" {
+			parts = append(parts, *value)
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+// stringValue returns the value of a string pointer or an empty string
+func stringValue(value *string) string {
+	if value == nil {
+		return ""
+	}
+	return *value
+}
@@ -0,0 +1,134 @@
+package datasource
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+
+	"github.com/SanteonNL/fenix/cmd/fenix/types"
+	"github.com/rs/zerolog"
+)
+
+// streamBuffer is the number of complete resources a stream holds ahead of its consumer
+const streamBuffer = 16
+
+// ResourceStream delivers the resources of a search one at a time, each as soon as all its
+// rows are read. Resources is closed when the search is done; Err then reports why it ended.
+// A consumer that stops reading early has to cancel the context the stream was created with.
+type ResourceStream struct {
+	Resources        <-chan ResourceResult
+	RemainingFilters []*types.Filter // filters the datasource did not handle, see DataSource
+	err              error
+	done             chan struct{}
+}
+
+// newResourceStream starts produce in a goroutine. The send function passed to produce
+// returns false once the context is cancelled, produce should then stop.
+func newResourceStream(ctx context.Context, remainingFilters []*types.Filter, produce func(send func(ResourceResult) bool) error) *ResourceStream {
+	resources := make(chan ResourceResult, streamBuffer)
+	stream := &ResourceStream{
+		Resources:        resources,
+		RemainingFilters: remainingFilters,
+		done:             make(chan struct{}),
+	}
+
+	go func() {
+		defer close(stream.done)
+		defer close(resources)
+
+		stream.err = produce(func(result ResourceResult) bool {
+			select {
+			case resources <- result:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		})
+	}()
+
+	return stream
+}
+
+// Err waits for the stream to end and returns the error that ended it, if any
+func (s *ResourceStream) Err() error {
+	<-s.done
+	return s.err
+}
+
+// CollectResources reads all resources of a stream
+func CollectResources(stream *ResourceStream) ([]ResourceResult, error) {
+	var results []ResourceResult
+	for result := range stream.Resources {
+		results = append(results, result)
+	}
+	return results, stream.Err()
+}
+
+// errStreamStopped stops reading a file when the consumer of its stream is gone
+var errStreamStopped = errors.New("stream stopped")
+
+// rowGrouper sends the resources of a file as soon as their rows are complete. The rows of a
+// resource have to be adjacent, as the rows of an ordered query are.
+type rowGrouper struct {
+	builder *resultBuilder
+	send    func(ResourceResult) bool
+	current string
+	started bool
+	sent    map[string]bool // resources already sent, to detect rows that are not adjacent
+}
+
+// newRowGrouper creates a rowGrouper that sends the resources of the builder
+func newRowGrouper(builder *resultBuilder, send func(ResourceResult) bool) *rowGrouper {
+	return &rowGrouper{
+		builder: builder,
+		send:    send,
+		sent:    make(map[string]bool),
+	}
+}
+
+// add adds a row, the resource of the previous row is sent when the row starts another one
+func (g *rowGrouper) add(row map[string]interface{}) error {
+	resourceID, _ := row["resource_id"].(string)
+	if g.started && resourceID != g.current {
+		if err := g.flush(); err != nil {
+			return err
+		}
+	}
+	if g.sent[resourceID] {
+		return fmt.Errorf("rows of resource %s are not adjacent, the file has to be ordered by resource_id", resourceID)
+	}
+	g.current, g.started = resourceID, true
+	g.builder.addRow(row)
+	return nil
+}
+
+// flush sends the resource of the last row
+func (g *rowGrouper) flush() error {
+	if !g.started {
+		return nil
+	}
+	g.sent[g.current] = true
+	g.started = false
+	if !g.send(g.builder.take(g.current)) {
+		return errStreamStopped
+	}
+	return nil
+}
+
+// streamRows streams the resources of a file that is read row by row. read passes every row to
+// add and stops with the error add returns. Each resource is sent as soon as the rows of the next
+// one start, so only the rows of a single resource are held.
+func streamRows(ctx context.Context, source string, filters []*types.Filter, log zerolog.Logger, read func(add func(row map[string]interface{}) error) error) *ResourceStream {
+	return newResourceStream(ctx, validFilters(filters), func(send func(ResourceResult) bool) error {
+		grouper := newRowGrouper(newResultBuilder(filepath.ToSlash(source), log), send)
+		err := read(grouper.add)
+		if err == nil {
+			err = grouper.flush()
+		}
+		if errors.Is(err, errStreamStopped) {
+			return ctx.Err()
+		}
+		return err
+	})
+}
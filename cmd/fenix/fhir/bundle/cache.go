@@ -19,12 +19,13 @@ type BundleCache struct {
 
 // ResultSetCache holds the complete search results
 type ResultSetCache struct {
-	Resources    []interface{} // The actual FHIR resources
-	Issues       []SearchIssue // Any issues encountered during search
-	Total        int           // Total number of resources
-	SearchParams string        // Original search parameters
-	CreatedAt    time.Time     // When this cache entry was created
-	ExpiresAt    time.Time     // When this cache entry expires
+	Resources    []interface{}   // The actual FHIR resources
+	Included     [][]interface{} // Resources included by each of the resources
+	Issues       []SearchIssue   // Any issues encountered during search
+	Total        int             // Total number of resources
+	SearchParams string          // Original search parameters
+	CreatedAt    time.Time       // When this cache entry was created
+	ExpiresAt    time.Time       // When this cache entry expires
 }
 type CacheConfig struct {
 	// Enabled determines if caching is active
@@ -169,6 +170,7 @@ func (c *BundleCache) StoreResultSet(resourceType string, searchParams string, r
 	cacheKey := c.generateCacheKey(resourceType, searchParams)
 	resultSet := &ResultSetCache{
 		Resources:    result.Resources,
+		Included:     result.Included,
 		Issues:       result.Issues,
 		Total:        result.Total,
 		SearchParams: searchParams,
@@ -213,6 +215,9 @@ func (c *BundleCache) GetPageFromCache(resourceType, searchParams string, offset
 			Issues:    resultSet.Issues,
 			Total:     resultSet.Total,
 		}
+		if len(resultSet.Included) == len(resultSet.Resources) {
+			pagedResult.Included = resultSet.Included[start:end]
+		}
 
 		c.log.Debug().
 			Str("key", cacheKey).
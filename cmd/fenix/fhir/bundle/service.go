@@ -26,13 +26,17 @@ type SearchResult struct {
 	Resources []interface{}
 	Issues    []SearchIssue
 	Total     int
+	// Included holds the resources _include and _revinclude add for each of the resources, by
+	// position. They are not counted in the total and follow the page of the resources.
+	Included [][]interface{}
 }
 
 // SearchIssue represents a validation or processing issue
 type SearchIssue struct {
-	Severity fhir.IssueSeverity
-	Code     fhir.IssueType
-	Details  string
+	Severity   fhir.IssueSeverity
+	Code       fhir.IssueType
+	Details    string
+	Expression string // element the issue is about, empty when it is not about an element
 }
 
 // PaginationParams contains information needed for pagination
@@ -57,6 +61,13 @@ func NewBundleService(log zerolog.Logger, cacheConfig *CacheConfig) *BundleServi
 	return service
 }
 
+// Stop stops the cleanup routine of the cache of the service
+func (s *BundleService) Stop() {
+	if s.cache != nil {
+		s.cache.Stop()
+	}
+}
+
 func (s *BundleService) CreateSearchBundle(result SearchResult, params *PaginationParams) (*fhir.Bundle, error) {
 	bundle := &fhir.Bundle{
 		Id:        util.StringPtr(fmt.Sprintf("bundle-%s", time.Now().Format("20060102150405"))),
@@ -76,17 +87,7 @@ func (s *BundleService) CreateSearchBundle(result SearchResult, params *Paginati
 
 	// Add issues as OperationOutcome entries
 	for _, issue := range result.Issues {
-		outcome := &fhir.OperationOutcome{
-			Issue: []fhir.OperationOutcomeIssue{
-				{
-					Severity: issue.Severity,
-					Code:     issue.Code,
-					Details: &fhir.CodeableConcept{
-						Text: ptr(issue.Details),
-					},
-				},
-			},
-		}
+		outcome := NewOperationOutcome([]SearchIssue{issue})
 
 		// Use buffer to prevent HTML escaping
 		var buf bytes.Buffer
@@ -96,8 +97,10 @@ func (s *BundleService) CreateSearchBundle(result SearchResult, params *Paginati
 			return nil, fmt.Errorf("failed to marshal operation outcome: %w", err)
 		}
 
+		mode := fhir.SearchEntryModeOutcome
 		entry := fhir.BundleEntry{
 			Resource: json.RawMessage(buf.Bytes()),
+			Search:   &fhir.BundleEntrySearch{Mode: &mode},
 		}
 		bundle.Entry = append(bundle.Entry, entry)
 	}
@@ -123,24 +126,73 @@ func (s *BundleService) CreateSearchBundle(result SearchResult, params *Paginati
 		}
 	}
 
-	// Add resources with proper JSON encoding
+	// Add resources with proper JSON encoding, a resource appears once even when several
+	// resources include it or it is a match itself
+	seen := make(map[string]bool)
 	for _, resource := range result.Resources[start:end] {
-		var buf bytes.Buffer
-		encoder := json.NewEncoder(&buf)
-		encoder.SetEscapeHTML(false)
-		if err := encoder.Encode(resource); err != nil {
-			return nil, fmt.Errorf("failed to marshal resource: %w", err)
+		raw, key, err := encodeResource(resource)
+		if err != nil {
+			return nil, err
 		}
+		seen[key] = true
 
-		entry := fhir.BundleEntry{
-			Resource: json.RawMessage(bytes.TrimSpace(buf.Bytes())),
+		mode := fhir.SearchEntryModeMatch
+		bundle.Entry = append(bundle.Entry, fhir.BundleEntry{
+			Resource: raw,
+			Search:   &fhir.BundleEntrySearch{Mode: &mode},
+		})
+	}
+
+	for _, resource := range includedResources(result, start, end) {
+		raw, key, err := encodeResource(resource)
+		if err != nil {
+			return nil, err
 		}
-		bundle.Entry = append(bundle.Entry, entry)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+
+		mode := fhir.SearchEntryModeInclude
+		bundle.Entry = append(bundle.Entry, fhir.BundleEntry{
+			Resource: raw,
+			Search:   &fhir.BundleEntrySearch{Mode: &mode},
+		})
 	}
 
 	return bundle, nil
 }
 
+// includedResources returns the resources included by the resources from start to end
+func includedResources(result SearchResult, start, end int) []interface{} {
+	var included []interface{}
+	for i := start; i < end && i < len(result.Included); i++ {
+		included = append(included, result.Included[i]...)
+	}
+	return included
+}
+
+// encodeResource returns the json of a resource without HTML escaping, and the resourceType/id it
+// is identified by
+func encodeResource(resource interface{}) (json.RawMessage, string, error) {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(resource); err != nil {
+		return nil, "", fmt.Errorf("failed to marshal resource: %w", err)
+	}
+	raw := json.RawMessage(bytes.TrimSpace(buf.Bytes()))
+
+	var identity struct {
+		ResourceType string `json:"resourceType"`
+		Id           string `json:"id"`
+	}
+	if err := json.Unmarshal(raw, &identity); err != nil {
+		return nil, "", fmt.Errorf("failed to read resource id: %w", err)
+	}
+	return raw, identity.ResourceType + "/" + identity.Id, nil
+}
+
 // createPaginationLinks creates the FHIR bundle links for pagination with proper URL handling
 func (s *BundleService) createPaginationLinks(params *PaginationParams, total int) []fhir.BundleLink {
 	var links []fhir.BundleLink
@@ -223,6 +275,29 @@ func (s *BundleService) createPaginationLinks(params *PaginationParams, total in
 	return links
 }
 
+// NewOperationOutcome creates an OperationOutcome containing the given issues
+func NewOperationOutcome(issues []SearchIssue) *fhir.OperationOutcome {
+	outcome := &fhir.OperationOutcome{
+		Issue: make([]fhir.OperationOutcomeIssue, 0, len(issues)),
+	}
+
+	for _, issue := range issues {
+		outcomeIssue := fhir.OperationOutcomeIssue{
+			Severity: issue.Severity,
+			Code:     issue.Code,
+			Details: &fhir.CodeableConcept{
+				Text: ptr(issue.Details),
+			},
+		}
+		if issue.Expression != "" {
+			outcomeIssue.Expression = []string{issue.Expression}
+		}
+		outcome.Issue = append(outcome.Issue, outcomeIssue)
+	}
+
+	return outcome
+}
+
 // Rest of the helper functions remain the same...
 
 // Processing failure
@@ -252,6 +327,15 @@ func NewInvalidParameterIssue(details string) SearchIssue {
 	}
 }
 
+// Timeout
+func NewTimeoutIssue(details string) SearchIssue {
+	return SearchIssue{
+		Severity: fhir.IssueSeverityError,
+		Code:     fhir.IssueTypeTimeout,
+		Details:  details,
+	}
+}
+
 // Business rule violation
 func NewBusinessRuleIssue(details string) SearchIssue {
 	return SearchIssue{
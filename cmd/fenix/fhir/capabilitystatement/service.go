@@ -0,0 +1,294 @@
+package capabilitystatement
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/SanteonNL/fenix/cmd/fenix/datasource"
+	"github.com/SanteonNL/fenix/cmd/fenix/fhir/searchparameter"
+	"github.com/SanteonNL/fenix/cmd/fenix/fhir/structuredefinition"
+	"github.com/SanteonNL/fenix/cmd/fenix/types"
+	"github.com/SanteonNL/fenix/models/fhir"
+	"github.com/SanteonNL/fenix/util"
+	"github.com/rs/zerolog"
+)
+
+// CapabilityStatementService generates the CapabilityStatement from the loaded configuration
+type CapabilityStatementService struct {
+	searchParamService *searchparameter.SearchParameterService
+	structDefService   *structuredefinition.StructureDefinitionService
+	registry           *datasource.Registry
+	log                zerolog.Logger
+}
+
+// NewCapabilityStatementService creates a new capability statement service
+func NewCapabilityStatementService(
+	searchParamService *searchparameter.SearchParameterService,
+	structDefService *structuredefinition.StructureDefinitionService,
+	registry *datasource.Registry,
+	log zerolog.Logger,
+) *CapabilityStatementService {
+	return &CapabilityStatementService{
+		searchParamService: searchParamService,
+		structDefService:   structDefService,
+		registry:           registry,
+		log:                log,
+	}
+}
+
+// CreateCapabilityStatement builds the CapabilityStatement for the current configuration.
+// It is generated on every call so reloaded query files, profiles or search parameters
+// are reflected without a restart.
+func (svc *CapabilityStatementService) CreateCapabilityStatement(baseURL string) (*fhir.CapabilityStatement, error) {
+	now := time.Now().Format(time.RFC3339)
+
+	rest := fhir.CapabilityStatementRest{
+		Mode: fhir.RestfulCapabilityModeServer,
+	}
+
+	for _, resourceType := range svc.supportedResourceTypes() {
+		resource, err := svc.createResource(resourceType, svc.queryFilesFor(resourceType))
+		if err != nil {
+			svc.log.Warn().Err(err).
+				Str("resourceType", resourceType).
+				Msg("Skipping resource type in CapabilityStatement")
+			continue
+		}
+		rest.Resource = append(rest.Resource, *resource)
+	}
+	svc.addIncludes(rest.Resource)
+
+	statement := &fhir.CapabilityStatement{
+		Name:        util.StringPtr("FenixCapabilityStatement"),
+		Title:       util.StringPtr("Fenix FHIR server capabilities"),
+		Status:      fhir.PublicationStatusActive,
+		Date:        now,
+		Publisher:   util.StringPtr("Santeon"),
+		Kind:        fhir.CapabilityStatementKindInstance,
+		FhirVersion: fhir.FHIRVersion4_0_1,
+		Format:      []string{"application/fhir+json", "json"},
+		Software: &fhir.CapabilityStatementSoftware{
+			Name: "Fenix",
+		},
+		Implementation: &fhir.CapabilityStatementImplementation{
+			Description: "FHIR Enabled Node for Information eXchange",
+			Url:         util.StringPtr(baseURL),
+		},
+		Rest: []fhir.CapabilityStatementRest{rest},
+	}
+
+	svc.log.Debug().
+		Int("resources", len(rest.Resource)).
+		Msg("Created CapabilityStatement")
+
+	return statement, nil
+}
+
+// supportedResourceTypes returns the resource types served by a datasource that have a factory
+func (svc *CapabilityStatementService) supportedResourceTypes() []string {
+	var resourceTypes []string
+	for _, resourceType := range svc.registry.ResourceTypes() {
+		if _, exists := types.ResourceFactoryMap[resourceType]; exists {
+			resourceTypes = append(resourceTypes, resourceType)
+		}
+	}
+	return resourceTypes
+}
+
+// queryFilesFor returns the query files of the sql datasources for a resource type
+func (svc *CapabilityStatementService) queryFilesFor(resourceType string) []*datasource.QueryFile {
+	var queryFiles []*datasource.QueryFile
+	for _, queryFile := range svc.registry.ListQueryFiles() {
+		if queryFile.Metadata.ResourceType == resourceType {
+			queryFiles = append(queryFiles, queryFile)
+		}
+	}
+	return queryFiles
+}
+
+// createResource creates the rest.resource entry for a resource type
+func (svc *CapabilityStatementService) createResource(resourceType string, queryFiles []*datasource.QueryFile) (*fhir.CapabilityStatementRestResource, error) {
+	// A search runs all query files, so their profiles and search parameters are combined.
+	// When one of the files does not declare its search parameters, or the resource type is
+	// also served by a file datasource, all of them are listed.
+	var profiles, declared []string
+	allDeclared := len(queryFiles) > 0 && !svc.servedWithoutQuery(resourceType)
+	for _, queryFile := range queryFiles {
+		if profile := queryFile.Metadata.Profile; profile != "" && !contains(profiles, profile) {
+			profiles = append(profiles, profile)
+		}
+		if len(queryFile.Metadata.SearchParameters) == 0 {
+			allDeclared = false
+		}
+		for _, code := range queryFile.Metadata.SearchParameters {
+			if !contains(declared, code) {
+				declared = append(declared, code)
+			}
+		}
+	}
+	if !allDeclared {
+		declared = nil
+	}
+
+	var fhirResourceType fhir.ResourceType
+	if err := fhirResourceType.UnmarshalJSON([]byte(`"` + resourceType + `"`)); err != nil {
+		return nil, fmt.Errorf("unknown resource type %s: %w", resourceType, err)
+	}
+
+	resource := &fhir.CapabilityStatementRestResource{
+		Type: fhirResourceType,
+		Interaction: []fhir.CapabilityStatementRestResourceInteraction{
+			{Code: fhir.TypeRestfulInteractionRead},
+			{Code: fhir.TypeRestfulInteractionSearchType},
+		},
+		SearchParam: svc.createSearchParams(resourceType, declared),
+	}
+
+	// The profiles declared by the queries are always supported
+	resource.SupportedProfile = append(resource.SupportedProfile, profiles...)
+
+	// Base definitions go in profile, constraints on it are supported profiles
+	for _, sd := range svc.structDefService.GetAllStructureDefinitions() {
+		if sd.Type != resourceType || sd.Kind != fhir.StructureDefinitionKindResource {
+			continue
+		}
+		if sd.Derivation != nil && *sd.Derivation == fhir.TypeDerivationRuleConstraint {
+			if contains(profiles, sd.Url) {
+				continue
+			}
+			resource.SupportedProfile = append(resource.SupportedProfile, sd.Url)
+		} else if resource.Profile == nil {
+			resource.Profile = util.StringPtr(sd.Url)
+		}
+	}
+	sort.Strings(resource.SupportedProfile)
+
+	return resource, nil
+}
+
+// addIncludes lists the reference search parameters of the resources for _include, and the ones
+// that refer to a served resource type for its _revinclude
+func (svc *CapabilityStatementService) addIncludes(resources []fhir.CapabilityStatementRestResource) {
+	for i := range resources {
+		sourceType := resources[i].Type.String()
+		for _, searchParam := range resources[i].SearchParam {
+			if searchParam.Type != fhir.SearchParamTypeReference {
+				continue
+			}
+			sp, err := svc.searchParamService.GetSearchParameterByCode(searchParam.Name, sourceType)
+			if err != nil {
+				continue
+			}
+
+			include := sourceType + ":" + searchParam.Name
+			resources[i].SearchInclude = append(resources[i].SearchInclude, include)
+			for j := range resources {
+				if refersTo(sp, resources[j].Type) {
+					resources[j].SearchRevInclude = append(resources[j].SearchRevInclude, include)
+				}
+			}
+		}
+	}
+
+	for i := range resources {
+		sort.Strings(resources[i].SearchRevInclude)
+	}
+}
+
+// refersTo reports whether a reference search parameter can refer to a resource type, a parameter
+// without targets refers to any
+func refersTo(sp *fhir.SearchParameter, resourceType fhir.ResourceType) bool {
+	if len(sp.Target) == 0 {
+		return true
+	}
+	for _, target := range sp.Target {
+		if target == resourceType {
+			return true
+		}
+	}
+	return false
+}
+
+// servedWithoutQuery reports whether a datasource other than the sql datasources serves the resource type
+func (svc *CapabilityStatementService) servedWithoutQuery(resourceType string) bool {
+	for _, source := range svc.registry.DataSourcesFor(resourceType) {
+		if _, isSQL := source.(*datasource.DataSourceService); !isSQL {
+			return true
+		}
+	}
+	return false
+}
+
+// createSearchParams lists the search parameters and their supported modifiers for a resource type.
+// When the query declares its search parameters only those are listed.
+func (svc *CapabilityStatementService) createSearchParams(resourceType string, declared []string) []fhir.CapabilityStatementRestResourceSearchParam {
+	parameters := svc.searchParamService.ListSearchParametersForResource(resourceType)
+
+	codes := make([]string, 0, len(parameters))
+	for code := range parameters {
+		if len(declared) > 0 && !contains(declared, code) {
+			continue
+		}
+		codes = append(codes, code)
+	}
+	sort.Strings(codes)
+
+	searchParams := make([]fhir.CapabilityStatementRestResourceSearchParam, 0, len(codes))
+	for _, code := range codes {
+		searchTypes := parameters[code]
+		if len(searchTypes) == 0 {
+			continue
+		}
+
+		var searchParamType fhir.SearchParamType
+		if err := searchParamType.UnmarshalJSON([]byte(`"` + searchTypes[0] + `"`)); err != nil {
+			svc.log.Warn().Err(err).
+				Str("code", code).
+				Str("type", searchTypes[0]).
+				Msg("Skipping search parameter with unknown type")
+			continue
+		}
+
+		searchParam := fhir.CapabilityStatementRestResourceSearchParam{
+			Name: code,
+			Type: searchParamType,
+		}
+
+		if sp, err := svc.searchParamService.GetSearchParameterByCode(code, resourceType); err == nil {
+			searchParam.Definition = util.StringPtr(sp.Url)
+		}
+
+		if modifiers := supportedModifiers(searchTypes[0]); len(modifiers) > 0 {
+			searchParam.Documentation = util.StringPtr(
+				fmt.Sprintf("Supported modifiers: %s", strings.Join(modifiers, ", ")))
+		}
+
+		searchParams = append(searchParams, searchParam)
+	}
+
+	return searchParams
+}
+
+// supportedModifiers returns the sorted modifiers that are valid for a search type
+func supportedModifiers(searchType string) []string {
+	var modifiers []string
+	for modifier, valid := range searchparameter.ValidModifiers[strings.ToLower(searchType)] {
+		if valid {
+			modifiers = append(modifiers, modifier)
+		}
+	}
+	sort.Strings(modifiers)
+	return modifiers
+}
+
+// contains reports whether code is in codes
+func contains(codes []string, code string) bool {
+	for _, c := range codes {
+		if c == code {
+			return true
+		}
+	}
+	return false
+}
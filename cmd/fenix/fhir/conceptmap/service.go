@@ -76,6 +76,7 @@ func (s *ConceptMapService) findDirectMapping(conceptMap *fhir.ConceptMap, sourc
 						return &TranslationResult{
 							TargetCode:    *target.Code,
 							TargetDisplay: getDisplayValue(target.Display),
+							TargetSystem:  getDisplayValue(group.Target),
 						}
 					}
 				}
@@ -94,6 +95,7 @@ func (s *ConceptMapService) findDefaultMapping(conceptMap *fhir.ConceptMap) *Tra
 						return &TranslationResult{
 							TargetCode:    *target.Code,
 							TargetDisplay: getDisplayValue(target.Display),
+							TargetSystem:  getDisplayValue(group.Target),
 						}
 					}
 				}
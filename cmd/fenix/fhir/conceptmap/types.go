@@ -19,6 +19,7 @@ type ValidationResult struct {
 type TranslationResult struct {
 	TargetCode    string
 	TargetDisplay string
+	TargetSystem  string // system of the target group, empty when the ConceptMap has none
 }
 
 // ConceptMapMetadata contains metadata about a stored ConceptMap
@@ -0,0 +1,936 @@
+package fhirpath
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Expression is a parsed FHIRPath expression
+type Expression struct {
+	text string
+	tree node
+}
+
+// item is an item of a collection: a resource or element of the generated FHIR models or of the
+// json form of a resource, or a primitive value (string, bool, int, json.Number)
+type item struct {
+	value    interface{}
+	typeName string // FHIR type when known from the model or a choice element, e.g. Quantity or dateTime
+}
+
+// environment holds the variables of an evaluation
+type environment struct {
+	resource interface{} // %resource, the resource that contains the context
+	context  interface{} // %context, the item the expression is evaluated on
+	this     *item       // $this within the argument of a function
+	index    int         // $index within the argument of a function
+	total    []item      // $total within the argument of aggregate
+}
+
+// primitiveTypes are the FHIR primitive types, their choice elements have the type name capitalized
+var primitiveTypes = []string{
+	"boolean", "integer", "integer64", "string", "decimal", "uri", "url", "canonical", "base64Binary", "instant",
+	"date", "dateTime", "time", "code", "oid", "id", "markdown", "unsignedInt", "positiveInt", "uuid",
+}
+
+// quantityTypes are the types that are a Quantity
+var quantityTypes = map[string]bool{
+	"Quantity": true, "SimpleQuantity": true, "MoneyQuantity": true, "Age": true, "Count": true, "Distance": true, "Duration": true,
+}
+
+// Parse parses a FHIRPath expression
+func Parse(expression string) (*Expression, error) {
+	tree, err := parse(expression)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse FHIRPath expression %q: %w", expression, err)
+	}
+	return &Expression{text: expression, tree: tree}, nil
+}
+
+// String returns the text of the expression
+func (e *Expression) String() string {
+	return e.text
+}
+
+// Evaluate evaluates the expression on a resource, a generated model struct or its json form. The
+// result holds model structs, json values and primitives.
+func (e *Expression) Evaluate(resource interface{}) ([]interface{}, error) {
+	return e.EvaluateOn(resource, resource)
+}
+
+// EvaluateOn evaluates the expression on an element within a resource, e.g. for the invariants of
+// the element. %resource refers to the resource.
+func (e *Expression) EvaluateOn(resource interface{}, element interface{}) ([]interface{}, error) {
+	env := &environment{resource: resource, context: element}
+	items, err := evaluate(e.tree, toItems(element, ""), env)
+	if err != nil {
+		return nil, fmt.Errorf("failed to evaluate %q: %w", e.text, err)
+	}
+	values := make([]interface{}, len(items))
+	for i, it := range items {
+		values[i] = it.value
+	}
+	return values, nil
+}
+
+// EvaluateBool evaluates an expression that results in a boolean, such as an invariant. An empty
+// result is returned as false with ok false.
+func (e *Expression) EvaluateBool(resource interface{}, element interface{}) (result bool, ok bool, err error) {
+	values, err := e.EvaluateOn(resource, element)
+	if err != nil {
+		return false, false, err
+	}
+	switch len(values) {
+	case 0:
+		return false, false, nil
+	case 1:
+		if b, isBool := values[0].(bool); isBool {
+			return b, true, nil
+		}
+		// A single item that is not a boolean is true
+		return true, true, nil
+	default:
+		return false, false, fmt.Errorf("%q results in %d items, expected a boolean", e.text, len(values))
+	}
+}
+
+// evaluate evaluates a node of the syntax tree on the focus
+func evaluate(n node, focus []item, env *environment) ([]item, error) {
+	switch n := n.(type) {
+	case *literalNode:
+		return n.items, nil
+
+	case *variableNode:
+		return variable(n.name, focus, env)
+
+	case *memberNode:
+		if n.target == nil {
+			// A type name at the start of a path selects the focus when it has that type, e.g. Patient.name
+			if isTypeName(n.name) {
+				var typed []item
+				for _, it := range focus {
+					if isType(it, n.name) {
+						typed = append(typed, it)
+					}
+				}
+				if len(typed) > 0 {
+					return typed, nil
+				}
+			}
+			return children(focus, n.name), nil
+		}
+		target, err := evaluate(n.target, focus, env)
+		if err != nil {
+			return nil, err
+		}
+		return children(target, n.name), nil
+
+	case *functionNode:
+		target := focus
+		if n.target != nil {
+			var err error
+			if target, err = evaluate(n.target, focus, env); err != nil {
+				return nil, err
+			}
+		}
+		return callFunction(n, target, focus, env)
+
+	case *indexNode:
+		target, err := evaluate(n.target, focus, env)
+		if err != nil {
+			return nil, err
+		}
+		index, err := evaluate(n.index, focus, env)
+		if err != nil {
+			return nil, err
+		}
+		position, ok, err := singleInteger(index)
+		if err != nil || !ok {
+			return nil, err
+		}
+		if position < 0 || position >= len(target) {
+			return nil, nil
+		}
+		return target[position : position+1], nil
+
+	case *unaryNode:
+		operand, err := evaluate(n.operand, focus, env)
+		if err != nil {
+			return nil, err
+		}
+		if n.operator == "+" || len(operand) == 0 {
+			return operand, nil
+		}
+		return arithmetic("*", operand, []item{{value: -1, typeName: "integer"}})
+
+	case *typeNode:
+		operand, err := evaluate(n.operand, focus, env)
+		if err != nil {
+			return nil, err
+		}
+		if n.operator == "is" {
+			if len(operand) == 0 {
+				return nil, nil
+			}
+			if len(operand) > 1 {
+				return nil, fmt.Errorf("is expects a single item, got %d", len(operand))
+			}
+			return boolean(isType(operand[0], n.typeName)), nil
+		}
+		return ofType(operand, n.typeName), nil
+
+	case *binaryNode:
+		return evaluateBinary(n, focus, env)
+
+	default:
+		return nil, fmt.Errorf("unknown node %T", n)
+	}
+}
+
+// variable returns the value of an environment or special variable
+func variable(name string, focus []item, env *environment) ([]item, error) {
+	switch name {
+	case "$this":
+		if env.this != nil {
+			return []item{*env.this}, nil
+		}
+		return focus, nil
+	case "$index":
+		return []item{{value: env.index, typeName: "integer"}}, nil
+	case "$total":
+		return env.total, nil
+	case "%resource", "%rootResource":
+		return toItems(env.resource, ""), nil
+	case "%context":
+		return toItems(env.context, ""), nil
+	case "%ucum":
+		return []item{{value: "http://unitsofmeasure.org", typeName: "string"}}, nil
+	case "%sct":
+		return []item{{value: "http://snomed.info/sct", typeName: "string"}}, nil
+	case "%loinc":
+		return []item{{value: "http://loinc.org", typeName: "string"}}, nil
+	}
+	// %vs-[name] and %ext-[name] refer to the canonical url of a ValueSet or extension
+	if rest, found := strings.CutPrefix(name, "%vs-"); found {
+		return []item{{value: "http://hl7.org/fhir/ValueSet/" + rest, typeName: "string"}}, nil
+	}
+	if rest, found := strings.CutPrefix(name, "%ext-"); found {
+		return []item{{value: "http://hl7.org/fhir/StructureDefinition/" + rest, typeName: "string"}}, nil
+	}
+	return nil, fmt.Errorf("unknown variable %s", name)
+}
+
+// evaluateBinary evaluates an operator with two operands
+func evaluateBinary(n *binaryNode, focus []item, env *environment) ([]item, error) {
+	left, err := evaluate(n.left, focus, env)
+	if err != nil {
+		return nil, err
+	}
+
+	// The boolean operators do not need the right operand when the left one decides the result
+	switch n.operator {
+	case "and", "or", "implies":
+		l, lok, err := singleBoolean(left)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case n.operator == "and" && lok && !l:
+			return boolean(false), nil
+		case n.operator == "or" && lok && l:
+			return boolean(true), nil
+		case n.operator == "implies" && lok && !l:
+			return boolean(true), nil
+		}
+	}
+
+	right, err := evaluate(n.right, focus, env)
+	if err != nil {
+		return nil, err
+	}
+
+	switch n.operator {
+	case "|":
+		return union(left, right), nil
+	case "=", "!=", "~", "!~":
+		if len(left) == 0 || len(right) == 0 {
+			if n.operator == "~" {
+				return boolean(len(left) == len(right)), nil
+			}
+			if n.operator == "!~" {
+				return boolean(len(left) != len(right)), nil
+			}
+			return nil, nil
+		}
+		equivalent := strings.HasSuffix(n.operator, "~")
+		equal := len(left) == len(right)
+		for i := 0; equal && i < len(left); i++ {
+			equal = itemsEqual(left[i], right[i], equivalent)
+		}
+		return boolean(equal == !strings.HasPrefix(n.operator, "!")), nil
+	case "<", ">", "<=", ">=":
+		return compare(n.operator, left, right)
+	case "in", "contains":
+		element, collection := left, right
+		if n.operator == "contains" {
+			element, collection = right, left
+		}
+		if len(element) == 0 {
+			return nil, nil
+		}
+		if len(element) > 1 {
+			return nil, fmt.Errorf("%s expects a single item, got %d", n.operator, len(element))
+		}
+		return boolean(containsItem(collection, element[0])), nil
+	case "and", "or", "xor", "implies":
+		return logic(n.operator, left, right)
+	case "&":
+		return []item{{value: concatString(left) + concatString(right), typeName: "string"}}, nil
+	default:
+		return arithmetic(n.operator, left, right)
+	}
+}
+
+// logic evaluates the three-valued boolean operators, an empty operand is unknown
+func logic(operator string, left, right []item) ([]item, error) {
+	l, lok, err := singleBoolean(left)
+	if err != nil {
+		return nil, err
+	}
+	r, rok, err := singleBoolean(right)
+	if err != nil {
+		return nil, err
+	}
+	switch operator {
+	case "and":
+		if (lok && !l) || (rok && !r) {
+			return boolean(false), nil
+		}
+		if lok && rok {
+			return boolean(true), nil
+		}
+	case "or":
+		if (lok && l) || (rok && r) {
+			return boolean(true), nil
+		}
+		if lok && rok {
+			return boolean(false), nil
+		}
+	case "xor":
+		if lok && rok {
+			return boolean(l != r), nil
+		}
+	case "implies":
+		if lok && !l {
+			return boolean(true), nil
+		}
+		if rok && r {
+			return boolean(true), nil
+		}
+		if lok && rok {
+			return boolean(false), nil
+		}
+	}
+	return nil, nil
+}
+
+// arithmetic evaluates the arithmetic operators on numbers, + also concatenates strings
+func arithmetic(operator string, left, right []item) ([]item, error) {
+	if len(left) == 0 || len(right) == 0 {
+		return nil, nil
+	}
+	if len(left) > 1 || len(right) > 1 {
+		return nil, fmt.Errorf("%s expects single items", operator)
+	}
+	if operator == "+" {
+		if l, ok := left[0].value.(string); ok {
+			if r, ok := right[0].value.(string); ok {
+				return []item{{value: l + r, typeName: "string"}}, nil
+			}
+		}
+	}
+
+	l, lok := toNumber(left[0].value)
+	r, rok := toNumber(right[0].value)
+	if !lok || !rok {
+		return nil, fmt.Errorf("%s expects numbers", operator)
+	}
+	integers := isInteger(left[0].value) && isInteger(right[0].value)
+	var result float64
+	switch operator {
+	case "+":
+		result = l + r
+	case "-":
+		result = l - r
+	case "*":
+		result = l * r
+	case "/":
+		if r == 0 {
+			return nil, nil
+		}
+		return []item{{value: json.Number(strconv.FormatFloat(l/r, 'f', -1, 64)), typeName: "decimal"}}, nil
+	case "div":
+		if r == 0 {
+			return nil, nil
+		}
+		return []item{{value: int(math.Trunc(l / r)), typeName: "integer"}}, nil
+	case "mod":
+		if r == 0 {
+			return nil, nil
+		}
+		result = math.Mod(l, r)
+	default:
+		return nil, fmt.Errorf("unknown operator %s", operator)
+	}
+	if integers {
+		return []item{{value: int(result), typeName: "integer"}}, nil
+	}
+	return []item{{value: json.Number(strconv.FormatFloat(result, 'f', -1, 64)), typeName: "decimal"}}, nil
+}
+
+// compare evaluates the ordering operators on numbers, strings and dates
+func compare(operator string, left, right []item) ([]item, error) {
+	if len(left) == 0 || len(right) == 0 {
+		return nil, nil
+	}
+	if len(left) > 1 || len(right) > 1 {
+		return nil, fmt.Errorf("%s expects single items", operator)
+	}
+
+	var order int
+	l, lok := toNumber(left[0].value)
+	r, rok := toNumber(right[0].value)
+	lq, lunit, lquantity := quantityValue(left[0])
+	rq, runit, rquantity := quantityValue(right[0])
+	switch {
+	case lquantity || rquantity:
+		// Quantities of different units are not converted, their order is unknown
+		if !lquantity || !rquantity || lunit != runit {
+			return nil, nil
+		}
+		order = compareFloats(lq, rq)
+	case lok && rok:
+		order = compareFloats(l, r)
+	default:
+		ls, lok := left[0].value.(string)
+		rs, rok := right[0].value.(string)
+		if !lok || !rok {
+			return nil, fmt.Errorf("%s cannot compare %T with %T", operator, left[0].value, right[0].value)
+		}
+		lt, lerr := parseDateTime(ls)
+		rt, rerr := parseDateTime(rs)
+		if lerr == nil && rerr == nil {
+			order = lt.Compare(rt)
+		} else {
+			order = strings.Compare(ls, rs)
+		}
+	}
+
+	switch operator {
+	case "<":
+		return boolean(order < 0), nil
+	case ">":
+		return boolean(order > 0), nil
+	case "<=":
+		return boolean(order <= 0), nil
+	default:
+		return boolean(order >= 0), nil
+	}
+}
+
+func compareFloats(l, r float64) int {
+	switch {
+	case l < r:
+		return -1
+	case l > r:
+		return 1
+	}
+	return 0
+}
+
+// parseDateTime parses a FHIR date, dateTime or instant, values without time zone are taken as UTC
+func parseDateTime(value string) (time.Time, error) {
+	for _, layout := range []string{"2006", "2006-01", "2006-01-02", "2006-01-02T15:04", "2006-01-02T15:04Z07:00", "2006-01-02T15:04:05", time.RFC3339} {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid date %q", value)
+}
+
+// children returns the children of a name of the items, a choice element is selected by its name
+// without type, e.g. value for valueQuantity
+func children(items []item, name string) []item {
+	var result []item
+	for _, it := range items {
+		result = append(result, childItems(it, name)...)
+	}
+	return result
+}
+
+// childItems returns the children of a name of a single item
+func childItems(it item, name string) []item {
+	switch value := it.value.(type) {
+	case map[string]interface{}:
+		if child, exists := value[name]; exists {
+			return toItems(child, "")
+		}
+		for key, child := range value {
+			if typeName, ok := choiceType(key, name); ok {
+				return toItems(child, typeName)
+			}
+		}
+		return nil
+	}
+
+	v := reflect.ValueOf(it.value)
+	for v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return nil
+		}
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Struct {
+		return nil
+	}
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		fieldName := jsonName(field)
+		if fieldName == name {
+			return toItems(v.Field(i).Interface(), "")
+		}
+		if typeName, ok := choiceType(fieldName, name); ok && !isNil(v.Field(i)) {
+			return toItems(v.Field(i).Interface(), typeName)
+		}
+	}
+	return nil
+}
+
+// fieldNames returns the element names of the fields of a model struct
+func fieldNames(value interface{}) []string {
+	t := reflect.TypeOf(value)
+	for t != nil && t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t == nil || t.Kind() != reflect.Struct {
+		return nil
+	}
+	var names []string
+	for i := 0; i < t.NumField(); i++ {
+		if t.Field(i).IsExported() {
+			names = append(names, jsonName(t.Field(i)))
+		}
+	}
+	return names
+}
+
+// choiceType returns the type of a choice element by its name with type, e.g. Quantity for valueQuantity
+func choiceType(key, name string) (string, bool) {
+	suffix, found := strings.CutPrefix(key, name)
+	if !found || suffix == "" || !unicode.IsUpper(rune(suffix[0])) {
+		return "", false
+	}
+	for _, primitive := range primitiveTypes {
+		if strings.EqualFold(primitive, suffix) {
+			return primitive, true
+		}
+	}
+	return suffix, true
+}
+
+// toItems returns the items of a value, the elements of a slice are separate items and empty values
+// have no items. Primitives of the models are returned as their json value.
+func toItems(value interface{}, typeName string) []item {
+	if value == nil {
+		return nil
+	}
+	if it, ok := value.(item); ok {
+		return []item{it}
+	}
+	switch v := value.(type) {
+	case []interface{}:
+		var items []item
+		for _, element := range v {
+			items = append(items, toItems(element, typeName)...)
+		}
+		return items
+	case map[string]interface{}, string, bool, int, json.Number:
+		return []item{{value: v, typeName: typeName}}
+	case float64:
+		return []item{{value: json.Number(strconv.FormatFloat(v, 'f', -1, 64)), typeName: typeName}}
+	}
+
+	rv := reflect.ValueOf(value)
+	for rv.Kind() == reflect.Ptr || rv.Kind() == reflect.Interface {
+		if rv.IsNil() {
+			return nil
+		}
+		rv = rv.Elem()
+	}
+	switch rv.Kind() {
+	case reflect.Slice:
+		if rv.Type().Elem().Kind() == reflect.Uint8 {
+			// json.RawMessage, e.g. contained resources, is decoded
+			var decoded interface{}
+			if err := json.Unmarshal(rv.Bytes(), &decoded); err != nil {
+				return nil
+			}
+			return toItems(jsonNumbers(decoded), typeName)
+		}
+		var items []item
+		for i := 0; i < rv.Len(); i++ {
+			items = append(items, toItems(rv.Index(i).Interface(), typeName)...)
+		}
+		return items
+	case reflect.Struct:
+		if hasExportedFields(rv.Type()) {
+			return []item{{value: rv.Interface(), typeName: typeName}}
+		}
+	}
+
+	// Primitives, code enumerations and dates are used in their json form
+	data, err := json.Marshal(rv.Interface())
+	if err != nil {
+		return nil
+	}
+	var primitive interface{}
+	decoder := json.NewDecoder(strings.NewReader(string(data)))
+	decoder.UseNumber()
+	if err := decoder.Decode(&primitive); err != nil || primitive == nil {
+		return nil
+	}
+	if isInteger(rv.Interface()) {
+		primitive = int(rv.Int())
+	}
+	return []item{{value: primitive, typeName: typeName}}
+}
+
+// jsonNumbers converts the float64 numbers of decoded json into json.Number
+func jsonNumbers(value interface{}) interface{} {
+	switch v := value.(type) {
+	case float64:
+		return json.Number(strconv.FormatFloat(v, 'f', -1, 64))
+	case []interface{}:
+		for i := range v {
+			v[i] = jsonNumbers(v[i])
+		}
+	case map[string]interface{}:
+		for key := range v {
+			v[key] = jsonNumbers(v[key])
+		}
+	}
+	return value
+}
+
+// hasExportedFields reports whether a struct is an element with children, rather than a primitive
+// such as fhir.Date
+func hasExportedFields(t reflect.Type) bool {
+	for i := 0; i < t.NumField(); i++ {
+		if t.Field(i).IsExported() {
+			return true
+		}
+	}
+	return false
+}
+
+// jsonName returns the FHIR element name of a struct field from its json tag
+func jsonName(field reflect.StructField) string {
+	name := strings.Split(field.Tag.Get("json"), ",")[0]
+	if name == "" || name == "-" {
+		return strings.ToLower(field.Name[:1]) + field.Name[1:]
+	}
+	return name
+}
+
+func isNil(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface, reflect.Slice, reflect.Map:
+		return v.IsNil()
+	}
+	return false
+}
+
+// typeOf returns the FHIR type of an item, from the model, a choice element or the value
+func typeOf(it item) string {
+	if it.typeName != "" {
+		return it.typeName
+	}
+	switch value := it.value.(type) {
+	case map[string]interface{}:
+		if resourceType, ok := value["resourceType"].(string); ok {
+			return resourceType
+		}
+		return ""
+	case string:
+		return "string"
+	case bool:
+		return "boolean"
+	case int:
+		return "integer"
+	case json.Number:
+		return "decimal"
+	}
+	t := reflect.TypeOf(it.value)
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return t.Name()
+}
+
+// isType reports whether an item is of a type, a resource is a Resource and DomainResource as well
+func isType(it item, typeName string) bool {
+	typeName = strings.TrimPrefix(strings.TrimPrefix(typeName, "FHIR."), "System.")
+	actual := typeOf(it)
+	switch {
+	case actual == typeName:
+		return true
+	case !isTypeName(actual) && strings.EqualFold(actual, typeName):
+		// System types are capitalized, e.g. System.String
+		return true
+	case typeName == "Quantity":
+		return quantityTypes[actual]
+	case typeName == "Resource" || typeName == "DomainResource":
+		return isResource(it)
+	case actual == "string" && it.typeName == "":
+		// Strings of the models have no type, they match every type with a string value
+		for _, primitive := range []string{"code", "uri", "url", "canonical", "id", "oid", "uuid", "markdown", "date", "dateTime", "instant", "time", "base64Binary"} {
+			if typeName == primitive {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// isResource reports whether an item is a resource
+func isResource(it item) bool {
+	if object, ok := it.value.(map[string]interface{}); ok {
+		_, isResource := object["resourceType"]
+		return isResource
+	}
+	v := reflect.ValueOf(it.value)
+	for v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return false
+		}
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Struct {
+		return false
+	}
+	_, hasMeta := v.Type().FieldByName("Meta")
+	_, hasImplicitRules := v.Type().FieldByName("ImplicitRules")
+	return hasMeta && hasImplicitRules
+}
+
+// isTypeName reports whether a name is a type rather than an element, types start with a capital
+func isTypeName(name string) bool {
+	return name != "" && unicode.IsUpper(rune(name[0]))
+}
+
+// ofType returns the items of a type
+func ofType(items []item, typeName string) []item {
+	var result []item
+	for _, it := range items {
+		if isType(it, typeName) {
+			result = append(result, it)
+		}
+	}
+	return result
+}
+
+// itemsEqual compares two items, equivalence ignores case and white space of strings
+func itemsEqual(left, right item, equivalent bool) bool {
+	if l, lunit, ok := quantityValue(left); ok {
+		r, runit, ok := quantityValue(right)
+		return ok && l == r && lunit == runit
+	}
+	if l, ok := toNumber(left.value); ok {
+		r, ok := toNumber(right.value)
+		return ok && l == r
+	}
+	ls, lok := left.value.(string)
+	rs, rok := right.value.(string)
+	if lok && rok {
+		if equivalent {
+			return strings.EqualFold(strings.Join(strings.Fields(ls), " "), strings.Join(strings.Fields(rs), " "))
+		}
+		if lt, err := parseDateTime(ls); err == nil && len(ls) == len(rs) {
+			if rt, err := parseDateTime(rs); err == nil {
+				return lt.Equal(rt)
+			}
+		}
+		return ls == rs
+	}
+	if lb, ok := left.value.(bool); ok {
+		rb, ok := right.value.(bool)
+		return ok && lb == rb
+	}
+	return reflect.DeepEqual(asJSON(left.value), asJSON(right.value))
+}
+
+// asJSON returns the json form of a value to compare complex items
+func asJSON(value interface{}) interface{} {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return nil
+	}
+	var decoded interface{}
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		return nil
+	}
+	return decoded
+}
+
+// quantityValue returns the value and unit of a Quantity item, the unit is its code or else the
+// unit text
+func quantityValue(it item) (float64, string, bool) {
+	if !isType(it, "Quantity") {
+		return 0, "", false
+	}
+	values := childItems(it, "value")
+	if len(values) != 1 {
+		return 0, "", false
+	}
+	value, ok := toNumber(values[0].value)
+	if !ok {
+		return 0, "", false
+	}
+	unit := childItems(it, "code")
+	if len(unit) != 1 {
+		unit = childItems(it, "unit")
+	}
+	if len(unit) != 1 {
+		return value, "", true
+	}
+	return value, toString(unit[0]), true
+}
+
+// toNumber returns the value of a number item
+func toNumber(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case int:
+		return float64(v), true
+	case json.Number:
+		f, err := v.Float64()
+		return f, err == nil
+	case float64:
+		return v, true
+	}
+	return 0, false
+}
+
+// isInteger reports whether a value is an integer
+func isInteger(value interface{}) bool {
+	switch reflect.ValueOf(value).Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		_, isMarshaler := value.(json.Marshaler)
+		return !isMarshaler
+	}
+	return false
+}
+
+// union merges two collections without duplicates
+func union(left, right []item) []item {
+	var result []item
+	for _, it := range append(append([]item{}, left...), right...) {
+		if !containsItem(result, it) {
+			result = append(result, it)
+		}
+	}
+	return result
+}
+
+// containsItem reports whether a collection has an item equal to the item
+func containsItem(items []item, it item) bool {
+	for _, candidate := range items {
+		if itemsEqual(candidate, it, false) {
+			return true
+		}
+	}
+	return false
+}
+
+// concatString returns the string of a collection for the & operator, empty for no items
+func concatString(items []item) string {
+	if len(items) == 0 {
+		return ""
+	}
+	return toString(items[0])
+}
+
+// toString returns the string representation of a primitive item
+func toString(it item) string {
+	switch value := it.value.(type) {
+	case string:
+		return value
+	case bool:
+		return strconv.FormatBool(value)
+	case int:
+		return strconv.Itoa(value)
+	case json.Number:
+		return value.String()
+	}
+	return fmt.Sprint(it.value)
+}
+
+// boolean returns the collection of a boolean
+func boolean(value bool) []item {
+	return []item{{value: value, typeName: "boolean"}}
+}
+
+// singleBoolean returns the boolean of a collection, ok is false for an empty collection. A single
+// item that is not a boolean is true.
+func singleBoolean(items []item) (value bool, ok bool, err error) {
+	switch len(items) {
+	case 0:
+		return false, false, nil
+	case 1:
+		if b, isBool := items[0].value.(bool); isBool {
+			return b, true, nil
+		}
+		return true, true, nil
+	default:
+		return false, false, fmt.Errorf("expected a single boolean, got %d items", len(items))
+	}
+}
+
+// singleInteger returns the integer of a collection, ok is false for an empty collection
+func singleInteger(items []item) (int, bool, error) {
+	switch len(items) {
+	case 0:
+		return 0, false, nil
+	case 1:
+		if number, ok := toNumber(items[0].value); ok && number == math.Trunc(number) {
+			return int(number), true, nil
+		}
+		return 0, false, fmt.Errorf("expected an integer, got %v", items[0].value)
+	default:
+		return 0, false, fmt.Errorf("expected a single integer, got %d items", len(items))
+	}
+}
+
+// singleString returns the string of a collection, ok is false for an empty collection
+func singleString(items []item) (string, bool, error) {
+	switch len(items) {
+	case 0:
+		return "", false, nil
+	case 1:
+		if s, ok := items[0].value.(string); ok {
+			return s, true, nil
+		}
+		return "", false, fmt.Errorf("expected a string, got %v", items[0].value)
+	default:
+		return "", false, fmt.Errorf("expected a single string, got %d items", len(items))
+	}
+}
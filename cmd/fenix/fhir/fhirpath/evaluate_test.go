@@ -0,0 +1,194 @@
+package fhirpath
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestEvaluate(t *testing.T) {
+	patient := map[string]interface{}{
+		"resourceType": "Patient",
+		"id":           "p1",
+		"gender":       "female",
+		"birthDate":    "1980-05-01",
+		"name": []interface{}{
+			map[string]interface{}{"use": "official", "family": "Smith", "given": []interface{}{"Anna", "Maria"}},
+			map[string]interface{}{"use": "nickname", "given": []interface{}{"Annie"}},
+		},
+		"telecom": []interface{}{
+			map[string]interface{}{"system": "phone", "value": "0612345678"},
+		},
+		"generalPractitioner": []interface{}{
+			map[string]interface{}{"reference": "Practitioner/pr1"},
+		},
+	}
+	observation := map[string]interface{}{
+		"resourceType":  "Observation",
+		"status":        "final",
+		"valueQuantity": map[string]interface{}{"value": json.Number("72.5"), "unit": "kg", "system": "http://unitsofmeasure.org", "code": "kg"},
+	}
+
+	tests := []struct {
+		name       string
+		expression string
+		resource   interface{}
+		want       []interface{}
+	}{
+		{"member", "Patient.gender", patient, []interface{}{"female"}},
+		{"flattened members", "Patient.name.given", patient, []interface{}{"Anna", "Maria", "Annie"}},
+		{"where", "Patient.name.where(use = 'official').family", patient, []interface{}{"Smith"}},
+		{"exists", "Patient.telecom.where(system = 'email').exists()", patient, []interface{}{false}},
+		{"count", "Patient.name.given.count()", patient, []interface{}{3}},
+		{"index", "Patient.name[1].given", patient, []interface{}{"Annie"}},
+		{"first", "Patient.name.given.first()", patient, []interface{}{"Anna"}},
+		{"union", "Patient.name.use | Patient.gender", patient, []interface{}{"official", "nickname", "female"}},
+		{"empty collection", "Patient.deceased.empty()", patient, []interface{}{true}},
+		{"implies", "Patient.name.exists() implies Patient.gender.exists()", patient, []interface{}{true}},
+		{"string concatenation", "Patient.name.first().family & ', ' & Patient.name.first().given.first()", patient, []interface{}{"Smith, Anna"}},
+		{"join", "Patient.name.given.join(', ')", patient, []interface{}{"Anna, Maria, Annie"}},
+		{"join without separator", "Patient.name.first().given.join()", patient, []interface{}{"AnnaMaria"}},
+		{"split", "'a,b,c'.split(',').count()", patient, []interface{}{3}},
+		{"date comparison", "Patient.birthDate < @2000-01-01", patient, []interface{}{true}},
+		{"iif", "iif(Patient.gender = 'male', 'M', 'F')", patient, []interface{}{"F"}},
+		{"resolve type", "Patient.generalPractitioner.where(resolve() is Practitioner).reference", patient, []interface{}{"Practitioner/pr1"}},
+		{"choice element", "Observation.value.ofType(Quantity).unit", observation, []interface{}{"kg"}},
+		{"quantity comparison", "Observation.value.ofType(Quantity) > 70 'kg'", observation, []interface{}{true}},
+		{"quantity equality", "Observation.value.ofType(Quantity) = 72.5 'kg'", observation, []interface{}{true}},
+		{"quantity with other unit", "Observation.value.ofType(Quantity) > 70 'g'", observation, nil},
+		{"calendar duration", "1 year = 1 'a'", observation, []interface{}{true}},
+		{"arithmetic", "2 + 3 * 4", patient, []interface{}{14}},
+		{"string functions", "Patient.name.first().family.upper().startsWith('SM')", patient, []interface{}{true}},
+		{"matches", "Patient.telecom.value.matches('^06[0-9]{8}$')", patient, []interface{}{true}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			expression, err := Parse(tt.expression)
+			if err != nil {
+				t.Fatalf("Parse: %v", err)
+			}
+			got, err := expression.Evaluate(tt.resource)
+			if err != nil {
+				t.Fatalf("Evaluate: %v", err)
+			}
+			if len(got) == 0 && len(tt.want) == 0 {
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestParseRejectsUnsupported(t *testing.T) {
+	for _, expression := range []string{
+		"Patient.name.unknownFunction()",
+		"Patient.name.where(",
+		"Patient.name.given.first(",
+		"Patient..name",
+	} {
+		if _, err := Parse(expression); err == nil {
+			t.Errorf("expected %q to fail to parse", expression)
+		}
+	}
+}
+
+// TestSearchParameterExpressions parses the expression of every search parameter of the repository
+// and evaluates it on an empty resource of each of its base types
+func TestSearchParameterExpressions(t *testing.T) {
+	data, err := os.ReadFile("../../../../searchParameter/search-parameter.json")
+	if err != nil {
+		t.Fatalf("failed to read search parameters: %v", err)
+	}
+	var bundle struct {
+		Entry []struct {
+			Resource struct {
+				ID         string   `json:"id"`
+				Base       []string `json:"base"`
+				Expression string   `json:"expression"`
+			} `json:"resource"`
+		} `json:"entry"`
+	}
+	if err := json.Unmarshal(data, &bundle); err != nil {
+		t.Fatalf("failed to decode search parameters: %v", err)
+	}
+
+	for _, entry := range bundle.Entry {
+		sp := entry.Resource
+		if sp.Expression == "" {
+			continue
+		}
+		t.Run(sp.ID, func(t *testing.T) {
+			expression, err := Parse(sp.Expression)
+			if err != nil {
+				t.Fatalf("Parse: %v", err)
+			}
+			for _, base := range sp.Base {
+				if _, err := expression.Evaluate(map[string]interface{}{"resourceType": base, "id": "1"}); err != nil {
+					t.Errorf("Evaluate on %s: %v", base, err)
+				}
+			}
+		})
+	}
+}
+
+// TestProfileInvariants parses the expression of every invariant of the profiles of the repository
+// and evaluates it on an empty resource of the profiled type
+func TestProfileInvariants(t *testing.T) {
+	files, err := filepath.Glob("../../../../profiles/*/*.json")
+	if err != nil || len(files) == 0 {
+		t.Fatalf("no profiles found: %v", err)
+	}
+
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatalf("failed to read %s: %v", file, err)
+		}
+		var profile struct {
+			Type     string `json:"type"`
+			Snapshot struct {
+				Element []elementConstraints `json:"element"`
+			} `json:"snapshot"`
+			Differential struct {
+				Element []elementConstraints `json:"element"`
+			} `json:"differential"`
+		}
+		if err := json.Unmarshal(data, &profile); err != nil {
+			t.Fatalf("failed to decode %s: %v", file, err)
+		}
+
+		resource := map[string]interface{}{"resourceType": profile.Type}
+		for _, element := range append(profile.Snapshot.Element, profile.Differential.Element...) {
+			for _, constraint := range element.Constraint {
+				if constraint.Expression == "" {
+					continue
+				}
+				name := strings.TrimSuffix(filepath.Base(file), ".profile.json") + "/" + element.Path + "/" + constraint.Key
+				t.Run(name, func(t *testing.T) {
+					expression, err := Parse(constraint.Expression)
+					if err != nil {
+						t.Fatalf("Parse: %v", err)
+					}
+					if _, _, err := expression.EvaluateBool(resource, resource); err != nil {
+						t.Errorf("Evaluate: %v", err)
+					}
+				})
+			}
+		}
+	}
+}
+
+// elementConstraints are the invariants of an element of a StructureDefinition
+type elementConstraints struct {
+	Path       string `json:"path"`
+	Constraint []struct {
+		Key        string `json:"key"`
+		Expression string `json:"expression"`
+	} `json:"constraint"`
+}
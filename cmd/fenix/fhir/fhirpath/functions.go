@@ -0,0 +1,546 @@
+package fhirpath
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// callFunction calls a function on the items of its target. The arguments of where, select, all,
+// exists, repeat and iif are evaluated for each item, the other arguments on the focus.
+func callFunction(n *functionNode, target []item, focus []item, env *environment) ([]item, error) {
+	switch n.name {
+	case "where", "select", "all", "exists", "repeat":
+		return iterate(n, target, env)
+	case "iif":
+		return iif(n, target, focus, env)
+	case "ofType", "as", "is":
+		if len(n.args) != 1 {
+			return nil, fmt.Errorf("%s expects a type", n.name)
+		}
+		typeName, err := typeArgument(n.args[0])
+		if err != nil {
+			return nil, err
+		}
+		if n.name == "is" {
+			if len(target) != 1 {
+				return nil, nil
+			}
+			return boolean(isType(target[0], typeName)), nil
+		}
+		return ofType(target, typeName), nil
+	}
+
+	args := make([][]item, len(n.args))
+	for i, arg := range n.args {
+		value, err := evaluate(arg, focus, env)
+		if err != nil {
+			return nil, err
+		}
+		args[i] = value
+	}
+	function, exists := functions[n.name]
+	if !exists {
+		return nil, fmt.Errorf("function %s is not supported", n.name)
+	}
+	return function(target, args)
+}
+
+// isFunction reports whether a function is supported, so unsupported functions fail when the
+// expression is parsed
+func isFunction(name string) bool {
+	switch name {
+	case "where", "select", "all", "exists", "repeat", "iif", "ofType", "as", "is":
+		return true
+	}
+	_, exists := functions[name]
+	return exists
+}
+
+// functions are the functions with arguments that are evaluated before the call
+var functions map[string]func(target []item, args [][]item) ([]item, error)
+
+func init() {
+	functions = map[string]func(target []item, args [][]item) ([]item, error){
+		"empty": func(target []item, _ [][]item) ([]item, error) {
+			return boolean(len(target) == 0), nil
+		},
+		"not": func(target []item, _ [][]item) ([]item, error) {
+			value, ok, err := singleBoolean(target)
+			if err != nil || !ok {
+				return nil, err
+			}
+			return boolean(!value), nil
+		},
+		"count": func(target []item, _ [][]item) ([]item, error) {
+			return []item{{value: len(target), typeName: "integer"}}, nil
+		},
+		"distinct": func(target []item, _ [][]item) ([]item, error) {
+			return union(target, nil), nil
+		},
+		"isDistinct": func(target []item, _ [][]item) ([]item, error) {
+			return boolean(len(union(target, nil)) == len(target)), nil
+		},
+		"allTrue":  booleanAggregate(true, true),
+		"anyTrue":  booleanAggregate(true, false),
+		"allFalse": booleanAggregate(false, true),
+		"anyFalse": booleanAggregate(false, false),
+		"subsetOf": func(target []item, args [][]item) ([]item, error) {
+			return boolean(subsetOf(target, argument(args, 0))), nil
+		},
+		"supersetOf": func(target []item, args [][]item) ([]item, error) {
+			return boolean(subsetOf(argument(args, 0), target)), nil
+		},
+		"single": func(target []item, _ [][]item) ([]item, error) {
+			if len(target) > 1 {
+				return nil, fmt.Errorf("single expects at most one item, got %d", len(target))
+			}
+			return target, nil
+		},
+		"first": func(target []item, _ [][]item) ([]item, error) {
+			return sliceItems(target, 0, 1), nil
+		},
+		"last": func(target []item, _ [][]item) ([]item, error) {
+			return sliceItems(target, len(target)-1, len(target)), nil
+		},
+		"tail": func(target []item, _ [][]item) ([]item, error) {
+			return sliceItems(target, 1, len(target)), nil
+		},
+		"skip": func(target []item, args [][]item) ([]item, error) {
+			count, _, err := singleInteger(argument(args, 0))
+			return sliceItems(target, count, len(target)), err
+		},
+		"take": func(target []item, args [][]item) ([]item, error) {
+			count, _, err := singleInteger(argument(args, 0))
+			return sliceItems(target, 0, count), err
+		},
+		"union": func(target []item, args [][]item) ([]item, error) {
+			return union(target, argument(args, 0)), nil
+		},
+		"combine": func(target []item, args [][]item) ([]item, error) {
+			return append(append([]item{}, target...), argument(args, 0)...), nil
+		},
+		"intersect": func(target []item, args [][]item) ([]item, error) {
+			var result []item
+			for _, it := range union(target, nil) {
+				if containsItem(argument(args, 0), it) {
+					result = append(result, it)
+				}
+			}
+			return result, nil
+		},
+		"exclude": func(target []item, args [][]item) ([]item, error) {
+			var result []item
+			for _, it := range target {
+				if !containsItem(argument(args, 0), it) {
+					result = append(result, it)
+				}
+			}
+			return result, nil
+		},
+		"children": func(target []item, _ [][]item) ([]item, error) {
+			var result []item
+			for _, it := range target {
+				result = append(result, allChildren(it)...)
+			}
+			return result, nil
+		},
+		"descendants": func(target []item, _ [][]item) ([]item, error) {
+			var result []item
+			for next := target; len(next) > 0; {
+				var level []item
+				for _, it := range next {
+					level = append(level, allChildren(it)...)
+				}
+				result = append(result, level...)
+				next = level
+			}
+			return result, nil
+		},
+		"hasValue": func(target []item, _ [][]item) ([]item, error) {
+			return boolean(len(target) == 1 && isPrimitive(target[0])), nil
+		},
+		"getValue": func(target []item, _ [][]item) ([]item, error) {
+			if len(target) == 1 && isPrimitive(target[0]) {
+				return target, nil
+			}
+			return nil, nil
+		},
+		"extension": func(target []item, args [][]item) ([]item, error) {
+			url, _, err := singleString(argument(args, 0))
+			if err != nil {
+				return nil, err
+			}
+			var result []item
+			for _, extension := range children(target, "extension") {
+				if values := childItems(extension, "url"); len(values) == 1 && values[0].value == url {
+					result = append(result, extension)
+				}
+			}
+			return result, nil
+		},
+		"resolve": func(target []item, _ [][]item) ([]item, error) {
+			// References are not resolved, a reference is typed as the resource type it refers to so
+			// resolve() is Patient can be answered
+			var result []item
+			for _, it := range target {
+				reference, _ := it.value.(string)
+				if values := childItems(it, "reference"); len(values) == 1 {
+					reference = toString(values[0])
+				}
+				if resourceType := referenceType(reference); resourceType != "" {
+					result = append(result, item{value: it.value, typeName: resourceType})
+				}
+			}
+			return result, nil
+		},
+		"trace": func(target []item, _ [][]item) ([]item, error) {
+			return target, nil
+		},
+		"htmlChecks": func(target []item, _ [][]item) ([]item, error) {
+			// The xhtml of narratives is not checked
+			return boolean(true), nil
+		},
+		"today": func(_ []item, _ [][]item) ([]item, error) {
+			return []item{{value: time.Now().Format("2006-01-02"), typeName: "date"}}, nil
+		},
+		"now": func(_ []item, _ [][]item) ([]item, error) {
+			return []item{{value: time.Now().Format(time.RFC3339), typeName: "dateTime"}}, nil
+		},
+		"toString": func(target []item, _ [][]item) ([]item, error) {
+			if len(target) != 1 {
+				return nil, nil
+			}
+			return []item{{value: toString(target[0]), typeName: "string"}}, nil
+		},
+		"toInteger": func(target []item, _ [][]item) ([]item, error) {
+			if len(target) != 1 {
+				return nil, nil
+			}
+			number, err := strconv.Atoi(toString(target[0]))
+			if err != nil {
+				return nil, nil
+			}
+			return []item{{value: number, typeName: "integer"}}, nil
+		},
+		"toDecimal": func(target []item, _ [][]item) ([]item, error) {
+			if len(target) != 1 {
+				return nil, nil
+			}
+			if _, err := strconv.ParseFloat(toString(target[0]), 64); err != nil {
+				return nil, nil
+			}
+			return []item{{value: json.Number(toString(target[0])), typeName: "decimal"}}, nil
+		},
+		"length":     stringFunction(func(s string, _ []string) interface{} { return len([]rune(s)) }),
+		"upper":      stringFunction(func(s string, _ []string) interface{} { return strings.ToUpper(s) }),
+		"lower":      stringFunction(func(s string, _ []string) interface{} { return strings.ToLower(s) }),
+		"trim":       stringFunction(func(s string, _ []string) interface{} { return strings.TrimSpace(s) }),
+		"startsWith": stringFunction(func(s string, args []string) interface{} { return strings.HasPrefix(s, args[0]) }),
+		"endsWith":   stringFunction(func(s string, args []string) interface{} { return strings.HasSuffix(s, args[0]) }),
+		"contains":   stringFunction(func(s string, args []string) interface{} { return strings.Contains(s, args[0]) }),
+		"indexOf":    stringFunction(func(s string, args []string) interface{} { return strings.Index(s, args[0]) }),
+		"replace":    stringFunction(func(s string, args []string) interface{} { return strings.ReplaceAll(s, args[0], args[1]) }),
+		"matches":    regexFunction(func(pattern *regexp.Regexp, s string, _ []string) interface{} { return pattern.MatchString(s) }),
+		"replaceMatches": regexFunction(func(pattern *regexp.Regexp, s string, args []string) interface{} {
+			return pattern.ReplaceAllString(s, args[0])
+		}),
+		"join": func(target []item, args [][]item) ([]item, error) {
+			separator, _, err := singleString(argument(args, 0))
+			if err != nil {
+				return nil, err
+			}
+			values := make([]string, len(target))
+			for i, it := range target {
+				values[i] = toString(it)
+			}
+			return []item{{value: strings.Join(values, separator), typeName: "string"}}, nil
+		},
+		"split": func(target []item, args [][]item) ([]item, error) {
+			s, ok, err := singleString(target)
+			if err != nil || !ok {
+				return nil, err
+			}
+			separator, _, err := singleString(argument(args, 0))
+			if err != nil {
+				return nil, err
+			}
+			var result []item
+			for _, part := range strings.Split(s, separator) {
+				result = append(result, item{value: part, typeName: "string"})
+			}
+			return result, nil
+		},
+		"substring": func(target []item, args [][]item) ([]item, error) {
+			s, ok, err := singleString(target)
+			if err != nil || !ok {
+				return nil, err
+			}
+			runes := []rune(s)
+			start, ok, err := singleInteger(argument(args, 0))
+			if err != nil || !ok || start < 0 || start >= len(runes) {
+				return nil, err
+			}
+			end := len(runes)
+			if length, ok, err := singleInteger(argument(args, 1)); err != nil {
+				return nil, err
+			} else if ok && start+length < end {
+				end = start + length
+			}
+			return []item{{value: string(runes[start:end]), typeName: "string"}}, nil
+		},
+	}
+}
+
+// iterate evaluates the functions with an expression that is evaluated for each item
+func iterate(n *functionNode, target []item, env *environment) ([]item, error) {
+	if len(n.args) == 0 {
+		switch n.name {
+		case "exists":
+			return boolean(len(target) > 0), nil
+		case "all":
+			return boolean(true), nil
+		}
+		return nil, fmt.Errorf("%s expects an expression", n.name)
+	}
+
+	evaluateFor := func(it item, index int) ([]item, error) {
+		itemEnv := *env
+		itemEnv.this, itemEnv.index = &it, index
+		return evaluate(n.args[0], []item{it}, &itemEnv)
+	}
+
+	var result []item
+	switch n.name {
+	case "where", "exists", "all":
+		for i, it := range target {
+			value, err := evaluateFor(it, i)
+			if err != nil {
+				return nil, err
+			}
+			passed, ok, err := singleBoolean(value)
+			if err != nil {
+				return nil, err
+			}
+			switch {
+			case n.name == "all" && (!ok || !passed):
+				return boolean(false), nil
+			case n.name == "exists" && ok && passed:
+				return boolean(true), nil
+			case n.name == "where" && ok && passed:
+				result = append(result, it)
+			}
+		}
+		switch n.name {
+		case "all":
+			return boolean(true), nil
+		case "exists":
+			return boolean(false), nil
+		}
+		return result, nil
+
+	case "select":
+		for i, it := range target {
+			value, err := evaluateFor(it, i)
+			if err != nil {
+				return nil, err
+			}
+			result = append(result, value...)
+		}
+		return result, nil
+
+	default: // repeat
+		for next := target; len(next) > 0; {
+			var level []item
+			for i, it := range next {
+				value, err := evaluateFor(it, i)
+				if err != nil {
+					return nil, err
+				}
+				for _, child := range value {
+					if !containsItem(result, child) {
+						level = append(level, child)
+						result = append(result, child)
+					}
+				}
+			}
+			next = level
+		}
+		return result, nil
+	}
+}
+
+// iif evaluates the true or otherwise result depending on a criterion
+func iif(n *functionNode, target []item, focus []item, env *environment) ([]item, error) {
+	if len(n.args) < 2 {
+		return nil, fmt.Errorf("iif expects a criterion and a result")
+	}
+	if n.target != nil {
+		focus = target
+	}
+	criterion, err := evaluate(n.args[0], focus, env)
+	if err != nil {
+		return nil, err
+	}
+	passed, ok, err := singleBoolean(criterion)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case ok && passed:
+		return evaluate(n.args[1], focus, env)
+	case len(n.args) > 2:
+		return evaluate(n.args[2], focus, env)
+	}
+	return nil, nil
+}
+
+// typeArgument returns the type name of the argument of ofType, as and is
+func typeArgument(arg node) (string, error) {
+	switch arg := arg.(type) {
+	case *memberNode:
+		if arg.target == nil {
+			return arg.name, nil
+		}
+		qualifier, err := typeArgument(arg.target)
+		return qualifier + "." + arg.name, err
+	}
+	return "", fmt.Errorf("expected a type name")
+}
+
+// booleanAggregate returns allTrue, anyTrue, allFalse or anyFalse
+func booleanAggregate(expected bool, all bool) func([]item, [][]item) ([]item, error) {
+	return func(target []item, _ [][]item) ([]item, error) {
+		for _, it := range target {
+			value, _ := it.value.(bool)
+			if all && value != expected {
+				return boolean(false), nil
+			}
+			if !all && value == expected {
+				return boolean(true), nil
+			}
+		}
+		return boolean(all), nil
+	}
+}
+
+// stringFunction returns a function on a single string with string arguments
+func stringFunction(function func(s string, args []string) interface{}) func([]item, [][]item) ([]item, error) {
+	return func(target []item, args [][]item) ([]item, error) {
+		s, ok, err := singleString(target)
+		if err != nil || !ok {
+			return nil, err
+		}
+		var values []string
+		for _, arg := range args {
+			value, ok, err := singleString(arg)
+			if err != nil || !ok {
+				return nil, err
+			}
+			values = append(values, value)
+		}
+		return resultItem(function(s, values)), nil
+	}
+}
+
+// regexFunction returns a function on a single string with a regular expression as first argument
+func regexFunction(function func(pattern *regexp.Regexp, s string, args []string) interface{}) func([]item, [][]item) ([]item, error) {
+	return stringFunction(func(s string, args []string) interface{} {
+		if len(args) == 0 {
+			return nil
+		}
+		pattern, err := regexp.Compile(args[0])
+		if err != nil {
+			return nil
+		}
+		return function(pattern, s, args[1:])
+	})
+}
+
+// resultItem returns the item of the result of a string function
+func resultItem(value interface{}) []item {
+	switch value := value.(type) {
+	case bool:
+		return boolean(value)
+	case int:
+		return []item{{value: value, typeName: "integer"}}
+	case string:
+		return []item{{value: value, typeName: "string"}}
+	}
+	return nil
+}
+
+// argument returns an argument of a function, or an empty collection when it was not given
+func argument(args [][]item, index int) []item {
+	if index < len(args) {
+		return args[index]
+	}
+	return nil
+}
+
+// sliceItems returns the items from start up to end, within the bounds of the collection
+func sliceItems(items []item, start, end int) []item {
+	start = max(start, 0)
+	end = min(end, len(items))
+	if start >= end {
+		return nil
+	}
+	return items[start:end]
+}
+
+// subsetOf reports whether every item of a collection is in the other collection
+func subsetOf(items, other []item) bool {
+	for _, it := range items {
+		if !containsItem(other, it) {
+			return false
+		}
+	}
+	return true
+}
+
+// allChildren returns the children of all elements of an item
+func allChildren(it item) []item {
+	var result []item
+	switch value := it.value.(type) {
+	case map[string]interface{}:
+		for key, child := range value {
+			if key != "resourceType" {
+				result = append(result, toItems(child, "")...)
+			}
+		}
+		return result
+	}
+	if isPrimitive(it) {
+		return nil
+	}
+	for _, name := range fieldNames(it.value) {
+		result = append(result, childItems(it, name)...)
+	}
+	return result
+}
+
+// isPrimitive reports whether an item is a primitive value rather than an element with children
+func isPrimitive(it item) bool {
+	switch it.value.(type) {
+	case string, bool, int, json.Number:
+		return true
+	}
+	return false
+}
+
+// referenceType returns the resource type of a relative or absolute reference, e.g. Patient for
+// Patient/123 or http://example.org/fhir/Patient/123/_history/1
+func referenceType(reference string) string {
+	segments := strings.Split(strings.Split(reference, "/_history/")[0], "/")
+	if len(segments) < 2 {
+		return ""
+	}
+	resourceType := segments[len(segments)-2]
+	if !isTypeName(resourceType) {
+		return ""
+	}
+	return resourceType
+}
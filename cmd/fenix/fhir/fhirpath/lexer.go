@@ -0,0 +1,176 @@
+package fhirpath
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// tokenKind is the kind of a token of a FHIRPath expression
+type tokenKind int
+
+const (
+	tokenEOF        tokenKind = iota
+	tokenIdentifier           // name, `delimited name` or keyword, e.g. where, and
+	tokenString               // 'text'
+	tokenNumber               // 12 or 1.5
+	tokenDateTime             // @2020-01-01, @2020-01-01T10:00 or @T10:00
+	tokenVariable             // %resource, $this
+	tokenOperator             // . , ( ) [ ] { } | = != ~ !~ < > <= >= + - * / &
+)
+
+// token is a lexical element of a FHIRPath expression
+type token struct {
+	kind  tokenKind
+	text  string
+	quote bool // identifier was delimited by backticks and is never a keyword
+}
+
+// twoCharOperators are the operators of two characters, they take precedence over their first character
+var twoCharOperators = map[string]bool{"!=": true, "!~": true, "<=": true, ">=": true}
+
+// tokenize splits a FHIRPath expression into tokens
+func tokenize(expression string) ([]token, error) {
+	var tokens []token
+	runes := []rune(expression)
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+
+		case r == '/' && i+1 < len(runes) && runes[i+1] == '/':
+			for i < len(runes) && runes[i] != '\n' {
+				i++
+			}
+
+		case r == '/' && i+1 < len(runes) && runes[i+1] == '*':
+			end := i + 2
+			for end+1 < len(runes) && (runes[end] != '*' || runes[end+1] != '/') {
+				end++
+			}
+			if end+1 >= len(runes) {
+				return nil, fmt.Errorf("unterminated comment")
+			}
+			i = end + 2
+
+		case r == '\'' || r == '`':
+			text, next, err := readQuoted(runes, i)
+			if err != nil {
+				return nil, err
+			}
+			if r == '\'' {
+				tokens = append(tokens, token{kind: tokenString, text: text})
+			} else {
+				tokens = append(tokens, token{kind: tokenIdentifier, text: text, quote: true})
+			}
+			i = next
+
+		case r == '@':
+			start := i + 1
+			i = start
+			for i < len(runes) && (unicode.IsDigit(runes[i]) || strings.ContainsRune("-:.TZ+", runes[i])) {
+				i++
+			}
+			tokens = append(tokens, token{kind: tokenDateTime, text: string(runes[start:i])})
+
+		case unicode.IsDigit(r):
+			start := i
+			for i < len(runes) && unicode.IsDigit(runes[i]) {
+				i++
+			}
+			if i+1 < len(runes) && runes[i] == '.' && unicode.IsDigit(runes[i+1]) {
+				i++
+				for i < len(runes) && unicode.IsDigit(runes[i]) {
+					i++
+				}
+			}
+			tokens = append(tokens, token{kind: tokenNumber, text: string(runes[start:i])})
+
+		case r == '%' || r == '$':
+			start := i
+			i++
+			if i < len(runes) && runes[i] == '`' {
+				text, next, err := readQuoted(runes, i)
+				if err != nil {
+					return nil, err
+				}
+				tokens = append(tokens, token{kind: tokenVariable, text: string(r) + text})
+				i = next
+				continue
+			}
+			for i < len(runes) && isIdentifierRune(runes[i]) {
+				i++
+			}
+			tokens = append(tokens, token{kind: tokenVariable, text: string(runes[start:i])})
+
+		case isIdentifierRune(r):
+			start := i
+			for i < len(runes) && isIdentifierRune(runes[i]) {
+				i++
+			}
+			tokens = append(tokens, token{kind: tokenIdentifier, text: string(runes[start:i])})
+
+		default:
+			if i+1 < len(runes) && twoCharOperators[string(runes[i:i+2])] {
+				tokens = append(tokens, token{kind: tokenOperator, text: string(runes[i : i+2])})
+				i += 2
+				continue
+			}
+			if !strings.ContainsRune(".,()[]{}|=~<>+-*/&", r) {
+				return nil, fmt.Errorf("unexpected character %q at position %d", r, i)
+			}
+			tokens = append(tokens, token{kind: tokenOperator, text: string(r)})
+			i++
+		}
+	}
+	return append(tokens, token{kind: tokenEOF}), nil
+}
+
+// readQuoted reads a string or delimited identifier starting at its opening quote and returns its
+// unescaped text and the position after the closing quote
+func readQuoted(runes []rune, start int) (string, int, error) {
+	quote := runes[start]
+	var text strings.Builder
+	for i := start + 1; i < len(runes); i++ {
+		switch runes[i] {
+		case quote:
+			return text.String(), i + 1, nil
+		case '\\':
+			i++
+			if i == len(runes) {
+				break
+			}
+			switch runes[i] {
+			case 'n':
+				text.WriteRune('\n')
+			case 'r':
+				text.WriteRune('\r')
+			case 't':
+				text.WriteRune('\t')
+			case 'f':
+				text.WriteRune('\f')
+			case 'u':
+				if i+4 < len(runes) {
+					var code rune
+					if _, err := fmt.Sscanf(string(runes[i+1:i+5]), "%04x", &code); err == nil {
+						text.WriteRune(code)
+						i += 4
+						continue
+					}
+				}
+				text.WriteRune('u')
+			default:
+				text.WriteRune(runes[i])
+			}
+		default:
+			text.WriteRune(runes[i])
+		}
+	}
+	return "", 0, fmt.Errorf("unterminated %c at position %d", quote, start)
+}
+
+// isIdentifierRune reports whether a rune can be part of an identifier
+func isIdentifierRune(r rune) bool {
+	return r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r)
+}
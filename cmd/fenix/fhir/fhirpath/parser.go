@@ -0,0 +1,354 @@
+package fhirpath
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// node is a node of the syntax tree of a FHIRPath expression
+type node interface{}
+
+// literalNode is a literal, {} is the empty collection
+type literalNode struct {
+	items []item
+}
+
+// memberNode selects the children of a name from the items of its target, or of the focus
+type memberNode struct {
+	target node // nil for the focus
+	name   string
+}
+
+// functionNode calls a function on the items of its target, or on the focus
+type functionNode struct {
+	target node // nil for the focus
+	name   string
+	args   []node
+}
+
+// indexNode selects an item of a collection by its position
+type indexNode struct {
+	target node
+	index  node
+}
+
+// variableNode is an environment variable (%resource) or a special variable ($this)
+type variableNode struct {
+	name string
+}
+
+// unaryNode is a polarity operator
+type unaryNode struct {
+	operator string
+	operand  node
+}
+
+// binaryNode is an operator with two operands
+type binaryNode struct {
+	operator    string
+	left, right node
+}
+
+// typeNode is the is or as operator
+type typeNode struct {
+	operator string
+	operand  node
+	typeName string
+}
+
+// operatorLevels are the binary operators by precedence, lowest first
+var operatorLevels = [][]string{
+	{"implies"},
+	{"or", "xor"},
+	{"and"},
+	{"in", "contains"},
+	{"=", "~", "!=", "!~"},
+	{"<=", "<", ">", ">="},
+	{"|"},
+	{"is", "as"},
+	{"+", "-", "&"},
+	{"*", "/", "div", "mod"},
+}
+
+// parser builds the syntax tree of a FHIRPath expression from its tokens
+type parser struct {
+	tokens   []token
+	position int
+}
+
+// parse parses a FHIRPath expression
+func parse(expression string) (node, error) {
+	tokens, err := tokenize(expression)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{tokens: tokens}
+	tree, err := p.parseLevel(0)
+	if err != nil {
+		return nil, err
+	}
+	if next := p.peek(); next.kind != tokenEOF {
+		return nil, fmt.Errorf("unexpected %q", next.text)
+	}
+	return tree, nil
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.position]
+}
+
+func (p *parser) next() token {
+	t := p.tokens[p.position]
+	if t.kind != tokenEOF {
+		p.position++
+	}
+	return t
+}
+
+// accept consumes the next token when it is the operator
+func (p *parser) accept(operator string) bool {
+	if t := p.peek(); t.kind == tokenOperator && t.text == operator {
+		p.position++
+		return true
+	}
+	return false
+}
+
+func (p *parser) expect(operator string) error {
+	if !p.accept(operator) {
+		return fmt.Errorf("expected %q, got %q", operator, p.peek().text)
+	}
+	return nil
+}
+
+// binaryOperator returns the operator of a level the next token is, keywords are only operators
+// when they are not delimited
+func (p *parser) binaryOperator(level int) (string, bool) {
+	t := p.peek()
+	if t.kind != tokenOperator && (t.kind != tokenIdentifier || t.quote) {
+		return "", false
+	}
+	for _, operator := range operatorLevels[level] {
+		if t.text == operator {
+			return operator, true
+		}
+	}
+	return "", false
+}
+
+// parseLevel parses the binary operators of a precedence level and the levels above it
+func (p *parser) parseLevel(level int) (node, error) {
+	if level == len(operatorLevels) {
+		return p.parseUnary()
+	}
+
+	left, err := p.parseLevel(level + 1)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		operator, ok := p.binaryOperator(level)
+		if !ok {
+			return left, nil
+		}
+		p.next()
+
+		if operator == "is" || operator == "as" {
+			typeName, err := p.parseTypeSpecifier()
+			if err != nil {
+				return nil, err
+			}
+			left = &typeNode{operator: operator, operand: left, typeName: typeName}
+			continue
+		}
+
+		right, err := p.parseLevel(level + 1)
+		if err != nil {
+			return nil, err
+		}
+		left = &binaryNode{operator: operator, left: left, right: right}
+	}
+}
+
+// parseTypeSpecifier parses a type name, qualified or not, e.g. Quantity or FHIR.Quantity
+func (p *parser) parseTypeSpecifier() (string, error) {
+	t := p.next()
+	if t.kind != tokenIdentifier {
+		return "", fmt.Errorf("expected type name, got %q", t.text)
+	}
+	name := t.text
+	for p.accept(".") {
+		t = p.next()
+		if t.kind != tokenIdentifier {
+			return "", fmt.Errorf("expected type name, got %q", t.text)
+		}
+		name += "." + t.text
+	}
+	return name, nil
+}
+
+func (p *parser) parseUnary() (node, error) {
+	for _, operator := range []string{"+", "-"} {
+		if p.accept(operator) {
+			operand, err := p.parseUnary()
+			if err != nil {
+				return nil, err
+			}
+			return &unaryNode{operator: operator, operand: operand}, nil
+		}
+	}
+	return p.parsePostfix()
+}
+
+// parsePostfix parses a term followed by invocations and indexers
+func (p *parser) parsePostfix() (node, error) {
+	term, err := p.parseTerm()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		switch {
+		case p.accept("."):
+			term, err = p.parseInvocation(term)
+			if err != nil {
+				return nil, err
+			}
+		case p.accept("["):
+			index, err := p.parseLevel(0)
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect("]"); err != nil {
+				return nil, err
+			}
+			term = &indexNode{target: term, index: index}
+		default:
+			return term, nil
+		}
+	}
+}
+
+func (p *parser) parseTerm() (node, error) {
+	t := p.peek()
+	switch t.kind {
+	case tokenString:
+		p.next()
+		return &literalNode{items: []item{{value: t.text, typeName: "string"}}}, nil
+	case tokenNumber:
+		p.next()
+		if unit := p.peek(); unit.kind == tokenString || isCalendarUnit(unit) {
+			p.next()
+			return &literalNode{items: []item{quantityLiteral(t.text, unit)}}, nil
+		}
+		if strings.Contains(t.text, ".") {
+			return &literalNode{items: []item{{value: json.Number(t.text), typeName: "decimal"}}}, nil
+		}
+		number, err := strconv.Atoi(t.text)
+		if err != nil {
+			return nil, fmt.Errorf("invalid integer %s", t.text)
+		}
+		return &literalNode{items: []item{{value: number, typeName: "integer"}}}, nil
+	case tokenDateTime:
+		p.next()
+		return &literalNode{items: []item{dateTimeLiteral(t.text)}}, nil
+	case tokenVariable:
+		p.next()
+		return &variableNode{name: t.text}, nil
+	case tokenIdentifier:
+		if !t.quote && (t.text == "true" || t.text == "false") {
+			p.next()
+			return &literalNode{items: []item{{value: t.text == "true", typeName: "boolean"}}}, nil
+		}
+		return p.parseInvocation(nil)
+	case tokenOperator:
+		switch {
+		case p.accept("("):
+			inner, err := p.parseLevel(0)
+			if err != nil {
+				return nil, err
+			}
+			return inner, p.expect(")")
+		case p.accept("{"):
+			return &literalNode{}, p.expect("}")
+		}
+	}
+	return nil, fmt.Errorf("unexpected %q", t.text)
+}
+
+// parseInvocation parses a member or function invocation on a target
+func (p *parser) parseInvocation(target node) (node, error) {
+	t := p.next()
+	if t.kind == tokenVariable && strings.HasPrefix(t.text, "$") && target == nil {
+		return &variableNode{name: t.text}, nil
+	}
+	if t.kind != tokenIdentifier {
+		return nil, fmt.Errorf("expected name, got %q", t.text)
+	}
+	if !p.accept("(") {
+		return &memberNode{target: target, name: t.text}, nil
+	}
+
+	if !isFunction(t.text) {
+		return nil, fmt.Errorf("function %s is not supported", t.text)
+	}
+	function := &functionNode{target: target, name: t.text}
+	if p.accept(")") {
+		return function, nil
+	}
+	for {
+		arg, err := p.parseLevel(0)
+		if err != nil {
+			return nil, err
+		}
+		function.args = append(function.args, arg)
+		if p.accept(")") {
+			return function, nil
+		}
+		if err := p.expect(","); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// calendarUnits are the UCUM codes of the calendar duration units
+var calendarUnits = map[string]string{
+	"year": "a", "month": "mo", "week": "wk", "day": "d", "hour": "h", "minute": "min", "second": "s", "millisecond": "ms",
+}
+
+// isCalendarUnit reports whether a token is a calendar duration unit of a quantity literal, e.g. 1 year
+func isCalendarUnit(t token) bool {
+	if t.kind != tokenIdentifier || t.quote {
+		return false
+	}
+	_, exists := calendarUnits[strings.TrimSuffix(t.text, "s")]
+	return exists
+}
+
+// quantityLiteral returns the item of a quantity literal, e.g. 4 'mg' or 1 year. The item has the
+// json form of a Quantity with the unit as UCUM code.
+func quantityLiteral(number string, unit token) item {
+	code := unit.text
+	if unit.kind == tokenIdentifier {
+		code = calendarUnits[strings.TrimSuffix(unit.text, "s")]
+	}
+	return item{value: map[string]interface{}{
+		"value":  json.Number(number),
+		"unit":   unit.text,
+		"system": "http://unitsofmeasure.org",
+		"code":   code,
+	}, typeName: "Quantity"}
+}
+
+// dateTimeLiteral returns the item of a date, dateTime or time literal, e.g. @2020-01-01 or @T10:00
+func dateTimeLiteral(text string) item {
+	switch {
+	case strings.HasPrefix(text, "T"):
+		return item{value: text[1:], typeName: "time"}
+	case strings.Contains(text, "T"):
+		return item{value: strings.TrimSuffix(text, "T"), typeName: "dateTime"}
+	default:
+		return item{value: text, typeName: "date"}
+	}
+}
@@ -0,0 +1,68 @@
+package fhirpath
+
+// Path is an element path an expression selects, e.g. Observation.value as Quantity
+type Path struct {
+	Path string // element path from the type the expression starts with, e.g. Observation.value
+	Type string // type the expression restricts the element to, e.g. Quantity
+}
+
+// Paths returns the element paths the expression selects, e.g. to index search parameters. Filters
+// such as where() are left out, paths through other functions are not returned.
+func (e *Expression) Paths() []Path {
+	return paths(e.tree)
+}
+
+func paths(n node) []Path {
+	switch n := n.(type) {
+	case *binaryNode:
+		if n.operator == "|" {
+			return append(paths(n.left), paths(n.right)...)
+		}
+
+	case *memberNode:
+		if n.target == nil {
+			return []Path{{Path: n.name}}
+		}
+		var result []Path
+		for _, target := range paths(n.target) {
+			result = append(result, Path{Path: target.Path + "." + n.name})
+		}
+		return result
+
+	case *typeNode:
+		if n.operator == "as" {
+			return typedPaths(paths(n.operand), n.typeName)
+		}
+
+	case *functionNode:
+		if n.target == nil {
+			return nil
+		}
+		switch n.name {
+		case "where", "first", "last", "single", "distinct", "trace":
+			return paths(n.target)
+		case "as", "ofType":
+			if len(n.args) == 1 {
+				if typeName, err := typeArgument(n.args[0]); err == nil {
+					return typedPaths(paths(n.target), typeName)
+				}
+			}
+		case "extension":
+			var result []Path
+			for _, target := range paths(n.target) {
+				result = append(result, Path{Path: target.Path + ".extension"})
+			}
+			return result
+		}
+	}
+	return nil
+}
+
+// typedPaths restricts paths to a type
+func typedPaths(targets []Path, typeName string) []Path {
+	result := make([]Path, 0, len(targets))
+	for _, target := range targets {
+		result = append(result, Path{Path: target.Path, Type: typeName})
+	}
+	return result
+}
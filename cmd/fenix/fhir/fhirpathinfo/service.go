@@ -2,13 +2,18 @@ package fhirpathinfo
 
 import (
 	"fmt"
+	"strings"
 
 	"github.com/SanteonNL/fenix/cmd/fenix/fhir/conceptmap"
+	"github.com/SanteonNL/fenix/cmd/fenix/fhir/fhirpath"
 	"github.com/SanteonNL/fenix/cmd/fenix/fhir/searchparameter"
 	"github.com/SanteonNL/fenix/cmd/fenix/fhir/structuredefinition"
 	"github.com/rs/zerolog"
 )
 
+// baseProfilePrefix is the canonical url of the base definitions of the resource types
+const baseProfilePrefix = "http://hl7.org/fhir/StructureDefinition/"
+
 // NewPathInfoService creates a new PathInfoService
 func NewPathInfoService(
 	structDefService *structuredefinition.StructureDefinitionService,
@@ -20,23 +25,32 @@ func NewPathInfoService(
 		structDefService:   structDefService,
 		searchParamService: searchParamService,
 		conceptMapService:  conceptMapService,
-		pathIndex:          make(map[string]*PathInfo),
+		pathIndex:          make(map[string]map[string]*PathInfo),
 		log:                log,
 	}
 }
 
-// GetPathInfo returns complete information for a path
-func (svc *PathInfoService) GetPathInfo(path string) (*PathInfo, error) {
-	info, exists := svc.pathIndex[path]
-	if !exists {
-		return nil, fmt.Errorf("no information found for path: %s", path)
+// GetPathInfo returns complete information for an element of a profile. Without a profile, or when
+// the profile is not indexed or does not have the element, the base definition of the resource type is used.
+func (svc *PathInfoService) GetPathInfo(profile, path string) (*PathInfo, error) {
+	profile = strings.SplitN(profile, "|", 2)[0]
+	if info, exists := svc.pathIndex[profile][path]; exists {
+		return info, nil
+	}
+
+	// The binding of the base definition only applies when the profile does not define the element otherwise
+	base := baseProfilePrefix + strings.SplitN(path, ".", 2)[0]
+	if valueSet, err := svc.structDefService.GetBindingValueSet(profile, path); err == nil {
+		if info, exists := svc.pathIndex[base][path]; exists && info.ValueSet == valueSet {
+			return info, nil
+		}
 	}
-	return info, nil
+	return nil, fmt.Errorf("no information found for path %s of profile %s", path, profile)
 }
 
 // GetSearchTypeByCode returns the search type for a specific path and code
 func (svc *PathInfoService) GetSearchTypeByCode(path, code string) (string, error) {
-	info, err := svc.GetPathInfo(path)
+	info, err := svc.GetPathInfo("", path)
 	if err != nil {
 		return "", err
 	}
@@ -49,9 +63,9 @@ func (svc *PathInfoService) GetSearchTypeByCode(path, code string) (string, erro
 	return searchType, nil
 }
 
-// GetValueSet returns the ValueSet URL binding  for a path
-func (svc *PathInfoService) GetValueSet(path string) (string, error) {
-	info, err := svc.GetPathInfo(path)
+// GetValueSet returns the ValueSet URL binding for an element of a profile
+func (svc *PathInfoService) GetValueSet(profile, path string) (string, error) {
+	info, err := svc.GetPathInfo(profile, path)
 	if err != nil {
 		return "", err
 	}
@@ -65,15 +79,15 @@ func (svc *PathInfoService) GetValueSet(path string) (string, error) {
 
 // BuildIndex creates the unified path index
 func (svc *PathInfoService) BuildIndex() error {
-	svc.pathIndex = make(map[string]*PathInfo)
+	svc.pathIndex = make(map[string]map[string]*PathInfo)
 
 	// Process structure definitions for ValueSet bindings
 	structDefs := svc.structDefService.GetAllStructureDefinitions()
 	for _, sd := range structDefs {
 		// First get ValueSet bindings from StructureDefinition service
-		bindings := svc.structDefService.GetAllPathBindings(sd)
+		bindings := svc.structDefService.GetElementBindings(sd)
 		for path, valueSetURL := range bindings {
-			info := svc.getOrCreatePathInfo(path)
+			info := svc.getOrCreatePathInfo(sd.Url, path)
 			info.ValueSet = valueSetURL
 
 			// Then find all ConceptMaps that reference this ValueSet
@@ -98,23 +112,28 @@ func (svc *PathInfoService) BuildIndex() error {
 	return nil
 }
 
-// getOrCreatePathInfo gets or creates a PathInfo for a path
-func (svc *PathInfoService) getOrCreatePathInfo(path string) *PathInfo {
-	if info, exists := svc.pathIndex[path]; exists {
+// getOrCreatePathInfo gets or creates a PathInfo for an element of a profile
+func (svc *PathInfoService) getOrCreatePathInfo(profile, path string) *PathInfo {
+	profile = strings.SplitN(profile, "|", 2)[0]
+	if info, exists := svc.pathIndex[profile][path]; exists {
 		return info
 	}
+	if svc.pathIndex[profile] == nil {
+		svc.pathIndex[profile] = make(map[string]*PathInfo)
+	}
 
 	info := &PathInfo{
+		Profile:     profile,
 		Path:        path,
 		SearchTypes: make(map[string]string),
 	}
-	svc.pathIndex[path] = info
+	svc.pathIndex[profile][path] = info
 	return info
 }
 
-// GetConceptMaps returns all ConceptMaps that reference this field's ValueSet
-func (svc *PathInfoService) GetConceptMaps(path string) ([]string, error) {
-	info, err := svc.GetPathInfo(path)
+// GetConceptMaps returns all ConceptMaps that reference the ValueSet of an element of a profile
+func (svc *PathInfoService) GetConceptMaps(profile, path string) ([]string, error) {
+	info, err := svc.GetPathInfo(profile, path)
 	if err != nil {
 		return nil, err
 	}
@@ -126,6 +145,16 @@ func (svc *PathInfoService) GetConceptMaps(path string) ([]string, error) {
 	return info.ConceptMaps, nil
 }
 
+// GetPathsForSearchParameter delegates to the SearchParameterService to get the paths of a search parameter
+func (svc *PathInfoService) GetPathsForSearchParameter(resourceType string, code string) []string {
+	return svc.searchParamService.GetPathsForSearchParameter(resourceType, code)
+}
+
+// GetSearchExpression delegates to the SearchParameterService to get the parsed expression of a search parameter
+func (svc *PathInfoService) GetSearchExpression(resourceType string, code string) *fhirpath.Expression {
+	return svc.searchParamService.GetExpression(resourceType, code)
+}
+
 // GetSearchTypeByPathAndCode delegates to the SearchParameterService to get the search type
 func (svc *PathInfoService) GetSearchTypeByPathAndCode(path string, code string) (string, error) {
 	return svc.searchParamService.GetSearchTypeByPathAndCode(path, code)
@@ -11,13 +11,14 @@ type PathInfoService struct {
 	structDefService   *structuredefinition.StructureDefinitionService
 	searchParamService *searchparameter.SearchParameterService
 	conceptMapService  *conceptmap.ConceptMapService
-	pathIndex          map[string]*PathInfo
+	pathIndex          map[string]map[string]*PathInfo // profile canonical -> element id -> path information
 	log                zerolog.Logger
 }
 
-// PathInfo represents complete path information
+// PathInfo represents complete path information of an element of a profile
 type PathInfo struct {
-	Path        string
+	Profile     string   // canonical of the profile the element is defined by
+	Path        string   // element id, slices included, e.g. Observation.component:systolic.code
 	ValueSet    string   // ValueSet URL from StructureDefinition
 	ConceptMaps []string // All ConceptMaps that reference this ValueSet
 	SearchTypes map[string]string
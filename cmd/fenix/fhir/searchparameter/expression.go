@@ -0,0 +1,55 @@
+package searchparameter
+
+import (
+	"strings"
+
+	"github.com/SanteonNL/fenix/cmd/fenix/fhir/fhirpath"
+	"github.com/SanteonNL/fenix/models/fhir"
+)
+
+// GetExpression returns the parsed FHIRPath expression of a search parameter for a resource type,
+// parameters of all resources (e.g. _id) are defined on Resource or DomainResource
+func (svc *SearchParameterService) GetExpression(resourceType string, code string) *fhirpath.Expression {
+	svc.mu.RLock()
+	defer svc.mu.RUnlock()
+
+	for _, base := range []string{resourceType, "DomainResource", "Resource"} {
+		sp, err := svc.repo.GetSearchParameterByCode(code, base)
+		if err != nil || sp.Expression == nil {
+			continue
+		}
+		return svc.expressions[sp.Url]
+	}
+	return nil
+}
+
+// indexExpression parses the expression of a search parameter and indexes the element paths it
+// selects by resource type and element, e.g. Observation.value
+func (svc *SearchParameterService) indexExpression(sp *fhir.SearchParameter) {
+	expression, err := fhirpath.Parse(*sp.Expression)
+	if err != nil {
+		svc.log.Warn().
+			Err(err).
+			Str("code", sp.Code).
+			Msg("Skipping search parameter with invalid expression")
+		return
+	}
+	svc.expressions[sp.Url] = expression
+
+	for _, path := range expression.Paths() {
+		parts := strings.Split(path.Path, ".")
+		if len(parts) < 2 {
+			svc.log.Debug().
+				Str("path", path.Path).
+				Msg("Skipping invalid path format")
+			continue
+		}
+
+		// Create standardized path
+		standardPath := parts[0] + "." + parts[1]
+		if _, exists := svc.pathCodeMap[standardPath]; !exists {
+			svc.pathCodeMap[standardPath] = make(map[string]string)
+		}
+		svc.pathCodeMap[standardPath][sp.Code] = sp.Type.String()
+	}
+}
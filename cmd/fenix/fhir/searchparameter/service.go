@@ -2,8 +2,10 @@ package searchparameter
 
 import (
 	"fmt"
+	"sort"
 	"strings"
 
+	"github.com/SanteonNL/fenix/cmd/fenix/fhir/fhirpath"
 	"github.com/SanteonNL/fenix/cmd/fenix/types"
 	"github.com/SanteonNL/fenix/models/fhir"
 	"github.com/rs/zerolog"
@@ -15,6 +17,7 @@ func NewSearchParameterService(repo *SearchParameterRepository, log zerolog.Logg
 		repo:        repo,
 		log:         log,
 		pathCodeMap: make(map[string]map[string]string), // Patient.gender -> map[code]type e.g	gender -> token
+		expressions: make(map[string]*fhirpath.Expression),
 	}
 }
 
@@ -24,6 +27,7 @@ func (svc *SearchParameterService) BuildSearchParameterIndex() error {
 
 	// Clear existing index
 	svc.pathCodeMap = make(map[string]map[string]string)
+	svc.expressions = make(map[string]*fhirpath.Expression)
 
 	// Get all search parameters from repository
 	searchParams := svc.repo.GetAllSearchParameters()
@@ -35,37 +39,7 @@ func (svc *SearchParameterService) BuildSearchParameterIndex() error {
 			continue
 		}
 
-		//svc.log.Debug().Str("expression", *sp.Expression).Msg("Processing Expresion")
-
-		// Split the expression into individual paths
-		paths := strings.Split(*sp.Expression, "|")
-		for _, pathRaw := range paths {
-			path := strings.TrimSpace(pathRaw)
-			if path == "" {
-				continue
-			}
-
-			// Extract resource and field
-			parts := strings.Split(path, ".")
-			if len(parts) < 2 {
-				svc.log.Debug().
-					Str("path", path).
-					Msg("Skipping invalid path format")
-				continue
-			}
-
-			// Create standardized path
-			standardPath := parts[0] + "." + parts[1]
-
-			// Initialize map for this path if needed
-			if _, exists := svc.pathCodeMap[standardPath]; !exists {
-				svc.pathCodeMap[standardPath] = make(map[string]string)
-			}
-
-			// Add this search parameter's code and type
-			svc.pathCodeMap[standardPath][sp.Code] = sp.Type.String()
-
-		}
+		svc.indexExpression(sp)
 	}
 
 	return nil
@@ -136,6 +110,7 @@ func (svc *SearchParameterService) ValidateSearchParameter(resourceType string,
 		return &types.Filter{
 			Code:     paramCode,
 			Modifier: modifier,
+			Type:     searchType,
 			IsValid:  true,
 		}, nil
 	}
@@ -145,6 +120,7 @@ func (svc *SearchParameterService) ValidateSearchParameter(resourceType string,
 		return &types.Filter{
 			Code:      paramCode,
 			Modifier:  modifier,
+			Type:      searchType,
 			IsValid:   false,
 			ErrorType: "invalid-modifier",
 		}, err
@@ -154,6 +130,7 @@ func (svc *SearchParameterService) ValidateSearchParameter(resourceType string,
 	return &types.Filter{
 		Code:     paramCode,
 		Modifier: modifier,
+		Type:     searchType,
 		IsValid:  true,
 	}, nil
 }
@@ -201,6 +178,25 @@ func (svc *SearchParameterService) IsValidResourceSearchParameter(resourceType,
 	return false, ""
 }
 
+// GetPathsForSearchParameter returns the indexed element paths (e.g. Patient.gender) a search
+// parameter code selects for a resource type
+func (svc *SearchParameterService) GetPathsForSearchParameter(resourceType string, code string) []string {
+	svc.mu.RLock()
+	defer svc.mu.RUnlock()
+
+	var paths []string
+	for path, codeMap := range svc.pathCodeMap {
+		if !strings.HasPrefix(path, resourceType+".") {
+			continue
+		}
+		if _, exists := codeMap[code]; exists {
+			paths = append(paths, path)
+		}
+	}
+	sort.Strings(paths)
+	return paths
+}
+
 // GetAllSearchParameters returns all search parameters from repository
 func (svc *SearchParameterService) GetAllSearchParameters() []*fhir.SearchParameter {
 	return svc.repo.GetAllSearchParameters()
@@ -3,6 +3,7 @@ package searchparameter
 import (
 	"sync"
 
+	"github.com/SanteonNL/fenix/cmd/fenix/fhir/fhirpath"
 	"github.com/SanteonNL/fenix/models/fhir"
 	"github.com/rs/zerolog"
 )
@@ -10,25 +11,28 @@ import (
 // ValidModifiers defines allowed modifiers for each search type according to FHIR spec
 var ValidModifiers = map[string]map[string]bool{
 	"number": {
-		"eq": true,
-		"ne": true,
-		"gt": true,
-		"lt": true,
-		"ge": true,
-		"le": true,
-		"sa": true,
-		"eb": true,
-		"ap": true,
+		"eq":      true,
+		"ne":      true,
+		"gt":      true,
+		"lt":      true,
+		"ge":      true,
+		"le":      true,
+		"sa":      true,
+		"eb":      true,
+		"ap":      true,
+		"missing": true,
 	},
 	"date": {
-		"eq": true,
-		"ne": true,
-		"gt": true,
-		"lt": true,
-		"ge": true,
-		"le": true,
-		"sa": true,
-		"eb": true,
+		"eq":      true,
+		"ne":      true,
+		"gt":      true,
+		"lt":      true,
+		"ge":      true,
+		"le":      true,
+		"sa":      true,
+		"eb":      true,
+		"ap":      true,
+		"missing": true,
 	},
 	"string": {
 		"contains": true,
@@ -38,31 +42,31 @@ var ValidModifiers = map[string]map[string]bool{
 	"token": {
 		"text":    true,
 		"not":     true,
-		"above":   true,
-		"below":   true,
 		"in":      true,
 		"not-in":  true,
 		"of-type": true,
+		"missing": true,
 	},
 	"reference": {
-		"above": true,
-		"below": true,
+		"missing": true,
 	},
 	"composite": {}, // Composite type doesn't support modifiers
 	"quantity": {
-		"eq": true,
-		"ne": true,
-		"gt": true,
-		"lt": true,
-		"ge": true,
-		"le": true,
-		"sa": true,
-		"eb": true,
-		"ap": true,
+		"eq":      true,
+		"ne":      true,
+		"gt":      true,
+		"lt":      true,
+		"ge":      true,
+		"le":      true,
+		"sa":      true,
+		"eb":      true,
+		"ap":      true,
+		"missing": true,
 	},
 	"uri": {
-		"below": true,
-		"above": true,
+		"below":   true,
+		"above":   true,
+		"missing": true,
 	},
 	"special": {}, // Special type typically doesn't support modifiers
 }
@@ -84,5 +88,6 @@ type SearchParameterService struct {
 	repo        *SearchParameterRepository
 	log         zerolog.Logger
 	pathCodeMap map[string]map[string]string
+	expressions map[string]*fhirpath.Expression // parsed expressions by search parameter url
 	mu          sync.RWMutex
 }
@@ -11,79 +11,115 @@ import (
 
 // StructureDefinitionService manages structure definition operations and indexing
 type StructureDefinitionService struct {
-	repo            *StructureDefinitionRepository
-	log             zerolog.Logger
-	pathBindingsMap map[string]string // Maps paths to ValueSet URLs
-	mu              sync.RWMutex
+	repo     *StructureDefinitionRepository
+	log      zerolog.Logger
+	bindings map[string]map[string]string // profile canonical -> element id -> ValueSet URL, empty when not bound
+	mu       sync.RWMutex
 }
 
 // NewStructureDefinitionService creates a new structure definition service
 func NewStructureDefinitionService(repo *StructureDefinitionRepository, log zerolog.Logger) *StructureDefinitionService {
 	return &StructureDefinitionService{
-		repo:            repo,
-		log:             log,
-		pathBindingsMap: make(map[string]string),
+		repo:     repo,
+		log:      log,
+		bindings: make(map[string]map[string]string),
 	}
 }
 
-// BuildStructureDefinitionIndex builds the structure definition index for efficient lookups
+// BuildStructureDefinitionIndex builds the structure definition index for efficient lookups.
+// Snapshots are generated first for the definitions that only have a differential.
 func (svc *StructureDefinitionService) BuildStructureDefinitionIndex() error {
 	svc.mu.Lock()
 	defer svc.mu.Unlock()
 
 	// Clear existing index
-	svc.pathBindingsMap = make(map[string]string)
+	svc.bindings = make(map[string]map[string]string)
 
 	// Get all structure definitions from repository
 	structDefs := svc.repo.GetAllStructureDefinitions()
+	svc.generateSnapshots(structDefs)
 
+	totalBindings := 0
 	for _, sd := range structDefs {
-		// Process each element for bindings
-		if sd.Snapshot != nil {
-			for _, element := range sd.Snapshot.Element {
-				if element.Binding != nil && element.Binding.ValueSet != nil {
-					path := element.Path
-					valueSetUrl := *element.Binding.ValueSet
-
-					svc.pathBindingsMap[path] = valueSetUrl
-
-					svc.log.Debug().
-						Str("path", path).
-						Str("valueSet", valueSetUrl).
-						Msg("Indexed path binding")
+		// Process each element for bindings, slices have their own element id
+		if sd.Snapshot == nil {
+			continue
+		}
+		profile := canonicalURL(sd.Url)
+		profileBindings := make(map[string]string)
+		for _, element := range sd.Snapshot.Element {
+			id := elementID(element)
+			if element.Binding == nil || element.Binding.ValueSet == nil {
+				// Known elements without binding are not looked up in the base definition
+				if _, exists := profileBindings[id]; !exists {
+					profileBindings[id] = ""
 				}
+				continue
 			}
+			valueSetUrl := *element.Binding.ValueSet
+
+			profileBindings[id] = valueSetUrl
+			totalBindings++
+
+			svc.log.Debug().
+				Str("profile", profile).
+				Str("element", id).
+				Str("valueSet", valueSetUrl).
+				Msg("Indexed element binding")
 		}
+		svc.bindings[profile] = profileBindings
 	}
 
 	svc.log.Info().
-		Int("total_bindings", len(svc.pathBindingsMap)).
+		Int("total_bindings", totalBindings).
 		Int("total_structdefs", len(structDefs)).
 		Msg("Completed building structure definition index")
 
 	return nil
 }
 
+// generateSnapshots generates the snapshots of the definitions without one. A definition whose
+// snapshot cannot be generated is logged and left without snapshot.
+func (svc *StructureDefinitionService) generateSnapshots(structDefs []*fhir.StructureDefinition) {
+	generator := newSnapshotGenerator(svc.repo, svc.log)
+
+	generated := 0
+	for _, sd := range structDefs {
+		if sd.Snapshot != nil && len(sd.Snapshot.Element) > 0 {
+			continue
+		}
+		if _, err := generator.snapshot(sd); err != nil {
+			svc.log.Error().Err(err).
+				Str("url", sd.Url).
+				Msg("Failed to generate snapshot")
+			continue
+		}
+		generated++
+	}
+
+	if generated > 0 {
+		svc.log.Info().
+			Int("generated", generated).
+			Msg("Generated snapshots from differentials")
+	}
+}
+
 // GetAllStructureDefinitions returns all structure definitions from repository
 func (svc *StructureDefinitionService) GetAllStructureDefinitions() []*fhir.StructureDefinition {
 	return svc.repo.GetAllStructureDefinitions()
 }
 
-// GetAllPathBindings returns all path bindings for a structure definition
-func (svc *StructureDefinitionService) GetAllPathBindings(sd *fhir.StructureDefinition) map[string]string {
+// GetElementBindings returns the ValueSet URLs bound to the elements of a structure definition by element id
+func (svc *StructureDefinitionService) GetElementBindings(sd *fhir.StructureDefinition) map[string]string {
 	svc.mu.RLock()
 	defer svc.mu.RUnlock()
 
 	result := make(map[string]string)
-	prefix := sd.Type + "."
-
-	// Only include paths that belong to this structure definition
-	for path, valueSet := range svc.pathBindingsMap {
-		if path == sd.Type || strings.HasPrefix(path, prefix) {
-			result[path] = valueSet
+	for id, valueSet := range svc.bindings[canonicalURL(sd.Url)] {
+		if valueSet != "" {
+			result[id] = valueSet
 		}
 	}
-
 	return result
 }
 
@@ -92,13 +128,38 @@ func (svc *StructureDefinitionService) GetStructureDefinition(identifier string)
 	return svc.repo.GetStructureDefinition(identifier)
 }
 
-// GetValueSetForPath returns the ValueSet URL for a given path
-func (svc *StructureDefinitionService) GetBindingValueSet(path string) (string, error) {
+// GetBindingValueSet returns the ValueSet URL bound to an element of a profile, the element given by
+// its id, e.g. Observation.component:systolic.code. Without a profile, or when the profile is not
+// loaded or does not have the element, the base definition of the resource type is used.
+func (svc *StructureDefinitionService) GetBindingValueSet(profile, elementID string) (string, error) {
 	svc.mu.RLock()
 	defer svc.mu.RUnlock()
 
-	if valueSet, exists := svc.pathBindingsMap[path]; exists {
-		return valueSet, nil
+	for _, url := range bindingProfiles(profile, elementID) {
+		profileBindings, loaded := svc.bindings[url]
+		if !loaded {
+			continue
+		}
+		if valueSet, exists := profileBindings[elementID]; exists {
+			if valueSet == "" {
+				break
+			}
+			return valueSet, nil
+		}
+	}
+	return "", fmt.Errorf("no ValueSet binding found for element %s of profile %s", elementID, profile)
+}
+
+// bindingProfiles returns the canonicals to look up the binding of an element in, the profile
+// followed by the base definition of the resource type
+func bindingProfiles(profile, elementID string) []string {
+	var urls []string
+	if profile != "" {
+		urls = append(urls, canonicalURL(profile))
+	}
+	resourceType := strings.SplitN(elementID, ".", 2)[0]
+	if base := baseDefinitionPrefix + resourceType; len(urls) == 0 || urls[0] != base {
+		urls = append(urls, base)
 	}
-	return "", fmt.Errorf("no ValueSet binding found for path: %s", path)
+	return urls
 }
@@ -0,0 +1,421 @@
+package structuredefinition
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/SanteonNL/fenix/models/fhir"
+	"github.com/rs/zerolog"
+)
+
+// baseDefinitionPrefix is the canonical url of the base definitions of the FHIR types
+const baseDefinitionPrefix = "http://hl7.org/fhir/StructureDefinition/"
+
+// errNotInBase is returned for a differential element that cannot be found in or added to the base
+var errNotInBase = errors.New("element is not in the base")
+
+// appendedElementProperties are the properties of an element a differential adds to those of the base
+// instead of replacing them
+var appendedElementProperties = map[string]bool{"constraint": true, "condition": true, "mapping": true, "alias": true, "code": true}
+
+// snapshotGenerator generates the snapshots of differential-only StructureDefinitions by merging
+// the differential onto the snapshot of the base definition
+type snapshotGenerator struct {
+	repo       *StructureDefinitionRepository
+	log        zerolog.Logger
+	generating map[string]bool // urls of the definitions being generated, to detect cycles
+}
+
+// newSnapshotGenerator creates a snapshotGenerator for the definitions of a repository
+func newSnapshotGenerator(repo *StructureDefinitionRepository, log zerolog.Logger) *snapshotGenerator {
+	return &snapshotGenerator{
+		repo:       repo,
+		log:        log,
+		generating: make(map[string]bool),
+	}
+}
+
+// snapshot returns the snapshot elements of a definition, generating the snapshot when it only has a
+// differential. The base definitions are generated first, following the baseDefinition chain.
+func (g *snapshotGenerator) snapshot(sd *fhir.StructureDefinition) ([]fhir.ElementDefinition, error) {
+	if sd.Snapshot != nil && len(sd.Snapshot.Element) > 0 {
+		return sd.Snapshot.Element, nil
+	}
+	if sd.Differential == nil || len(sd.Differential.Element) == 0 {
+		return nil, fmt.Errorf("StructureDefinition %s has no snapshot and no differential", sd.Url)
+	}
+	if sd.BaseDefinition == nil {
+		return nil, fmt.Errorf("StructureDefinition %s has no snapshot and no baseDefinition", sd.Url)
+	}
+	if g.generating[sd.Url] {
+		return nil, fmt.Errorf("baseDefinition of StructureDefinition %s refers to itself", sd.Url)
+	}
+	g.generating[sd.Url] = true
+	defer delete(g.generating, sd.Url)
+
+	base, err := g.repo.GetStructureDefinition(canonicalURL(*sd.BaseDefinition))
+	if err != nil {
+		return nil, fmt.Errorf("baseDefinition of %s: %w", sd.Url, err)
+	}
+	baseElements, err := g.snapshot(base)
+	if err != nil {
+		return nil, err
+	}
+
+	elements, err := copyElements(baseElements)
+	if err != nil {
+		return nil, err
+	}
+	for _, diff := range sd.Differential.Element {
+		applied, err := g.apply(elements, diff)
+		if errors.Is(err, errNotInBase) {
+			// The rest of the profile is still usable for bindings and validation
+			g.log.Warn().Err(err).
+				Str("url", sd.Url).
+				Str("element", elementID(diff)).
+				Msg("Skipping differential element")
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("StructureDefinition %s, element %s: %w", sd.Url, elementID(diff), err)
+		}
+		elements = applied
+	}
+
+	sd.Snapshot = &fhir.StructureDefinitionSnapshot{Element: elements}
+	g.log.Debug().
+		Str("url", sd.Url).
+		Str("baseDefinition", base.Url).
+		Int("elements", len(elements)).
+		Msg("Generated snapshot")
+	return elements, nil
+}
+
+// apply merges a single element of a differential onto the snapshot elements
+func (g *snapshotGenerator) apply(elements []fhir.ElementDefinition, diff fhir.ElementDefinition) ([]fhir.ElementDefinition, error) {
+	id := elementID(diff)
+
+	index, elements, err := g.find(elements, id)
+	if err != nil {
+		return nil, err
+	}
+	if index >= 0 {
+		merged, err := mergeElement(elements[index], diff)
+		if err != nil {
+			return nil, err
+		}
+		elements[index] = merged
+		return elements, nil
+	}
+
+	// A new slice starts as a copy of the element it slices, without the slicing
+	if diff.SliceName != nil {
+		slicedID := strings.TrimSuffix(id, ":"+*diff.SliceName)
+		slicedIndex, expanded, err := g.find(elements, slicedID)
+		if err != nil {
+			return nil, err
+		}
+		if slicedIndex == -1 {
+			return nil, fmt.Errorf("sliced element %s: %w", slicedID, errNotInBase)
+		}
+		elements = expanded
+
+		slice := elements[slicedIndex]
+		slice.Slicing = nil
+		slice.Id = &id
+		slice.SliceName = diff.SliceName
+		if slice, err = mergeElement(slice, diff); err != nil {
+			return nil, err
+		}
+		return insertElements(elements, subtreeEnd(elements, slicedIndex), slice), nil
+	}
+
+	return nil, errNotInBase
+}
+
+// find returns the index of the element with the id. Elements below the elements of the snapshot
+// are added from the definition of their type, e.g. Observation.code.coding from CodeableConcept.
+// Elements of a choice may be named by their type, e.g. Observation.valueQuantity for value[x].
+func (g *snapshotGenerator) find(elements []fhir.ElementDefinition, id string) (int, []fhir.ElementDefinition, error) {
+	if index := indexByID(elements, id); index >= 0 {
+		return index, elements, nil
+	}
+
+	dot := strings.LastIndex(id, ".")
+	if dot == -1 {
+		return -1, elements, nil
+	}
+	parentID, name := id[:dot], id[dot+1:]
+
+	parentIndex, elements, err := g.find(elements, parentID)
+	if err != nil || parentIndex == -1 {
+		return -1, elements, err
+	}
+
+	// A choice element restricted to one of its types is renamed to that type
+	if index := choiceIndex(elements, parentID, name); index >= 0 {
+		element := elements[index]
+		choice := strings.TrimSuffix(lastSegment(elementID(element)), "[x]")
+		for _, elementType := range element.Type {
+			if strings.EqualFold(elementType.Code, name[len(choice):]) {
+				element.Type = []fhir.ElementDefinitionType{elementType}
+			}
+		}
+		element.Id = &id
+		element.Path = elements[parentIndex].Path + "." + name
+		elements[index] = element
+		return index, elements, nil
+	}
+
+	// The children of the parent are not in the snapshot yet
+	if hasChildren(elements, parentIndex) {
+		return -1, elements, nil
+	}
+	children, err := g.children(elements, parentIndex)
+	if err != nil {
+		return -1, elements, err
+	}
+	elements = insertElements(elements, parentIndex+1, children...)
+	return indexByID(elements, id), elements, nil
+}
+
+// children returns the child elements of an element from the slice it belongs to or the definition
+// of its type, with the ids and paths of the element
+func (g *snapshotGenerator) children(elements []fhir.ElementDefinition, parentIndex int) ([]fhir.ElementDefinition, error) {
+	parent := elements[parentIndex]
+	parentID := elementID(parent)
+
+	// The children of a slice are those of the sliced element
+	if parent.SliceName != nil {
+		slicedID := strings.TrimSuffix(parentID, ":"+*parent.SliceName)
+		if slicedIndex := indexByID(elements, slicedID); slicedIndex >= 0 && hasChildren(elements, slicedIndex) {
+			var children []fhir.ElementDefinition
+			for _, child := range elements[slicedIndex+1 : subtreeEnd(elements, slicedIndex)] {
+				childID := elementID(child)
+				if strings.HasPrefix(childID, slicedID+":") {
+					continue
+				}
+				children = append(children, child)
+			}
+			return rebaseElements(children, slicedID, parentID, parent.Path)
+		}
+	}
+
+	if len(parent.Type) != 1 {
+		return nil, fmt.Errorf("children of %s are unknown, it has %d types: %w", parentID, len(parent.Type), errNotInBase)
+	}
+	elementType := parent.Type[0]
+	typeURL := baseDefinitionPrefix + elementType.Code
+	if len(elementType.Profile) > 0 {
+		typeURL = canonicalURL(elementType.Profile[0])
+	}
+
+	typeDefinition, err := g.repo.GetStructureDefinition(typeURL)
+	if err != nil {
+		return nil, fmt.Errorf("children of %s: %v: %w", parentID, err, errNotInBase)
+	}
+	typeElements, err := g.snapshot(typeDefinition)
+	if err != nil {
+		return nil, err
+	}
+	if len(typeElements) < 2 {
+		return nil, nil
+	}
+	return rebaseElements(typeElements[1:], elementID(typeElements[0]), parentID, parent.Path)
+}
+
+// mergeElement applies the properties of a differential element to an element. Constraints,
+// conditions, mappings, aliases and codes are added, the other properties replace those of the element.
+func mergeElement(element, diff fhir.ElementDefinition) (fhir.ElementDefinition, error) {
+	var merged, diffProperties map[string]interface{}
+	if err := convertJSON(element, &merged); err != nil {
+		return element, err
+	}
+	if err := convertJSON(diff, &diffProperties); err != nil {
+		return element, err
+	}
+
+	for key, value := range diffProperties {
+		switch {
+		case key == "id" || key == "path":
+			continue
+		case key == "constraint":
+			merged[key] = mergeConstraints(merged[key], value)
+		case appendedElementProperties[key]:
+			merged[key] = appendNew(merged[key], value)
+		default:
+			merged[key] = value
+		}
+	}
+
+	var result fhir.ElementDefinition
+	if err := convertJSON(merged, &result); err != nil {
+		return element, err
+	}
+	return result, nil
+}
+
+// mergeConstraints adds the constraints of a differential, a constraint with the key of an
+// existing one replaces it
+func mergeConstraints(existing, added interface{}) interface{} {
+	constraints, _ := existing.([]interface{})
+	addedConstraints, _ := added.([]interface{})
+	for _, constraint := range addedConstraints {
+		key, _ := constraint.(map[string]interface{})["key"].(string)
+		replaced := false
+		for i, current := range constraints {
+			if currentKey, _ := current.(map[string]interface{})["key"].(string); currentKey == key && key != "" {
+				constraints[i] = constraint
+				replaced = true
+			}
+		}
+		if !replaced {
+			constraints = append(constraints, constraint)
+		}
+	}
+	return constraints
+}
+
+// appendNew adds the values of a list that are not in the existing list yet
+func appendNew(existing, added interface{}) interface{} {
+	values, _ := existing.([]interface{})
+	addedValues, _ := added.([]interface{})
+	for _, value := range addedValues {
+		found := false
+		for _, current := range values {
+			if reflect.DeepEqual(current, value) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+// rebaseElements returns copies of elements with the id and path prefix of another element,
+// e.g. HumanName.given as Patient.name.given
+func rebaseElements(elements []fhir.ElementDefinition, fromID, toID, toPath string) ([]fhir.ElementDefinition, error) {
+	copies, err := copyElements(elements)
+	if err != nil {
+		return nil, err
+	}
+	fromPath := idToPath(fromID)
+	for i := range copies {
+		id := toID + strings.TrimPrefix(elementID(copies[i]), fromID)
+		copies[i].Id = &id
+		copies[i].Path = toPath + strings.TrimPrefix(copies[i].Path, fromPath)
+	}
+	return copies, nil
+}
+
+// copyElements returns a deep copy of elements, the snapshot of a base is never changed
+func copyElements(elements []fhir.ElementDefinition) ([]fhir.ElementDefinition, error) {
+	var copies []fhir.ElementDefinition
+	if err := convertJSON(elements, &copies); err != nil {
+		return nil, fmt.Errorf("failed to copy elements: %w", err)
+	}
+	return copies, nil
+}
+
+// convertJSON converts a value to another type through its json form
+func convertJSON(from, to interface{}) error {
+	data, err := json.Marshal(from)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, to)
+}
+
+// insertElements inserts elements at an index
+func insertElements(elements []fhir.ElementDefinition, index int, inserted ...fhir.ElementDefinition) []fhir.ElementDefinition {
+	result := make([]fhir.ElementDefinition, 0, len(elements)+len(inserted))
+	result = append(result, elements[:index]...)
+	result = append(result, inserted...)
+	return append(result, elements[index:]...)
+}
+
+// subtreeEnd returns the index after the last child or slice of an element
+func subtreeEnd(elements []fhir.ElementDefinition, index int) int {
+	id := elementID(elements[index])
+	end := index + 1
+	for end < len(elements) {
+		next := elementID(elements[end])
+		if !strings.HasPrefix(next, id+".") && !strings.HasPrefix(next, id+":") {
+			break
+		}
+		end++
+	}
+	return end
+}
+
+// hasChildren reports whether the element at the index is followed by its children
+func hasChildren(elements []fhir.ElementDefinition, index int) bool {
+	return index+1 < len(elements) && strings.HasPrefix(elementID(elements[index+1]), elementID(elements[index])+".")
+}
+
+// choiceIndex returns the index of the choice element of a parent a type-specific name refers to,
+// e.g. value[x] for valueQuantity, or -1
+func choiceIndex(elements []fhir.ElementDefinition, parentID, name string) int {
+	for i, element := range elements {
+		id := elementID(element)
+		if !strings.HasPrefix(id, parentID+".") || !strings.HasSuffix(id, "[x]") {
+			continue
+		}
+		choice := strings.TrimSuffix(id[len(parentID)+1:], "[x]")
+		if strings.Contains(choice, ".") || len(name) <= len(choice) || !strings.HasPrefix(name, choice) {
+			continue
+		}
+		if c := name[len(choice)]; c >= 'A' && c <= 'Z' {
+			return i
+		}
+	}
+	return -1
+}
+
+// indexByID returns the index of the element with the id, or -1
+func indexByID(elements []fhir.ElementDefinition, id string) int {
+	for i, element := range elements {
+		if elementID(element) == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// elementID returns the id of an element, derived from its path and slice name when it has none
+func elementID(element fhir.ElementDefinition) string {
+	if element.Id != nil && *element.Id != "" {
+		return *element.Id
+	}
+	if element.SliceName != nil {
+		return element.Path + ":" + *element.SliceName
+	}
+	return element.Path
+}
+
+// idToPath returns the path of an element id, without the slice names
+func idToPath(id string) string {
+	parts := strings.Split(id, ".")
+	for i, part := range parts {
+		if colon := strings.Index(part, ":"); colon != -1 {
+			parts[i] = part[:colon]
+		}
+	}
+	return strings.Join(parts, ".")
+}
+
+// lastSegment returns the last element name of an id
+func lastSegment(id string) string {
+	return id[strings.LastIndex(id, ".")+1:]
+}
+
+// canonicalURL returns a canonical reference without its version
+func canonicalURL(reference string) string {
+	return strings.SplitN(reference, "|", 2)[0]
+}
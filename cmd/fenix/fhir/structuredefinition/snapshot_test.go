@@ -0,0 +1,278 @@
+package structuredefinition
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/SanteonNL/fenix/models/fhir"
+	"github.com/rs/zerolog"
+)
+
+// The fixtures in testdata have a blood pressure profile with only a differential, on a vital
+// signs profile with only a differential, on the base Observation
+const (
+	vitalSignsURL    = "http://example.org/fhir/StructureDefinition/vitalsigns"
+	bloodPressureURL = "http://example.org/fhir/StructureDefinition/bloodpressure"
+)
+
+// newTestRepository loads the definitions in testdata
+func newTestRepository(t *testing.T) *StructureDefinitionRepository {
+	t.Helper()
+	repo := NewStructureDefinitionRepository(zerolog.Nop())
+	if err := repo.LoadStructureDefinitions("testdata"); err != nil {
+		t.Fatalf("LoadStructureDefinitions: %v", err)
+	}
+	return repo
+}
+
+// generateSnapshot generates the snapshot of a definition of the repository
+func generateSnapshot(t *testing.T, repo *StructureDefinitionRepository, url string) []fhir.ElementDefinition {
+	t.Helper()
+	sd, err := repo.GetStructureDefinition(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	elements, err := newSnapshotGenerator(repo, zerolog.Nop()).snapshot(sd)
+	if err != nil {
+		t.Fatalf("snapshot of %s: %v", url, err)
+	}
+	return elements
+}
+
+// elementByID returns the element with the id, failing the test when there is none
+func elementByID(t *testing.T, elements []fhir.ElementDefinition, id string) fhir.ElementDefinition {
+	t.Helper()
+	index := indexByID(elements, id)
+	if index == -1 {
+		t.Fatalf("element %s not in snapshot", id)
+	}
+	return elements[index]
+}
+
+func TestSnapshotElementIDs(t *testing.T) {
+	elements := generateSnapshot(t, newTestRepository(t), bloodPressureURL)
+
+	want := []string{
+		"Observation",
+		"Observation.status",
+		"Observation.category",
+		"Observation.category:VSCat",
+		"Observation.category:VSCat.coding",
+		"Observation.category:VSCat.coding.system",
+		"Observation.category:VSCat.coding.code",
+		"Observation.category:VSCat.text",
+		"Observation.code",
+		"Observation.code.coding",
+		"Observation.code.coding.system",
+		"Observation.code.coding.code",
+		"Observation.code.text",
+		"Observation.value[x]",
+		"Observation.component",
+		"Observation.component.code",
+		"Observation.component.value[x]",
+		"Observation.component:systolic",
+		"Observation.component:systolic.code",
+		"Observation.component:systolic.valueQuantity",
+		"Observation.component:systolic.valueQuantity.value",
+		"Observation.component:systolic.valueQuantity.unit",
+		"Observation.component:systolic.valueQuantity.system",
+		"Observation.component:systolic.valueQuantity.code",
+		"Observation.component:diastolic",
+	}
+	var ids []string
+	for _, element := range elements {
+		ids = append(ids, elementID(element))
+	}
+	if !reflect.DeepEqual(ids, want) {
+		t.Errorf("expected ids\n%s\ngot\n%s", strings.Join(want, "\n"), strings.Join(ids, "\n"))
+	}
+
+	// Elements added from the definition of their type take the path of the element
+	if path := elementByID(t, elements, "Observation.component:systolic.valueQuantity.code").Path; path != "Observation.component.valueQuantity.code" {
+		t.Errorf("expected the path without slice names, got %s", path)
+	}
+}
+
+func TestSnapshotSlices(t *testing.T) {
+	elements := generateSnapshot(t, newTestRepository(t), bloodPressureURL)
+
+	tests := []struct {
+		id        string
+		sliceName string
+		min       int
+		slicing   bool
+	}{
+		{"Observation.category", "", 1, true},
+		{"Observation.category:VSCat", "VSCat", 1, false},
+		{"Observation.component", "", 2, true},
+		{"Observation.component:systolic", "systolic", 1, false},
+		{"Observation.component:diastolic", "diastolic", 1, false},
+	}
+	for _, tt := range tests {
+		element := elementByID(t, elements, tt.id)
+		sliceName := ""
+		if element.SliceName != nil {
+			sliceName = *element.SliceName
+		}
+		if sliceName != tt.sliceName {
+			t.Errorf("%s: expected slice name %q, got %q", tt.id, tt.sliceName, sliceName)
+		}
+		if element.Min == nil || *element.Min != tt.min {
+			t.Errorf("%s: expected min %d, got %v", tt.id, tt.min, element.Min)
+		}
+		if (element.Slicing != nil) != tt.slicing {
+			t.Errorf("%s: expected slicing %v, got %v", tt.id, tt.slicing, element.Slicing)
+		}
+	}
+
+	// A slice starts as a copy of the sliced element, its children as those of the sliced element
+	if code := elementByID(t, elements, "Observation.component:systolic.code"); code.Min == nil || *code.Min != 1 {
+		t.Errorf("expected the slice to take the min of component.code of the vital signs profile, got %v", code.Min)
+	}
+	if value := elementByID(t, elements, "Observation.component:systolic.valueQuantity"); len(value.Type) != 1 || value.Type[0].Code != "Quantity" {
+		t.Errorf("expected value[x] restricted to Quantity, got %v", value.Type)
+	}
+
+	fixed := map[string]string{
+		"Observation.category:VSCat.coding.code":            "vital-signs",
+		"Observation.code.coding.code":                      "85354-9",
+		"Observation.component:systolic.valueQuantity.code": "mm[Hg]",
+	}
+	for id, want := range fixed {
+		if element := elementByID(t, elements, id); element.FixedCode == nil || *element.FixedCode != want {
+			t.Errorf("%s: expected fixed code %s, got %v", id, want, element.FixedCode)
+		}
+	}
+}
+
+func TestSnapshotBindings(t *testing.T) {
+	elements := generateSnapshot(t, newTestRepository(t), bloodPressureURL)
+
+	tests := []struct {
+		id       string
+		valueSet string
+		strength fhir.BindingStrength
+	}{
+		// From the base Observation through both profiles
+		{"Observation.status", "http://hl7.org/fhir/ValueSet/observation-status|4.0.1", fhir.BindingStrengthRequired},
+		// From the vital signs profile
+		{"Observation.code", "http://example.org/fhir/ValueSet/vitalsigns", fhir.BindingStrengthExtensible},
+		// A slice takes the binding of the sliced element
+		{"Observation.category:VSCat", "http://hl7.org/fhir/ValueSet/observation-category", fhir.BindingStrengthPreferred},
+		{"Observation.component.code", "http://hl7.org/fhir/ValueSet/observation-codes", fhir.BindingStrengthExample},
+		// From the blood pressure profile, on the slice only
+		{"Observation.component:systolic.code", "http://example.org/fhir/ValueSet/systolic", fhir.BindingStrengthRequired},
+		{"Observation.component:diastolic", "", 0},
+	}
+	for _, tt := range tests {
+		binding := elementByID(t, elements, tt.id).Binding
+		if tt.valueSet == "" {
+			if binding != nil {
+				t.Errorf("%s: expected no binding, got %v", tt.id, binding)
+			}
+			continue
+		}
+		if binding == nil || binding.ValueSet == nil || *binding.ValueSet != tt.valueSet || binding.Strength != tt.strength {
+			t.Errorf("%s: expected %s binding to %s, got %+v", tt.id, tt.strength.Code(), tt.valueSet, binding)
+		}
+	}
+}
+
+func TestSnapshotMergesConstraints(t *testing.T) {
+	elements := generateSnapshot(t, newTestRepository(t), bloodPressureURL)
+
+	var keys []string
+	for _, constraint := range elementByID(t, elements, "Observation.code").Constraint {
+		keys = append(keys, constraint.Key)
+	}
+	if want := []string{"ele-1", "vs-1"}; !reflect.DeepEqual(keys, want) {
+		t.Errorf("expected constraints %v, got %v", want, keys)
+	}
+}
+
+func TestSnapshotKeepsBaseDefinitions(t *testing.T) {
+	repo := newTestRepository(t)
+	generateSnapshot(t, repo, bloodPressureURL)
+
+	// The intermediate profile gets its own snapshot, without the elements of the blood pressure profile
+	vitalSigns, err := repo.GetStructureDefinition(vitalSignsURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vitalSigns.Snapshot == nil {
+		t.Fatal("expected the snapshot of the vital signs profile to be generated")
+	}
+	if indexByID(vitalSigns.Snapshot.Element, "Observation.component:systolic") != -1 {
+		t.Error("expected the slices of the blood pressure profile not to be in the vital signs profile")
+	}
+	if index := indexByID(vitalSigns.Snapshot.Element, "Observation.unknown"); index != -1 {
+		t.Error("expected the differential element that is not in the base to be skipped")
+	}
+
+	observation, err := repo.GetStructureDefinition(baseDefinitionPrefix + "Observation")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(observation.Snapshot.Element) != 8 {
+		t.Errorf("expected the base Observation to keep its 8 elements, got %d", len(observation.Snapshot.Element))
+	}
+	if category := elementByID(t, observation.Snapshot.Element, "Observation.category"); category.Slicing != nil || *category.Min != 0 {
+		t.Errorf("expected the base Observation.category to be unchanged, got %+v", category)
+	}
+}
+
+func TestSnapshotErrors(t *testing.T) {
+	base := "http://example.org/fhir/StructureDefinition/missing"
+	self := "http://example.org/fhir/StructureDefinition/self"
+	differential := &fhir.StructureDefinitionDifferential{Element: []fhir.ElementDefinition{{Path: "Observation.status"}}}
+
+	tests := []struct {
+		name string
+		sd   *fhir.StructureDefinition
+		want string
+	}{
+		{"no differential", &fhir.StructureDefinition{Url: self, BaseDefinition: &base}, "has no snapshot and no differential"},
+		{"no baseDefinition", &fhir.StructureDefinition{Url: self, Differential: differential}, "has no snapshot and no baseDefinition"},
+		{"unknown baseDefinition", &fhir.StructureDefinition{Url: self, BaseDefinition: &base, Differential: differential}, "StructureDefinition not found"},
+		{"cycle", &fhir.StructureDefinition{Url: self, BaseDefinition: &self, Differential: differential}, "refers to itself"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repo := newTestRepository(t)
+			repo.structureDefinitionsMap[tt.sd.Url] = tt.sd
+			_, err := newSnapshotGenerator(repo, zerolog.Nop()).snapshot(tt.sd)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("expected error %q, got %v", tt.want, err)
+			}
+		})
+	}
+}
+
+func TestBuildIndexUsesGeneratedSnapshots(t *testing.T) {
+	svc := NewStructureDefinitionService(newTestRepository(t), zerolog.Nop())
+	if err := svc.BuildStructureDefinitionIndex(); err != nil {
+		t.Fatalf("BuildStructureDefinitionIndex: %v", err)
+	}
+
+	tests := []struct {
+		profile   string
+		elementID string
+		want      string
+	}{
+		{bloodPressureURL, "Observation.component:systolic.code", "http://example.org/fhir/ValueSet/systolic"},
+		{bloodPressureURL, "Observation.code", "http://example.org/fhir/ValueSet/vitalsigns"},
+		{vitalSignsURL, "Observation.code", "http://example.org/fhir/ValueSet/vitalsigns"},
+		{"", "Observation.code", "http://hl7.org/fhir/ValueSet/observation-codes"},
+	}
+	for _, tt := range tests {
+		got, err := svc.GetBindingValueSet(tt.profile, tt.elementID)
+		if err != nil {
+			t.Errorf("%s of %s: %v", tt.elementID, tt.profile, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s of %s: expected %s, got %s", tt.elementID, tt.profile, tt.want, got)
+		}
+	}
+}
@@ -82,7 +82,8 @@ func (s *ValueSetService) GetValueSet(ctx context.Context, url string) (*fhir.Va
 	}
 
 	// Try local storage first
-	valueSet, err := s.fetchFromLocal(valueSetID)
+	localValueSet, err := s.fetchFromLocal(valueSetID)
+	valueSet := localValueSet
 	if err == nil && valueSet != nil {
 		// Check if local storage is still valid
 		if !s.isLocalStorageExpired(valueSetID) {
@@ -101,6 +102,11 @@ func (s *ValueSetService) GetValueSet(ctx context.Context, url string) (*fhir.Va
 				s.log.Warn().Err(err).Str("valueSetID", valueSetID).Msg("Remote fetch failed, using expired cache")
 				return cached.ValueSet, nil
 			}
+			if localValueSet != nil {
+				s.log.Warn().Err(err).Str("valueSetID", valueSetID).Msg("Remote fetch failed, using expired local storage")
+				s.updateCache(valueSetID, localValueSet)
+				return localValueSet, nil
+			}
 			return nil, fmt.Errorf("failed to fetch ValueSet from remote: %w", err)
 		}
 
@@ -306,17 +312,21 @@ func (s *ValueSetService) validateCodeRecursive(ctx context.Context, valueSetURL
 	}, nil
 }
 
+// validateDirectConcepts checks the concepts listed in the ValueSet itself. A coding without
+// system is the value of an element of type code, it matches the code in any included system.
 func (s *ValueSetService) validateDirectConcepts(valueSet *fhir.ValueSet, coding *fhir.Coding) *ValidationResult {
-	var codingSystem, codingCode string
-	if coding.System != nil {
-		codingSystem = *coding.System
-	}
+	var codingCode string
 	if coding.Code != nil {
 		codingCode = *coding.Code
 	}
+	if valueSet.Compose == nil {
+		return &ValidationResult{
+			Valid: false,
+		}
+	}
 
 	for _, include := range valueSet.Compose.Include {
-		if include.System != nil && *include.System != codingSystem {
+		if include.System != nil && coding.System != nil && *include.System != *coding.System {
 			continue
 		}
 
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"sync"
 	"time"
 
 	"github.com/rs/zerolog"
@@ -14,6 +15,7 @@ import (
 type OutputManager struct {
 	baseDir   string
 	timestamp string
+	mu        sync.Mutex // resources are processed concurrently and may write the same file
 	log       zerolog.Logger
 }
 
@@ -108,6 +110,9 @@ func (om *OutputManager) WriteToJSON(data interface{}, prefix string) error {
 	filename := fmt.Sprintf("%s_%s.json", prefix, om.timestamp)
 	outputPath := filepath.Join(om.baseDir, filename)
 
+	om.mu.Lock()
+	defer om.mu.Unlock()
+
 	// Create the file
 	file, err := os.Create(outputPath)
 	if err != nil {
@@ -0,0 +1,182 @@
+package processor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/SanteonNL/fenix/cmd/fenix/datasource"
+	"github.com/SanteonNL/fenix/cmd/fenix/types"
+	"github.com/SanteonNL/fenix/models/fhir"
+)
+
+// resolveChains replaces the chained filters the datasource cannot join by plain filters on the
+// results of their inner search. It returns false when an inner search has no results, then no
+// resource can match.
+func (p *ProcessorService) resolveChains(ctx context.Context, ds datasource.DataSource, resourceType string, filters []*types.Filter) ([]*types.Filter, bool, error) {
+	resolved := make([]*types.Filter, 0, len(filters))
+	for _, filter := range filters {
+		if filter == nil || filter.Chain == nil {
+			resolved = append(resolved, filter)
+			continue
+		}
+		if joiner, ok := ds.(datasource.ChainJoiner); ok && joiner.CanJoinChain(resourceType, filter) {
+			resolved = append(resolved, filter)
+			continue
+		}
+
+		plain, err := p.resolveChain(ctx, ds, resourceType, filter)
+		if err != nil {
+			return nil, false, err
+		}
+		if plain == nil {
+			return nil, false, nil
+		}
+		resolved = append(resolved, plain)
+	}
+	return resolved, true, nil
+}
+
+// maxChainMatches bounds the number of resources the inner search of a chain the datasource cannot
+// join may match, they all become values of a single filter
+const maxChainMatches = 1000
+
+// ErrTooManyChainMatches is returned when the inner search of a chained parameter matches more
+// than maxChainMatches resources
+var ErrTooManyChainMatches = errors.New("chained search parameter matches too many resources")
+
+// resolveChain searches the inner resources of a chained filter through their own query files. A
+// chain becomes a filter on the reference to them, _has a filter on the ids they refer to. It
+// returns nil when there are no inner resources.
+func (p *ProcessorService) resolveChain(ctx context.Context, ds datasource.DataSource, resourceType string, filter *types.Filter) (*types.Filter, error) {
+	// Stops the datasource when there are too many matches
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	chain := filter.Chain
+	filters, matchable, err := p.resolveChains(ctx, ds, chain.ResourceType, []*types.Filter{chain.Filter})
+	if err != nil {
+		return nil, err
+	}
+	if !matchable {
+		return nil, nil
+	}
+	stream, err := ds.StreamResources(ctx, chain.ResourceType, "", filters)
+	if err != nil {
+		return nil, fmt.Errorf("failed to search %s for chained parameter %s: %w", chain.ResourceType, filter.Code, err)
+	}
+
+	seen := make(map[string]bool)
+	var values []string
+	for result := range stream.Resources {
+		for _, value := range p.chainValues(ctx, chain, resourceType, result, stream.RemainingFilters) {
+			if seen[value] {
+				continue
+			}
+			if len(values) == maxChainMatches {
+				return nil, fmt.Errorf("%w: %s matches more than %d resources of %s", ErrTooManyChainMatches, filter.Code, maxChainMatches, chain.ResourceType)
+			}
+			seen[value] = true
+			values = append(values, value)
+		}
+	}
+	if err := stream.Err(); err != nil {
+		return nil, fmt.Errorf("failed to search %s for chained parameter %s: %w", chain.ResourceType, filter.Code, err)
+	}
+
+	p.log.Debug().
+		Str("code", filter.Code).
+		Str("resourceType", chain.ResourceType).
+		Int("matches", len(values)).
+		Msg("Resolved chained search parameter")
+	if len(values) == 0 {
+		return nil, nil
+	}
+
+	plain := &types.Filter{Code: chain.Reference, Type: "reference", IsValid: true}
+	if chain.Reverse {
+		plain = &types.Filter{Code: "_id", Type: "token", IsValid: true}
+	}
+	plain.SetValue(strings.Join(values, ","))
+	return plain, nil
+}
+
+// chainValues returns the values an inner resource of a chain adds to its plain filter. The
+// resource is only processed when its references are needed or filters remain to be checked, it
+// is not validated so the validation policy does not change what a chain matches.
+func (p *ProcessorService) chainValues(ctx context.Context, chain *types.Chain, resourceType string, result datasource.ResourceResult, filters []*types.Filter) []string {
+	if !chain.Reverse && len(filters) == 0 {
+		if id := datasource.ResultID(result, chain.ResourceType); id != "" {
+			return []string{chain.ResourceType + "/" + id}
+		}
+	}
+
+	rc := p.newResourceContext(chain.ResourceType, result)
+	resource, err := rc.processSingleResource(filters)
+	if err != nil {
+		p.log.Error().Err(err).Msg("Error processing resource of chained search")
+		return nil
+	}
+	if resource == nil {
+		return nil
+	}
+	passed, err := rc.matchesFilters(ctx, resource, filters)
+	if err != nil {
+		p.log.Error().Err(err).Msg("Error filtering resource of chained search")
+		return nil
+	}
+	if !passed {
+		return nil
+	}
+
+	if chain.Reverse {
+		return p.referencedIDs(chain, resourceType, resource)
+	}
+	if id := resourceID(resource); id != "" {
+		return []string{chain.ResourceType + "/" + id}
+	}
+	return nil
+}
+
+// referencedIDs returns the ids of the resources of a resource type an inner resource of _has
+// refers to with the reference parameter of the chain
+func (p *ProcessorService) referencedIDs(chain *types.Chain, resourceType string, resource interface{}) []string {
+	expression := p.pathInfoSvc.GetSearchExpression(chain.ResourceType, chain.Reference)
+	if expression == nil {
+		return nil
+	}
+	values, err := expression.Evaluate(resource)
+	if err != nil {
+		p.log.Debug().
+			Err(err).
+			Str("code", chain.Reference).
+			Msg("Failed to evaluate reference search parameter")
+		return nil
+	}
+
+	var ids []string
+	for _, value := range values {
+		reference, ok := value.(fhir.Reference)
+		if !ok || reference.Reference == nil {
+			continue
+		}
+		// Relative or absolute literal references, e.g. Patient/123 or https://example.org/fhir/Patient/123/_history/2
+		literal, _, _ := strings.Cut(*reference.Reference, "/_history/")
+		parts := strings.Split(literal, "/")
+		if len(parts) >= 2 && parts[len(parts)-2] == resourceType && parts[len(parts)-1] != "" {
+			ids = append(ids, parts[len(parts)-1])
+		}
+	}
+	return ids
+}
+
+// resourceID returns the id of a processed resource
+func resourceID(resource interface{}) string {
+	instance, err := resourceJSON(resource)
+	if err != nil {
+		return ""
+	}
+	id, _ := instance["id"].(string)
+	return id
+}
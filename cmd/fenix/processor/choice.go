@@ -0,0 +1,414 @@
+package processor
+
+import (
+	"fmt"
+	"reflect"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/SanteonNL/fenix/cmd/fenix/datasource"
+	"github.com/SanteonNL/fenix/cmd/fenix/types"
+	"github.com/SanteonNL/fenix/models/fhir"
+)
+
+// choiceTypeSuffix is the suffix of the column that names the type of a choice element,
+// e.g. value[x]:type holds Quantity when value[x].value and value[x].unit hold a Quantity
+const choiceTypeSuffix = "[x]:type"
+
+// choiceTypes are the FHIR data types a choice element can have. The Go field of a choice
+// element is its name followed by one of these, e.g. ValueQuantity or EffectiveDateTime.
+var choiceTypes = []string{
+	"Base64Binary", "Boolean", "Canonical", "Code", "Date", "DateTime", "Decimal", "Id", "Instant",
+	"Integer", "Markdown", "Oid", "PositiveInt", "String", "Time", "UnsignedInt", "Uri", "Url", "Uuid",
+	"Address", "Age", "Annotation", "Attachment", "CodeableConcept", "Coding", "ContactPoint", "Count",
+	"Distance", "Duration", "HumanName", "Identifier", "Money", "Period", "Quantity", "Range", "Ratio",
+	"Reference", "SampledData", "Signature", "Timing", "ContactDetail", "Contributor", "DataRequirement",
+	"Expression", "ParameterDefinition", "RelatedArtifact", "TriggerDefinition", "UsageContext", "Dosage", "Meta",
+}
+
+// choiceGroup is a choice element of a struct, e.g. value[x] of Observation
+type choiceGroup struct {
+	name     string          // Go name of the element without type, e.g. Value
+	variants []choiceVariant // one per allowed type
+}
+
+// choiceVariant is the Go field of one type of a choice element
+type choiceVariant struct {
+	typeName  string // e.g. Quantity
+	fieldName string // e.g. ValueQuantity
+	jsonName  string // e.g. valueQuantity
+}
+
+// choiceElements are the choice elements of the FHIR R4 data types and the resources that are
+// supported, by the Go type that holds them. The Go fields alone do not tell a choice element,
+// e.g. reasonCode and reasonReference of Encounter are two elements.
+var choiceElements = map[string][]string{
+	"Annotation":                  {"author"},
+	"Condition":                   {"onset", "abatement"},
+	"DataRequirement":             {"subject"},
+	"DataRequirementDateFilter":   {"value"},
+	"Dosage":                      {"asNeeded"},
+	"DosageDoseAndRate":           {"dose", "rate"},
+	"Extension":                   {"value"},
+	"Immunization":                {"occurrence"},
+	"ImmunizationProtocolApplied": {"doseNumber", "seriesDoses"},
+	"Observation":                 {"effective", "value"},
+	"ObservationComponent":        {"value"},
+	"Patient":                     {"deceased", "multipleBirth"},
+	"Procedure":                   {"performed"},
+	"TimingRepeat":                {"bounds"},
+	"TriggerDefinition":           {"timing"},
+	"UsageContext":                {"value"},
+}
+
+// choiceGroupCache holds the choice groups per struct type
+var choiceGroupCache sync.Map
+
+// choiceGroups returns the choice elements of a struct type, with a variant for each field of
+// the element name followed by a FHIR data type
+func choiceGroups(t reflect.Type) []choiceGroup {
+	if cached, ok := choiceGroupCache.Load(t); ok {
+		return cached.([]choiceGroup)
+	}
+
+	var groups []choiceGroup
+	for _, element := range choiceElements[t.Name()] {
+		group := choiceGroup{name: strings.ToUpper(element[:1]) + element[1:]}
+		for i := 0; i < t.NumField(); i++ {
+			fieldName := t.Field(i).Name
+			if !strings.HasPrefix(fieldName, group.name) {
+				continue
+			}
+			typeName := strings.TrimPrefix(fieldName, group.name)
+			if slices.Contains(choiceTypes, typeName) {
+				group.variants = append(group.variants, choiceVariant{typeName: typeName, fieldName: fieldName, jsonName: types.JSONName(t.Field(i))})
+			}
+		}
+		if len(group.variants) > 0 {
+			groups = append(groups, group)
+		}
+	}
+
+	choiceGroupCache.Store(t, groups)
+	return groups
+}
+
+// findChoiceGroup returns the choice element of a struct type by name, case insensitive
+func findChoiceGroup(t reflect.Type, name string) *choiceGroup {
+	for _, group := range choiceGroups(t) {
+		if strings.EqualFold(group.name, name) {
+			return &group
+		}
+	}
+	return nil
+}
+
+// variant returns the Go field of a type of the choice element, case insensitive
+func (g *choiceGroup) variant(typeName string) (choiceVariant, bool) {
+	for _, variant := range g.variants {
+		if strings.EqualFold(variant.typeName, typeName) {
+			return variant, true
+		}
+	}
+	return choiceVariant{}, false
+}
+
+// normalizeResult prepares the rows of a resource for population. Paths are written with the json
+// names of the Go fields, so valueQuantity and valuequantity are the same element. Extensions are
+// resolved against their definitions. Choice elements that are given as <name>[x] with a
+// <name>[x]:type column are moved to the field of that type.
+func (p *resourceContext) normalizeResult(resourceType reflect.Type) error {
+	result := canonicalResultPaths(p.result, resourceType)
+	if err := p.resolveExtensions(result); err != nil {
+		return err
+	}
+
+	// Moved rows get new paths that can hold choice elements themselves, so repeat until done
+	for resolved := true; resolved; {
+		resolved = false
+
+		paths := make([]string, 0, len(result))
+		for path := range result {
+			paths = append(paths, path)
+		}
+		sort.Strings(paths)
+
+		for _, path := range paths {
+			for _, row := range result[path] {
+				for key, value := range row.Data {
+					if !strings.HasSuffix(strings.ToLower(key), choiceTypeSuffix) {
+						continue
+					}
+					if err := p.resolveChoiceType(result, resourceType, path, row, key, value); err != nil {
+						return err
+					}
+					resolved = true
+				}
+			}
+		}
+	}
+
+	p.result = result
+	return nil
+}
+
+// resolveChoiceType moves the value of a choice element to the Go field of the type in its type column
+func (p *resourceContext) resolveChoiceType(result datasource.ResourceResult, resourceType reflect.Type, path string, row datasource.RowData, key string, typeValue interface{}) error {
+	delete(row.Data, key)
+	name := key[:len(key)-len(choiceTypeSuffix)]
+	typeName := fmt.Sprint(typeValue)
+	if b, ok := typeValue.([]byte); ok {
+		typeName = string(b)
+	}
+
+	structType := structTypeAt(resourceType, strings.Split(path, ".")[1:])
+	if structType == nil {
+		return fmt.Errorf("no element found for path %s", path)
+	}
+	group := findChoiceGroup(structType, name)
+	if group == nil {
+		return fmt.Errorf("%s.%s is not a choice element", path, name)
+	}
+	variant, ok := group.variant(typeName)
+	if !ok {
+		return fmt.Errorf("%s.%s[x] has no type %s", path, name, typeName)
+	}
+
+	p.log.Debug().
+		Str("path", path).
+		Str("element", name).
+		Str("type", typeName).
+		Str("field", variant.fieldName).
+		Msg("Resolved choice type")
+
+	// Primitive types are in the row itself
+	for dataKey, value := range row.Data {
+		if strings.EqualFold(dataKey, name+"[x]") {
+			delete(row.Data, dataKey)
+			row.Data[variant.jsonName] = value
+		}
+	}
+
+	// Complex types are rows of their own, children of the root have no parent ID
+	parents := map[string]bool{row.ID: true}
+	if !strings.Contains(path, ".") {
+		parents[""] = true
+	}
+	moveRows(result, path+"."+name, path+"."+variant.jsonName, parents)
+
+	return nil
+}
+
+// moveRows moves the rows of the parents from one path to another, together with all their descendants
+func moveRows(result datasource.ResourceResult, from string, to string, parents map[string]bool) {
+	var kept []datasource.RowData
+	moved := make(map[string]bool)
+	for _, row := range result[from] {
+		if parents[row.ParentID] {
+			result[to] = append(result[to], row)
+			moved[row.ID] = true
+		} else {
+			kept = append(kept, row)
+		}
+	}
+	if len(moved) == 0 {
+		return
+	}
+	if len(kept) == 0 {
+		delete(result, from)
+	} else {
+		result[from] = kept
+	}
+
+	var children []string
+	for path := range result {
+		if strings.HasPrefix(path, from+".") && !strings.Contains(path[len(from)+1:], ".") {
+			children = append(children, path)
+		}
+	}
+	for _, child := range children {
+		moveRows(result, child, to+child[len(from):], moved)
+	}
+}
+
+// canonicalResultPaths returns a copy of the result with the elements of all paths written as the
+// json names of the Go fields, case insensitive. Rows of paths that only differ in case are merged.
+func canonicalResultPaths(result datasource.ResourceResult, resourceType reflect.Type) datasource.ResourceResult {
+	canonical := make(datasource.ResourceResult, len(result))
+	for path, rows := range result {
+		path = canonicalPath(resourceType, path)
+
+		for _, row := range rows {
+			merged := false
+			for _, existing := range canonical[path] {
+				if existing.ID == row.ID && existing.ParentID == row.ParentID {
+					for key, value := range row.Data {
+						existing.Data[key] = value
+					}
+					merged = true
+					break
+				}
+			}
+			if !merged {
+				data := make(map[string]interface{}, len(row.Data))
+				for key, value := range row.Data {
+					data[key] = value
+				}
+				canonical[path] = append(canonical[path], datasource.RowData{ID: row.ID, ParentID: row.ParentID, Data: data})
+			}
+		}
+	}
+	return canonical
+}
+
+// canonicalPath writes the elements of a path as the json names of the Go fields. Elements that
+// are not fields, e.g. value of value[x], are kept as written and end the lookup.
+func canonicalPath(resourceType reflect.Type, path string) string {
+	parts := strings.Split(path, ".")
+	t := elementType(resourceType)
+	for i := 1; i < len(parts) && t != nil; i++ {
+		field, found := structFieldByJSONName(t, parts[i])
+		if !found {
+			break
+		}
+		parts[i] = types.JSONName(field)
+		t = elementType(field.Type)
+	}
+	return strings.Join(parts, ".")
+}
+
+// structTypeAt returns the struct type of the element at the path below a struct type,
+// or nil if there is no such struct element
+func structTypeAt(t reflect.Type, path []string) reflect.Type {
+	t = elementType(t)
+	for _, part := range path {
+		field, found := structFieldByJSONName(t, part)
+		if !found {
+			return nil
+		}
+		t = elementType(field.Type)
+	}
+	if t.Kind() != reflect.Struct {
+		return nil
+	}
+	return t
+}
+
+// structFieldByJSONName returns the field of a struct type by its json name, case insensitive
+func structFieldByJSONName(t reflect.Type, name string) (reflect.StructField, bool) {
+	if t.Kind() != reflect.Struct {
+		return reflect.StructField{}, false
+	}
+	for i := 0; i < t.NumField(); i++ {
+		if strings.EqualFold(types.JSONName(t.Field(i)), name) {
+			return t.Field(i), true
+		}
+	}
+	return reflect.StructField{}, false
+}
+
+// elementType returns the type of the values of pointer and slice types
+func elementType(t reflect.Type) reflect.Type {
+	for t.Kind() == reflect.Ptr || t.Kind() == reflect.Slice {
+		t = t.Elem()
+	}
+	return t
+}
+
+// checkChoiceTypes checks that every choice element of a populated resource has at most one
+// type set, and maps the codes of the coded types with the ConceptMaps of their binding
+func (p *resourceContext) checkChoiceTypes(value reflect.Value, fhirPath string) error {
+	switch value.Kind() {
+	case reflect.Ptr:
+		if value.IsNil() {
+			return nil
+		}
+		return p.checkChoiceTypes(value.Elem(), fhirPath)
+	case reflect.Slice:
+		for i := 0; i < value.Len(); i++ {
+			if err := p.checkChoiceTypes(value.Index(i), fhirPath); err != nil {
+				return err
+			}
+		}
+		return nil
+	case reflect.Struct:
+	default:
+		return nil
+	}
+
+	structType := value.Type()
+	for _, group := range choiceGroups(structType) {
+		elementPath := fmt.Sprintf("%s.%s[x]", fhirPath, strings.ToLower(group.name[:1])+group.name[1:])
+
+		var set []string
+		for _, variant := range group.variants {
+			field := value.FieldByName(variant.fieldName)
+			if field.IsZero() {
+				continue
+			}
+			set = append(set, variant.fieldName)
+
+			if variant.typeName == "CodeableConcept" || variant.typeName == "Coding" {
+				p.mapChoiceCodings(elementPath, field)
+			}
+		}
+		if len(set) > 1 {
+			return fmt.Errorf("choice element %s has more than one type: %s", elementPath, strings.Join(set, ", "))
+		}
+	}
+
+	for i := 0; i < structType.NumField(); i++ {
+		field := structType.Field(i)
+		if field.PkgPath != "" || elementType(field.Type).Kind() != reflect.Struct {
+			continue
+		}
+		if err := p.checkChoiceTypes(value.Field(i), fhirPath+"."+types.JSONName(field)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mapChoiceCodings translates the codings of a coded choice type with the ConceptMaps of the
+// ValueSet the profile of the resource binds to the choice element, e.g. Observation.value[x]
+func (p *resourceContext) mapChoiceCodings(elementPath string, field reflect.Value) {
+	conceptMapURLs, err := p.pathInfoSvc.GetConceptMaps(p.profile, elementPath)
+	if err != nil {
+		p.log.Debug().Err(err).Str("profile", p.profile).Msg("No ConceptMap for choice element binding")
+		return
+	}
+
+	var codings []*fhir.Coding
+	switch v := field.Interface().(type) {
+	case *fhir.Coding:
+		codings = append(codings, v)
+	case *fhir.CodeableConcept:
+		for i := range v.Coding {
+			codings = append(codings, &v.Coding[i])
+		}
+	}
+
+	for _, coding := range codings {
+		if coding.Code == nil {
+			continue
+		}
+		translated, err := p.conceptMapSvc.TranslateCode(conceptMapURLs, *coding.Code, false)
+		if err != nil {
+			p.log.Error().Err(err).Str("path", elementPath).Msg("Failed to translate code")
+			continue
+		}
+		if translated == nil {
+			p.log.Debug().Str("path", elementPath).Str("code", *coding.Code).Msg("No translation found")
+			continue
+		}
+		coding.Code = stringPtr(translated.TargetCode)
+		if translated.TargetDisplay != "" {
+			coding.Display = stringPtr(translated.TargetDisplay)
+		}
+		if translated.TargetSystem != "" {
+			coding.System = stringPtr(translated.TargetSystem)
+		}
+	}
+}
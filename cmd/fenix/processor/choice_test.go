@@ -0,0 +1,219 @@
+package processor
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/SanteonNL/fenix/cmd/fenix/datasource"
+	"github.com/SanteonNL/fenix/models/fhir"
+	"github.com/rs/zerolog"
+)
+
+// newTestContext creates the processing state of a resource without the FHIR services
+func newTestContext(resourceType string, result datasource.ResourceResult) *resourceContext {
+	p := &ProcessorService{log: zerolog.Nop(), policy: ValidationPolicyFlag}
+	return p.newResourceContext(resourceType, result)
+}
+
+func TestChoiceGroups(t *testing.T) {
+	tests := []struct {
+		name   string
+		value  interface{}
+		groups map[string][]string
+	}{
+		{
+			name:  "Observation",
+			value: fhir.Observation{},
+			groups: map[string][]string{
+				"Effective": {"DateTime", "Period", "Timing", "Instant"},
+				"Value":     {"Quantity", "CodeableConcept", "String", "Boolean", "Integer", "Range", "Ratio", "SampledData", "Time", "DateTime", "Period"},
+			},
+		},
+		{
+			name:   "Patient",
+			value:  fhir.Patient{},
+			groups: map[string][]string{"Deceased": {"Boolean", "DateTime"}, "MultipleBirth": {"Boolean", "Integer"}},
+		},
+		{
+			// reasonCode, reasonReference, instantiatesCanonical, instantiatesUri, usedReference and
+			// usedCode are elements of their own
+			name:   "Procedure",
+			value:  fhir.Procedure{},
+			groups: map[string][]string{"Performed": {"DateTime", "Period", "String", "Age", "Range"}},
+		},
+		{
+			name:   "Encounter",
+			value:  fhir.Encounter{},
+			groups: map[string][]string{},
+		},
+		{
+			name:   "Immunization",
+			value:  fhir.Immunization{},
+			groups: map[string][]string{"Occurrence": {"DateTime", "String"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			groups := make(map[string][]string)
+			for _, group := range choiceGroups(reflect.TypeOf(tt.value)) {
+				for _, variant := range group.variants {
+					groups[group.name] = append(groups[group.name], variant.typeName)
+				}
+			}
+			if !reflect.DeepEqual(groups, tt.groups) {
+				t.Errorf("expected %v, got %v", tt.groups, groups)
+			}
+		})
+	}
+}
+
+func TestCheckChoiceTypes(t *testing.T) {
+	reason := "reason"
+	now := "2024-01-01"
+	text := "text"
+	yes := true
+
+	tests := []struct {
+		name     string
+		resource interface{}
+		wantErr  string
+	}{
+		{
+			name: "elements with a common prefix",
+			resource: &fhir.Procedure{
+				ReasonCode:            []fhir.CodeableConcept{{Text: &reason}},
+				ReasonReference:       []fhir.Reference{{Reference: &reason}},
+				InstantiatesCanonical: []string{"http://example.org/a"},
+				InstantiatesUri:       []string{"http://example.org/b"},
+				PerformedString:       &text,
+			},
+		},
+		{
+			name:     "single type",
+			resource: &fhir.Patient{DeceasedBoolean: &yes},
+		},
+		{
+			name:     "two types",
+			resource: &fhir.Procedure{PerformedString: &text, PerformedDateTime: &now},
+			wantErr:  "Procedure.performed[x] has more than one type",
+		},
+		{
+			name:     "two types in a backbone element",
+			resource: &fhir.Immunization{ProtocolApplied: []fhir.ImmunizationProtocolApplied{{DoseNumberString: "one", DoseNumberPositiveInt: 1}}},
+			wantErr:  "Immunization.protocolApplied.doseNumber[x] has more than one type",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resourceType := reflect.TypeOf(tt.resource).Elem().Name()
+			err := newTestContext(resourceType, nil).checkChoiceTypes(reflect.ValueOf(tt.resource), resourceType)
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Errorf("unexpected error: %v", err)
+			case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+				t.Errorf("expected error %q, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestNormalizeResultResolvesChoiceTypes(t *testing.T) {
+	result := datasource.ResourceResult{
+		"Observation": {{ID: "o1", Data: map[string]interface{}{
+			"id":                "o1",
+			"effective[x]":      "2024-01-01",
+			"effective[x]:type": "dateTime",
+			"value[x]:type":     "Quantity",
+		}}},
+		"Observation.value": {{ID: "v1", ParentID: "", Data: map[string]interface{}{"value": 72.5, "unit": "kg"}}},
+		"Observation.value.extension": {{ID: "e1", ParentID: "v1", Data: map[string]interface{}{
+			"url": "http://example.org/extension",
+		}}},
+	}
+
+	rc := newTestContext("Observation", result)
+	if err := rc.normalizeResult(reflect.TypeOf(fhir.Observation{})); err != nil {
+		t.Fatalf("normalizeResult: %v", err)
+	}
+
+	root := rc.result["Observation"][0].Data
+	if root["effectiveDateTime"] != "2024-01-01" {
+		t.Errorf("expected effective[x] to move to effectiveDateTime, got %v", root)
+	}
+	for key := range root {
+		if strings.Contains(key, "[x]") {
+			t.Errorf("expected %s to be resolved", key)
+		}
+	}
+	if len(rc.result["Observation.valueQuantity"]) != 1 {
+		t.Errorf("expected the value rows to move to valueQuantity, got paths %v", resultPaths(rc.result))
+	}
+	if len(rc.result["Observation.valueQuantity.extension"]) != 1 {
+		t.Errorf("expected the descendants to move along, got paths %v", resultPaths(rc.result))
+	}
+	if _, exists := rc.result["Observation.value"]; exists {
+		t.Errorf("expected Observation.value to be moved, got paths %v", resultPaths(rc.result))
+	}
+}
+
+func TestNormalizeResultRejectsUnknownChoiceTypes(t *testing.T) {
+	tests := []struct {
+		name         string
+		resourceType string
+		key          string
+		want         string
+	}{
+		{"unknown type", "Observation", "value[x]:type", "has no type Money"},
+		{"not a choice element", "Procedure", "reasonCode[x]:type", "is not a choice element"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := datasource.ResourceResult{
+				tt.resourceType: {{ID: "1", Data: map[string]interface{}{tt.key: "Money"}}},
+			}
+			err := newTestContext(tt.resourceType, result).normalizeResult(reflect.TypeOf(testModels[tt.resourceType]))
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("expected error %q, got %v", tt.want, err)
+			}
+		})
+	}
+}
+
+func TestCanonicalPath(t *testing.T) {
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"Patient.Name.Given", "Patient.name.given"},
+		{"Patient.multiplebirthinteger", "Patient.multipleBirthInteger"},
+		{"Observation.component.valuequantity.value", "Observation.component.valueQuantity.value"},
+		{"Observation.value.unknown", "Observation.value.unknown"},
+	}
+
+	for _, tt := range tests {
+		resourceType := reflect.TypeOf(testModels[strings.Split(tt.path, ".")[0]])
+		if got := canonicalPath(resourceType, tt.path); got != tt.want {
+			t.Errorf("canonicalPath(%s): expected %s, got %s", tt.path, tt.want, got)
+		}
+	}
+}
+
+// testModels are the models of the resource types of the tests
+var testModels = map[string]interface{}{
+	"Observation": fhir.Observation{},
+	"Patient":     fhir.Patient{},
+	"Procedure":   fhir.Procedure{},
+}
+
+// resultPaths returns the paths of a result
+func resultPaths(result datasource.ResourceResult) []string {
+	var paths []string
+	for path := range result {
+		paths = append(paths, path)
+	}
+	return paths
+}
@@ -0,0 +1,103 @@
+package processor
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/SanteonNL/fenix/cmd/fenix/datasource"
+	"github.com/SanteonNL/fenix/models/fhir"
+)
+
+// resolveExtensions resolves the url of every extension against the loaded profiles. An extension
+// may name its definition by StructureDefinition name instead of canonical url, and may give its
+// value as value without type when the definition allows a single type.
+func (p *resourceContext) resolveExtensions(result datasource.ResourceResult) error {
+	for path, rows := range result {
+		if !strings.HasSuffix(path, ".extension") && !strings.HasSuffix(path, ".modifierExtension") {
+			continue
+		}
+
+		for _, row := range rows {
+			url, ok := row.Data["url"].(string)
+			if !ok {
+				continue
+			}
+
+			var definition *fhir.StructureDefinition
+			if p.structDefSvc != nil {
+				definition, _ = p.structDefSvc.GetStructureDefinition(url)
+			}
+			if definition != nil && definition.Url != url {
+				p.log.Debug().Str("name", url).Str("url", definition.Url).Msg("Resolved extension url")
+				row.Data["url"] = definition.Url
+				url = definition.Url
+			}
+
+			if !hasUntypedValue(result, path, row) {
+				continue
+			}
+			if definition == nil {
+				return fmt.Errorf("extension %s at %s has a value without type and no StructureDefinition", url, path)
+			}
+			typeName, err := extensionValueType(definition)
+			if err != nil {
+				return fmt.Errorf("extension %s at %s: %w", url, path, err)
+			}
+
+			// The value is resolved like any other choice element with a type column
+			for key, value := range row.Data {
+				if strings.EqualFold(key, "value") {
+					delete(row.Data, key)
+					row.Data["value[x]"] = value
+				}
+			}
+			row.Data["value"+choiceTypeSuffix] = typeName
+		}
+	}
+	return nil
+}
+
+// hasUntypedValue reports whether an extension row has a value without type, either a primitive
+// value column or complex value rows
+func hasUntypedValue(result datasource.ResourceResult, path string, row datasource.RowData) bool {
+	for key := range row.Data {
+		if strings.EqualFold(key, "value"+choiceTypeSuffix) {
+			return false
+		}
+	}
+	for key := range row.Data {
+		if strings.EqualFold(key, "value") {
+			return true
+		}
+	}
+	for _, valueRow := range result[path+".value"] {
+		if valueRow.ParentID == row.ID {
+			return true
+		}
+	}
+	return false
+}
+
+// extensionValueType returns the type of Extension.value[x] of an extension definition
+func extensionValueType(definition *fhir.StructureDefinition) (string, error) {
+	var elements []fhir.ElementDefinition
+	if definition.Snapshot != nil {
+		elements = definition.Snapshot.Element
+	} else if definition.Differential != nil {
+		elements = definition.Differential.Element
+	}
+
+	for _, element := range elements {
+		if element.Path != "Extension.value[x]" {
+			continue
+		}
+		if element.Max != nil && *element.Max == "0" {
+			return "", fmt.Errorf("extension has no value")
+		}
+		if len(element.Type) != 1 {
+			return "", fmt.Errorf("extension value has %d types, use value<Type>", len(element.Type))
+		}
+		return element.Type[0].Code, nil
+	}
+	return "", fmt.Errorf("no value[x] element in StructureDefinition %s", definition.Url)
+}
@@ -3,143 +3,145 @@ package processor
 import (
 	"context"
 	"fmt"
-	"reflect"
+	"strconv"
 	"strings"
 
 	"github.com/SanteonNL/fenix/cmd/fenix/types"
-	"github.com/SanteonNL/fenix/models/fhir"
 )
 
-func (p *ProcessorService) checkFilter(ctx context.Context, field reflect.Value, path string, searchType string, filter *types.Filter) (bool, error) {
-	switch searchType {
-	case "token":
-		return p.checkTokenFilter(ctx, field, path, filter.Value)
-	case "string":
-		return p.checkStringFilter(field, filter.Value)
-	case "date":
-		return p.checkDateFilter(field, filter.Value)
-	default:
-		p.log.Debug().
-			Str("type", searchType).
-			Msg("Unsupported search parameter type")
+// matchesFilters checks a processed resource against the filters that were not pushed down to the datasource
+func (p *resourceContext) matchesFilters(ctx context.Context, resource interface{}, filters []*types.Filter) (bool, error) {
+	if len(filters) == 0 {
 		return true, nil
 	}
-}
-
-func (p *ProcessorService) checkTokenFilter(ctx context.Context, field reflect.Value, path string, filterValue string) (bool, error) {
-	// Get path info to check for ValueSet
-	pathInfo, err := p.pathInfoSvc.GetPathInfo(path)
-	if err == nil && pathInfo.ValueSet != "" {
-		return p.checkValueSetFilter(ctx, field, pathInfo.ValueSet)
+	instance, err := resourceJSON(resource)
+	if err != nil {
+		return false, err
 	}
 
-	// If no ValueSet, do direct comparison
-	code := getCodeFromField(field)
-	return code == filterValue, nil
-}
-
-func (p *ProcessorService) checkValueSetFilter(ctx context.Context, field reflect.Value, valueSetURL string) (bool, error) {
-	switch field.Type().String() {
-	case "fhir.Coding", "*fhir.Coding":
-		coding := getCodingFromField(field)
-		if coding == nil {
-			return false, nil
-		}
-		valid, err := p.valueSetSvc.ValidateCode(ctx, valueSetURL, coding)
+	for _, filter := range filters {
+		passed, err := p.matchesFilter(ctx, instance, filter)
 		if err != nil {
 			return false, err
 		}
-		return valid.Valid, nil
-
-	case "fhir.CodeableConcept", "*fhir.CodeableConcept":
-		concept := getCodeableConceptFromField(field)
-		if concept == nil {
+		if !passed {
+			p.log.Debug().
+				Str("code", filter.Code).
+				Str("value", filter.Value).
+				Msg("Resource did not pass filter")
 			return false, nil
 		}
-		for _, coding := range concept.Coding {
-			valid, err := p.valueSetSvc.ValidateCode(ctx, valueSetURL, &coding)
-			if err == nil && valid.Valid {
-				return true, nil
-			}
-		}
-		return false, nil
-
-	default:
-		return false, fmt.Errorf("unsupported field type for ValueSet validation: %s", field.Type().String())
 	}
+	return true, nil
 }
 
-// Helper functions
+// matchesFilter checks whether the resource matches one of the values of a filter. A negating
+// filter, :not, :not-in or the ne prefix, has to hold for all of its values instead.
+func (p *resourceContext) matchesFilter(ctx context.Context, instance map[string]interface{}, filter *types.Filter) (bool, error) {
+	values := p.searchValues(instance, filter)
 
-func getCodeFromField(field reflect.Value) string {
-	switch field.Type().String() {
-	case "fhir.Coding", "*fhir.Coding":
-		coding := getCodingFromField(field)
-		if coding != nil && coding.Code != nil {
-			return *coding.Code
-		}
-	case "fhir.CodeableConcept", "*fhir.CodeableConcept":
-		concept := getCodeableConceptFromField(field)
-		if concept != nil && len(concept.Coding) > 0 && concept.Coding[0].Code != nil {
-			return *concept.Coding[0].Code
+	negating := filter.IsNegating()
+	for _, alternative := range filter.Alternatives() {
+		passed, err := p.matchesValue(ctx, values, alternative)
+		if err != nil {
+			return false, err
 		}
-	case "string", "*string":
-		if field.Kind() == reflect.Ptr {
-			if field.IsNil() {
-				return ""
-			}
-			return field.Elem().String()
+		if passed != negating {
+			return passed, nil
 		}
-		return field.String()
 	}
-	return ""
+	return negating, nil
 }
 
-func getCodingFromField(field reflect.Value) *fhir.Coding {
-	if field.Kind() == reflect.Ptr {
-		if field.IsNil() {
-			return nil
+// matchesValue checks whether an element the search parameter selects passes a filter with a
+// single value. A negating filter passes when no element has the value.
+func (p *resourceContext) matchesValue(ctx context.Context, values []interface{}, filter *types.Filter) (bool, error) {
+	switch modifier := strings.ToLower(filter.Modifier); modifier {
+	case "missing":
+		missing, err := strconv.ParseBool(filter.Value)
+		if err != nil {
+			return false, fmt.Errorf("missing expects true or false, got %q", filter.Value)
+		}
+		return (len(values) == 0) == missing, nil
+	case "not", "not-in":
+		positive := *filter
+		positive.Modifier = ""
+		if modifier == "not-in" {
+			positive.Modifier = "in"
 		}
-		return field.Interface().(*fhir.Coding)
+		matched, err := p.anyValueMatches(ctx, values, &positive)
+		return !matched, err
 	}
-	return field.Addr().Interface().(*fhir.Coding)
+
+	if prefix, value := filter.Prefix(); prefix == "ne" && types.IsOrderedType(filter.Type) {
+		positive := *filter
+		positive.Modifier, positive.Value = "eq", value
+		matched, err := p.anyValueMatches(ctx, values, &positive)
+		return len(values) > 0 && !matched, err
+	}
+	return p.anyValueMatches(ctx, values, filter)
 }
 
-func getCodeableConceptFromField(field reflect.Value) *fhir.CodeableConcept {
-	if field.Kind() == reflect.Ptr {
-		if field.IsNil() {
-			return nil
+// anyValueMatches reports whether any of the values passes the filter
+func (p *resourceContext) anyValueMatches(ctx context.Context, values []interface{}, filter *types.Filter) (bool, error) {
+	for _, value := range values {
+		passed, err := p.checkFilter(ctx, value, filter)
+		if err != nil {
+			return false, err
+		}
+		if passed {
+			return true, nil
 		}
-		return field.Interface().(*fhir.CodeableConcept)
 	}
-	return field.Addr().Interface().(*fhir.CodeableConcept)
+	return false, nil
 }
 
-// Basic type filters
-
-func (p *ProcessorService) checkStringFilter(field reflect.Value, filterValue string) (bool, error) {
-	if field.Kind() == reflect.Ptr && !field.IsNil() {
-		field = field.Elem()
+// searchValues returns the json values of the elements the search parameter of a filter selects
+func (p *resourceContext) searchValues(instance map[string]interface{}, filter *types.Filter) []interface{} {
+	if filter.Code == "_id" {
+		if id, ok := instance["id"]; ok {
+			return []interface{}{id}
+		}
+		return nil
 	}
 
-	if field.Kind() != reflect.String {
-		return false, fmt.Errorf("field is not a string")
+	expression := p.pathInfoSvc.GetSearchExpression(p.resourceType, filter.Code)
+	if expression == nil {
+		return nil
 	}
-
-	return strings.Contains(strings.ToLower(field.String()),
-		strings.ToLower(filterValue)), nil
-}
-
-func (p *ProcessorService) checkDateFilter(field reflect.Value, filterValue string) (bool, error) {
-	// Basic date comparison - can be expanded based on requirements
-	if field.Kind() == reflect.Ptr && !field.IsNil() {
-		field = field.Elem()
+	values, err := expression.Evaluate(instance)
+	if err != nil {
+		p.log.Debug().
+			Err(err).
+			Str("code", filter.Code).
+			Str("expression", expression.String()).
+			Msg("Failed to evaluate search parameter expression")
+		return nil
 	}
+	return values
+}
 
-	date, ok := field.Interface().(fhir.Date)
-	if !ok {
-		return false, fmt.Errorf("field is not a date")
+// checkFilter checks a single json value against a filter with the semantics of its search type
+func (p *ProcessorService) checkFilter(ctx context.Context, value interface{}, filter *types.Filter) (bool, error) {
+	switch strings.ToLower(filter.Type) {
+	case "token":
+		return p.checkTokenFilter(ctx, value, filter)
+	case "string":
+		return checkStringFilter(value, filter)
+	case "date":
+		return checkDateFilter(value, filter)
+	case "number":
+		return checkNumberFilter(value, filter)
+	case "quantity":
+		return checkQuantityFilter(value, filter)
+	case "uri":
+		return checkURIFilter(value, filter)
+	case "reference":
+		return p.checkReferenceFilter(value, filter)
+	default:
+		p.log.Debug().
+			Str("type", filter.Type).
+			Msg("Unsupported search parameter type")
+		return true, nil
 	}
-
-	return date.String() == filterValue, nil
 }
@@ -0,0 +1,389 @@
+package processor
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/SanteonNL/fenix/models/fhir"
+)
+
+// profileSlicing is the slicing of an element of a profile
+type profileSlicing struct {
+	discriminators []fhir.ElementDefinitionSlicingDiscriminator
+	slices         []string // element ids of the slices, e.g. Patient.identifier:bsn
+}
+
+// profileValues applies the fixed and pattern values of a profile to the json form of a resource
+type profileValues struct {
+	resourceType string
+	elements     map[string]fhir.ElementDefinition // by element id
+	slicings     map[string]*profileSlicing        // by element id of the sliced element
+	changed      bool
+}
+
+// applyProfileValues fills in the fixed and pattern values of the profile of a resource, so query
+// files only have to supply the data itself. Values are added to the elements of the resource that
+// are present: a missing child gets the value, a pattern is merged into the value that is there.
+// Values that differ are left to validation. An element of a slice gets the values of the slice it
+// matches by the discriminators, or of the only slice it does not contradict.
+func (p *resourceContext) applyProfileValues(resource interface{}) (interface{}, error) {
+	if p.structDefSvc == nil {
+		return resource, nil
+	}
+
+	instance, err := resourceJSON(resource)
+	if err != nil {
+		return nil, err
+	}
+	profile := p.resourceProfile(instance)
+	if profile == nil || profile.Snapshot == nil {
+		return resource, nil
+	}
+
+	values := newProfileValues(p.resourceType, profile)
+	for _, element := range profile.Snapshot.Element {
+		value, typeName := profileValue(element)
+		if value == nil {
+			continue
+		}
+		values.apply(instance, element, value, typeName)
+	}
+	if !values.changed {
+		return resource, nil
+	}
+
+	data, err := json.Marshal(instance)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal resource: %w", err)
+	}
+	updated, err := p.createResource()
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, updated); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal resource with profile values: %w", err)
+	}
+	p.log.Debug().Str("profile", profile.Url).Msg("Applied fixed and pattern values of profile")
+	return updated, nil
+}
+
+// newProfileValues indexes the elements and slicings of the snapshot of a profile
+func newProfileValues(resourceType string, profile *fhir.StructureDefinition) *profileValues {
+	values := &profileValues{
+		resourceType: resourceType,
+		elements:     make(map[string]fhir.ElementDefinition),
+		slicings:     make(map[string]*profileSlicing),
+	}
+	for _, element := range profile.Snapshot.Element {
+		id := definitionID(element)
+		values.elements[id] = element
+		if element.Slicing != nil {
+			values.slicings[id] = &profileSlicing{discriminators: element.Slicing.Discriminator}
+		}
+		if element.SliceName != nil {
+			// Reslices, e.g. component:bp/systolic, are not applied
+			sliced := id[:strings.LastIndex(id, ":")]
+			if slicing, exists := values.slicings[sliced]; exists && !strings.Contains(*element.SliceName, "/") {
+				slicing.slices = append(slicing.slices, id)
+			}
+		}
+	}
+	return values
+}
+
+// apply adds the value of an element to every instance of its parent in the resource
+func (v *profileValues) apply(instance map[string]interface{}, element fhir.ElementDefinition, value interface{}, typeName string) {
+	id := definitionID(element)
+	dot := strings.LastIndex(id, ".")
+	if dot == -1 {
+		return
+	}
+	parentID, segment := id[:dot], id[dot+1:]
+	name, slice, _ := strings.Cut(segment, ":")
+
+	for _, parent := range v.nodes(instance, parentID) {
+		object, ok := parent.value.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		children := childNodes(parent, name)
+
+		// No elements are created for a slice, only the elements that belong to it get its values
+		if slice != "" {
+			for _, member := range v.sliceMembers(parentID+"."+name, id, children) {
+				v.changed = mergePattern(member.value, value) || v.changed
+			}
+			continue
+		}
+
+		if len(children) == 0 {
+			key := name
+			if choice := strings.TrimSuffix(name, "[x]"); choice != name {
+				key = choice + typeName
+			}
+			if repeats(element) {
+				object[key] = []interface{}{jsonValue(value)}
+			} else {
+				object[key] = jsonValue(value)
+			}
+			v.changed = true
+			continue
+		}
+		for _, child := range children {
+			v.changed = mergePattern(child.value, value) || v.changed
+		}
+	}
+}
+
+// nodes returns the instances of an element in a resource by its element id, the elements of a
+// slice being those that belong to the slice
+func (v *profileValues) nodes(instance map[string]interface{}, id string) []jsonNode {
+	segments := strings.Split(id, ".")
+	if segments[0] != v.resourceType {
+		return nil
+	}
+
+	nodes := []jsonNode{{location: v.resourceType, value: instance}}
+	elementID := v.resourceType
+	for _, segment := range segments[1:] {
+		name, slice, _ := strings.Cut(segment, ":")
+		var next []jsonNode
+		for _, node := range nodes {
+			children := childNodes(node, name)
+			if slice != "" {
+				children = v.sliceMembers(elementID+"."+name, elementID+"."+segment, children)
+			}
+			next = append(next, children...)
+		}
+		nodes = next
+		elementID += "." + segment
+	}
+	return nodes
+}
+
+// sliceMembers returns the instances of a sliced element that belong to the slice
+func (v *profileValues) sliceMembers(slicedID, sliceID string, children []jsonNode) []jsonNode {
+	slicing, exists := v.slicings[slicedID]
+	if !exists {
+		return nil
+	}
+	var members []jsonNode
+	for _, child := range children {
+		if v.sliceOf(slicing, child.value) == sliceID {
+			members = append(members, child)
+		}
+	}
+	return members
+}
+
+// sliceOf returns the slice an instance of a sliced element belongs to, the slice it matches or
+// else the only slice it does not contradict, or an empty string
+func (v *profileValues) sliceOf(slicing *profileSlicing, item interface{}) string {
+	var compatible []string
+	for _, slice := range slicing.slices {
+		matches, contradicts := v.matchesSlice(slicing, slice, item)
+		if matches {
+			return slice
+		}
+		if !contradicts {
+			compatible = append(compatible, slice)
+		}
+	}
+	if len(compatible) == 1 {
+		return compatible[0]
+	}
+	return ""
+}
+
+// matchesSlice reports whether an instance has the discriminator values of a slice, and whether it
+// has a value that is not the one of the slice. Only value and pattern discriminators are supported,
+// instances never match a slice with another kind of discriminator.
+func (v *profileValues) matchesSlice(slicing *profileSlicing, slice string, item interface{}) (matches, contradicts bool) {
+	if len(slicing.discriminators) == 0 {
+		return false, true
+	}
+
+	matches = true
+	for _, discriminator := range slicing.discriminators {
+		if discriminator.Type != fhir.DiscriminatorTypeValue && discriminator.Type != fhir.DiscriminatorTypePattern {
+			return false, true
+		}
+		expected := v.discriminatorValue(slice, discriminator.Path)
+		if expected == nil {
+			return false, true
+		}
+
+		found := valuesAt(item, discriminator.Path)
+		if len(found) == 0 {
+			matches = false
+			continue
+		}
+		matched := false
+		for _, value := range found {
+			if matchesPattern(value, expected) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false, true
+		}
+	}
+	return matches, false
+}
+
+// discriminatorValue returns the fixed or pattern value of the element of a slice a discriminator
+// path refers to
+func (v *profileValues) discriminatorValue(slice, path string) interface{} {
+	id := slice
+	if path != "$this" {
+		id += "." + path
+	}
+	element, exists := v.elements[id]
+	if !exists {
+		return nil
+	}
+	value, _ := profileValue(element)
+	return value
+}
+
+// valuesAt returns the values of a discriminator path within an instance
+func valuesAt(item interface{}, path string) []interface{} {
+	if path == "$this" {
+		return []interface{}{item}
+	}
+	nodes := []jsonNode{{value: item}}
+	for _, name := range strings.Split(path, ".") {
+		var next []jsonNode
+		for _, node := range nodes {
+			next = append(next, childNodes(node, name)...)
+		}
+		nodes = next
+	}
+
+	values := make([]interface{}, 0, len(nodes))
+	for _, node := range nodes {
+		values = append(values, node.value)
+	}
+	return values
+}
+
+// mergePattern adds the content of a pattern that a json object misses and reports whether it
+// changed the object. An array of the pattern has its items merged into an item that does not
+// contradict it, or appended.
+func mergePattern(value, pattern interface{}) bool {
+	object, ok := value.(map[string]interface{})
+	patternObject, isObject := pattern.(map[string]interface{})
+	if !ok || !isObject {
+		return false
+	}
+
+	changed := false
+	for key, patternValue := range patternObject {
+		existing, exists := object[key]
+		if !exists || isEmptyObject(existing) {
+			object[key] = jsonValue(patternValue)
+			changed = true
+			continue
+		}
+
+		switch patternValue := patternValue.(type) {
+		case map[string]interface{}:
+			changed = mergePattern(existing, patternValue) || changed
+		case []interface{}:
+			items, ok := existing.([]interface{})
+			if !ok {
+				continue
+			}
+			for _, patternItem := range patternValue {
+				if containsPattern(items, patternItem) {
+					continue
+				}
+				merged := false
+				for _, item := range items {
+					if !contradictsPattern(item, patternItem) {
+						merged = mergePattern(item, patternItem)
+						break
+					}
+				}
+				if !merged {
+					items = append(items, jsonValue(patternItem))
+				}
+				changed = true
+			}
+			object[key] = items
+		}
+	}
+	return changed
+}
+
+// containsPattern reports whether an item of an array matches the pattern
+func containsPattern(items []interface{}, pattern interface{}) bool {
+	for _, item := range items {
+		if matchesPattern(item, pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+// contradictsPattern reports whether a value has a primitive that differs from the pattern
+func contradictsPattern(value, pattern interface{}) bool {
+	switch pattern := pattern.(type) {
+	case map[string]interface{}:
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return true
+		}
+		for key, patternValue := range pattern {
+			if existing, exists := object[key]; exists && contradictsPattern(existing, patternValue) {
+				return true
+			}
+		}
+		return false
+	case []interface{}:
+		return false
+	default:
+		return !reflect.DeepEqual(value, pattern)
+	}
+}
+
+// profileValue returns the fixed value of an element, or else its pattern, with the name of its
+// type, e.g. Uri for fixedUri
+func profileValue(element fhir.ElementDefinition) (interface{}, string) {
+	value := reflect.ValueOf(element)
+	var pattern interface{}
+	var patternType string
+	for i := 0; i < value.NumField(); i++ {
+		fieldName := value.Type().Field(i).Name
+		field := value.Field(i)
+		if field.Kind() != reflect.Ptr || field.IsNil() {
+			continue
+		}
+		if typeName := strings.TrimPrefix(fieldName, "Fixed"); typeName != fieldName {
+			return jsonValue(field.Interface()), typeName
+		}
+		if typeName := strings.TrimPrefix(fieldName, "Pattern"); typeName != fieldName {
+			pattern, patternType = jsonValue(field.Interface()), typeName
+		}
+	}
+	return pattern, patternType
+}
+
+// repeats reports whether an element is an array in json, slices of an array are arrays as well
+func repeats(element fhir.ElementDefinition) bool {
+	if element.Base != nil {
+		return element.Base.Max != "1" && element.Base.Max != "0"
+	}
+	return element.Max != nil && *element.Max != "1" && *element.Max != "0"
+}
+
+// definitionID returns the id of an element definition, or its path when it has none
+func definitionID(element fhir.ElementDefinition) string {
+	if element.Id != nil {
+		return *element.Id
+	}
+	return element.Path
+}
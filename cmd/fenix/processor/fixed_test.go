@@ -0,0 +1,121 @@
+package processor
+
+import (
+	"testing"
+
+	"github.com/SanteonNL/fenix/models/fhir"
+)
+
+func TestApplyProfileValues(t *testing.T) {
+	const (
+		mrnSystem  = "http://example.org/mrn"
+		v2System   = "http://terminology.hl7.org/CodeSystem/v2-0203"
+		maritalURL = "http://terminology.hl7.org/CodeSystem/v3-MaritalStatus"
+	)
+	identifierType := func(code string) *fhir.CodeableConcept {
+		return &fhir.CodeableConcept{Coding: []fhir.Coding{{System: stringPtr(v2System), Code: stringPtr(code)}}}
+	}
+	inactive := false
+
+	tests := []struct {
+		name   string
+		modify func(*fhir.Patient)
+		check  func(*testing.T, *fhir.Patient)
+	}{
+		{
+			name:   "missing fixed value",
+			modify: func(patient *fhir.Patient) { patient.Active = nil },
+			check: func(t *testing.T, patient *fhir.Patient) {
+				if patient.Active == nil || !*patient.Active {
+					t.Errorf("expected active to be fixed to true, got %v", patient.Active)
+				}
+			},
+		},
+		{
+			name:   "differing fixed value",
+			modify: func(patient *fhir.Patient) { patient.Active = &inactive },
+			check: func(t *testing.T, patient *fhir.Patient) {
+				if patient.Active == nil || *patient.Active {
+					t.Errorf("expected active to be left to validation, got %v", patient.Active)
+				}
+			},
+		},
+		{
+			name: "pattern merged into a coding",
+			modify: func(patient *fhir.Patient) {
+				patient.MaritalStatus = &fhir.CodeableConcept{Coding: []fhir.Coding{{Code: stringPtr("S")}}}
+			},
+			check: func(t *testing.T, patient *fhir.Patient) {
+				coding := patient.MaritalStatus.Coding
+				if len(coding) != 1 || coding[0].System == nil || *coding[0].System != maritalURL || *coding[0].Code != "S" {
+					t.Errorf("expected the system of the pattern to be added to the coding, got %+v", coding)
+				}
+			},
+		},
+		{
+			name: "slice matched by its discriminator",
+			modify: func(patient *fhir.Patient) {
+				patient.Identifier = []fhir.Identifier{{Type: identifierType("MR"), Value: stringPtr("12345")}}
+			},
+			check: func(t *testing.T, patient *fhir.Patient) {
+				if system := patient.Identifier[0].System; system == nil || *system != mrnSystem {
+					t.Errorf("expected the fixed system of the slice, got %v", system)
+				}
+			},
+		},
+		{
+			name: "only slice that is not contradicted",
+			modify: func(patient *fhir.Patient) {
+				patient.Identifier = []fhir.Identifier{{Value: stringPtr("12345")}}
+			},
+			check: func(t *testing.T, patient *fhir.Patient) {
+				identifier := patient.Identifier[0]
+				if identifier.System == nil || *identifier.System != mrnSystem {
+					t.Errorf("expected the fixed system of the slice, got %v", identifier.System)
+				}
+				if identifier.Type == nil || len(identifier.Type.Coding) != 1 || *identifier.Type.Coding[0].Code != "MR" {
+					t.Errorf("expected the type pattern of the slice, got %+v", identifier.Type)
+				}
+			},
+		},
+		{
+			name: "contradicted slice",
+			modify: func(patient *fhir.Patient) {
+				patient.Identifier = []fhir.Identifier{{Type: identifierType("SS"), Value: stringPtr("12345")}}
+			},
+			check: func(t *testing.T, patient *fhir.Patient) {
+				if system := patient.Identifier[0].System; system != nil {
+					t.Errorf("expected no system for an identifier of another slice, got %s", *system)
+				}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			patient := validPatient()
+			tt.modify(patient)
+
+			updated, err := newValidationContext(t).applyProfileValues(patient)
+			if err != nil {
+				t.Fatalf("applyProfileValues: %v", err)
+			}
+			result, ok := updated.(*fhir.Patient)
+			if !ok {
+				t.Fatalf("expected a *fhir.Patient, got %T", updated)
+			}
+			tt.check(t, result)
+		})
+	}
+}
+
+func TestApplyProfileValuesKeepsConformingResource(t *testing.T) {
+	patient := validPatient()
+	updated, err := newValidationContext(t).applyProfileValues(patient)
+	if err != nil {
+		t.Fatalf("applyProfileValues: %v", err)
+	}
+	if updated != patient {
+		t.Error("expected the resource itself when the profile adds nothing")
+	}
+}
@@ -15,13 +15,19 @@ import (
 // Add this type at the top level
 type ProcessedPaths map[string]bool
 
+// processedKey is the key of a path in processedPaths. Paths are processed per parent,
+// so every element of a repeating field gets its own nested fields.
+func processedKey(path string, parentID string) string {
+	return path + "|" + parentID
+}
+
 // populateResourceStruct maintains your current population logic
-func (p *ProcessorService) populateResourceStruct(value reflect.Value, filter []*types.Filter) (bool, error) {
+func (p *resourceContext) populateResourceStruct(value reflect.Value, filter []*types.Filter) (bool, error) {
 	return p.determinePopulateType(p.resourceType, value, "", filter)
 }
 
 // determinePopulateType handles different field types
-func (p *ProcessorService) determinePopulateType(structPath string, value reflect.Value, parentID string, filter []*types.Filter) (bool, error) {
+func (p *resourceContext) determinePopulateType(structPath string, value reflect.Value, parentID string, filter []*types.Filter) (bool, error) {
 	//p.log.Debug().Str("structPath", structPath).Str("value.Kind()", value.Kind().String()).Msg("Determining populate type")
 	p.log.Debug().
 		Str("structPath", structPath).
@@ -54,7 +60,7 @@ func (p *ProcessorService) determinePopulateType(structPath string, value reflec
 }
 
 // Modify populateSlice to mark processed paths
-func (p *ProcessorService) populateSlice(structPath string, value reflect.Value, parentID string, rows []datasource.RowData, filter []*types.Filter) (bool, error) {
+func (p *resourceContext) populateSlice(structPath string, value reflect.Value, parentID string, rows []datasource.RowData, filter []*types.Filter) (bool, error) {
 	p.log.Debug().
 		Str("structPath", structPath).
 		Str("parentID", parentID).
@@ -62,24 +68,24 @@ func (p *ProcessorService) populateSlice(structPath string, value reflect.Value,
 		Msg("Populating slice")
 
 	// Mark this path as processed
-	p.processedPaths[structPath] = true
+	p.processedPaths[processedKey(structPath, parentID)] = true
 
 	// Create slice to hold all elements
 	allElements := reflect.MakeSlice(value.Type(), 0, len(rows))
 	anyElementPassed := false
 
-	// Track processed parent IDs to avoid duplicates
-	processedParentIDs := make(map[string]bool)
+	// Track processed row IDs to avoid duplicates, elements of the same parent have different IDs
+	processedIDs := make(map[string]bool)
 
 	for _, row := range rows {
 		// Process rows without a parent ID or with a matching parent ID
 		// Importantly, allow multiple entries with different parent IDs
 		if row.ParentID == parentID || parentID == "" {
-			// Prevent processing the same parent ID multiple times
-			if processedParentIDs[row.ParentID] {
+			// Prevent processing the same element multiple times
+			if processedIDs[row.ParentID+"/"+row.ID] {
 				continue
 			}
-			processedParentIDs[row.ParentID] = true
+			processedIDs[row.ParentID+"/"+row.ID] = true
 
 			p.log.Debug().
 				Str("rowID", row.ID).
@@ -119,7 +125,7 @@ func (p *ProcessorService) populateSlice(structPath string, value reflect.Value,
 }
 
 // populateStruct handles struct population with filter integration
-func (p *ProcessorService) populateStruct(path string, value reflect.Value, parentID string, rows []datasource.RowData, filter []*types.Filter) (bool, error) {
+func (p *resourceContext) populateStruct(path string, value reflect.Value, parentID string, rows []datasource.RowData, filter []*types.Filter) (bool, error) {
 	p.log.Debug().
 		Str("path", path).
 		Str("parentID", parentID).
@@ -157,7 +163,7 @@ func (p *ProcessorService) populateStruct(path string, value reflect.Value, pare
 
 // Part 1: Struct and Nested Fields
 // populateStructAndNestedFields handles both direct and nested field population
-func (p *ProcessorService) populateStructAndNestedFields(structPath string, value reflect.Value, row datasource.RowData, filter []*types.Filter) (bool, error) {
+func (p *resourceContext) populateStructAndNestedFields(structPath string, value reflect.Value, row datasource.RowData, filter []*types.Filter) (bool, error) {
 	// First populate and filter struct fields
 	structPassed, err := p.populateStructFields(structPath, value.Addr().Interface(), row, filter)
 	if err != nil {
@@ -174,16 +180,15 @@ func (p *ProcessorService) populateStructAndNestedFields(structPath string, valu
 
 // Modify populateNestedFields to check processed paths
 // populateNestedFields handles nested field population
-func (p *ProcessorService) populateNestedFields(parentPath string, parentValue reflect.Value, parentID string, filter []*types.Filter) (bool, error) {
+func (p *resourceContext) populateNestedFields(parentPath string, parentValue reflect.Value, parentID string, filter []*types.Filter) (bool, error) {
 	anyFieldPassed := false
 
 	for i := 0; i < parentValue.NumField(); i++ {
 		field := parentValue.Field(i)
-		fieldName := parentValue.Type().Field(i).Name
-		fieldPath := fmt.Sprintf("%s.%s", parentPath, strings.ToLower(fieldName))
+		fieldPath := fmt.Sprintf("%s.%s", parentPath, types.JSONName(parentValue.Type().Field(i)))
 
 		// Skip if we've already processed this path
-		if p.processedPaths[fieldPath] {
+		if p.processedPaths[processedKey(fieldPath, parentID)] {
 			p.log.Debug().
 				Str("fieldPath", fieldPath).
 				Msg("Skipping already processed nested field")
@@ -191,7 +196,7 @@ func (p *ProcessorService) populateNestedFields(parentPath string, parentValue r
 		}
 
 		if rows, exists := p.result[fieldPath]; exists {
-			p.processedPaths[fieldPath] = true
+			p.processedPaths[processedKey(fieldPath, parentID)] = true
 			p.log.Debug().Str("fieldPath", fieldPath).Msg("Marked path as processed in populateNestedFields")
 
 			// Important change: For top-level nested fields, use empty parentID if the data shows empty parentID
@@ -213,7 +218,7 @@ func (p *ProcessorService) populateNestedFields(parentPath string, parentValue r
 	return anyFieldPassed, nil
 }
 
-func (p *ProcessorService) populateStructFields(structPath string, structPtr interface{}, row datasource.RowData, filter []*types.Filter) (bool, error) {
+func (p *resourceContext) populateStructFields(structPath string, structPtr interface{}, row datasource.RowData, filter []*types.Filter) (bool, error) {
 	structValue := reflect.ValueOf(structPtr).Elem()
 	structType := structValue.Type()
 	processedFields := make(map[string]bool)
@@ -232,9 +237,9 @@ func (p *ProcessorService) populateStructFields(structPath string, structPtr int
 			strings.Contains(fieldType, "CodeableConcept") ||
 			strings.Contains(fieldType, "Quantity") {
 
-			codingPath := fmt.Sprintf("%s.%s", structPath, strings.ToLower(fieldName))
+			codingPath := fmt.Sprintf("%s.%s", structPath, types.JSONName(structType.Field(i)))
 
-			p.processedPaths[codingPath] = true
+			p.processedPaths[processedKey(codingPath, row.ID)] = true
 
 			codingRows, exists := p.result[codingPath]
 			if !exists {
@@ -257,9 +262,9 @@ func (p *ProcessorService) populateStructFields(structPath string, structPtr int
 				}
 				anyFieldPassed = true
 			} else {
-				// Handle regular Coding and Quantity fields
+				// Handle regular Coding and Quantity fields, those of the resource itself have no parent ID
 				for _, codingRow := range codingRows {
-					if codingRow.ParentID == row.ID {
+					if codingRow.ParentID == row.ID || (codingRow.ParentID == "" && row.ParentID == "") {
 						if strings.Contains(fieldType, "Quantity") {
 							if err := p.setCodingOrQuantityFromRow(codingPath, codingPath, field, fieldName, codingRow, processedFields, false); err != nil {
 								return false, err
@@ -307,7 +312,7 @@ func (p *ProcessorService) populateStructFields(structPath string, structPtr int
 					return false, fmt.Errorf("failed to set field %s: %w", fieldName, err)
 				}
 
-				fieldPath := fmt.Sprintf("%s.%s", structPath, strings.ToLower(fieldName))
+				fieldPath := fmt.Sprintf("%s.%s", structPath, types.JSONName(structType.Field(i)))
 				passed, err := true, error(nil)
 				if err != nil {
 					return false, fmt.Errorf("failed to check filter for field %s: %w", fieldName, err)
@@ -338,7 +343,7 @@ func (p *ProcessorService) populateStructFields(structPath string, structPtr int
 	return anyFieldPassed, nil
 }
 
-func (p *ProcessorService) setCodeableConceptField(field reflect.Value, path string, fieldName string, parentID string, rows []datasource.RowData, processedFields map[string]bool) error {
+func (p *resourceContext) setCodeableConceptField(field reflect.Value, path string, fieldName string, parentID string, rows []datasource.RowData, processedFields map[string]bool) error {
 	p.log.Debug().
 		Str("path", path).
 		Str("fieldName", fieldName).
@@ -357,21 +362,21 @@ func (p *ProcessorService) setCodeableConceptField(field reflect.Value, path str
 			field.Set(reflect.MakeSlice(field.Type(), 0, len(rows)))
 		}
 
-		// Create a map to track unique concepts
-		conceptMap := make(map[string]datasource.RowData)
-
-		// First, collect all unique top-level concepts
+		// Collect the unique concepts of this parent in row order, top-level concepts have no parent
+		var conceptRows []datasource.RowData
+		seen := make(map[string]bool)
 		for _, row := range rows {
-			if row.ParentID == "" { // Only process top-level concepts
-				conceptMap[row.ID] = row
+			if (row.ParentID == "" || row.ParentID == parentID) && !seen[row.ID] {
+				seen[row.ID] = true
+				conceptRows = append(conceptRows, row)
 			}
 		}
 
 		// Process each unique concept
-		for conceptID, conceptRow := range conceptMap {
+		for _, conceptRow := range conceptRows {
 			newConcept := reflect.New(field.Type().Elem()).Elem()
 			if err := p.populateCodeableConcept(newConcept, path, conceptRow, processedFields); err != nil {
-				return fmt.Errorf("failed to populate concept %s: %w", conceptID, err)
+				return fmt.Errorf("failed to populate concept %s: %w", conceptRow.ID, err)
 			}
 			field.Set(reflect.Append(field, newConcept))
 		}
@@ -384,10 +389,10 @@ func (p *ProcessorService) setCodeableConceptField(field reflect.Value, path str
 			field = field.Elem()
 		}
 
-		// Use empty concept if one exists
+		// Use the concept of this parent, top-level concepts have no parent
 		var conceptRow datasource.RowData
 		for _, row := range rows {
-			if (row.ParentID == parentID || parentID == "") && row.ParentID == "" {
+			if row.ParentID == parentID || row.ParentID == "" {
 				conceptRow = row
 				break
 			}
@@ -406,7 +411,7 @@ func (p *ProcessorService) setCodeableConceptField(field reflect.Value, path str
 	return nil
 }
 
-func (p *ProcessorService) populateCodeableConcept(conceptValue reflect.Value, path string, row datasource.RowData, processedFields map[string]bool) error {
+func (p *resourceContext) populateCodeableConcept(conceptValue reflect.Value, path string, row datasource.RowData, processedFields map[string]bool) error {
 	p.log.Debug().
 		Str("path", path).
 		Str("rowID", row.ID).
@@ -644,7 +649,7 @@ func fieldMatchesPattern(fieldName string, prefix string, suffix string) bool {
 }
 
 // Part 2: Field Setting and Type Conversion
-func (rp *ProcessorService) setField(structPath string, structPtr interface{}, fieldName string, value interface{}) error {
+func (rp *resourceContext) setField(structPath string, structPtr interface{}, fieldName string, value interface{}) error {
 	fhirPath := fmt.Sprintf("%s.%s", structPath, strings.ToLower(fieldName[:1])+fieldName[1:])
 
 	structValue := reflect.ValueOf(structPtr)
@@ -658,11 +663,40 @@ func (rp *ProcessorService) setField(structPath string, structPtr interface{}, f
 		return fmt.Errorf("invalid or cannot set field: %s", fieldName)
 	}
 
+	rp.log.Debug().Str("structPath", structPath).Str("fieldName", fieldName).Str("fieldType", field.Type().String()).Interface("value", value).Msg("Setting field")
+
+	return rp.setValue(fhirPath, field, value)
+}
+
+// setValue sets a field to a value of a row, converting it to the type of the field. Codes are
+// translated with the ConceptMaps of the ValueSet the profile of the resource binds to the element.
+func (rp *resourceContext) setValue(fhirPath string, field reflect.Value, value interface{}) error {
 	if value == nil {
 		field.Set(reflect.Zero(field.Type()))
 		return nil
 	}
 
+	// Repeating primitives get the values of all indexes of the alias, e.g. given[0] and given[1]
+	if field.Kind() == reflect.Slice {
+		values, ok := value.([]interface{})
+		if !ok {
+			values = []interface{}{value}
+		}
+		elements := reflect.MakeSlice(field.Type(), 0, len(values))
+		for _, elementValue := range values {
+			if elementValue == nil {
+				continue
+			}
+			element := reflect.New(field.Type().Elem()).Elem()
+			if err := rp.setValue(fhirPath, element, elementValue); err != nil {
+				return err
+			}
+			elements = reflect.Append(elements, element)
+		}
+		field.Set(elements)
+		return nil
+	}
+
 	// Handle pointer types first - initialize if needed
 	if field.Kind() == reflect.Ptr {
 		if field.IsNil() {
@@ -671,8 +705,6 @@ func (rp *ProcessorService) setField(structPath string, structPtr interface{}, f
 		field = field.Elem() // Dereference for further processing
 	}
 
-	rp.log.Debug().Str("structPath", structPath).Str("fieldName", fieldName).Str("fieldType", field.Type().String()).Interface("value", value).Msg("Setting field")
-
 	// Now check for special types after potentially dereferencing
 	switch field.Type().String() {
 	case "fhir.Date":
@@ -701,30 +733,23 @@ func (rp *ProcessorService) setField(structPath string, structPtr interface{}, f
 		// TODO: make sure that nils etc. are handled properly
 		// TODO: also translate the display field
 		// TODO: make a function insetad of much code within setFied
-		bindingValueSet, err := rp.structDefSvc.GetBindingValueSet(fhirPath)
-		if err != nil {
-			rp.log.Error().Err(err).Msg("Failed to get ValueSet")
-		}
-
-		rp.log.Debug().Msgf("binding ValueSet: %s", bindingValueSet)
-
-		conceptMapURL, err := rp.conceptMapSvc.GetConceptMapsByValuesetURL(bindingValueSet)
+		conceptMapURLs, err := rp.pathInfoSvc.GetConceptMaps(rp.profile, fhirPath)
 		if err != nil {
-			rp.log.Error().Err(err).Msg("Failed to get ConceptMap")
-		}
-
-		rp.log.Debug().Msgf("conceptMapURL: %s", conceptMapURL)
-
-		// Perform concept mapping using the retrieved concept map
-		translatedCode, err := rp.conceptMapSvc.TranslateCode(conceptMapURL, value.(string), true)
-		if err != nil {
-			rp.log.Error().Err(err).Msg("Failed to translate code")
+			rp.log.Debug().Err(err).Str("profile", rp.profile).Msg("No ConceptMap for code")
 		} else {
-			if translatedCode != nil {
-				rp.log.Debug().Msgf("Translated code: %s", translatedCode.TargetCode)
-				value = translatedCode.TargetCode
+			rp.log.Debug().Msgf("conceptMapURLs: %s", conceptMapURLs)
+
+			// Perform concept mapping using the retrieved concept map
+			translatedCode, err := rp.conceptMapSvc.TranslateCode(conceptMapURLs, value.(string), true)
+			if err != nil {
+				rp.log.Error().Err(err).Msg("Failed to translate code")
 			} else {
-				rp.log.Debug().Msg("No translation found")
+				if translatedCode != nil {
+					rp.log.Debug().Msgf("Translated code: %s", translatedCode.TargetCode)
+					value = translatedCode.TargetCode
+				} else {
+					rp.log.Debug().Msg("No translation found")
+				}
 			}
 		}
 
@@ -860,7 +885,7 @@ func getByteValue(v interface{}) ([]byte, error) {
 }
 
 // setBasicType handles basic type field population
-func (p *ProcessorService) setBasicType(path string, field reflect.Value, parentID string, rows []datasource.RowData, filter []*types.Filter) (bool, error) {
+func (p *resourceContext) setBasicType(path string, field reflect.Value, parentID string, rows []datasource.RowData, filter []*types.Filter) (bool, error) {
 	p.log.Debug().Str("path", path).Msg("Setting basic type")
 	for _, row := range rows {
 		if row.ParentID == parentID || parentID == "" {
@@ -891,7 +916,7 @@ func typeHasCodeMethod(t reflect.Type) bool {
 	return ok
 }
 
-func (p *ProcessorService) debugPrintResultMap() {
+func (p *resourceContext) debugPrintResultMap() {
 	p.log.Debug().Msg("START: Full Result Map Contents")
 	for path, rows := range p.result {
 		p.log.Debug().
@@ -0,0 +1,383 @@
+package processor
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/SanteonNL/fenix/cmd/fenix/types"
+	"github.com/SanteonNL/fenix/models/fhir"
+)
+
+// token is a code of an element for token search, the code of an Identifier is its value
+type token struct {
+	system string
+	code   string
+}
+
+// checkTokenFilter matches a code, Coding, CodeableConcept, Identifier or ContactPoint against a
+// token, [code], system|code, |code or system|
+func (p *ProcessorService) checkTokenFilter(ctx context.Context, value interface{}, filter *types.Filter) (bool, error) {
+	switch strings.ToLower(filter.Modifier) {
+	case "in":
+		// The in modifier takes the ValueSet to check against as value
+		return p.checkValueSetFilter(ctx, value, filter.Value)
+	case "text":
+		search := strings.ToLower(filter.Value)
+		for _, text := range tokenTexts(value) {
+			if strings.Contains(strings.ToLower(text), search) {
+				return true, nil
+			}
+		}
+		return false, nil
+	case "of-type":
+		return checkOfTypeFilter(value, filter.Value)
+	default:
+		if filter.Modifier == "" {
+			break
+		}
+		return false, fmt.Errorf("modifier %s is not supported for token search", filter.Modifier)
+	}
+
+	system, code, hasSystem := strings.Cut(filter.Value, "|")
+	if !hasSystem {
+		code, system = system, ""
+	}
+	for _, t := range valueTokens(value) {
+		if hasSystem && t.system != system {
+			continue
+		}
+		if code == "" || t.code == code {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// valueTokens returns the tokens of a json value
+func valueTokens(value interface{}) []token {
+	switch value := value.(type) {
+	case string:
+		return []token{{code: value}}
+	case bool:
+		return []token{{code: strconv.FormatBool(value)}}
+	case json.Number:
+		return []token{{code: value.String()}}
+	case map[string]interface{}:
+		if codings, ok := value["coding"].([]interface{}); ok {
+			var tokens []token
+			for _, item := range codings {
+				if coding, ok := item.(map[string]interface{}); ok {
+					tokens = append(tokens, token{system: jsonText(coding["system"]), code: jsonText(coding["code"])})
+				}
+			}
+			return tokens
+		}
+		// Identifier and ContactPoint have their code as value
+		if _, hasCode := value["code"]; !hasCode {
+			if identifierValue, ok := value["value"].(string); ok {
+				return []token{{system: jsonText(value["system"]), code: identifierValue}}
+			}
+		}
+		return []token{{system: jsonText(value["system"]), code: jsonText(value["code"])}}
+	}
+	return nil
+}
+
+// tokenTexts returns the texts of a json value for the text modifier, e.g. CodeableConcept.text
+// and the displays of its codings
+func tokenTexts(value interface{}) []string {
+	object, ok := value.(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	var texts []string
+	if text, ok := object["text"].(string); ok {
+		texts = append(texts, text)
+	}
+	if display, ok := object["display"].(string); ok {
+		texts = append(texts, display)
+	}
+	if codings, ok := object["coding"].([]interface{}); ok {
+		for _, coding := range codings {
+			texts = append(texts, tokenTexts(coding)...)
+		}
+	}
+	if identifierType, ok := object["type"].(map[string]interface{}); ok {
+		texts = append(texts, tokenTexts(identifierType)...)
+	}
+	return texts
+}
+
+// checkOfTypeFilter matches an Identifier on its type and value, type-system|type-code|value
+func checkOfTypeFilter(value interface{}, filterValue string) (bool, error) {
+	parts := strings.SplitN(filterValue, "|", 3)
+	if len(parts) != 3 {
+		return false, fmt.Errorf("of-type expects system|code|value, got %q", filterValue)
+	}
+	identifier, ok := value.(map[string]interface{})
+	if !ok || jsonText(identifier["value"]) != parts[2] {
+		return false, nil
+	}
+	for _, t := range valueTokens(identifier["type"]) {
+		if (parts[0] == "" || t.system == parts[0]) && t.code == parts[1] {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// checkValueSetFilter checks whether a code, Coding or a coding of a CodeableConcept is in a ValueSet
+func (p *ProcessorService) checkValueSetFilter(ctx context.Context, value interface{}, valueSetURL string) (bool, error) {
+	for _, t := range valueTokens(value) {
+		if t.code == "" {
+			continue
+		}
+		coding := fhir.Coding{Code: stringPtr(t.code)}
+		if t.system != "" {
+			coding.System = stringPtr(t.system)
+		}
+		valid, err := p.valueSetSvc.ValidateCode(ctx, valueSetURL, &coding)
+		if err != nil {
+			return false, err
+		}
+		if valid.Valid {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// checkStringFilter matches a string or the strings of a complex type, e.g. the parts of a
+// HumanName, case-insensitive from the start, or as :contains or :exact
+func checkStringFilter(value interface{}, filter *types.Filter) (bool, error) {
+	for _, text := range valueStrings(value) {
+		switch strings.ToLower(filter.Modifier) {
+		case "":
+			if strings.HasPrefix(strings.ToLower(text), strings.ToLower(filter.Value)) {
+				return true, nil
+			}
+		case "contains":
+			if strings.Contains(strings.ToLower(text), strings.ToLower(filter.Value)) {
+				return true, nil
+			}
+		case "exact":
+			if text == filter.Value {
+				return true, nil
+			}
+		default:
+			return false, fmt.Errorf("modifier %s is not supported for string search", filter.Modifier)
+		}
+	}
+	return false, nil
+}
+
+// valueStrings returns the strings of a json value for string search
+func valueStrings(value interface{}) []string {
+	switch value := value.(type) {
+	case string:
+		return []string{value}
+	case []interface{}:
+		var texts []string
+		for _, item := range value {
+			texts = append(texts, valueStrings(item)...)
+		}
+		return texts
+	case map[string]interface{}:
+		var texts []string
+		for key, item := range value {
+			if !types.StringExcludedElements[key] {
+				texts = append(texts, valueStrings(item)...)
+			}
+		}
+		return texts
+	}
+	return nil
+}
+
+// checkURIFilter matches a uri exactly, or with :below the uris within it and with :above the uris it is within
+func checkURIFilter(value interface{}, filter *types.Filter) (bool, error) {
+	uri, ok := value.(string)
+	if !ok {
+		return false, nil
+	}
+	switch strings.ToLower(filter.Modifier) {
+	case "":
+		return uri == filter.Value, nil
+	case "below":
+		return strings.HasPrefix(uri, filter.Value), nil
+	case "above":
+		return strings.HasPrefix(filter.Value, uri), nil
+	default:
+		return false, fmt.Errorf("modifier %s is not supported for uri search", filter.Modifier)
+	}
+}
+
+// checkReferenceFilter matches a Reference or canonical on an id, Type/id or absolute url
+func (p *ProcessorService) checkReferenceFilter(value interface{}, filter *types.Filter) (bool, error) {
+	if filter.Modifier != "" {
+		return false, fmt.Errorf("modifier %s is not supported for reference search", filter.Modifier)
+	}
+
+	reference := jsonText(value)
+	if object, ok := value.(map[string]interface{}); ok {
+		reference = jsonText(object["reference"])
+	}
+	if reference == "" {
+		return false, nil
+	}
+	// Canonical references may have a version, url|version
+	reference = strings.SplitN(reference, "|", 2)[0]
+
+	search := filter.Value
+	switch {
+	case reference == search:
+		return true, nil
+	case !strings.Contains(search, "/"):
+		return reference[strings.LastIndex(reference, "/")+1:] == search, nil
+	case strings.Contains(search, "://"):
+		return strings.HasSuffix(search, "/"+reference), nil
+	default:
+		return strings.HasSuffix(reference, "/"+search), nil
+	}
+}
+
+// checkDateFilter compares the period a date, dateTime, instant or Period covers with the period
+// of the search value, both taking the precision they are given in
+func checkDateFilter(value interface{}, filter *types.Filter) (bool, error) {
+	prefix, searchValue := filter.Prefix()
+	searchStart, searchEnd, _, err := types.DateRange(searchValue)
+	if err != nil {
+		return false, err
+	}
+
+	var start, end time.Time
+	switch value := value.(type) {
+	case string:
+		if start, end, _, err = types.DateRange(value); err != nil {
+			return false, nil
+		}
+	case map[string]interface{}:
+		// A period without start or end is open on that side
+		start, end = time.Time{}, time.Date(9999, 12, 31, 0, 0, 0, 0, time.UTC)
+		if periodStart, ok := value["start"].(string); ok {
+			if start, _, _, err = types.DateRange(periodStart); err != nil {
+				return false, nil
+			}
+		}
+		if periodEnd, ok := value["end"].(string); ok {
+			if _, end, _, err = types.DateRange(periodEnd); err != nil {
+				return false, nil
+			}
+		}
+	default:
+		return false, nil
+	}
+
+	contained := !start.Before(searchStart) && !end.After(searchEnd)
+	switch prefix {
+	case "eq":
+		return contained, nil
+	case "ne":
+		return !contained, nil
+	case "gt":
+		return end.After(searchEnd), nil
+	case "lt":
+		return start.Before(searchStart), nil
+	case "ge":
+		return end.After(searchEnd) || contained, nil
+	case "le":
+		return start.Before(searchStart) || contained, nil
+	case "sa":
+		return !start.Before(searchEnd), nil
+	case "eb":
+		return !end.After(searchStart), nil
+	case "ap":
+		// Approximately is interpreted as overlapping the search period widened by 10% of its distance from now
+		margin := time.Since(searchStart).Abs() / 10
+		return start.Before(searchEnd.Add(margin)) && end.After(searchStart.Add(-margin)), nil
+	default:
+		return false, fmt.Errorf("unknown prefix %s", prefix)
+	}
+}
+
+// checkNumberFilter compares a number with the search value, eq taking the precision of the
+// search value: 100 matches from 99.5 up to 100.5
+func checkNumberFilter(value interface{}, filter *types.Filter) (bool, error) {
+	prefix, searchValue := filter.Prefix()
+	return compareNumber(value, prefix, searchValue)
+}
+
+// checkQuantityFilter compares a Quantity with [prefix]number|system|code, the code matching the
+// code or, without system, the unit
+func checkQuantityFilter(value interface{}, filter *types.Filter) (bool, error) {
+	quantity, ok := value.(map[string]interface{})
+	if !ok {
+		return false, nil
+	}
+	prefix, searchValue := filter.Prefix()
+	parts := strings.SplitN(searchValue, "|", 3)
+	for len(parts) < 3 {
+		parts = append(parts, "")
+	}
+
+	if system := parts[1]; system != "" && jsonText(quantity["system"]) != system {
+		return false, nil
+	}
+	if code := parts[2]; code != "" {
+		unitMatches := parts[1] == "" && jsonText(quantity["unit"]) == code
+		if jsonText(quantity["code"]) != code && !unitMatches {
+			return false, nil
+		}
+	}
+	return compareNumber(quantity["value"], prefix, parts[0])
+}
+
+// compareNumber compares a json number with a search value using a prefix
+func compareNumber(value interface{}, prefix, searchValue string) (bool, error) {
+	search, low, high, err := types.NumberRange(searchValue)
+	if err != nil {
+		return false, err
+	}
+	number, ok := value.(json.Number)
+	if !ok {
+		return false, nil
+	}
+	actual, err := number.Float64()
+	if err != nil {
+		return false, nil
+	}
+
+	// The precision of the search value decides the range eq matches
+	equal := actual >= low && actual < high
+
+	switch prefix {
+	case "eq":
+		return equal, nil
+	case "ne":
+		return !equal, nil
+	case "gt", "sa":
+		return actual > search, nil
+	case "lt", "eb":
+		return actual < search, nil
+	case "ge":
+		return actual >= search, nil
+	case "le":
+		return actual <= search, nil
+	case "ap":
+		// Approximately is interpreted as within 10% of the value
+		return math.Abs(actual-search) <= math.Abs(search)*0.1, nil
+	default:
+		return false, fmt.Errorf("unknown prefix %s", prefix)
+	}
+}
+
+// jsonText returns a json string, or an empty string for other values
+func jsonText(value interface{}) string {
+	text, _ := value.(string)
+	return text
+}
@@ -0,0 +1,299 @@
+package processor
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/SanteonNL/fenix/cmd/fenix/types"
+)
+
+// newTestFilter creates a filter with its alternatives split from the value
+func newTestFilter(searchType string, modifier string, value string) *types.Filter {
+	filter := &types.Filter{Code: "test", Type: searchType, Modifier: modifier, IsValid: true}
+	filter.SetValue(value)
+	return filter
+}
+
+func TestCheckDateFilter(t *testing.T) {
+	period := map[string]interface{}{"start": "2024-03-10", "end": "2024-03-20"}
+	openPeriod := map[string]interface{}{"start": "2024-03-10"}
+
+	tests := []struct {
+		name     string
+		value    interface{}
+		modifier string
+		search   string
+		want     bool
+	}{
+		{"eq on the same day", "2024-03-15", "", "2024-03-15", true},
+		{"eq within the month", "2024-03-15", "", "2024-03", true},
+		{"eq within the year", "2024-03-15T10:00:00Z", "", "2024", true},
+		{"eq outside the month", "2024-04-01", "", "2024-03", false},
+		{"eq of a day on a minute", "2024-03-15", "", "2024-03-15T10:00", false},
+		{"ne outside the month", "2024-04-01", "", "ne2024-03", true},
+		{"ne within the month", "2024-03-31", "", "ne2024-03", false},
+		{"gt after the day", "2024-03-16", "", "gt2024-03-15", true},
+		{"gt on the day", "2024-03-15", "", "gt2024-03-15", false},
+		{"ge on the day", "2024-03-15", "", "ge2024-03-15", true},
+		{"lt before the month", "2024-02-29", "", "lt2024-03", true},
+		{"le within the month", "2024-03-31", "", "le2024-03", true},
+		{"le after the month", "2024-04-01", "", "le2024-03", false},
+		{"prefix as modifier", "2024-03-16", "gt", "2024-03-15", true},
+		{"sa after the day", "2024-03-16", "", "sa2024-03-15", true},
+		{"eb before the day", "2024-03-14", "", "eb2024-03-15", true},
+		{"eb on the day", "2024-03-15", "", "eb2024-03-15", false},
+		{"period within the month", period, "", "2024-03", true},
+		{"period overlapping the day", period, "", "2024-03-15", false},
+		{"period ending after the day", period, "", "gt2024-03-15", true},
+		{"open period after the day", openPeriod, "", "gt2025", true},
+		{"open period within the year", openPeriod, "", "2024", false},
+		{"time zone of an instant", "2024-03-15T23:30:00-02:00", "", "2024-03-16", true},
+		{"invalid element value", "March", "", "2024", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := checkDateFilter(tt.value, newTestFilter("date", tt.modifier, tt.search))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+
+	if _, err := checkDateFilter("2024-03-15", newTestFilter("date", "", "15-03-2024")); err == nil {
+		t.Error("expected an error for an invalid search value")
+	}
+}
+
+func TestCheckNumberFilter(t *testing.T) {
+	tests := []struct {
+		name   string
+		value  string
+		search string
+		want   bool
+	}{
+		{"eq within the precision", "100.4", "100", true},
+		{"eq at the lower bound", "99.5", "100", true},
+		{"eq at the upper bound", "100.5", "100", false},
+		{"eq with decimals", "100.04", "100.0", true},
+		{"eq outside the decimals", "100.06", "100.0", false},
+		{"ne within the precision", "100.4", "ne100", false},
+		{"ne outside the precision", "101", "ne100", true},
+		{"gt", "100.1", "gt100", true},
+		{"gt on the value", "100", "gt100", false},
+		{"ge on the value", "100", "ge100", true},
+		{"lt", "99.9", "lt100", true},
+		{"le on the value", "100", "le100", true},
+		{"sa", "101", "sa100", true},
+		{"eb", "99", "eb100", true},
+		{"ap within 10%", "109", "ap100", true},
+		{"ap outside 10%", "111", "ap100", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := checkNumberFilter(json.Number(tt.value), newTestFilter("number", "", tt.search))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+
+	if _, err := checkNumberFilter(json.Number("1"), newTestFilter("number", "", "one")); err == nil {
+		t.Error("expected an error for an invalid search value")
+	}
+}
+
+func TestCheckQuantityFilter(t *testing.T) {
+	weight := map[string]interface{}{
+		"value":  json.Number("72.5"),
+		"unit":   "kg",
+		"system": "http://unitsofmeasure.org",
+		"code":   "kg",
+	}
+
+	tests := []struct {
+		name   string
+		search string
+		want   bool
+	}{
+		{"number only", "72.5", true},
+		{"number within the precision", "72", false},
+		{"number at the lower bound of the precision", "73", true},
+		{"system and code", "72.5|http://unitsofmeasure.org|kg", true},
+		{"other system", "72.5|http://example.org|kg", false},
+		{"other code", "72.5|http://unitsofmeasure.org|g", false},
+		{"unit without system", "72.5||kg", true},
+		{"prefix with code", "gt70|http://unitsofmeasure.org|kg", true},
+		{"prefix below the value", "lt70||kg", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := checkQuantityFilter(weight, newTestFilter("quantity", "", tt.search))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestCheckTokenFilter(t *testing.T) {
+	concept := map[string]interface{}{
+		"text": "Body weight",
+		"coding": []interface{}{
+			map[string]interface{}{"system": "http://loinc.org", "code": "29463-7", "display": "Body weight Measured"},
+		},
+	}
+	identifier := map[string]interface{}{
+		"system": "http://example.org/mrn",
+		"value":  "12345",
+		"type": map[string]interface{}{
+			"coding": []interface{}{
+				map[string]interface{}{"system": "http://terminology.hl7.org/CodeSystem/v2-0203", "code": "MR"},
+			},
+		},
+	}
+
+	tests := []struct {
+		name     string
+		value    interface{}
+		modifier string
+		search   string
+		want     bool
+	}{
+		{"code", concept, "", "29463-7", true},
+		{"system and code", concept, "", "http://loinc.org|29463-7", true},
+		{"other system", concept, "", "http://snomed.info/sct|29463-7", false},
+		{"system only", concept, "", "http://loinc.org|", true},
+		{"code without system", concept, "", "|29463-7", false},
+		{"code of a code element", "final", "", "final", true},
+		{"boolean", true, "", "true", true},
+		{"identifier value", identifier, "", "http://example.org/mrn|12345", true},
+		{"text of the concept", concept, "text", "body", true},
+		{"display of a coding", concept, "text", "measured", true},
+		{"text not found", concept, "text", "height", false},
+		{"of-type", identifier, "of-type", "http://terminology.hl7.org/CodeSystem/v2-0203|MR|12345", true},
+		{"of-type without type system", identifier, "of-type", "|MR|12345", true},
+		{"of-type other value", identifier, "of-type", "http://terminology.hl7.org/CodeSystem/v2-0203|MR|54321", false},
+		{"of-type other type", identifier, "of-type", "http://terminology.hl7.org/CodeSystem/v2-0203|SS|12345", false},
+	}
+
+	p := &ProcessorService{}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := p.checkTokenFilter(context.Background(), tt.value, newTestFilter("token", tt.modifier, tt.search))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+
+	errorTests := []struct {
+		name     string
+		modifier string
+		search   string
+	}{
+		{"of-type without value", "of-type", "http://terminology.hl7.org/CodeSystem/v2-0203|MR"},
+		{"subsumption", "below", "http://loinc.org|29463-7"},
+	}
+	for _, tt := range errorTests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := p.checkTokenFilter(context.Background(), identifier, newTestFilter("token", tt.modifier, tt.search)); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
+
+func TestCheckStringFilter(t *testing.T) {
+	name := map[string]interface{}{
+		"use":    "official",
+		"family": "van den Berg",
+		"given":  []interface{}{"Anna", "Maria"},
+		"period": map[string]interface{}{"start": "2020-01-01"},
+	}
+
+	tests := []struct {
+		name     string
+		modifier string
+		search   string
+		want     bool
+	}{
+		{"start of the family name", "", "van", true},
+		{"case-insensitive", "", "ANNA", true},
+		{"second given name", "", "mar", true},
+		{"not from the start", "", "berg", false},
+		{"excluded element", "", "official", false},
+		{"excluded nested element", "", "2020", false},
+		{"contains", "contains", "berg", true},
+		{"exact", "exact", "Maria", true},
+		{"exact case", "exact", "maria", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := checkStringFilter(name, newTestFilter("string", tt.modifier, tt.search))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestMatchesValue(t *testing.T) {
+	codes := []interface{}{"final", "amended"}
+	dates := []interface{}{"2024-03-15"}
+
+	tests := []struct {
+		name   string
+		values []interface{}
+		filter *types.Filter
+		want   bool
+	}{
+		{"missing true without values", nil, newTestFilter("token", "missing", "true"), true},
+		{"missing true with values", codes, newTestFilter("token", "missing", "true"), false},
+		{"missing false with values", codes, newTestFilter("token", "missing", "false"), true},
+		{"missing false without values", nil, newTestFilter("token", "missing", "false"), false},
+		{"not a code that is present", codes, newTestFilter("token", "not", "final"), false},
+		{"not a code that is absent", codes, newTestFilter("token", "not", "draft"), true},
+		{"not without values", nil, newTestFilter("token", "not", "final"), true},
+		{"ne outside the period", dates, newTestFilter("date", "", "ne2024-04"), true},
+		{"ne within the period", dates, newTestFilter("date", "", "ne2024-03"), false},
+		{"ne without values", nil, newTestFilter("date", "", "ne2024-03"), false},
+		{"eq of any value", codes, newTestFilter("token", "", "amended"), true},
+	}
+
+	rc := newTestContext("Observation", nil)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := rc.matchesValue(context.Background(), tt.values, tt.filter)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+
+	if _, err := rc.matchesValue(context.Background(), nil, newTestFilter("token", "missing", "maybe")); err == nil {
+		t.Error("expected an error for an invalid missing value")
+	}
+}
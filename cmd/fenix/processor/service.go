@@ -5,6 +5,8 @@ import (
 	"context"
 	"fmt"
 	"reflect"
+	"runtime"
+	"sync"
 
 	"github.com/SanteonNL/fenix/cmd/fenix/datasource"
 	"github.com/SanteonNL/fenix/cmd/fenix/fhir/conceptmap"
@@ -13,19 +15,35 @@ import (
 	"github.com/SanteonNL/fenix/cmd/fenix/fhir/valueset"
 	"github.com/SanteonNL/fenix/cmd/fenix/output"
 	"github.com/SanteonNL/fenix/cmd/fenix/types"
+	"github.com/SanteonNL/fenix/models/fhir"
 	"github.com/rs/zerolog"
 )
 
+// ProcessorService turns the rows of a datasource into FHIR resources. It holds no state of a
+// single request, so one instance serves all requests concurrently.
 type ProcessorService struct {
-	log            zerolog.Logger
-	pathInfoSvc    *fhirpathinfo.PathInfoService
-	structDefSvc   *structuredefinition.StructureDefinitionService
-	valueSetSvc    *valueset.ValueSetService
-	conceptMapSvc  *conceptmap.ConceptMapService
-	outputManager  *output.OutputManager
-	processedPaths map[string]bool // Changed from sync.Map for simpler usage
+	log           zerolog.Logger
+	pathInfoSvc   *fhirpathinfo.PathInfoService
+	structDefSvc  *structuredefinition.StructureDefinitionService
+	valueSetSvc   *valueset.ValueSetService
+	conceptMapSvc *conceptmap.ConceptMapService
+	outputManager *output.OutputManager
+	workers       int
+	debugOutput   bool
+	policy        ValidationPolicy
+	// unavailableValueSets are the ValueSets of required bindings that could not be resolved
+	unavailableValueSets sync.Map
+	// constraintExpressions are the parsed FHIRPath expressions of invariants by their text
+	constraintExpressions sync.Map
+}
+
+// resourceContext holds the state of processing a single resource, every resource gets its own
+type resourceContext struct {
+	*ProcessorService
 	resourceType   string
+	profile        string // profile the query declares for the resource, empty for the base definition
 	result         datasource.ResourceResult
+	processedPaths map[string]bool
 }
 
 // ProcessorConfig holds all the configuration needed to create a new processor
@@ -36,6 +54,10 @@ type ProcessorConfig struct {
 	ValueSetSvc   *valueset.ValueSetService
 	ConceptMapSvc *conceptmap.ConceptMapService
 	OutputManager *output.OutputManager
+	Workers       int  // resources of a search processed in parallel, defaults to the number of CPUs
+	DebugOutput   bool // writes the resources of every search to the output directory
+	// ValidationPolicy decides what happens to resources that do not conform to their profile, defaults to flag
+	ValidationPolicy ValidationPolicy
 }
 
 // NewProcessorService creates a new processor service with all required dependencies
@@ -53,66 +75,259 @@ func NewProcessorService(config ProcessorConfig) (*ProcessorService, error) {
 		return nil, fmt.Errorf("outputManager is required")
 	}
 
-	return &ProcessorService{
-		log:            config.Log,
-		pathInfoSvc:    config.PathInfoSvc,
-		structDefSvc:   config.StructDefSvc,
-		valueSetSvc:    config.ValueSetSvc,
-		conceptMapSvc:  config.ConceptMapSvc,
-		outputManager:  config.OutputManager,
-		processedPaths: make(map[string]bool),
-	}, nil
+	workers := config.Workers
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+
+	policy := config.ValidationPolicy
+	switch policy {
+	case "":
+		policy = ValidationPolicyFlag
+	case ValidationPolicyDrop, ValidationPolicyFlag, ValidationPolicyAsIs:
+	default:
+		return nil, fmt.Errorf("unknown validation policy: %s", policy)
+	}
+
+	p := &ProcessorService{
+		log:           config.Log,
+		pathInfoSvc:   config.PathInfoSvc,
+		structDefSvc:  config.StructDefSvc,
+		valueSetSvc:   config.ValueSetSvc,
+		conceptMapSvc: config.ConceptMapSvc,
+		outputManager: config.OutputManager,
+		workers:       workers,
+		debugOutput:   config.DebugOutput,
+		policy:        policy,
+	}
+	p.parseConstraints()
+	return p, nil
 }
 
-// ProcessResources processes resources with filtering
-func (p *ProcessorService) ProcessResources(ctx context.Context, ds *datasource.DataSourceService, resourceType string, patientID string, filter []*types.Filter) ([]interface{}, error) {
-	results, err := ds.ReadResources(resourceType, patientID)
+// ProcessResources processes resources with filtering. Resources are processed while the datasource
+// is still reading, so the rows of a search are never all in memory. The resources are processed
+// in parallel by the configured number of workers and returned in the order of the datasource.
+// The resources are validated against their profile, what is returned of resources that do not
+// conform depends on the ValidationPolicy.
+func (p *ProcessorService) ProcessResources(ctx context.Context, ds datasource.DataSource, resourceType string, patientID string, filter []*types.Filter) ([]interface{}, []ValidationIssue, error) {
+	// Stops the datasource when processing ends before the stream does
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// Chained parameters the datasource cannot join are searched first
+	filter, matchable, err := p.resolveChains(ctx, ds, resourceType, filter)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read resources: %w", err)
+		return nil, nil, err
+	}
+	if !matchable {
+		return nil, nil, nil
 	}
 
-	err = p.outputManager.WriteToJSON(results, "temp_result")
+	// Filters that could not be pushed down to the datasource are checked on the processed resources
+	stream, err := ds.StreamResources(ctx, resourceType, patientID, filter)
 	if err != nil {
-		return nil, fmt.Errorf("failed to write resources to JSON: %w", err)
+		return nil, nil, fmt.Errorf("failed to read resources: %w", err)
+	}
+	remainingFilters := stream.RemainingFilters
+
+	// Every resource keeps its position in the stream so the output order does not depend on the workers
+	type job struct {
+		index  int
+		result datasource.ResourceResult
+	}
+	type processedResource struct {
+		index    int
+		resource interface{}
+		issues   []ValidationIssue
+	}
+
+	jobs := make(chan job)
+	processed := make(chan processedResource)
+
+	go func() {
+		defer close(jobs)
+		index := 0
+		for result := range stream.Resources {
+			jobs <- job{index: index, result: result}
+			index++
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for w := 0; w < p.workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range jobs {
+				resource, issues := p.processResource(ctx, resourceType, job.result, remainingFilters)
+				processed <- processedResource{index: job.index, resource: resource, issues: issues}
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(processed)
+	}()
+
+	var ordered []processedResource
+	for result := range processed {
+		for len(ordered) <= result.index {
+			ordered = append(ordered, processedResource{})
+		}
+		ordered[result.index] = result
+	}
+
+	if err := stream.Err(); err != nil {
+		return nil, nil, fmt.Errorf("failed to read resources: %w", err)
 	}
 
 	var processedResources []interface{}
-	for _, result := range results {
-		// Reset processor state for new resource
-		p.processedPaths = make(map[string]bool)
-		p.result = result
-		p.resourceType = resourceType // Set from parameter directly
-
-		processed, err := p.ProcessSingleResource(result, filter)
-		if err != nil {
-			p.log.Error().Err(err).Msg("Error processing resource")
-			continue
+	var issues []ValidationIssue
+	for _, result := range ordered {
+		if result.resource != nil {
+			processedResources = append(processedResources, result.resource)
 		}
-		if processed != nil {
-			processedResources = append(processedResources, processed)
+		issues = append(issues, result.issues...)
+	}
+
+	if p.debugOutput {
+		if err := p.outputManager.WriteToJSON(processedResources, "result"); err != nil {
+			p.log.Error().Err(err).Msg("Failed to write resources to JSON")
 		}
 	}
 
-	return processedResources, nil
+	return processedResources, issues, nil
 }
 
-// ProcessSingleResource processes a single resource
-func (p *ProcessorService) ProcessSingleResource(result datasource.ResourceResult, filter []*types.Filter) (interface{}, error) {
+// processResource processes a single resource, checks the remaining filters and validates it.
+// It returns nil when the resource cannot be processed, does not pass the filters or is dropped
+// for the issues it has. A resource that cannot be processed or validated is reported as an issue.
+func (p *ProcessorService) processResource(ctx context.Context, resourceType string, result datasource.ResourceResult, filters []*types.Filter) (interface{}, []ValidationIssue) {
+	rc := p.newResourceContext(resourceType, result)
+
+	processed, err := rc.processSingleResource(filters)
+	if err != nil {
+		return p.applyPolicy(nil, []ValidationIssue{rc.errorIssue(fhir.IssueTypeProcessing, "cannot be processed", err)})
+	}
+	if processed == nil {
+		return nil, nil
+	}
+
+	passed, err := rc.matchesFilters(ctx, processed, filters)
+	if err != nil {
+		p.log.Error().Err(err).Msg("Error filtering resource")
+		return nil, nil
+	}
+	if !passed {
+		return nil, nil
+	}
+
+	issues, err := rc.validateResource(ctx, processed)
+	if err != nil {
+		issues = []ValidationIssue{rc.errorIssue(fhir.IssueTypeException, "cannot be validated", err)}
+	}
+	return p.applyPolicy(processed, issues)
+}
+
+// applyPolicy logs the issues of a resource and returns what the ValidationPolicy keeps of it
+func (p *ProcessorService) applyPolicy(resource interface{}, issues []ValidationIssue) (interface{}, []ValidationIssue) {
+	if len(issues) == 0 {
+		return resource, nil
+	}
+
+	for _, issue := range issues {
+		p.log.Warn().
+			Str("policy", string(p.policy)).
+			Str("expression", issue.Expression).
+			Msg(issue.Details)
+	}
+	switch p.policy {
+	case ValidationPolicyDrop:
+		if hasErrors(issues) {
+			return nil, issues
+		}
+		return resource, issues
+	case ValidationPolicyAsIs:
+		return resource, nil
+	default:
+		return resource, issues
+	}
+}
+
+// errorIssue returns the issue for a resource that could not be processed or validated
+func (p *resourceContext) errorIssue(code fhir.IssueType, problem string, err error) ValidationIssue {
+	reference := p.resourceType
+	if rows := p.result[p.resourceType]; len(rows) > 0 && rows[0].ID != "" {
+		reference += "/" + rows[0].ID
+	}
+	return ValidationIssue{
+		Severity:   fhir.IssueSeverityError,
+		Code:       code,
+		Expression: p.resourceType,
+		Details:    fmt.Sprintf("%s %s: %v", reference, problem, err),
+	}
+}
+
+// ProcessSingleResource processes the rows of a single resource of the resource type
+func (p *ProcessorService) ProcessSingleResource(resourceType string, result datasource.ResourceResult, filter []*types.Filter) (interface{}, error) {
+	return p.newResourceContext(resourceType, result).processSingleResource(filter)
+}
+
+// newResourceContext creates the state for processing a single resource
+func (p *ProcessorService) newResourceContext(resourceType string, result datasource.ResourceResult) *resourceContext {
+	return &resourceContext{
+		ProcessorService: p,
+		resourceType:     resourceType,
+		profile:          declaredProfile(resourceType, result),
+		result:           result,
+		processedPaths:   make(map[string]bool),
+	}
+}
+
+// declaredProfile returns the first meta.profile of the rows of a resource, the datasource sets it
+// to the profile its query declares
+func declaredProfile(resourceType string, result datasource.ResourceResult) string {
+	for _, row := range result[resourceType+".meta"] {
+		switch profile := row.Data["profile"].(type) {
+		case string:
+			return profile
+		case []interface{}:
+			for _, value := range profile {
+				if url, ok := value.(string); ok && url != "" {
+					return url
+				}
+			}
+		}
+	}
+	return ""
+}
+
+// processSingleResource processes a single resource
+func (p *resourceContext) processSingleResource(filter []*types.Filter) (interface{}, error) {
 	// Create resource
 	resource, err := p.createResource()
 	if err != nil {
 		return nil, fmt.Errorf("error creating resource: %w", err)
 	}
 
+	if err := p.normalizeResult(reflect.TypeOf(resource)); err != nil {
+		return nil, fmt.Errorf("error resolving choice types: %w", err)
+	}
+
 	// Populate and filter resource
 	passed, err := p.populateResourceStruct(reflect.ValueOf(resource).Elem(), filter)
 	if err != nil {
 		return nil, fmt.Errorf("error populating resource: %w", err)
 	}
 
-	err = p.outputManager.WriteToJSON(resource, "result")
+	if err := p.checkChoiceTypes(reflect.ValueOf(resource), p.resourceType); err != nil {
+		return nil, err
+	}
+
+	// Values the profile fixes are not needed in the query files
+	resource, err = p.applyProfileValues(resource)
 	if err != nil {
-		return nil, fmt.Errorf("failed to write resources to JSON: %w", err)
+		return nil, fmt.Errorf("error applying profile values: %w", err)
 	}
 
 	if !passed {
@@ -123,8 +338,8 @@ func (p *ProcessorService) ProcessSingleResource(result datasource.ResourceResul
 }
 
 // createResource creates a new instance of the appropriate resource type
-func (p *ProcessorService) createResource() (interface{}, error) {
-	factory, exists := ResourceFactoryMap[p.resourceType]
+func (p *resourceContext) createResource() (interface{}, error) {
+	factory, exists := types.ResourceFactoryMap[p.resourceType]
 	if !exists {
 		return nil, fmt.Errorf("unsupported resource type: %s", p.resourceType)
 	}
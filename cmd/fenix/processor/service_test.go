@@ -0,0 +1,84 @@
+package processor
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/SanteonNL/fenix/cmd/fenix/datasource"
+	"github.com/SanteonNL/fenix/models/fhir"
+	"github.com/rs/zerolog"
+)
+
+func TestProcessResourceReportsProcessingErrors(t *testing.T) {
+	// Medication has no model, so its rows cannot be processed
+	result := datasource.ResourceResult{
+		"Medication": {{ID: "m1", Data: map[string]interface{}{"id": "m1"}}},
+	}
+
+	tests := []struct {
+		policy ValidationPolicy
+		issues int
+	}{
+		{ValidationPolicyDrop, 1},
+		{ValidationPolicyFlag, 1},
+		{ValidationPolicyAsIs, 0},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.policy), func(t *testing.T) {
+			p := &ProcessorService{log: zerolog.Nop(), policy: tt.policy}
+			resource, issues := p.processResource(context.Background(), "Medication", result, nil)
+			if resource != nil {
+				t.Errorf("expected no resource, got %v", resource)
+			}
+			if len(issues) != tt.issues {
+				t.Fatalf("expected %d issues, got %v", tt.issues, issues)
+			}
+			if tt.issues == 0 {
+				return
+			}
+			issue := issues[0]
+			if issue.Severity != fhir.IssueSeverityError || issue.Code != fhir.IssueTypeProcessing {
+				t.Errorf("expected a processing error, got %s %s", issue.Severity.Code(), issue.Code.Code())
+			}
+			if issue.Expression != "Medication" || !strings.HasPrefix(issue.Details, "Medication/m1 cannot be processed") {
+				t.Errorf("expected the issue to name the resource, got %+v", issue)
+			}
+		})
+	}
+}
+
+func TestApplyPolicy(t *testing.T) {
+	resource := &fhir.Patient{}
+	issues := []ValidationIssue{
+		{Severity: fhir.IssueSeverityWarning, Code: fhir.IssueTypeInvariant, Expression: "Patient"},
+		{Severity: fhir.IssueSeverityError, Code: fhir.IssueTypeException, Expression: "Patient"},
+	}
+	warnings := issues[:1]
+
+	tests := []struct {
+		name       string
+		policy     ValidationPolicy
+		issues     []ValidationIssue
+		keeps      bool
+		wantIssues int
+	}{
+		{"drop with errors", ValidationPolicyDrop, issues, false, 2},
+		{"drop with warnings", ValidationPolicyDrop, warnings, true, 1},
+		{"flag with errors", ValidationPolicyFlag, issues, true, 2},
+		{"as-is with errors", ValidationPolicyAsIs, issues, true, 0},
+		{"no issues", ValidationPolicyDrop, nil, true, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &ProcessorService{log: zerolog.Nop(), policy: tt.policy}
+			kept, reported := p.applyPolicy(resource, tt.issues)
+			if (kept != nil) != tt.keeps {
+				t.Errorf("expected resource kept %v, got %v", tt.keeps, kept)
+			}
+			if len(reported) != tt.wantIssues {
+				t.Errorf("expected %d issues, got %v", tt.wantIssues, reported)
+			}
+		})
+	}
+}
@@ -0,0 +1,454 @@
+package processor
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/SanteonNL/fenix/cmd/fenix/fhir/fhirpath"
+	"github.com/SanteonNL/fenix/models/fhir"
+)
+
+// ValidationPolicy decides what happens to a resource that does not conform to its profile
+type ValidationPolicy string
+
+const (
+	ValidationPolicyDrop ValidationPolicy = "drop"  // leave a resource with errors out and report the issues
+	ValidationPolicyFlag ValidationPolicy = "flag"  // return the resource and report the issues
+	ValidationPolicyAsIs ValidationPolicy = "as-is" // return the resource, the issues are only logged
+)
+
+// baseProfilePrefix is the canonical url of the base definitions of the resource types
+const baseProfilePrefix = "http://hl7.org/fhir/StructureDefinition/"
+
+// ValidationIssue is a way in which a processed resource does not conform to its profile
+type ValidationIssue struct {
+	Severity   fhir.IssueSeverity
+	Code       fhir.IssueType
+	Expression string // location of the element in the resource, e.g. Patient.contact[0].gender
+	Details    string
+}
+
+// jsonNode is an instance of an element in the json form of a resource
+type jsonNode struct {
+	location string
+	value    interface{}
+}
+
+// validateResource validates a processed resource against the first profile of meta.profile that
+// is loaded, or against the base definition of the resource type. Only the snapshot of the profile
+// is used, slices are not validated. Invariants are checked with their FHIRPath expression.
+func (p *resourceContext) validateResource(ctx context.Context, resource interface{}) ([]ValidationIssue, error) {
+	if p.structDefSvc == nil {
+		return nil, nil
+	}
+
+	instance, err := resourceJSON(resource)
+	if err != nil {
+		return nil, err
+	}
+
+	profile := p.resourceProfile(instance)
+	if profile == nil || profile.Snapshot == nil {
+		p.log.Debug().Str("resourceType", p.resourceType).Msg("No profile with snapshot to validate against")
+		return nil, nil
+	}
+
+	reference := p.resourceType
+	if id, ok := instance["id"].(string); ok {
+		reference += "/" + id
+	}
+
+	var issues []ValidationIssue
+	issue := func(severity fhir.IssueSeverity, code fhir.IssueType, location, format string, args ...interface{}) {
+		issues = append(issues, ValidationIssue{
+			Severity:   severity,
+			Code:       code,
+			Expression: location,
+			Details:    fmt.Sprintf("%s does not conform to %s: %s", reference, profile.Url, fmt.Sprintf(format, args...)),
+		})
+	}
+	report := func(code fhir.IssueType, location, format string, args ...interface{}) {
+		issue(fhir.IssueSeverityError, code, location, format, args...)
+	}
+	checkConstraints := func(element fhir.ElementDefinition, node jsonNode) {
+		for _, constraint := range p.failedConstraints(instance, element, node.value) {
+			severity := fhir.IssueSeverityError
+			if constraint.Severity == fhir.ConstraintSeverityWarning {
+				severity = fhir.IssueSeverityWarning
+			}
+			issue(severity, fhir.IssueTypeInvariant, node.location, "constraint %s failed: %s", constraint.Key, constraint.Human)
+		}
+	}
+
+	for _, element := range profile.Snapshot.Element {
+		// Slices and their elements are only known from the slicing discriminators
+		if element.SliceName != nil || (element.Id != nil && strings.Contains(*element.Id, ":")) {
+			continue
+		}
+		dot := strings.LastIndex(element.Path, ".")
+		if dot == -1 {
+			checkConstraints(element, jsonNode{location: p.resourceType, value: instance})
+			continue
+		}
+
+		name := element.Path[dot+1:]
+		fixed, pattern := fixedAndPattern(element)
+		for _, parent := range elementNodes(instance, p.resourceType, element.Path[:dot]) {
+			children := childNodes(parent, name)
+
+			if element.Min != nil && len(children) < *element.Min {
+				code := fhir.IssueTypeStructure
+				if len(children) == 0 {
+					code = fhir.IssueTypeRequired
+				}
+				report(code, parent.location+"."+name, "minimum cardinality of %s is %d, found %d", element.Path, *element.Min, len(children))
+			}
+			if element.Max != nil && *element.Max != "*" {
+				if max, err := strconv.Atoi(*element.Max); err == nil && len(children) > max {
+					report(fhir.IssueTypeStructure, parent.location+"."+name, "maximum cardinality of %s is %d, found %d", element.Path, max, len(children))
+				}
+			}
+
+			for _, child := range children {
+				if fixed != nil && !reflect.DeepEqual(child.value, fixed) {
+					report(fhir.IssueTypeValue, child.location, "%s has to be %s", element.Path, jsonString(fixed))
+				} else if pattern != nil && !matchesPattern(child.value, pattern) {
+					report(fhir.IssueTypeValue, child.location, "%s has to match %s", element.Path, jsonString(pattern))
+				}
+
+				if message := p.checkRequiredBinding(ctx, element, child.value); message != "" {
+					report(fhir.IssueTypeCodeInvalid, child.location, "%s", message)
+				}
+				checkConstraints(element, child)
+			}
+		}
+	}
+	return issues, nil
+}
+
+// hasErrors reports whether any of the issues is an error, warnings such as best practice
+// invariants do not make a resource invalid
+func hasErrors(issues []ValidationIssue) bool {
+	for _, issue := range issues {
+		if issue.Severity == fhir.IssueSeverityError {
+			return true
+		}
+	}
+	return false
+}
+
+// failedConstraints returns the invariants of an element an instance of it does not satisfy. An
+// invariant that results in an empty collection, or that cannot be evaluated, is not reported.
+func (p *resourceContext) failedConstraints(instance map[string]interface{}, element fhir.ElementDefinition, value interface{}) []fhir.ElementDefinitionConstraint {
+	var failed []fhir.ElementDefinitionConstraint
+	for _, constraint := range element.Constraint {
+		if constraint.Expression == nil {
+			continue
+		}
+		expression := p.constraintExpression(*constraint.Expression)
+		if expression == nil {
+			continue
+		}
+		result, ok, err := expression.EvaluateBool(instance, value)
+		if err != nil {
+			p.log.Debug().
+				Err(err).
+				Str("key", constraint.Key).
+				Str("path", element.Path).
+				Msg("Failed to evaluate constraint")
+			continue
+		}
+		if ok && !result {
+			failed = append(failed, constraint)
+		}
+	}
+	return failed
+}
+
+// constraintExpression returns the parsed expression of an invariant, nil when it cannot be parsed.
+// Expressions are parsed once and shared by all resources.
+func (p *ProcessorService) constraintExpression(text string) *fhirpath.Expression {
+	if cached, ok := p.constraintExpressions.Load(text); ok {
+		return cached.(*fhirpath.Expression)
+	}
+	expression, err := fhirpath.Parse(text)
+	if err != nil {
+		p.log.Warn().
+			Err(err).
+			Msg("Skipping constraint with unsupported expression")
+	}
+	p.constraintExpressions.Store(text, expression)
+	return expression
+}
+
+// parseConstraints parses the invariants of all loaded profiles, so unsupported expressions are
+// reported once at startup rather than when a resource is validated
+func (p *ProcessorService) parseConstraints() {
+	if p.structDefSvc == nil {
+		return
+	}
+	for _, sd := range p.structDefSvc.GetAllStructureDefinitions() {
+		if sd.Snapshot == nil {
+			continue
+		}
+		for _, element := range sd.Snapshot.Element {
+			for _, constraint := range element.Constraint {
+				if constraint.Expression != nil {
+					p.constraintExpression(*constraint.Expression)
+				}
+			}
+		}
+	}
+}
+
+// resourceJSON returns the json form of a resource, numbers are kept as json.Number
+func resourceJSON(resource interface{}) (map[string]interface{}, error) {
+	var buf bytes.Buffer
+	if err := json.NewEncoder(&buf).Encode(resource); err != nil {
+		return nil, fmt.Errorf("failed to marshal resource: %w", err)
+	}
+	decoder := json.NewDecoder(&buf)
+	decoder.UseNumber()
+	var instance map[string]interface{}
+	if err := decoder.Decode(&instance); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal resource: %w", err)
+	}
+	return instance, nil
+}
+
+// resourceProfile returns the profile to validate the resource against
+func (p *resourceContext) resourceProfile(instance map[string]interface{}) *fhir.StructureDefinition {
+	var urls []string
+	if meta, ok := instance["meta"].(map[string]interface{}); ok {
+		if profiles, ok := meta["profile"].([]interface{}); ok {
+			for _, profile := range profiles {
+				if url, ok := profile.(string); ok {
+					urls = append(urls, url)
+				}
+			}
+		}
+	}
+	urls = append(urls, baseProfilePrefix+p.resourceType)
+
+	for _, url := range urls {
+		if profile, err := p.structDefSvc.GetStructureDefinition(url); err == nil {
+			return profile
+		}
+		p.log.Debug().Str("profile", url).Msg("Profile is not loaded")
+	}
+	return nil
+}
+
+// elementNodes returns the instances of the element with the path in a resource, e.g. every
+// contact of a Patient for Patient.contact
+func elementNodes(instance map[string]interface{}, resourceType, path string) []jsonNode {
+	names := strings.Split(path, ".")
+	if names[0] != resourceType {
+		return nil
+	}
+
+	nodes := []jsonNode{{location: resourceType, value: instance}}
+	for _, name := range names[1:] {
+		var next []jsonNode
+		for _, node := range nodes {
+			next = append(next, childNodes(node, name)...)
+		}
+		nodes = next
+	}
+	return nodes
+}
+
+// childNodes returns the values of an element of a json object, every item of an array being an
+// instance. A choice element, e.g. value[x], matches every type of the choice.
+func childNodes(parent jsonNode, name string) []jsonNode {
+	object, ok := parent.value.(map[string]interface{})
+	if !ok {
+		return nil
+	}
+
+	var keys []string
+	if choice := strings.TrimSuffix(name, "[x]"); choice != name {
+		for key := range object {
+			if len(key) > len(choice) && strings.HasPrefix(key, choice) && key[len(choice)] >= 'A' && key[len(choice)] <= 'Z' {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+	} else if _, exists := object[name]; exists {
+		keys = append(keys, name)
+	}
+
+	var nodes []jsonNode
+	for _, key := range keys {
+		if items, ok := object[key].([]interface{}); ok {
+			for i, item := range items {
+				if !isEmptyObject(item) {
+					nodes = append(nodes, jsonNode{location: fmt.Sprintf("%s.%s[%d]", parent.location, key, i), value: item})
+				}
+			}
+			continue
+		}
+		if !isEmptyObject(object[key]) {
+			nodes = append(nodes, jsonNode{location: parent.location + "." + key, value: object[key]})
+		}
+	}
+	return nodes
+}
+
+// isEmptyObject reports whether a json value is an object without content, the Go models write
+// elements that are not pointers also when they are not set
+func isEmptyObject(value interface{}) bool {
+	object, ok := value.(map[string]interface{})
+	return ok && len(object) == 0
+}
+
+// fixedAndPattern returns the json values of the fixed[x] and pattern[x] of an element definition
+func fixedAndPattern(element fhir.ElementDefinition) (fixed, pattern interface{}) {
+	value := reflect.ValueOf(element)
+	for i := 0; i < value.NumField(); i++ {
+		fieldName := value.Type().Field(i).Name
+		field := value.Field(i)
+		if field.Kind() != reflect.Ptr || field.IsNil() {
+			continue
+		}
+		switch {
+		case strings.HasPrefix(fieldName, "Fixed"):
+			fixed = jsonValue(field.Interface())
+		case strings.HasPrefix(fieldName, "Pattern"):
+			pattern = jsonValue(field.Interface())
+		}
+	}
+	return fixed, pattern
+}
+
+// jsonValue returns a value as it is in the json form of a resource
+func jsonValue(value interface{}) interface{} {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return nil
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var result interface{}
+	if err := decoder.Decode(&result); err != nil {
+		return nil
+	}
+	return result
+}
+
+// jsonString formats a json value for an issue
+func jsonString(value interface{}) string {
+	data, _ := json.Marshal(value)
+	return string(data)
+}
+
+// matchesPattern reports whether a value has at least the content of the pattern. Every item of
+// an array in the pattern has to match an item of the array in the value.
+func matchesPattern(value, pattern interface{}) bool {
+	switch pattern := pattern.(type) {
+	case map[string]interface{}:
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return false
+		}
+		for key, patternValue := range pattern {
+			if !matchesPattern(object[key], patternValue) {
+				return false
+			}
+		}
+		return true
+	case []interface{}:
+		items, ok := value.([]interface{})
+		if !ok {
+			return false
+		}
+		for _, patternItem := range pattern {
+			found := false
+			for _, item := range items {
+				if matchesPattern(item, patternItem) {
+					found = true
+					break
+				}
+			}
+			if !found {
+				return false
+			}
+		}
+		return true
+	default:
+		return reflect.DeepEqual(value, pattern)
+	}
+}
+
+// checkRequiredBinding checks a code, Coding or CodeableConcept against the ValueSet of a required
+// binding and returns why it is not valid. ValueSets that cannot be resolved are not checked.
+func (p *resourceContext) checkRequiredBinding(ctx context.Context, element fhir.ElementDefinition, value interface{}) string {
+	if element.Binding == nil || element.Binding.Strength != fhir.BindingStrengthRequired || element.Binding.ValueSet == nil {
+		return ""
+	}
+	// The version of a canonical is not part of how ValueSets are stored
+	valueSetURL := strings.SplitN(*element.Binding.ValueSet, "|", 2)[0]
+
+	var codings []fhir.Coding
+	switch value := value.(type) {
+	case string:
+		codings = append(codings, fhir.Coding{Code: &value})
+	case map[string]interface{}:
+		if items, ok := value["coding"].([]interface{}); ok {
+			for _, item := range items {
+				if coding, ok := item.(map[string]interface{}); ok {
+					codings = append(codings, codingFromJSON(coding))
+				}
+			}
+			if len(codings) == 0 {
+				return fmt.Sprintf("%s has no coding from ValueSet %s", element.Path, valueSetURL)
+			}
+		} else if _, ok := value["code"]; ok {
+			codings = append(codings, codingFromJSON(value))
+		}
+	}
+	if len(codings) == 0 {
+		return ""
+	}
+
+	if _, unavailable := p.unavailableValueSets.Load(valueSetURL); unavailable {
+		return ""
+	}
+	for _, coding := range codings {
+		result, err := p.valueSetSvc.ValidateCode(ctx, valueSetURL, &coding)
+		if err != nil {
+			if ctx.Err() == nil {
+				p.unavailableValueSets.Store(valueSetURL, true)
+				p.log.Warn().Err(err).Str("valueSet", valueSetURL).Msg("Cannot validate required binding, ValueSet is not available")
+			}
+			return ""
+		}
+		if result.Valid {
+			return ""
+		}
+	}
+
+	code := ""
+	if codings[0].Code != nil {
+		code = *codings[0].Code
+	}
+	return fmt.Sprintf("code %q of %s is not in ValueSet %s", code, element.Path, valueSetURL)
+}
+
+// codingFromJSON returns the system and code of a Coding or Quantity in json form
+func codingFromJSON(value map[string]interface{}) fhir.Coding {
+	var coding fhir.Coding
+	if system, ok := value["system"].(string); ok {
+		coding.System = &system
+	}
+	if code, ok := value["code"].(string); ok {
+		coding.Code = &code
+	}
+	return coding
+}
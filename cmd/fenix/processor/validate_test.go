@@ -0,0 +1,168 @@
+package processor
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/SanteonNL/fenix/cmd/fenix/fhir/structuredefinition"
+	"github.com/SanteonNL/fenix/cmd/fenix/fhir/valueset"
+	"github.com/SanteonNL/fenix/models/fhir"
+	"github.com/rs/zerolog"
+)
+
+// newValidationContext creates the processing state of a Patient validated against the profile
+// in testdata, with the ValueSets of its required bindings
+func newValidationContext(t *testing.T) *resourceContext {
+	t.Helper()
+	log := zerolog.Nop()
+
+	repo := structuredefinition.NewStructureDefinitionRepository(log)
+	if err := repo.LoadStructureDefinitions("testdata"); err != nil {
+		t.Fatalf("LoadStructureDefinitions: %v", err)
+	}
+	structDefSvc := structuredefinition.NewStructureDefinitionService(repo, log)
+	if err := structDefSvc.BuildStructureDefinitionIndex(); err != nil {
+		t.Fatalf("BuildStructureDefinitionIndex: %v", err)
+	}
+
+	valueSetSvc, err := valueset.NewValueSetService(valueset.Config{LocalPath: t.TempDir()}, log)
+	if err != nil {
+		t.Fatalf("NewValueSetService: %v", err)
+	}
+	valueSets := map[string][]fhir.ValueSetComposeInclude{
+		"http://example.org/fhir/ValueSet/gender": {{
+			System:  stringPtr("http://hl7.org/fhir/administrative-gender"),
+			Concept: []fhir.ValueSetComposeIncludeConcept{{Code: "male"}, {Code: "female"}},
+		}},
+		"http://example.org/fhir/ValueSet/marital-status": {{
+			System:  stringPtr("http://terminology.hl7.org/CodeSystem/v3-MaritalStatus"),
+			Concept: []fhir.ValueSetComposeIncludeConcept{{Code: "M"}, {Code: "S"}},
+		}},
+	}
+	for url, include := range valueSets {
+		valueSet := &fhir.ValueSet{Url: stringPtr(url), Id: stringPtr(url[strings.LastIndex(url, "/")+1:]), Compose: &fhir.ValueSetCompose{Include: include}}
+		if err := valueSetSvc.WriteNewValueSet(context.Background(), valueSet); err != nil {
+			t.Fatalf("WriteNewValueSet: %v", err)
+		}
+	}
+
+	p := &ProcessorService{log: log, structDefSvc: structDefSvc, valueSetSvc: valueSetSvc, policy: ValidationPolicyFlag}
+	return p.newResourceContext("Patient", nil)
+}
+
+// validPatient returns a Patient that conforms to the profile in testdata
+func validPatient() *fhir.Patient {
+	active := true
+	gender := fhir.AdministrativeGenderFemale
+	return &fhir.Patient{
+		Id:     stringPtr("p1"),
+		Active: &active,
+		Identifier: []fhir.Identifier{{
+			Type: &fhir.CodeableConcept{Coding: []fhir.Coding{{
+				System: stringPtr("http://terminology.hl7.org/CodeSystem/v2-0203"),
+				Code:   stringPtr("MR"),
+			}}},
+			System: stringPtr("http://example.org/mrn"),
+			Value:  stringPtr("12345"),
+		}},
+		Name:   []fhir.HumanName{{Family: stringPtr("Jansen")}},
+		Gender: &gender,
+		MaritalStatus: &fhir.CodeableConcept{Coding: []fhir.Coding{{
+			System: stringPtr("http://terminology.hl7.org/CodeSystem/v3-MaritalStatus"),
+			Code:   stringPtr("M"),
+		}}},
+	}
+}
+
+func TestValidateResource(t *testing.T) {
+	inactive := false
+	other := fhir.AdministrativeGenderOther
+
+	tests := []struct {
+		name   string
+		modify func(*fhir.Patient)
+		issues map[string][]fhir.IssueType // expected issues by expression
+	}{
+		{
+			name:   "conforms",
+			modify: func(*fhir.Patient) {},
+		},
+		{
+			name:   "minimum cardinality",
+			modify: func(patient *fhir.Patient) { patient.Identifier = nil },
+			issues: map[string][]fhir.IssueType{"Patient.identifier": {fhir.IssueTypeRequired}},
+		},
+		{
+			name:   "minimum cardinality of a child",
+			modify: func(patient *fhir.Patient) { patient.Identifier[0].Value = nil },
+			issues: map[string][]fhir.IssueType{"Patient.identifier[0].value": {fhir.IssueTypeRequired}},
+		},
+		{
+			name: "maximum cardinality",
+			modify: func(patient *fhir.Patient) {
+				patient.Name = append(patient.Name, fhir.HumanName{Family: stringPtr("de Vries")})
+			},
+			issues: map[string][]fhir.IssueType{"Patient.name": {fhir.IssueTypeStructure}},
+		},
+		{
+			name:   "fixed value",
+			modify: func(patient *fhir.Patient) { patient.Active = &inactive },
+			issues: map[string][]fhir.IssueType{"Patient.active": {fhir.IssueTypeValue}},
+		},
+		{
+			name: "pattern",
+			modify: func(patient *fhir.Patient) {
+				patient.MaritalStatus.Coding[0].System = stringPtr("http://snomed.info/sct")
+			},
+			issues: map[string][]fhir.IssueType{"Patient.maritalStatus": {fhir.IssueTypeValue, fhir.IssueTypeCodeInvalid}},
+		},
+		{
+			name:   "required binding of a code",
+			modify: func(patient *fhir.Patient) { patient.Gender = &other },
+			issues: map[string][]fhir.IssueType{"Patient.gender": {fhir.IssueTypeCodeInvalid}},
+		},
+		{
+			name:   "required binding of a CodeableConcept",
+			modify: func(patient *fhir.Patient) { patient.MaritalStatus.Coding[0].Code = stringPtr("W") },
+			issues: map[string][]fhir.IssueType{"Patient.maritalStatus": {fhir.IssueTypeCodeInvalid}},
+		},
+		{
+			name: "CodeableConcept without coding",
+			modify: func(patient *fhir.Patient) {
+				patient.MaritalStatus = &fhir.CodeableConcept{Text: stringPtr("married")}
+			},
+			issues: map[string][]fhir.IssueType{"Patient.maritalStatus": {fhir.IssueTypeValue}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			patient := validPatient()
+			tt.modify(patient)
+
+			issues, err := newValidationContext(t).validateResource(context.Background(), patient)
+			if err != nil {
+				t.Fatalf("validateResource: %v", err)
+			}
+
+			got := make(map[string][]fhir.IssueType)
+			for _, issue := range issues {
+				if issue.Severity != fhir.IssueSeverityError {
+					t.Errorf("expected an error, got %s: %s", issue.Severity.Code(), issue.Details)
+				}
+				if !strings.HasPrefix(issue.Details, "Patient/p1 does not conform to") {
+					t.Errorf("expected the details to name the resource, got %s", issue.Details)
+				}
+				got[issue.Expression] = append(got[issue.Expression], issue.Code)
+			}
+			if len(tt.issues) == 0 && len(got) == 0 {
+				return
+			}
+			if !reflect.DeepEqual(got, tt.issues) {
+				t.Errorf("expected issues %v, got %v", tt.issues, issues)
+			}
+		})
+	}
+}
@@ -1,10 +1,70 @@
 package types
 
-// Filter represents the basic filter input and validation results
+import "strings"
+
+// Filter represents the basic filter input and validation results. A repeated search parameter
+// gives a filter per occurrence, a resource has to match all of them (AND). The comma-separated
+// values of one occurrence are alternatives, a resource has to match one of them (OR).
 type Filter struct {
-	Code      string // The search parameter code (e.g., "gender", "status")
-	Modifier  string // The modifier (e.g., "exact", "contains")
-	Value     string // The value to filter on
-	IsValid   bool   // Whether the filter is valid
-	ErrorType string // Type of error if invalid (e.g., "unknown-parameter", "invalid-modifier")
+	Code      string   // The search parameter code (e.g., "gender", "status")
+	Modifier  string   // The modifier (e.g., "exact", "contains")
+	Type      string   // The search parameter type (e.g., "token", "date")
+	Value     string   // The value to filter on, as given in the request (e.g., "male,female")
+	Values    []string // The alternatives of the value (e.g., "male" and "female")
+	IsValid   bool     // Whether the filter is valid
+	ErrorType string   // Type of error if invalid (e.g., "unknown-parameter", "invalid-modifier")
+	Chain     *Chain   // The search on the resources a reference connects to, nil for a plain parameter
+}
+
+// Chain is the search of a chained parameter on the referenced resources, e.g. the
+// name of subject:Patient.name, or of a reverse chained parameter on the resources that refer to
+// the searched ones, e.g. the code of _has:Observation:patient:code. The value of the parameter
+// belongs to the innermost filter.
+type Chain struct {
+	Reverse      bool    // _has, the resources of ResourceType refer to the searched resources
+	ResourceType string  // Resource type the inner filter searches
+	Reference    string  // Reference search parameter, of the searched type or with _has of ResourceType
+	Filter       *Filter // The inner filter, it may be chained itself
+}
+
+// SetValue sets the value of a filter and splits it into its comma-separated alternatives.
+// An escaped comma (\,) is part of the value.
+func (f *Filter) SetValue(value string) {
+	f.Value = value
+	f.Values = splitValues(value)
+}
+
+// Alternatives returns a filter for each of the values of the filter, with that value only. A
+// filter whose value was not split is its own alternative.
+func (f *Filter) Alternatives() []*Filter {
+	if len(f.Values) == 0 {
+		return []*Filter{f}
+	}
+	alternatives := make([]*Filter, 0, len(f.Values))
+	for _, value := range f.Values {
+		alternative := *f
+		alternative.Value = value
+		alternative.Values = []string{value}
+		alternatives = append(alternatives, &alternative)
+	}
+	return alternatives
+}
+
+// splitValues splits a search parameter value on the commas that are not escaped
+func splitValues(value string) []string {
+	var values []string
+	var current strings.Builder
+	for i := 0; i < len(value); i++ {
+		switch {
+		case value[i] == '\\' && i+1 < len(value) && value[i+1] == ',':
+			current.WriteByte(',')
+			i++
+		case value[i] == ',':
+			values = append(values, current.String())
+			current.Reset()
+		default:
+			current.WriteByte(value[i])
+		}
+	}
+	return append(values, current.String())
 }
@@ -0,0 +1,27 @@
+package types
+
+import (
+	"reflect"
+	"strings"
+
+	"github.com/SanteonNL/fenix/models/fhir"
+)
+
+// ResourceFactoryMap maps resource types to their factory functions
+var ResourceFactoryMap = map[string]func() interface{}{
+	"Patient":      func() interface{} { return &fhir.Patient{} },
+	"Observation":  func() interface{} { return &fhir.Observation{} },
+	"Encounter":    func() interface{} { return &fhir.Encounter{} },
+	"Condition":    func() interface{} { return &fhir.Condition{} },
+	"Procedure":    func() interface{} { return &fhir.Procedure{} },
+	"Immunization": func() interface{} { return &fhir.Immunization{} },
+}
+
+// JSONName returns the FHIR element name of a struct field, taken from its json tag
+func JSONName(field reflect.StructField) string {
+	name := strings.Split(field.Tag.Get("json"), ",")[0]
+	if name == "" || name == "-" {
+		return strings.ToLower(field.Name[:1]) + field.Name[1:]
+	}
+	return name
+}
@@ -0,0 +1,107 @@
+package types
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// comparisonPrefixes are the FHIR prefixes for ordered search types
+var comparisonPrefixes = map[string]bool{
+	"eq": true, "ne": true, "gt": true, "lt": true, "ge": true, "le": true, "sa": true, "eb": true, "ap": true,
+}
+
+// StringExcludedElements are elements of complex types that are not searched by string parameters
+var StringExcludedElements = map[string]bool{
+	"use": true, "system": true, "code": true, "type": true, "rank": true, "id": true, "period": true, "extension": true,
+}
+
+// IsOrderedType reports whether values of the search type are compared with a prefix
+func IsOrderedType(searchType string) bool {
+	switch strings.ToLower(searchType) {
+	case "date", "number", "quantity":
+		return true
+	}
+	return false
+}
+
+// SplitPrefix takes the prefix from the modifier (birthdate:ge=1970) or from the value
+// (birthdate=ge1970) and defaults to eq
+func SplitPrefix(modifier string, value string) (string, string) {
+	if comparisonPrefixes[strings.ToLower(modifier)] {
+		return strings.ToLower(modifier), value
+	}
+	if len(value) > 2 && comparisonPrefixes[strings.ToLower(value[:2])] {
+		return strings.ToLower(value[:2]), value[2:]
+	}
+	return "eq", value
+}
+
+// Prefix returns the comparison prefix of the filter and its value without prefix
+func (f *Filter) Prefix() (string, string) {
+	return SplitPrefix(f.Modifier, f.Value)
+}
+
+// IsNegating reports whether a filter excludes values rather than selecting them: :not, :not-in
+// and the ne prefix of an ordered type. A negating filter has to hold for all of its values.
+func (f *Filter) IsNegating() bool {
+	switch strings.ToLower(f.Modifier) {
+	case "not", "not-in":
+		return true
+	}
+	prefix, _ := f.Prefix()
+	return prefix == "ne" && IsOrderedType(f.Type)
+}
+
+// MatchesMissing reports whether a filter matches resources without the element it searches, a
+// negating filter or :missing=true
+func (f *Filter) MatchesMissing() bool {
+	if strings.EqualFold(f.Modifier, "missing") {
+		return strings.EqualFold(f.Value, "true")
+	}
+	return f.IsNegating()
+}
+
+// dateLayouts are the layouts of the precisions of FHIR dates, with the end of the period a value
+// of the precision covers and the layout to bind its bounds in SQL
+var dateLayouts = []struct {
+	layout     string
+	bindLayout string
+	next       func(time.Time) time.Time
+}{
+	{"2006", "2006-01-02", func(t time.Time) time.Time { return t.AddDate(1, 0, 0) }},
+	{"2006-01", "2006-01-02", func(t time.Time) time.Time { return t.AddDate(0, 1, 0) }},
+	{"2006-01-02", "2006-01-02", func(t time.Time) time.Time { return t.AddDate(0, 0, 1) }},
+	{"2006-01-02T15:04", "2006-01-02T15:04:05", func(t time.Time) time.Time { return t.Add(time.Minute) }},
+	{"2006-01-02T15:04Z07:00", time.RFC3339, func(t time.Time) time.Time { return t.Add(time.Minute) }},
+	{"2006-01-02T15:04:05", "2006-01-02T15:04:05", func(t time.Time) time.Time { return t.Add(time.Second) }},
+	{time.RFC3339, time.RFC3339, func(t time.Time) time.Time { return t.Add(time.Second) }},
+}
+
+// DateRange parses a FHIR date, dateTime or instant and returns the start and exclusive end of the
+// period its precision covers, together with the layout to bind the bounds in SQL. Values without
+// time zone are taken as UTC.
+func DateRange(value string) (time.Time, time.Time, string, error) {
+	for _, l := range dateLayouts {
+		if t, err := time.Parse(l.layout, value); err == nil {
+			return t, l.next(t), l.bindLayout, nil
+		}
+	}
+	return time.Time{}, time.Time{}, "", fmt.Errorf("invalid date %q", value)
+}
+
+// NumberRange parses a number search value and returns the range eq matches, the precision of the
+// value decides its width: 100 matches from 99.5 up to 100.5
+func NumberRange(value string) (number float64, low float64, high float64, err error) {
+	number, err = strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0, 0, 0, fmt.Errorf("invalid number %q", value)
+	}
+	margin := 0.5
+	if dot := strings.IndexByte(value, '.'); dot != -1 {
+		margin = 0.5 * math.Pow(10, -float64(len(value)-dot-1))
+	}
+	return number, number - margin, number + margin, nil
+}
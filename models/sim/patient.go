@@ -17,4 +17,6 @@ type Patient struct {
 	Geboortedatum              *time.Time `csv:"Geboortedatum,omitempty" json:"geboortedatum,omitempty" parquet:"Geboortedatum"`
 	DatumOverlijden            *time.Time `csv:"DatumOverlijden,omitempty" json:"datumOverlijden,omitempty" parquet:"DatumOverlijden"`
 	DatumCheckStatusOverlijden *time.Time `csv:"DatumCheckStatusOverlijden,omitempty" json:"datumCheckStatusOverlijden,omitempty" parquet:"DatumCheckStatusOverlijden"`
+	Voornaam                   *string    `csv:"Voornaam,omitempty" json:"voornaam,omitempty" parquet:"Voornaam"`
+	Achternaam                 *string    `csv:"Achternaam,omitempty" json:"achternaam,omitempty" parquet:"Achternaam"`
 }
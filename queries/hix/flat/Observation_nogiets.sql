@@ -1,5 +1,10 @@
+-- resourceType: Observation
+-- profile: http://hl7.org/fhir/StructureDefinition/Observation
+-- datasource: HIX
+-- searchParameters: _id, patient, date, code, category, status
+-- description: Metingen uit HIX (observation_raw)
+
 SELECT 
-   identificatienummer as "Patient.id",
     metingid as "resource_id",
     metingid AS id,
     '' AS parent_id,
@@ -56,7 +61,7 @@ SELECT
 FROM 
     observation_raw
 -- WHERE   identificatienummer ?patient 
--- WHERE  <metingid> ?id
+-- WHERE   metingid ?id
 -- WHERE  <geslachstveldin HIX> ?gender (niet implementeren)
 -- WHERE   datum ?date 
 LIMIT 5;
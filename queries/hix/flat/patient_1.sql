@@ -1,3 +1,9 @@
+-- resourceType: Patient
+-- profile: http://hl7.org/fhir/StructureDefinition/Patient
+-- datasource: HIX
+-- searchParameters: _id, identifier, gender, birthdate, family, active
+-- description: Patiënten uit HIX (patient)
+
 SELECT
     identificatienummer AS "Patient.id",
     '' AS parent_id,
@@ -29,5 +35,4 @@ SELECT
 FROM
     patient
 -- WHERE identificatienummer ?id
--- WHERE identificatienummer ?patient
 LIMIT 1;
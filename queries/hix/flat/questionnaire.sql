@@ -1,3 +1,9 @@
+-- resourceType: Questionnaire
+-- profile: http://hl7.org/fhir/StructureDefinition/Questionnaire
+-- datasource: HIX
+-- searchParameters: _id, code, status, date
+-- description: Vragenlijsten uit HIX (questionnaire_raw)
+
 SELECT 
   
     identificatienummer AS "Patient.id", -- "subject.reference"    